@@ -2,13 +2,16 @@ package pto3
 
 import (
 	"bufio"
-	"compress/bzip2"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 // ConditionSet tracks conditions seen in analysis output by name.
@@ -103,15 +106,13 @@ func (norm *SerialScanningNormalizer) Normalize(in *os.File, metain io.Reader, o
 	}
 
 	// check filetype for compression
-	filetype := rmd.Filetype(true)
-
-	var scanner *bufio.Scanner
-	if strings.HasSuffix(filetype, "-bz2") {
-		scanner = bufio.NewScanner(bzip2.NewReader(in))
-		filetype = filetype[0 : len(filetype)-4]
-	} else {
-		scanner = bufio.NewScanner(in)
+	rawin, filetype, err := NewDecompressingReader(rmd.Filetype(true), in)
+	if err != nil {
+		return err
 	}
+	defer rawin.Close()
+
+	scanner := bufio.NewScanner(rawin)
 
 	// lookup file type in registry
 	fte, ok := norm.filetypeMap[filetype]
@@ -125,13 +126,15 @@ func (norm *SerialScanningNormalizer) Normalize(in *os.File, metain io.Reader, o
 	// now set up scanner and iterate
 	scanner.Split(fte.splitFunc)
 
+	obsw := NewObservationWriter(out)
+
 	var recno int
 	for scanner.Scan() {
 		recno++
 		rec := scanner.Bytes()
 
 		obsen, err := fte.normFunc(rec, rmd, omd)
-		if err == nil {
+		if err != nil {
 			return PTOErrorf("error normalizing record %d: %v", recno, err)
 		}
 
@@ -139,11 +142,19 @@ func (norm *SerialScanningNormalizer) Normalize(in *os.File, metain io.Reader, o
 			hasCondition[o.Condition.Name] = struct{}{}
 		}
 
-		if err := WriteObservations(obsen, out); err != nil {
+		if err := obsw.WriteObservations(obsen); err != nil {
 			return PTOErrorf("error writing observation from record %d: %v", recno, err)
 		}
 	}
 
+	if err := scanner.Err(); err != nil {
+		return PTOErrorf("error reading input after record %d: %v", recno, err)
+	}
+
+	if err := obsw.Flush(); err != nil {
+		return PTOErrorf("error writing observations: %v", err)
+	}
+
 	// finalize output metadata if necessary
 	if fte.finalFunc != nil {
 		if err := fte.finalFunc(rmd, omd); err != nil {
@@ -183,6 +194,9 @@ type ParallelScanningNormalizer struct {
 	filetypeMap map[string]parallelFiletypeMapEntry
 	metadataURL string
 	concurrency int
+
+	// records between checkpoints; 0 disables checkpointing
+	checkpointInterval int
 }
 
 type ParallelNormFunc func(rec []byte, rawmeta *RawMetadata, metachan chan<- map[string]interface{}) ([]Observation, error)
@@ -232,12 +246,78 @@ func (norm *ParallelScanningNormalizer) RegisterFiletype(
 			mergeFunc: mergeFunc}
 }
 
+// EnableCheckpoints causes this normalizer to checkpoint its progress every
+// interval records, so that a normalization that crashes can be resumed from
+// the last checkpoint by running it again with the same input and output. The
+// output given to Normalize must then be an *os.File opened without
+// truncation; the checkpoint is stored alongside it, and removed once
+// normalization completes successfully.
+func (norm *ParallelScanningNormalizer) EnableCheckpoints(interval int) {
+	norm.checkpointInterval = interval
+}
+
+// NormalizationError is returned by a ScanningNormalizer when normalization
+// of a given input record fails.
+type NormalizationError struct {
+	// Number of the record in the input, starting at 1
+	Record int
+	// Underlying error
+	Err error
+}
+
+func (e *NormalizationError) Error() string {
+	return fmt.Sprintf("error normalizing record %d: %v", e.Record, e.Err)
+}
+
 type psnRecord struct {
 	n     int
 	bytes []byte
 }
 
+type psnResult struct {
+	n     int
+	obsen []Observation
+	err   error
+}
+
+// discardPartialOutput truncates an output file to a given length after a
+// failed normalization, so no partial output remains.
+func discardPartialOutput(out *os.File, length int64) {
+	if err := out.Truncate(length); err != nil {
+		log.Printf("error discarding partial output in %s: %v", out.Name(), err)
+		return
+	}
+
+	if _, err := out.Seek(length, io.SeekStart); err != nil {
+		log.Printf("error discarding partial output in %s: %v", out.Name(), err)
+	}
+}
+
+// Normalize normalizes raw data from an input file with given metadata,
+// writing observations and metadata to the output.
 func (norm *ParallelScanningNormalizer) Normalize(in *os.File, metain io.Reader, out io.Writer) error {
+	return norm.NormalizeContext(context.Background(), in, metain, out)
+}
+
+// NormalizeContext normalizes raw data from an input file with given
+// metadata, writing observations and metadata to the output. Normalization
+// stops as soon as any record fails or the context is cancelled; in this case,
+// partial output written to an output file is removed, and the first error
+// encountered is returned.
+func (norm *ParallelScanningNormalizer) NormalizeContext(ctx context.Context, in *os.File, metain io.Reader, out io.Writer) error {
+	// first error cancels everything
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstError error
+	var errorOnce sync.Once
+	fail := func(err error) {
+		errorOnce.Do(func() {
+			firstError = err
+			cancel()
+		})
+	}
+
 	// create channels
 
 	// (munt): It seems yet unclear how to determine the "ideal" channel size
@@ -246,21 +326,15 @@ func (norm *ParallelScanningNormalizer) Normalize(in *os.File, metain io.Reader,
 	//         Until we know how to calculate this value experimental evidence
 	//         suggests that "a little extra room" is at least not hurtful.
 	recChan := make(chan *psnRecord, norm.concurrency*norm.concurrency)
-	obsChan := make(chan []Observation, norm.concurrency*norm.concurrency)
-	errChan := make(chan error, norm.concurrency)
+	resChan := make(chan *psnResult, norm.concurrency*norm.concurrency)
 	mdChan := make(chan map[string]interface{}, norm.concurrency)
+	mergeBarrier := make(chan chan map[string]interface{})
 
 	// create signals
-	recordComplete := make([]chan struct{}, norm.concurrency)
-	for i := 0; i < norm.concurrency; i++ {
-		recordComplete[i] = make(chan struct{})
-	}
+	var normalizers sync.WaitGroup
 	mergeComplete := make(chan struct{})
 	writeComplete := make(chan struct{})
 
-	// create error accumulators
-	var writeError, outError error
-
 	// read raw metadata
 	rmd, err := RawMetadataFromReader(metain, nil)
 	if err != nil {
@@ -274,107 +348,243 @@ func (norm *ParallelScanningNormalizer) Normalize(in *os.File, metain io.Reader,
 	}
 
 	// check filetype for compression
-	filetype := rmd.Filetype(true)
-
-	var scanner *bufio.Scanner
-	if strings.HasSuffix(filetype, "-bz2") {
-		scanner = bufio.NewScanner(bzip2.NewReader(in))
-		filetype = filetype[0 : len(filetype)-4]
-	} else {
-		scanner = bufio.NewScanner(in)
+	rawin, filetype, err := NewDecompressingReader(rmd.Filetype(true), in)
+	if err != nil {
+		return err
 	}
+	defer rawin.Close()
 
 	// lookup file type in registry
 	fte, ok := norm.filetypeMap[filetype]
 	if !ok {
 		return PTOErrorf("no registered handler for filetype %s", filetype)
 	}
-	scanner.Split(fte.splitFunc)
 
 	// create condition cache
 	hasCondition := make(ConditionSet)
 
+	// track progress through input and output
+	var recno int
+	var inOffset int64
+	cout := &countingWriter{w: out}
+	obsw := NewObservationWriter(cout)
+
+	// note where output starts, so we can discard partial output on error
+	var discardFile *os.File
+	var discardFrom int64
+	if outfile, ok := out.(*os.File); ok {
+		if fi, err := outfile.Stat(); err == nil && fi.Mode().IsRegular() {
+			if discardFrom, err = outfile.Seek(0, io.SeekCurrent); err == nil {
+				discardFile = outfile
+			}
+		}
+	}
+
+	// resume from checkpoint if checkpointing is enabled and we have one
+	var outfile *os.File
+	if norm.checkpointInterval > 0 {
+		outfile, ok = out.(*os.File)
+		if !ok {
+			return PTOErrorf("checkpointing normalizer requires output to a file")
+		}
+
+		cp, err := readCheckpoint(outfile)
+		if err != nil {
+			return err
+		}
+
+		if cp != nil {
+			if err := resumeFromCheckpoint(cp, rawin, outfile); err != nil {
+				return err
+			}
+
+			recno = cp.Records
+			inOffset = cp.InputOffset
+			cout.n = cp.OutputOffset
+			discardFrom = cp.OutputOffset
+
+			for _, c := range cp.Conditions {
+				hasCondition.AddCondition(c)
+			}
+
+			for k, v := range cp.Metadata {
+				mdOut[k] = v
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(rawin)
+	scanner.Split(offsetTrackingSplit(fte.splitFunc, &inOffset))
+
+	// track records written, for checkpointing
+	var progress sync.Mutex
+	progressCond := sync.NewCond(&progress)
+	written := recno
+
+	// wake up anything waiting on progress on cancellation
+	go func() {
+		<-ctx.Done()
+		progress.Lock()
+		progressCond.Broadcast()
+		progress.Unlock()
+	}()
+
 	// start merging metadata
 	go func() {
-		for mdNext := range mdChan {
-			fte.mergeFunc(mdNext, mdOut)
+		for {
+			select {
+			case mdNext, ok := <-mdChan:
+				if !ok {
+					close(mergeComplete)
+					return
+				}
+				fte.mergeFunc(mdNext, mdOut)
+			case ack := <-mergeBarrier:
+				// merge everything pending, then hand back a snapshot
+				for pending := true; pending; {
+					select {
+					case mdNext := <-mdChan:
+						fte.mergeFunc(mdNext, mdOut)
+					default:
+						pending = false
+					}
+				}
+				snapshot := make(map[string]interface{})
+				for k, v := range mdOut {
+					snapshot[k] = v
+				}
+				ack <- snapshot
+			}
 		}
-		close(mergeComplete)
 	}()
 
-	// start writing records
+	// start writing records. results are drained until the channel is
+	// closed, but nothing is written after the first error.
 	go func() {
-		for obsen := range obsChan {
-			for _, o := range obsen {
-				hasCondition[o.Condition.Name] = struct{}{}
-			}
+		for res := range resChan {
+			progress.Lock()
+			if res.err != nil {
+				fail(&NormalizationError{Record: res.n, Err: res.err})
+			} else if ctx.Err() == nil {
+				for _, o := range res.obsen {
+					hasCondition[o.Condition.Name] = struct{}{}
+				}
 
-			if err := WriteObservations(obsen, out); err != nil {
-				writeError = PTOErrorf("error writing observation: %v", err)
-				break
+				if err := obsw.WriteObservations(res.obsen); err != nil {
+					fail(PTOErrorf("error writing observations from record %d: %v", res.n, err))
+				}
 			}
+			written++
+			progressCond.Broadcast()
+			progress.Unlock()
 		}
 
 		close(writeComplete)
 	}()
 
-	// start normalizing records
+	// start normalizing records. after cancellation, remaining records are
+	// drained without being normalized.
 	for i := 0; i < norm.concurrency; i++ {
-		go func(me int) {
-			// process all records
+		normalizers.Add(1)
+		go func() {
+			defer normalizers.Done()
 			for rec := range recChan {
-				obsen, err := fte.normFunc(rec.bytes, rmd, mdChan)
-				if err != nil {
-					errChan <- PTOErrorf("error normalizing record %d: %v (goroutine %d)", rec.n, err, me)
-					close(recordComplete[me])
-					return
+				if ctx.Err() != nil {
+					continue
 				}
-				obsChan <- obsen
+				obsen, err := fte.normFunc(rec.bytes, rmd, mdChan)
+				resChan <- &psnResult{n: rec.n, obsen: obsen, err: err}
 			}
+		}()
+	}
 
-			close(recordComplete[me])
-		}(i)
+	// checkpoint waits for all records scanned so far to be written and
+	// their metadata merged, then records progress alongside the output.
+	checkpoint := func() error {
+		progress.Lock()
+		for written < recno && ctx.Err() == nil {
+			progressCond.Wait()
+		}
+		if err := ctx.Err(); err != nil {
+			progress.Unlock()
+			return err
+		}
+		if err := obsw.Flush(); err != nil {
+			progress.Unlock()
+			return PTOErrorf("error writing observations: %v", err)
+		}
+		cp := normalizerCheckpoint{
+			Records:      recno,
+			InputOffset:  inOffset,
+			OutputOffset: cout.n,
+			Conditions:   hasCondition.Conditions(),
+		}
+		progress.Unlock()
+
+		ack := make(chan map[string]interface{})
+		mergeBarrier <- ack
+		cp.Metadata = <-ack
+
+		if err := writeCheckpoint(outfile, &cp); err != nil {
+			return err
+		}
+
+		discardFrom = cp.OutputOffset
+		return nil
 	}
 
 	// now go. split and process.
-	var recno int
-
 	for scanner.Scan() {
 		recno++
 		recBytes := make([]byte, len(scanner.Bytes()))
 		copy(recBytes, scanner.Bytes())
 
 		select {
-		case err = <-errChan:
-			outError = err
+		case <-ctx.Done():
 			goto shutdown
 		case recChan <- &psnRecord{n: recno, bytes: recBytes}:
 			// NOP
 		}
+
+		if outfile != nil && recno%norm.checkpointInterval == 0 {
+			if err := checkpoint(); err != nil {
+				fail(err)
+				goto shutdown
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fail(PTOErrorf("error reading input after record %d: %v", recno, err))
 	}
 
 shutdown:
 
 	// signal shutdown to record normalizers and wait for shutdown
 	close(recChan)
-	for i := 0; i < norm.concurrency; i++ {
-		<-recordComplete[i]
-	}
+	normalizers.Wait()
 
 	// signal shutdown to writer and wait for shutdown
-	close(obsChan)
+	close(resChan)
 	<-writeComplete
-	if writeError != nil {
-		outError = writeError
-	}
 
 	// signal shutdown to merger and wait for shutdown
 	close(mdChan)
 	<-mergeComplete
 
 	// all goroutines have shut down. did we error?
-	if outError != nil {
-		return outError
+	if err := ctx.Err(); err != nil {
+		fail(err)
+	}
+	if firstError != nil {
+		if discardFile != nil {
+			discardPartialOutput(discardFile, discardFrom)
+		}
+		return firstError
+	}
+
+	if err := obsw.Flush(); err != nil {
+		return PTOErrorf("error writing observations: %v", err)
 	}
 
 	// add conditions
@@ -393,6 +603,11 @@ shutdown:
 		return fmt.Errorf("error writing metadata: %s", err.Error())
 	}
 
+	// normalization complete, checkpoint no longer necessary
+	if outfile != nil {
+		return removeCheckpoint(outfile)
+	}
+
 	// all done
 	return nil
 }
@@ -411,14 +626,28 @@ func (st AnalysisSetTable) AddSetFrom(obs *Observation) {
 	}
 }
 
+// MetadataConflicts reports metadata keys with conflicting values across
+// observation sets, mapping each key to the value of that key in each set (by
+// set ID) in which it appears.
+type MetadataConflicts map[string]map[int]string
+
 // MergeMetadata creates merged output metadata from the set of incoming
 // observation sets, tracking sources and including all metadata keys for
 // which the value is the same in each set in the table.
 func (st AnalysisSetTable) MergeMetadata() map[string]interface{} {
+	mdout, _ := st.MergeMetadataWithConflicts()
+	return mdout
+}
+
+// MergeMetadataWithConflicts creates merged output metadata as MergeMetadata,
+// additionally returning the keys dropped from the output due to conflicting
+// values, so analyzers can resolve them explicitly.
+func (st AnalysisSetTable) MergeMetadataWithConflicts() (map[string]interface{}, MetadataConflicts) {
 	mdout := make(map[string]interface{})
 
 	sources := make([]string, 0)
-	conflictingKeys := make(map[string]struct{})
+	valuesByKey := make(map[string]map[int]string)
+	conflicts := make(MetadataConflicts)
 
 	for setid := range st {
 
@@ -430,7 +659,12 @@ func (st AnalysisSetTable) MergeMetadata() map[string]interface{} {
 
 		// inherit arbitrary metadata for all keys without conflict
 		for k, newval := range st[setid].Metadata {
-			if _, ok := conflictingKeys[k]; ok {
+			if valuesByKey[k] == nil {
+				valuesByKey[k] = make(map[int]string)
+			}
+			valuesByKey[k][setid] = newval
+
+			if _, ok := conflicts[k]; ok {
 				continue
 			} else {
 				existval, ok := mdout[k]
@@ -438,17 +672,22 @@ func (st AnalysisSetTable) MergeMetadata() map[string]interface{} {
 					mdout[k] = newval
 				} else if fmt.Sprintf("%v", existval) != fmt.Sprintf("%v", newval) {
 					delete(mdout, k)
-					conflictingKeys[k] = struct{}{}
+					conflicts[k] = nil
 				}
 			}
 		}
 	}
 
+	// report all values seen for each conflicting key
+	for k := range conflicts {
+		conflicts[k] = valuesByKey[k]
+	}
+
 	if len(sources) > 0 {
 		mdout["_sources"] = sources
 	}
 
-	return mdout
+	return mdout, conflicts
 }
 
 // AnalyzeObservationStream reads observation set metadata and data from a
@@ -469,14 +708,11 @@ func AnalyzeObservationStream(in io.Reader, afn func(obs *Observation) error) (A
 	for scanner.Scan() {
 		lineno++
 		line := strings.TrimSpace(scanner.Text())
-		switch line[0] {
-		case '{':
-			// New observation set; cache metadata
-			currentSet = new(ObservationSet)
-			if err := currentSet.UnmarshalJSON(scanner.Bytes()); err != nil {
-				return nil, PTOErrorf("error parsing set on input line %d: %s", lineno, err.Error())
-			}
-		case '[':
+		if line == "" {
+			continue
+		}
+		switch {
+		case isObservationLine([]byte(line)):
 			// New observation; call analysis function
 			obs = new(Observation)
 			if err := obs.UnmarshalJSON(scanner.Bytes()); err != nil {
@@ -504,7 +740,222 @@ func AnalyzeObservationStream(in io.Reader, afn func(obs *Observation) error) (A
 			if err := afn(obs); err != nil {
 				return nil, PTOWrapError(err)
 			}
+		case line[0] == '{':
+			// New observation set; cache metadata
+			currentSet = new(ObservationSet)
+			if err := currentSet.UnmarshalJSON(scanner.Bytes()); err != nil {
+				return nil, PTOErrorf("error parsing set on input line %d: %s", lineno, err.Error())
+			}
+		}
+	}
+
+	return setTable, nil
+}
+
+// obsStreamLines reads non-empty lines from an observation stream, with
+// single-line pushback.
+type obsStreamLines struct {
+	scanner *bufio.Scanner
+	lineno  int
+	line    []byte
+	unread  bool
+}
+
+func (l *obsStreamLines) next() bool {
+	if l.unread {
+		l.unread = false
+		return true
+	}
+	for l.scanner.Scan() {
+		l.lineno++
+		l.line = bytes.TrimSpace(l.scanner.Bytes())
+		if len(l.line) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *obsStreamLines) unreadLine() {
+	l.unread = true
+}
+
+// obsLineSetID extracts the set ID from an observation line without parsing
+// the rest of the observation, if it is in version 1 format.
+func obsLineSetID(line []byte) (int, error) {
+	if line[0] == '{' {
+		jslice, _, _, err := decodeObsLine(line)
+		if err != nil {
+			return 0, PTOWrapError(err)
+		} else if jslice[0] == "" {
+			return 0, nil
+		}
+		setid, err := ParseSetID(jslice[0])
+		if err != nil {
+			return 0, err
 		}
+		return int(setid), nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return 0, PTOErrorf("observation is not a JSON array")
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	setidstr, ok := tok.(string)
+	if !ok {
+		return 0, PTOErrorf("observation set ID is not a string")
+	} else if setidstr == "" {
+		return 0, nil
+	}
+
+	setid, err := ParseSetID(setidstr)
+	if err != nil {
+		return 0, err
+	}
+	return int(setid), nil
+}
+
+// ObservationIterator iterates over the observations in a single observation
+// set in an observation stream, parsing each observation only when requested.
+type ObservationIterator struct {
+	lines    *obsStreamLines
+	setTable AnalysisSetTable
+	set      *ObservationSet
+	obs      *Observation
+	err      error
+	done     bool
+}
+
+// Next advances the iterator to the next observation in the set, returning
+// false when no observations remain or an error occurred.
+func (it *ObservationIterator) Next() bool {
+	for !it.done {
+		if !it.lines.next() {
+			it.done = true
+			break
+		}
+
+		switch {
+		case isObservationLine(it.lines.line):
+			obs := new(Observation)
+			if err := obs.UnmarshalJSON(it.lines.line); err != nil {
+				it.err = PTOErrorf("error parsing observation on input line %d: %s", it.lines.lineno, err.Error())
+				it.done = true
+				break
+			}
+
+			if obs.SetID == it.set.ID {
+				obs.Set = it.set
+			} else if set, ok := it.setTable[obs.SetID]; ok {
+				obs.Set = set
+			} else {
+				it.err = PTOErrorf("observation on input line %d refers to uncached set %x", it.lines.lineno, obs.SetID)
+				it.done = true
+				break
+			}
+
+			it.obs = obs
+			return true
+		case it.lines.line[0] == '{':
+			// start of next set; leave it for the caller
+			it.lines.unreadLine()
+			it.done = true
+		}
+	}
+
+	it.obs = nil
+	return false
+}
+
+// Observation returns the current observation.
+func (it *ObservationIterator) Observation() *Observation {
+	return it.obs
+}
+
+// Err returns the error which stopped iteration, if any.
+func (it *ObservationIterator) Err() error {
+	return it.err
+}
+
+// skip consumes the remaining lines in this set without parsing them.
+func (it *ObservationIterator) skip() {
+	for !it.done && it.err == nil {
+		if !it.lines.next() {
+			break
+		}
+		if it.lines.line[0] == '{' && !isObservationLine(it.lines.line) {
+			it.lines.unreadLine()
+			break
+		}
+	}
+	it.done = true
+}
+
+// AnalyzeObservationSets reads observation set metadata and data from a file
+// (as created by ptocat) and calls a provided analysis function once per
+// observation set, with an iterator over the observations in the set.
+// Observations are only parsed if the analysis function iterates over them, so
+// analyzers which only need set metadata, or which can stop early, need not
+// pay for parsing every observation. Sets without observations are skipped.
+// It returns a table mapping set IDs to observation sets, from which metadata
+// can be derived.
+func AnalyzeObservationSets(in io.Reader, sfn func(set *ObservationSet, obsen *ObservationIterator) error) (AnalysisSetTable, error) {
+	lines := &obsStreamLines{scanner: bufio.NewScanner(in)}
+
+	setTable := make(AnalysisSetTable)
+
+	for lines.next() {
+		switch {
+		case isObservationLine(lines.line):
+			return nil, PTOErrorf("observation on input line %d without current set", lines.lineno)
+
+		case lines.line[0] == '{':
+			// New observation set; parse metadata
+			set := new(ObservationSet)
+			if err := set.UnmarshalJSON(lines.line); err != nil {
+				return nil, PTOErrorf("error parsing set on input line %d: %s", lines.lineno, err.Error())
+			}
+
+			// get set ID from first observation
+			if !lines.next() {
+				break
+			}
+			if !isObservationLine(lines.line) {
+				lines.unreadLine()
+				break
+			}
+
+			setid, err := obsLineSetID(lines.line)
+			if err != nil {
+				return nil, PTOErrorf("error parsing observation on input line %d: %s", lines.lineno, err.Error())
+			}
+			lines.unreadLine()
+
+			set.ID = setid
+			if _, ok := setTable[setid]; setid != 0 && !ok {
+				setTable[setid] = set
+			}
+
+			// call analysis function, then skip anything it didn't iterate over
+			it := &ObservationIterator{lines: lines, setTable: setTable, set: set}
+			if err := sfn(set, it); err != nil {
+				return nil, PTOWrapError(err)
+			}
+			if it.err != nil {
+				return nil, it.err
+			}
+			it.skip()
+		}
+	}
+
+	if err := lines.scanner.Err(); err != nil {
+		return nil, PTOWrapError(err)
 	}
 
 	return setTable, nil
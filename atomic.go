@@ -0,0 +1,122 @@
+package pto3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is a file which is written to a temporary path alongside its
+// destination, and renamed into place only when committed. Readers of the
+// destination path therefore see either the previous content or the complete
+// new content, never a partially written file.
+type AtomicFile struct {
+	*os.File
+	path string
+	perm os.FileMode
+	done bool
+}
+
+// CreateAtomic creates a new AtomicFile which will replace the file at the
+// given path when committed.
+func CreateAtomic(path string, perm os.FileMode) (*AtomicFile, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &AtomicFile{File: f, path: path, perm: perm}, nil
+}
+
+// CreateAtomicVia creates a new AtomicFile which will replace the file at the
+// given path when committed, written via a temporary file at a known path, so
+// that the content written so far can be read before it is committed. Any
+// existing file at the temporary path is truncated.
+func CreateAtomicVia(path string, tmppath string, perm os.FileMode) (*AtomicFile, error) {
+	f, err := os.OpenFile(tmppath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &AtomicFile{File: f, path: path, perm: perm}, nil
+}
+
+// Commit flushes the file to disk, closes it, and renames it into place.
+func (af *AtomicFile) Commit() error {
+	if af.done {
+		return PTOErrorf("atomic write to %s already completed", af.path)
+	}
+	af.done = true
+
+	tmppath := af.File.Name()
+
+	if err := af.File.Chmod(af.perm); err != nil {
+		af.File.Close()
+		os.Remove(tmppath)
+		return PTOWrapError(err)
+	}
+
+	if err := af.File.Sync(); err != nil {
+		af.File.Close()
+		os.Remove(tmppath)
+		return PTOWrapError(err)
+	}
+
+	if err := af.File.Close(); err != nil {
+		os.Remove(tmppath)
+		return PTOWrapError(err)
+	}
+
+	if err := os.Rename(tmppath, af.path); err != nil {
+		os.Remove(tmppath)
+		return PTOWrapError(err)
+	}
+
+	// make the rename durable; not all platforms support syncing directories,
+	// so errors here are ignored.
+	if dir, err := os.Open(filepath.Dir(af.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// Abort closes and removes the temporary file, leaving the destination
+// untouched. It does nothing if the file has already been committed, so it
+// can be deferred immediately after CreateAtomic.
+func (af *AtomicFile) Abort() error {
+	if af.done {
+		return nil
+	}
+	af.done = true
+
+	af.File.Close()
+	if err := os.Remove(af.File.Name()); err != nil && !os.IsNotExist(err) {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// WriteFileAtomic writes data to the file at the given path atomically, as
+// with ioutil.WriteFile but replacing any existing file only once the new
+// content is completely on disk.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	af, err := CreateAtomic(path, perm)
+	if err != nil {
+		return err
+	}
+	defer af.Abort()
+
+	if _, err := af.Write(data); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return af.Commit()
+}
@@ -0,0 +1,181 @@
+package pto3
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// AnonymousPrincipal is the principal of operations requested without an API
+// key.
+const AnonymousPrincipal = "default"
+
+// AuditRecord records a single mutating operation on the observatory.
+type AuditRecord struct {
+	// Time at which the operation completed
+	Time time.Time `json:"time"`
+	// Principal requesting the operation: an API key fingerprint (see
+	// APIKeyPrincipal), AnonymousPrincipal, or a local user for command-line
+	// tools
+	Principal string `json:"principal"`
+	// Operation performed, as method and route (e.g. PUT /obs/{set}), or as
+	// command for command-line tools
+	Operation string `json:"operation"`
+	// Resource operated on (e.g. /obs/1a2b)
+	Target string `json:"target"`
+	// Identifier of the request, as returned to the client
+	RequestID string `json:"request_id"`
+	// HTTP status of the response, if any
+	Status int `json:"status,omitempty"`
+}
+
+// AuditFilter selects audit records. Zero-valued fields select all records.
+type AuditFilter struct {
+	Start     *time.Time
+	End       *time.Time
+	Principal string
+	// Prefix of the targets to select
+	Target string
+}
+
+func (filter *AuditFilter) matches(rec *AuditRecord) bool {
+	if filter.Start != nil && rec.Time.Before(*filter.Start) {
+		return false
+	}
+	if filter.End != nil && rec.Time.After(*filter.End) {
+		return false
+	}
+	if filter.Principal != "" && rec.Principal != filter.Principal {
+		return false
+	}
+	return strings.HasPrefix(rec.Target, filter.Target)
+}
+
+// AuditLog is an append-only log of mutating operations, stored as a file of
+// newline-delimited JSON audit records. It may be shared among multiple
+// processes; appends are serialized with an advisory lock on the log file.
+type AuditLog struct {
+	path string
+}
+
+// NewAuditLog opens the audit log given in the configuration, creating it if
+// necessary. It returns nil without error if no audit log is configured.
+func NewAuditLog(config *PTOConfiguration) (*AuditLog, error) {
+	if config.AuditLogPath == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(config.AuditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	f.Close()
+
+	return &AuditLog{path: config.AuditLogPath}, nil
+}
+
+// Record appends a record to the audit log, filling in its time if not set.
+// The record is synced to disk before Record returns.
+func (al *AuditLog) Record(rec *AuditRecord) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	lock, err := lockFile(al.path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// Records returns the records in the audit log selected by a filter, in the
+// order in which they were recorded.
+func (al *AuditLog) Records(filter *AuditFilter) ([]AuditRecord, error) {
+	lock, err := lockFile(al.path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	f, err := os.Open(al.path)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	defer f.Close()
+
+	out := make([]AuditRecord, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, PTOErrorf("corrupt audit log %s: %v", al.path, err)
+		}
+		if filter == nil || filter.matches(&rec) {
+			out = append(out, rec)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return out, nil
+}
+
+// APIKeyPrincipal returns the principal recorded in the audit log for an API
+// key: a fingerprint of the key, so that keys themselves are not stored in
+// the log. The empty key and the default key are anonymous.
+func APIKeyPrincipal(key string) string {
+	if key == "" || key == AnonymousPrincipal {
+		return AnonymousPrincipal
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:8])
+}
+
+// LocalPrincipal returns the principal recorded in the audit log for
+// operations performed with command-line tools: "local:" followed by the name
+// of the user running the tool, or "local" if it cannot be determined.
+func LocalPrincipal() string {
+	if u, err := user.Current(); err == nil {
+		return "local:" + u.Username
+	}
+	return "local"
+}
+
+// NewRequestID returns a new random identifier for a request.
+func NewRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		// fall back to the time, which is unique enough for audit purposes
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
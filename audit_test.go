@@ -0,0 +1,96 @@
+package pto3_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pto3-test-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no log without a path
+	if al, err := pto3.NewAuditLog(&pto3.PTOConfiguration{}); err != nil || al != nil {
+		t.Fatalf("expected no audit log, got %v, %v", al, err)
+	}
+
+	config := &pto3.PTOConfiguration{AuditLogPath: filepath.Join(dir, "audit.ndjson")}
+	al, err := pto3.NewAuditLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := pto3.APIKeyPrincipal("07e57ab18e70")
+	records := []pto3.AuditRecord{
+		{Time: t0, Principal: key, Operation: "PUT /raw/{campaign}", Target: "/raw/test", RequestID: pto3.NewRequestID(), Status: 201},
+		{Time: t0.Add(time.Hour), Principal: key, Operation: "DELETE /raw/{campaign}/{file}", Target: "/raw/test/file.json", RequestID: pto3.NewRequestID(), Status: 204},
+		{Time: t0.Add(2 * time.Hour), Principal: pto3.APIKeyPrincipal(""), Operation: "PUT /obs/{set}", Target: "/obs/1", RequestID: pto3.NewRequestID(), Status: 403},
+	}
+
+	for i := range records {
+		if err := al.Record(&records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reopening the log appends to it
+	al, err = pto3.NewAuditLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Record(&pto3.AuditRecord{Principal: "local:ptoadmin", Operation: "ptodb alias", Target: "a b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := al.Records(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("expected 4 audit records, got %d", len(all))
+	}
+	if all[1].RequestID != records[1].RequestID || all[1].Status != 204 {
+		t.Fatalf("audit record 1 not preserved: %+v", all[1])
+	}
+	if all[3].Time.IsZero() {
+		t.Fatal("audit record time not filled in")
+	}
+
+	start := t0.Add(30 * time.Minute)
+	end := t0.Add(3 * time.Hour)
+	filters := []struct {
+		filter pto3.AuditFilter
+		count  int
+	}{
+		{pto3.AuditFilter{Principal: key}, 2},
+		{pto3.AuditFilter{Principal: pto3.AnonymousPrincipal}, 1},
+		{pto3.AuditFilter{Target: "/raw/"}, 2},
+		{pto3.AuditFilter{Start: &start}, 3},
+		{pto3.AuditFilter{Start: &start, End: &end}, 2},
+		{pto3.AuditFilter{Start: &start, Target: "/raw/test"}, 1},
+	}
+
+	for i, f := range filters {
+		recs, err := al.Records(&f.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != f.count {
+			t.Fatalf("filter %d: expected %d records, got %d", i, f.count, len(recs))
+		}
+	}
+
+	// keys are not recorded
+	if key == "07e57ab18e70" || key == pto3.AnonymousPrincipal {
+		t.Fatalf("bad principal %s for API key", key)
+	}
+}
@@ -0,0 +1,194 @@
+package pto3
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// RawMetadataRecord is a line in a raw metadata backup stream, as written by
+// RawDataStore.WriteMetadataToStream: the metadata of a campaign, if File is
+// empty, or of a file in it, without inherited or virtual metadata.
+type RawMetadataRecord struct {
+	Campaign string          `json:"campaign"`
+	File     string          `json:"file,omitempty"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// WriteMetadataToStream writes the metadata of every campaign and file in
+// this raw data store to the given stream as newline-delimited JSON
+// RawMetadataRecords, each campaign followed by its files. File data is not
+// written.
+func (rds *RawDataStore) WriteMetadataToStream(out io.Writer) error {
+	enc := json.NewEncoder(out)
+
+	camnames := rds.CampaignNames()
+	sort.Strings(camnames)
+
+	for _, camname := range camnames {
+		cam, err := rds.CampaignForName(camname)
+		if err != nil {
+			return err
+		}
+
+		cammd, err := cam.GetCampaignMetadata()
+		if err != nil {
+			return err
+		}
+		b, err := cammd.DumpJSONObject(false)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(RawMetadataRecord{Campaign: camname, Metadata: b}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		filenames, err := cam.FileNames()
+		if err != nil {
+			return err
+		}
+
+		for _, filename := range filenames {
+			filemd, err := cam.GetFileMetadata(filename)
+			if err != nil {
+				return err
+			}
+			b, err := filemd.DumpJSONObject(false)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(RawMetadataRecord{Campaign: camname, File: filename, Metadata: b}); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadMetadataFromStream restores campaign and file metadata written by
+// WriteMetadataToStream into this raw data store, creating campaigns which
+// do not exist and overwriting the metadata of those which do. File data is
+// not restored; it must be copied into the store separately.
+func (rds *RawDataStore) ReadMetadataFromStream(in io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(in))
+
+	for {
+		var rec RawMetadataRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return PTOWrapError(err)
+		}
+
+		if rec.File == "" {
+			var md RawMetadata
+			if err := json.Unmarshal(rec.Metadata, &md); err != nil {
+				return PTOErrorf("bad metadata for campaign %s: %v", rec.Campaign, err)
+			}
+
+			cam, err := rds.CampaignForName(rec.Campaign)
+			if err == nil {
+				err = cam.PutCampaignMetadata(&md)
+			} else {
+				_, err = rds.CreateCampaign(rec.Campaign, &md)
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			cam, err := rds.CampaignForName(rec.Campaign)
+			if err != nil {
+				return err
+			}
+
+			var md RawMetadata
+			if err := json.Unmarshal(rec.Metadata, &md); err != nil {
+				return PTOErrorf("bad metadata for file %s/%s: %v", rec.Campaign, rec.File, err)
+			}
+
+			if err := cam.PutFileMetadata(rec.File, &md); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// queryBackupBatchSize is the number of query records read from the database
+// at once when writing query metadata to a stream.
+const queryBackupBatchSize = 1000
+
+// WriteMetadataToStream writes the state and metadata of every query in this
+// cache to the given stream as newline-delimited JSON QueryRecords. Query
+// results are not written.
+func (qc *QueryCache) WriteMetadataToStream(out io.Writer) error {
+	enc := json.NewEncoder(out)
+
+	last := ""
+	for {
+		var recs []QueryRecord
+		if err := qc.db.Model(&recs).
+			Where("identifier > ?", last).
+			Order("identifier").
+			Limit(queryBackupBatchSize).
+			Select(); err != nil {
+			return PTOWrapError(err)
+		}
+
+		for i := range recs {
+			if err := enc.Encode(&recs[i]); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+
+		if len(recs) < queryBackupBatchSize {
+			return nil
+		}
+		last = recs[len(recs)-1].Identifier
+	}
+}
+
+// ReadMetadataFromStream restores query state and metadata written by
+// WriteMetadataToStream into this cache. Queries already in the cache are
+// left alone. Completed queries whose results are not in the cache's result
+// directory are restored as not yet executed, so that they can be executed
+// again against the observation sets they are pinned to.
+func (qc *QueryCache) ReadMetadataFromStream(in io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(in))
+
+	for {
+		var rec QueryRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return PTOWrapError(err)
+		}
+
+		if rec.Completed != nil {
+			if _, err := os.Stat(qc.dataPath(rec.Identifier)); os.IsNotExist(err) {
+				rec.Executed = nil
+				rec.Completed = nil
+				rec.Error = ""
+				rec.RowsSoFar = 0
+				rec.ResultRows = nil
+				rec.Stats = nil
+			}
+		}
+
+		// observation set metadata carries modification times at second
+		// precision, so sets restored from a backup are only that precise.
+		for i := range rec.Sources {
+			if rec.Sources[i].Modified != nil {
+				t := rec.Sources[i].Modified.Truncate(time.Second)
+				rec.Sources[i].Modified = &t
+			}
+		}
+
+		if _, err := qc.db.Model(&rec).OnConflict("DO NOTHING").Insert(); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -77,6 +78,48 @@ func ParseTime(s string) (time.Time, error) {
 	return time.Time{}, PTOErrorf("%s not parseable as time", s).StatusIs(http.StatusBadRequest)
 }
 
+// relativeTimeUnits maps the unit suffixes of relative time expressions to
+// durations.
+var relativeTimeUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// ParseRelativeTime parses a time expression relative to a reference time:
+// either "now", or an offset from now such as "-7d" or "now-12h", in seconds
+// (s), minutes (m), hours (h), days (d), or weeks (w). It returns false if the
+// expression is not relative, in which case it should be parsed with
+// ParseTime.
+func ParseRelativeTime(s string, now time.Time) (time.Time, bool, error) {
+	expr := strings.TrimPrefix(s, "now")
+	if expr == "" {
+		return now, true, nil
+	}
+
+	if expr[0] != '-' && expr[0] != '+' {
+		return time.Time{}, false, nil
+	}
+
+	unit, ok := relativeTimeUnits[expr[len(expr)-1]]
+	if !ok {
+		if expr == s {
+			// not relative, e.g. negative epoch seconds
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, PTOErrorf("%s has unknown relative time unit", s).StatusIs(http.StatusBadRequest)
+	}
+
+	n, err := strconv.Atoi(expr[:len(expr)-1])
+	if err != nil {
+		return time.Time{}, false, PTOErrorf("%s not parseable as relative time", s).StatusIs(http.StatusBadRequest)
+	}
+
+	return now.Add(time.Duration(n) * unit), true, nil
+}
+
 // AsTime tries to typeswitch an interface to a time.Time.
 func AsTime(v interface{}) (time.Time, error) {
 	switch cv := v.(type) {
@@ -0,0 +1,124 @@
+package pto3
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// CheckpointSuffix is the suffix on a normalizer checkpoint file, stored
+// alongside the output file it describes.
+const CheckpointSuffix = ".pto_checkpoint.json"
+
+// normalizerCheckpoint records the progress of a long-running normalization,
+// such that a crashed normalization can be resumed from the last checkpoint
+// instead of restarting from the beginning of the input.
+type normalizerCheckpoint struct {
+	// Number of records completely normalized and written to output
+	Records int `json:"records"`
+	// Offset in the (decompressed) input of the first unprocessed record
+	InputOffset int64 `json:"input_offset"`
+	// Length of the output at the time of the checkpoint
+	OutputOffset int64 `json:"output_offset"`
+	// Conditions seen in output so far
+	Conditions []string `json:"conditions"`
+	// Partially merged output metadata
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// checkpointPath returns the path to the checkpoint file for a given output file.
+func checkpointPath(out *os.File) string {
+	return out.Name() + CheckpointSuffix
+}
+
+// readCheckpoint reads the checkpoint for a given output file, if present.
+// It returns nil without error if no checkpoint exists.
+func readCheckpoint(out *os.File) (*normalizerCheckpoint, error) {
+	b, err := ioutil.ReadFile(checkpointPath(out))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, PTOWrapError(err)
+	}
+
+	var cp normalizerCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, PTOErrorf("error parsing checkpoint %s: %v", checkpointPath(out), err)
+	}
+
+	return &cp, nil
+}
+
+// writeCheckpoint flushes the output file to disk, then writes a checkpoint
+// for it. The checkpoint is written to a temporary file and renamed into
+// place, so a crash during checkpointing leaves the previous checkpoint intact.
+func writeCheckpoint(out *os.File, cp *normalizerCheckpoint) error {
+	if err := out.Sync(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	return WriteFileAtomic(checkpointPath(out), b, 0644)
+}
+
+// removeCheckpoint removes the checkpoint for a given output file after a
+// successful normalization.
+func removeCheckpoint(out *os.File) error {
+	if err := os.Remove(checkpointPath(out)); err != nil && !os.IsNotExist(err) {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// resumeFromCheckpoint prepares input and output to continue a normalization
+// from a checkpoint: the output is truncated to the checkpointed length, and
+// the input is advanced past all records already normalized.
+func resumeFromCheckpoint(cp *normalizerCheckpoint, in io.Reader, out *os.File) error {
+	if err := out.Truncate(cp.OutputOffset); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := out.Seek(cp.OutputOffset, io.SeekStart); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// seek directly if we can, otherwise skip forward through the stream.
+	if seeker, ok := in.(io.Seeker); ok {
+		if _, err := seeker.Seek(cp.InputOffset, io.SeekStart); err != nil {
+			return PTOWrapError(err)
+		}
+	} else if _, err := io.CopyN(ioutil.Discard, in, cp.InputOffset); err != nil {
+		return PTOErrorf("error skipping to checkpointed input offset %d: %v", cp.InputOffset, err)
+	}
+
+	return nil
+}
+
+// offsetTrackingSplit wraps a split function to keep track of the offset in
+// the input of the next record to be returned by a Scanner.
+func offsetTrackingSplit(splitFunc bufio.SplitFunc, offset *int64) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := splitFunc(data, atEOF)
+		*offset += int64(advance)
+		return advance, token, err
+	}
+}
+
+// countingWriter counts bytes written to an underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
@@ -61,14 +61,17 @@ func main() {
 	// create a database connection
 	db := pg.Connect(&pconfig.ObsDatabase)
 
+	// annotate new paths with countries if configured
+	if err := pto3.EnableGeoIP(pconfig); err != nil {
+		log.Fatal(err)
+	}
+
 	// share pid and condition caches across all files in a single autonorm run
-	cidCache, err := pto3.LoadConditionCache(db)
+	loader, err := pto3.NewLoader(db)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	pidCache := make(pto3.PathCache)
-
 	log.Printf("autonorm starting with configuration %+v", aconfig.Autonorm)
 
 	// for each campaign directory
@@ -150,7 +153,7 @@ func main() {
 				log.Printf("...loading observation file %s...", obsfile.Name())
 
 				// load it
-				set, err := pto3.CopySetFromObsFile(obsfile.Name(), db, cidCache, pidCache)
+				set, err := loader.LoadSet(obsfile.Name())
 				if err != nil {
 					log.Fatal(err)
 				}
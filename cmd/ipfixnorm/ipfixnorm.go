@@ -0,0 +1,86 @@
+// ipfixnorm is an example normalizer for raw IPFIX files, e.g. as exported
+// by QoF. For each IPv4 or IPv6 flow record, it reports the ECN codepoint on
+// the flow's first packet, from the low bits of ipClassOfService, as an
+// ecn.ipmark condition on the path from source to destination. Use it as a
+// starting point for normalizers of other IPFIX data.
+//
+// Like other normalizers, it reads raw data on standard input and metadata on
+// file descriptor 3, and writes an observation file to standard output; see
+// doc/ANALYZER.md.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var analyzerFlag = flag.String("analyzer", "https://raw.githubusercontent.com/mami-project/pto3-go/master/cmd/ipfixnorm/ipfixnorm_analyzer.json", "`URL` of analyzer metadata")
+
+// ecnConditions maps ECN codepoints to conditions
+var ecnConditions = [4]string{
+	"ecn.ipmark.not-ect.seen",
+	"ecn.ipmark.ect1.seen",
+	"ecn.ipmark.ect0.seen",
+	"ecn.ipmark.ce.seen",
+}
+
+// flowAddresses returns the source and destination addresses of a flow
+// record, IPv4 or IPv6.
+func flowAddresses(rec *pto3.IPFIXRecord) (net.IP, net.IP, bool) {
+	if src, ok := rec.IP(pto3.IESourceIPv4Address); ok {
+		dst, ok := rec.IP(pto3.IEDestinationIPv4Address)
+		return src, dst, ok
+	}
+	if src, ok := rec.IP(pto3.IESourceIPv6Address); ok {
+		dst, ok := rec.IP(pto3.IEDestinationIPv6Address)
+		return src, dst, ok
+	}
+	return nil, nil, false
+}
+
+// normalizeFlow turns a flow record into an ECN observation. Records which
+// are not flows with addresses, times, and class of service (e.g. options
+// records) yield no observations.
+func normalizeFlow(rec *pto3.IPFIXRecord, mdin *pto3.RawMetadata, mdout map[string]interface{}) ([]pto3.Observation, error) {
+	src, dst, ok := flowAddresses(rec)
+	if !ok {
+		return nil, nil
+	}
+
+	start, ok := rec.Milliseconds(pto3.IEFlowStartMilliseconds)
+	if !ok {
+		return nil, nil
+	}
+	end, ok := rec.Milliseconds(pto3.IEFlowEndMilliseconds)
+	if !ok {
+		return nil, nil
+	}
+
+	tos, ok := rec.Uint(pto3.IEIPClassOfService)
+	if !ok {
+		return nil, nil
+	}
+
+	return []pto3.Observation{{
+		TimeStart: &start,
+		TimeEnd:   &end,
+		Path:      pto3.NewPath(fmt.Sprintf("%s * %s", src, dst)),
+		Condition: pto3.NewCondition(ecnConditions[tos&3]),
+	}}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	norm := pto3.NewSerialScanningNormalizer(*analyzerFlag)
+	norm.RegisterFiletype(pto3.IPFIXFiletype, pto3.SplitIPFIXMessages, pto3.NewIPFIXSerialNormFunc(normalizeFlow), nil)
+
+	if err := norm.Normalize(os.Stdin, os.NewFile(3, ".piped_metadata.json"), os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
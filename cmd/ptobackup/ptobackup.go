@@ -0,0 +1,330 @@
+// ptobackup exports the contents of a PTO to a backup directory or tarball,
+// and restores them into another PTO.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file`")
+var formatFlag = flag.Int("format", pto3.ObsFormatV1, "observation file `format` version for observation set bundles")
+
+// Names of files and directories in a backup
+const (
+	obsBackupDir        = "obs"
+	rawBackupFilename   = "raw.ndjson"
+	queryBackupFilename = "queries.ndjson"
+)
+
+// isTarball returns true if a backup path names a tarball rather than a
+// directory.
+func isTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar") || strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// backupObs writes each observation set in the database as a bundle named by
+// its ID into the obs directory of a backup.
+func backupObs(db *pg.DB, dir string) error {
+	obsdir := filepath.Join(dir, obsBackupDir)
+	if err := os.Mkdir(obsdir, 0755); err != nil {
+		return err
+	}
+
+	setIDs, err := pto3.AllObservationSetIDs(db)
+	if err != nil {
+		return err
+	}
+
+	for i, setid := range setIDs {
+		set := pto3.ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			return fmt.Errorf("retrieving set %x: %v", setid, err)
+		}
+
+		out, err := os.Create(filepath.Join(obsdir, pto3.SetID(setid).String()+".ndjson"))
+		if err != nil {
+			return err
+		}
+
+		if err := set.CopyBundleToStream(db, out, *formatFlag); err != nil {
+			out.Close()
+			return fmt.Errorf("writing set %x: %v", setid, err)
+		}
+
+		if err := out.Close(); err != nil {
+			return err
+		}
+
+		log.Printf("%d/%d backed up observation set 0x%x: %d observations", i+1, len(setIDs), setid, set.Count)
+	}
+
+	return nil
+}
+
+// restoreObs restores each observation set bundle in the obs directory of a
+// backup under its original ID.
+func restoreObs(db *pg.DB, dir string) error {
+	obsdir := filepath.Join(dir, obsBackupDir)
+
+	direntries, err := ioutil.ReadDir(obsdir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	setIDs := make([]int, 0, len(direntries))
+	for _, direntry := range direntries {
+		name := direntry.Name()
+		if !strings.HasSuffix(name, ".ndjson") {
+			continue
+		}
+		setid, err := pto3.ParseSetID(strings.TrimSuffix(name, ".ndjson"))
+		if err != nil {
+			return fmt.Errorf("bad observation set bundle name %s: %v", name, err)
+		}
+		setIDs = append(setIDs, int(setid))
+	}
+	sort.Ints(setIDs)
+
+	loader, err := pto3.NewLoader(db)
+	if err != nil {
+		return err
+	}
+
+	for i, setid := range setIDs {
+		set, err := loader.RestoreSet(filepath.Join(obsdir, pto3.SetID(setid).String()+".ndjson"), setid)
+		if err != nil {
+			return fmt.Errorf("restoring set %x: %v", setid, err)
+		}
+
+		log.Printf("%d/%d restored observation set 0x%x: %d observations", i+1, len(setIDs), setid, set.Count)
+	}
+
+	return nil
+}
+
+// backupRaw writes the metadata of every campaign and file in the raw data
+// store to a backup.
+func backupRaw(config *pto3.PTOConfiguration, dir string) error {
+	rds, err := pto3.NewRawDataStore(config)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(filepath.Join(dir, rawBackupFilename))
+	if err != nil {
+		return err
+	}
+
+	if err := rds.WriteMetadataToStream(out); err != nil {
+		out.Close()
+		return err
+	}
+
+	log.Printf("backed up raw metadata from %s", config.RawRoot)
+	return out.Close()
+}
+
+// restoreRaw restores campaign and file metadata from a backup into the raw
+// data store.
+func restoreRaw(config *pto3.PTOConfiguration, dir string) error {
+	in, err := os.Open(filepath.Join(dir, rawBackupFilename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	rds, err := pto3.NewRawDataStore(config)
+	if err != nil {
+		return err
+	}
+
+	if err := rds.ReadMetadataFromStream(in); err != nil {
+		return err
+	}
+
+	log.Printf("restored raw metadata to %s", config.RawRoot)
+	return nil
+}
+
+// backupQueries writes the state and metadata of every query in the query
+// cache to a backup.
+func backupQueries(config *pto3.PTOConfiguration, dir string) error {
+	qc, err := pto3.NewQueryCache(config)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(filepath.Join(dir, queryBackupFilename))
+	if err != nil {
+		return err
+	}
+
+	if err := qc.WriteMetadataToStream(out); err != nil {
+		out.Close()
+		return err
+	}
+
+	log.Printf("backed up query metadata")
+	return out.Close()
+}
+
+// restoreQueries restores query state and metadata from a backup into the
+// query cache.
+func restoreQueries(config *pto3.PTOConfiguration, dir string) error {
+	in, err := os.Open(filepath.Join(dir, queryBackupFilename))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	qc, err := pto3.NewQueryCache(config)
+	if err != nil {
+		return err
+	}
+
+	if err := qc.ReadMetadataFromStream(in); err != nil {
+		return err
+	}
+
+	log.Printf("restored query metadata")
+	return nil
+}
+
+// backup writes the observation sets, raw metadata, and query metadata of the
+// configured PTO to a new backup directory or tarball.
+func backup(config *pto3.PTOConfiguration, target string) error {
+	dir := target
+	if isTarball(target) {
+		var err error
+		dir, err = ioutil.TempDir("", "ptobackup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	} else if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+
+	if config.ObsDatabase.Database != "" {
+		if err := backupObs(pg.Connect(&config.ObsDatabase), dir); err != nil {
+			return err
+		}
+	}
+
+	if config.RawRoot != "" {
+		if err := backupRaw(config, dir); err != nil {
+			return err
+		}
+	}
+
+	if config.QueryCacheRoot != "" && config.ObsDatabase.Database != "" {
+		if err := backupQueries(config, dir); err != nil {
+			return err
+		}
+	}
+
+	if isTarball(target) {
+		return packTarball(dir, target)
+	}
+
+	return nil
+}
+
+// restore restores the observation sets, raw metadata, and query metadata in
+// a backup directory or tarball into the configured PTO.
+func restore(config *pto3.PTOConfiguration, source string) error {
+	dir := source
+	if isTarball(source) {
+		var err error
+		dir, err = ioutil.TempDir("", "ptobackup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		if err := unpackTarball(source, dir); err != nil {
+			return err
+		}
+	}
+
+	if config.ObsDatabase.Database != "" {
+		db := pg.Connect(&config.ObsDatabase)
+		if err := pto3.CreateTables(db); err != nil {
+			return err
+		}
+		if err := restoreObs(db, dir); err != nil {
+			return err
+		}
+	}
+
+	if config.RawRoot != "" {
+		if err := restoreRaw(config, dir); err != nil {
+			return err
+		}
+	}
+
+	if config.QueryCacheRoot != "" && config.ObsDatabase.Database != "" {
+		if err := restoreQueries(config, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: back up or restore the contents of a PTO\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> <command> <path>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  backup <path>: write observation sets, raw metadata, and query metadata to a new directory,\n")
+		fmt.Fprintf(os.Stderr, "                 or to a tarball if path ends in .tar, .tar.gz, or .tgz\n")
+		fmt.Fprintf(os.Stderr, "  restore <path>: restore a backup directory or tarball\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	if *helpFlag || len(args) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "backup":
+		err = backup(config, args[1])
+	case "restore":
+		err = restore(config, args[1])
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
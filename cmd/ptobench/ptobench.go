@@ -0,0 +1,308 @@
+// ptobench generates synthetic load against a running ptosrv, and reports
+// latency percentiles and throughput for each kind of request
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/obsgen"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var urlFlag = flag.String("url", "", "base `URL` of the PTO to benchmark")
+var keyFlag = flag.String("key", "", "API `key` to use; needs write_obs to upload and submit_query_obs and submit_query_group to query")
+var durationFlag = flag.Duration("duration", 30*time.Second, "how long to generate load for")
+var uploadersFlag = flag.Int("uploaders", 1, "number of concurrent clients uploading observation sets")
+var queriersFlag = flag.Int("queriers", 4, "number of concurrent clients submitting queries")
+var countFlag = flag.Int("count", 1000, "number of observations per uploaded set")
+var specFlag = flag.String("spec", "", "JSON `file` of obsgen specs to generate uploads from; default obsgen's default specs")
+var groupFlag = flag.Float64("group", 0.5, "fraction of queries which are aggregation (group) queries")
+var waitFlag = flag.Bool("wait", true, "poll submitted queries until they complete, and include execution in query latency")
+var pollFlag = flag.Duration("poll", 250*time.Millisecond, "interval between polls of pending queries")
+
+// opResult records the outcome of a single benchmarked operation.
+type opResult struct {
+	latency time.Duration
+	err     error
+}
+
+// opStats accumulates results for one kind of operation.
+type opStats struct {
+	lock      sync.Mutex
+	latencies []time.Duration
+	errors    int
+	lastError error
+}
+
+func (s *opStats) record(res opResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if res.err != nil {
+		s.errors++
+		s.lastError = res.err
+		return
+	}
+	s.latencies = append(s.latencies, res.latency)
+}
+
+// percentile returns the latency at the given percentile of successful
+// operations, which must be sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func (s *opStats) report(out io.Writer, name string, elapsed time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	fmt.Fprintf(out, "%-8s %7d ok %5d err %8.2f/s   p50 %9.1fms   p90 %9.1fms   p99 %9.1fms   max %9.1fms\n",
+		name, len(s.latencies), s.errors,
+		float64(len(s.latencies))/elapsed.Seconds(),
+		ms(percentile(s.latencies, 50)),
+		ms(percentile(s.latencies, 90)),
+		ms(percentile(s.latencies, 99)),
+		ms(percentile(s.latencies, 100)))
+	if s.lastError != nil {
+		fmt.Fprintf(out, "%-8s last error: %v\n", "", s.lastError)
+	}
+}
+
+// bench holds the state shared by all benchmark clients.
+type bench struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+	specs   []obsgen.Spec
+	started time.Time
+}
+
+func (b *bench) request(method, path string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if b.apiKey != "" {
+		req.Header.Set("Authorization", "APIKEY "+b.apiKey)
+	}
+	return b.client.Do(req)
+}
+
+// checkStatus returns an error including the start of the response body if
+// the response does not have the expected status.
+func checkStatus(res *http.Response, expected int) error {
+	if res.StatusCode != expected {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// upload generates an observation set from a random spec and uploads it as
+// a bundle, timing the upload only.
+func (b *bench) upload(r *rand.Rand) opResult {
+	spec := b.specs[r.Intn(len(b.specs))]
+	spec.Count = *countFlag
+	spec.Start = time.Now().UTC().Format(time.RFC3339)
+	spec.Seed = r.Int63()
+
+	bundle := new(bytes.Buffer)
+	if err := spec.Generate(bundle, true); err != nil {
+		return opResult{err: err}
+	}
+
+	start := time.Now()
+	res, err := b.request("POST", "/obs/bundle", "application/vnd.mami.ndjson", bundle)
+	if err != nil {
+		return opResult{err: err}
+	}
+	defer res.Body.Close()
+	if err := checkStatus(res, http.StatusCreated); err != nil {
+		return opResult{err: err}
+	}
+	io.Copy(ioutil.Discard, res.Body)
+
+	return opResult{latency: time.Since(start)}
+}
+
+// queryForm returns a random query over the conditions in the specs: a time
+// window of up to a day ending now, selecting one condition or all
+// conditions in a family, optionally grouped by condition or by day.
+func (b *bench) queryForm(r *rand.Rand) url.Values {
+	now := time.Now().UTC()
+	window := time.Duration(r.Int63n(int64(24 * time.Hour)))
+
+	qb := pto3.NewQueryBuilder(now.Add(-window), now)
+
+	spec := b.specs[r.Intn(len(b.specs))]
+	conditions := make([]string, 0, len(spec.Conditions))
+	for c := range spec.Conditions {
+		conditions = append(conditions, c)
+	}
+	sort.Strings(conditions)
+	condition := conditions[r.Intn(len(conditions))]
+	if r.Intn(4) == 0 {
+		if i := strings.LastIndex(condition, "."); i > 0 {
+			condition = condition[:i] + ".*"
+		}
+	}
+	qb.WithConditions(condition)
+
+	if r.Float64() < *groupFlag {
+		if r.Intn(2) == 0 {
+			qb.WithGroup("condition")
+		} else {
+			qb.WithGroup("day")
+		}
+	}
+
+	return qb.Form()
+}
+
+// query submits a random query, and if -wait is given, polls it until it
+// completes, timing submission and execution.
+func (b *bench) query(r *rand.Rand) opResult {
+	form := b.queryForm(r)
+
+	start := time.Now()
+	res, err := b.request("POST", "/query/submit", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return opResult{err: err}
+	}
+	defer res.Body.Close()
+	if err := checkStatus(res, http.StatusOK); err != nil {
+		return opResult{err: err}
+	}
+
+	var qmd struct {
+		Link  string `json:"__link"`
+		State string `json:"__state"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&qmd); err != nil {
+		return opResult{err: err}
+	}
+
+	for *waitFlag && qmd.State == "pending" {
+		time.Sleep(*pollFlag)
+
+		req, err := http.NewRequest("GET", qmd.Link, nil)
+		if err != nil {
+			return opResult{err: err}
+		}
+		if b.apiKey != "" {
+			req.Header.Set("Authorization", "APIKEY "+b.apiKey)
+		}
+		pres, err := b.client.Do(req)
+		if err != nil {
+			return opResult{err: err}
+		}
+		err = checkStatus(pres, http.StatusOK)
+		if err == nil {
+			err = json.NewDecoder(pres.Body).Decode(&qmd)
+		}
+		pres.Body.Close()
+		if err != nil {
+			return opResult{err: err}
+		}
+	}
+
+	if qmd.State == "failed" {
+		return opResult{err: fmt.Errorf("query %s failed", qmd.Link)}
+	}
+
+	return opResult{latency: time.Since(start)}
+}
+
+// run starts n clients each running op in a loop until the deadline,
+// recording results in stats.
+func run(wg *sync.WaitGroup, n int, deadline time.Time, stats *opStats, op func(*rand.Rand) opResult) {
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				stats.record(op(r))
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+}
+
+func main() {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: generate load against a PTO and report latency and throughput\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s -url <base URL> <flags>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag || *urlFlag == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	b := &bench{
+		baseURL: strings.TrimSuffix(*urlFlag, "/"),
+		apiKey:  *keyFlag,
+		client:  &http.Client{Timeout: 10 * time.Minute},
+		specs:   obsgen.DefaultSpecs(),
+	}
+
+	if *specFlag != "" {
+		var err error
+		b.specs, err = obsgen.LoadSpecs(*specFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(b.specs) == 0 {
+			log.Fatalf("no specs in %s", *specFlag)
+		}
+	}
+
+	log.Printf("benchmarking %s for %v with %d uploaders and %d queriers...",
+		b.baseURL, *durationFlag, *uploadersFlag, *queriersFlag)
+
+	var uploadStats, queryStats opStats
+	var wg sync.WaitGroup
+
+	b.started = time.Now()
+	deadline := b.started.Add(*durationFlag)
+	run(&wg, *uploadersFlag, deadline, &uploadStats, b.upload)
+	run(&wg, *queriersFlag, deadline, &queryStats, b.query)
+	wg.Wait()
+	elapsed := time.Since(b.started)
+
+	fmt.Printf("elapsed %v\n", elapsed.Round(time.Millisecond))
+	if *uploadersFlag > 0 {
+		uploadStats.report(os.Stdout, "upload", elapsed)
+	}
+	if *queriersFlag > 0 {
+		queryStats.report(os.Stdout, "query", elapsed)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"io"
 	"log"
 	"os"
-	"strconv"
 
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
@@ -51,7 +50,7 @@ func main() {
 
 	setIDs := make([]int, 0)
 	for _, arg := range flag.Args() {
-		idarg, err := strconv.ParseUint(arg, 16, 64)
+		idarg, err := pto3.ParseSetID(arg)
 		if err != nil {
 			log.Printf("cannot parse Set ID %s", arg)
 			flag.Usage()
@@ -0,0 +1,280 @@
+// ptodb performs maintenance operations on a PTO observation database.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+var pruneFlag = flag.Bool("prune", false, "with reconcile-conditions, also remove conditions appearing in no observation of a set")
+
+// setIDsFromArgs parses observation set IDs given as arguments, returning the
+// IDs of all sets if none are given.
+func setIDsFromArgs(db *pg.DB, args []string) ([]int, error) {
+	if len(args) == 0 {
+		return pto3.AllObservationSetIDs(db)
+	}
+
+	setIDs := make([]int, 0, len(args))
+	for _, arg := range args {
+		setid, err := pto3.ParseSetID(arg)
+		if err != nil {
+			return nil, err
+		}
+		setIDs = append(setIDs, int(setid))
+	}
+	return setIDs, nil
+}
+
+// recount recomputes cached observation counts and time intervals for the
+// given observation sets, or for all sets if none are given.
+func recount(db *pg.DB, args []string) error {
+	setIDs, err := setIDsFromArgs(db, args)
+	if err != nil {
+		return err
+	}
+
+	for i, setid := range setIDs {
+		set := pto3.ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			return fmt.Errorf("retrieving set %x: %v", setid, err)
+		}
+
+		oldCount := set.Count
+
+		if err := set.Recount(db); err != nil {
+			return fmt.Errorf("recounting set %x: %v", setid, err)
+		}
+
+		log.Printf("%d/%d recounted observation set 0x%x: %d observations (cached %d)",
+			i+1, len(setIDs), setid, set.Count, oldCount)
+	}
+
+	return nil
+}
+
+// reconcileConditions links the given observation sets, or all sets if none
+// are given, to the conditions appearing in their observations, and if prune
+// is set, unlinks conditions appearing in none.
+func reconcileConditions(db *pg.DB, args []string, prune bool) error {
+	setIDs, err := setIDsFromArgs(db, args)
+	if err != nil {
+		return err
+	}
+
+	for i, setid := range setIDs {
+		set := pto3.ObservationSet{ID: setid}
+		linked, unlinked, err := set.ReconcileConditions(db, prune)
+		if err != nil {
+			return fmt.Errorf("reconciling conditions of set %x: %v", setid, err)
+		}
+
+		if linked > 0 || unlinked > 0 {
+			log.Printf("%d/%d reconciled observation set 0x%x: %d conditions linked, %d unlinked",
+				i+1, len(setIDs), setid, linked, unlinked)
+		}
+	}
+
+	return nil
+}
+
+// verifySources finds observation sets whose _sources link to local raw data
+// files or observation sets which do not exist. Raw data links are only checked
+// if the configuration has a raw data store.
+func verifySources(config *pto3.PTOConfiguration, db *pg.DB) error {
+	var rds pto3.RawStore
+	if config.RawRoot != "" {
+		var err error
+		rds, err = pto3.NewRawDataStore(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	setIDs, err := pto3.AllObservationSetIDs(db)
+	if err != nil {
+		return err
+	}
+
+	danglingSets := 0
+	for _, setid := range setIDs {
+		set := pto3.ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			return fmt.Errorf("retrieving set %x: %v", setid, err)
+		}
+
+		dangling, err := set.DanglingSources(config, db, rds)
+		if err != nil {
+			return fmt.Errorf("verifying set %x: %v", setid, err)
+		}
+
+		for _, link := range dangling {
+			fmt.Printf("%x\t%s\n", setid, link)
+		}
+		if len(dangling) > 0 {
+			danglingSets++
+		}
+	}
+
+	log.Printf("verified sources of %d observation sets: %d with dangling sources", len(setIDs), danglingSets)
+
+	if danglingSets > 0 {
+		return fmt.Errorf("found %d observation sets with dangling sources", danglingSets)
+	}
+
+	return nil
+}
+
+// mirror mirrors new and changed observation sets from the upstream PTOs in
+// the configuration once.
+func mirror(config *pto3.PTOConfiguration) error {
+	m, err := pto3.NewMirror(config)
+	if err != nil {
+		return err
+	}
+
+	n, err := m.Refresh()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("mirrored %d observation sets from %d upstream PTOs", n, len(config.Upstreams))
+	return nil
+}
+
+// listAliases prints all condition aliases, one old and new name per line.
+func listAliases(db *pg.DB) error {
+	aliases, err := pto3.LoadConditionAliases(db)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+
+	for _, alias := range names {
+		fmt.Printf("%s\t%s\n", alias, aliases[alias])
+	}
+
+	return nil
+}
+
+// checkArgs checks that a command was given exactly n arguments.
+func checkArgs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %d arguments, got %d", n, len(args))
+	}
+	return nil
+}
+
+// auditedCommands are the commands which change the observation database,
+// and are therefore recorded in the audit log if one is configured.
+var auditedCommands = map[string]bool{
+	"mirror":               true,
+	"reconcile-conditions": true,
+	"alias":                true,
+	"unalias":              true,
+	"rename-condition":     true,
+}
+
+// audit records a successful command in the audit log, if one is configured,
+// with the local user running it as principal.
+func audit(config *pto3.PTOConfiguration, args []string) error {
+	al, err := pto3.NewAuditLog(config)
+	if err != nil || al == nil {
+		return err
+	}
+
+	return al.Record(&pto3.AuditRecord{
+		Principal: pto3.LocalPrincipal(),
+		Operation: "ptodb " + args[0],
+		Target:    strings.Join(args[1:], " "),
+		RequestID: pto3.NewRequestID(),
+	})
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: perform maintenance on a PTO database\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> <command> [args]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  recount [set-ids]: recompute cached observation counts and time intervals\n")
+		fmt.Fprintf(os.Stderr, "  reconcile-conditions [set-ids]: link observation sets to all conditions in their observations; with -prune, unlink conditions in none\n")
+		fmt.Fprintf(os.Stderr, "  verify-sources: list observation sets with _sources links to missing raw files or sets\n")
+		fmt.Fprintf(os.Stderr, "  mirror: mirror new and changed observation sets from configured upstream PTOs\n")
+		fmt.Fprintf(os.Stderr, "  aliases: list condition aliases\n")
+		fmt.Fprintf(os.Stderr, "  alias <old> <new>: find observations of condition old when querying for new\n")
+		fmt.Fprintf(os.Stderr, "  unalias <old>: remove the alias for condition old\n")
+		fmt.Fprintf(os.Stderr, "  rename-condition <old> <new>: rename condition old to new in all observations, aliasing old to new\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase)
+
+	switch args[0] {
+	case "recount":
+		err = recount(db, args[1:])
+	case "reconcile-conditions":
+		err = reconcileConditions(db, args[1:], *pruneFlag)
+	case "verify-sources":
+		err = verifySources(config, db)
+	case "mirror":
+		err = mirror(config)
+	case "aliases":
+		err = listAliases(db)
+	case "alias":
+		if err = checkArgs(args[1:], 2); err == nil {
+			err = pto3.AliasCondition(db, args[1], args[2])
+		}
+	case "unalias":
+		if err = checkArgs(args[1:], 1); err == nil {
+			err = pto3.UnaliasCondition(db, args[1])
+		}
+	case "rename-condition":
+		if err = checkArgs(args[1:], 2); err == nil {
+			err = pto3.RenameCondition(db, args[1], args[2])
+		}
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err == nil && auditedCommands[args[0]] {
+		err = audit(config, args)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// isURL returns true if a ptoload argument is an http or https URL rather
+// than a local path.
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// obsFileV2Type requests observation data in version 2 observation file
+// format, which preserves per-observation metadata; PTOs which do not
+// support it return version 1.
+const obsFileV2Type = "application/vnd.mami.ndjson; version=2"
+
+// apiGet retrieves a resource from a PTO API, authorized by an API key if
+// given, and accepting the given media type if not empty, failing on any
+// status other than 200.
+func apiGet(link string, apikey string, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	if apikey != "" {
+		req.Header.Set("Authorization", "APIKEY "+apikey)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", link, res.Status)
+	}
+
+	return res, nil
+}
+
+// fetchObsFile streams an observation set or a raw data file from a PTO API
+// into a temporary observation file, and returns its path. Observation set
+// links (.../obs/<set>, optionally followed by /data) produce a file with the
+// set's metadata followed by its data. Raw data file links
+// (.../raw/<campaign>/<file>, optionally followed by /data) produce a file
+// with the raw data, which must itself be an observation file. The caller
+// must remove the file.
+func fetchObsFile(link string, apikey string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	elements := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if elements[len(elements)-1] == "data" {
+		elements = elements[:len(elements)-1]
+	}
+
+	tf, err := ioutil.TempFile("", "ptoload")
+	if err != nil {
+		return "", err
+	}
+	defer tf.Close()
+
+	switch {
+	case len(elements) >= 2 && elements[len(elements)-2] == "obs":
+		u.Path = "/" + strings.Join(elements, "/")
+		err = fetchObsSet(u.String(), apikey, tf)
+	case len(elements) >= 3 && elements[len(elements)-3] == "raw":
+		u.Path = "/" + strings.Join(elements, "/") + "/data"
+		err = fetchRawData(u.String(), apikey, tf)
+	default:
+		err = fmt.Errorf("%s is not a link to an observation set or raw data file", link)
+	}
+
+	if err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return "", err
+	}
+
+	return tf.Name(), nil
+}
+
+// fetchObsSet writes an observation set's metadata and data to a file.
+func fetchObsSet(link string, apikey string, out io.Writer) error {
+	res, err := apiGet(link, apikey, "")
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	// find the data link, and make sure metadata is on a single line
+	var meta map[string]interface{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return fmt.Errorf("reading metadata from %s: %v", link, err)
+	}
+	datalink, ok := meta["__data"].(string)
+	if !ok {
+		datalink = link + "/data"
+	}
+
+	b, err = json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+		return err
+	}
+
+	res, err = apiGet(datalink, apikey, obsFileV2Type)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(out, res.Body)
+	return err
+}
+
+// fetchRawData writes a raw data file's content to a file.
+func fetchRawData(link string, apikey string, out io.Writer) error {
+	res, err := apiGet(link, apikey, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(out, res.Body)
+	return err
+}
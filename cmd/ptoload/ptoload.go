@@ -3,10 +3,14 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/go-pg/pg"
 	pto3 "github.com/mami-project/pto3-go"
@@ -15,11 +19,91 @@ import (
 var helpFlag = flag.Bool("h", false, "display a help message")
 var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
 var initdbFlag = flag.Bool("initdb", false, "Create database tables on startup")
+var jobsFlag = flag.Int("j", 1, "number of files to load concurrently")
+var manifestFlag = flag.String("manifest", "", "path to manifest `file` recording loaded files; files already listed are skipped")
+var apikeyFlag = flag.String("apikey", "", "API `key` for retrieving observation sets and raw files given as URLs")
+
+// manifest records the files which have been loaded, so that a rerun after a
+// failure can skip them. Each line contains the absolute path or URL of a
+// loaded file and the link to the observation set created from it, separated
+// by a tab.
+type manifest struct {
+	lock   sync.Mutex
+	out    *os.File
+	loaded map[string]string
+}
+
+// openManifest reads the manifest at the given path, if it exists, and opens
+// it for appending.
+func openManifest(filename string) (*manifest, error) {
+	m := manifest{loaded: make(map[string]string)}
+
+	if in, err := os.Open(filename); err == nil {
+		s := bufio.NewScanner(in)
+		for s.Scan() {
+			fields := strings.SplitN(s.Text(), "\t", 2)
+			if len(fields) == 2 {
+				m.loaded[fields[0]] = fields[1]
+			}
+		}
+		in.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m.out = out
+
+	return &m, nil
+}
+
+// record adds a loaded file to the manifest, syncing it to disk immediately
+// so that it survives the failure of a later file.
+func (m *manifest) record(filename string, link string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := fmt.Fprintf(m.out, "%s\t%s\n", filename, link); err != nil {
+		return err
+	}
+	m.loaded[filename] = link
+	return m.out.Sync()
+}
+
+// loadResult reports the outcome of loading one file.
+type loadResult struct {
+	filename string
+	set      *pto3.ObservationSet
+	err      error
+}
+
+// loadFile loads a single file, given as a local path or as a URL of an
+// observation set or raw file on a PTO API, into the database as a new
+// observation set.
+func loadFile(source string, loader *pto3.Loader) (*pto3.ObservationSet, error) {
+	filename := source
+	if isURL(source) {
+		var err error
+		filename, err = fetchObsFile(source, *apikeyFlag)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(filename)
+	}
+
+	return loader.LoadSet(filename)
+}
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s: load observations from a file into a PTO database\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Usage: %s <flags> input-files\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> input-files-or-urls\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -37,6 +121,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *jobsFlag < 1 {
+		log.Fatalf("bad number of concurrent loads %d", *jobsFlag)
+	}
+
 	config, err := pto3.NewConfigWithDefault(*configFlag)
 	if err != nil {
 		log.Fatal(err)
@@ -49,29 +137,120 @@ func main() {
 		}
 	}
 
-	// share pid and condition caches across all files
-	cidCache, err := pto3.LoadConditionCache(db)
+	// annotate new paths with countries if configured
+	if err := pto3.EnableGeoIP(config); err != nil {
+		log.Fatal("opening GeoIP database: ", err)
+	}
+
+	// record loaded sets in the audit log if configured
+	al, err := pto3.NewAuditLog(config)
+	if err != nil {
+		log.Fatal("opening audit log: ", err)
+	}
+
+	// skip files already loaded by a previous run
+	var m *manifest
+	if *manifestFlag != "" {
+		m, err = openManifest(*manifestFlag)
+		if err != nil {
+			log.Fatal("opening manifest: ", err)
+		}
+		defer m.out.Close()
+	}
+
+	filenames := make([]string, 0, len(args))
+	skipped := 0
+	for _, filename := range args {
+		absname := filename
+		if !isURL(filename) {
+			absname, err = filepath.Abs(filename)
+			if err != nil {
+				log.Fatalf("resolving %s: %v", filename, err)
+			}
+		}
+
+		if m != nil {
+			if link, ok := m.loaded[absname]; ok {
+				log.Printf("skipping %s, already loaded as %s", filename, link)
+				skipped++
+				continue
+			}
+		}
+
+		filenames = append(filenames, absname)
+	}
+
+	// share condition and path caches across all files and workers
+	loader, err := pto3.NewLoader(db)
 	if err != nil {
 		log.Fatal("loading condition cache: ", err)
 	}
 
-	pidCache := make(pto3.PathCache)
+	jobs := make(chan string)
+	results := make(chan loadResult)
 
-	for i, filename := range args {
-		var set *pto3.ObservationSet
-		set, err = pto3.CopySetFromObsFile(filename, db, cidCache, pidCache)
-		if err != nil {
-			log.Fatal("copying set from obs file: ", err)
+	var wg sync.WaitGroup
+	for i := 0; i < *jobsFlag; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for filename := range jobs {
+				set, err := loadFile(filename, loader)
+				results <- loadResult{filename: filename, set: set, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, filename := range filenames {
+			jobs <- filename
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// report results as they arrive
+	done, failed := 0, 0
+	for res := range results {
+		done++
+
+		if res.err != nil {
+			failed++
+			log.Printf("%d/%d failed to load %s: %v", done, len(filenames), res.filename, res.err)
+			continue
+		}
+
+		res.set.LinkVia(config)
+
+		if al != nil {
+			if err := al.Record(&pto3.AuditRecord{
+				Principal: pto3.LocalPrincipal(),
+				Operation: "ptoload",
+				Target:    "/obs/" + pto3.SetID(res.set.ID).String(),
+				RequestID: pto3.NewRequestID(),
+			}); err != nil {
+				log.Printf("failed to record loading of %s in audit log: %v", res.filename, err)
+			}
+		}
+
+		// push to downstream PTOs
+		if err := pto3.EnqueueReplication(config, db, res.set.ID); err != nil {
+			log.Printf("error queueing replication of set %x: %v", res.set.ID, err)
 		}
 
-		set.LinkVia(config)
+		if m != nil {
+			if err := m.record(res.filename, res.set.Link()); err != nil {
+				log.Fatal("recording loaded file in manifest: ", err)
+			}
+		}
 
-		log.Printf("%d/%d (%5.2f%%) done, created observation set 0x%x",
-			i+1, len(args), 100.0*float64(i+1)/float64(len(args)), set.ID)
-		/* Previous debugging output:
-		 * b, _ := json.MarshalIndent(set, "  ", "  ")
-		 * os.Stderr.Write(b)
-		 * log.Println("")
-		 */
+		log.Printf("%d/%d (%5.2f%%) done, created observation set 0x%x from %s",
+			done, len(filenames), 100.0*float64(done)/float64(len(filenames)), res.set.ID, res.filename)
+	}
+
+	log.Printf("loaded %d files, skipped %d, %d failed", done-failed, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
 	}
 }
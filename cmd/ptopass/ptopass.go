@@ -7,7 +7,6 @@ package main
 
 import (
 	"bufio"
-	"compress/bzip2"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -32,15 +31,16 @@ func ObsPassthrough(in io.Reader, metain io.Reader, out io.Writer) error {
 	}
 
 	// check filetype and select scanner
-	var scanner *bufio.Scanner
-	switch md.Filetype(true) {
-	case "obs":
-		scanner = bufio.NewScanner(in)
-	case "obs-bz2":
-		scanner = bufio.NewScanner(bzip2.NewReader(in))
-	default:
+	rawin, filetype, err := pto3.NewDecompressingReader(md.Filetype(true), in)
+	if err != nil {
+		return err
+	}
+	defer rawin.Close()
+
+	if filetype != "obs" {
 		return fmt.Errorf("unsupported filetype %s", md.Filetype(true))
 	}
+	scanner := bufio.NewScanner(rawin)
 
 	// track conditions in the input
 	hasCondition := make(map[string]bool)
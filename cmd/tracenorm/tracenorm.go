@@ -0,0 +1,28 @@
+// tracenorm is a normalizer for traceroute data. It turns each trace in a
+// RIPE Atlas traceroute result file into a path observation, with the
+// condition trace.path.reached or trace.path.unreached. scamper warts files
+// are split into records by the PTO, but need a decoder for their trace
+// records; normalizers for warts data build on this one by passing a
+// pto3.WartsDecoder to pto3.RegisterTracerouteFiletypes.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var analyzerFlag = flag.String("analyzer", "https://raw.githubusercontent.com/mami-project/pto3-go/master/cmd/tracenorm/tracenorm_analyzer.json", "`URL` of analyzer metadata")
+
+func main() {
+	flag.Parse()
+
+	norm := pto3.NewSerialScanningNormalizer(*analyzerFlag)
+	pto3.RegisterTracerouteFiletypes(norm, nil)
+
+	if err := norm.Normalize(os.Stdin, os.NewFile(3, ".piped_metadata.json"), os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 )
 
 type Condition struct {
-	ID      int
-	Name    string
-	Feature string
-	Aspect  string
+	ID          int
+	Name        string
+	Feature     string
+	Aspect      string
+	Description string
 }
 
 func NewCondition(name string) *Condition {
@@ -50,6 +52,38 @@ func (c *Condition) InsertOnce(db orm.DB) error {
 	return nil
 }
 
+// CreateConditions ensures that each of the given conditions exists in the
+// database, filling in their IDs. Existing conditions are left as they are,
+// except that their descriptions are replaced by those of the given
+// conditions, where these are not empty. It should be run in a transaction,
+// so that either all or none of the conditions are created.
+func CreateConditions(db orm.DB, conditions []Condition) error {
+	for i := range conditions {
+		c := &conditions[i]
+		if c.Name == "" || strings.ContainsAny(c.Name, "* \t") {
+			return PTOErrorf("invalid condition name %q", c.Name).StatusIs(http.StatusBadRequest)
+		}
+
+		description := c.Description
+		*c = *NewCondition(c.Name)
+		c.Description = description
+
+		if err := c.InsertOnce(db); err != nil {
+			return err
+		}
+
+		if description != "" {
+			if _, err := db.Model(c).Column("description").Where("id = ?id").Update(); err != nil {
+				return PTOWrapError(err)
+			}
+		} else if err := db.Model(c).Column("description").Where("id = ?id").Select(); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
 // FIXME consider replacing this with a condition cache everywhere
 func (c *Condition) SelectByID(db orm.DB) error {
 	return db.Select(c)
@@ -108,32 +142,60 @@ func (cache ConditionCache) Reload(db orm.DB) error {
 	return nil
 }
 
+// ConditionsByName returns the conditions matching a condition name, which
+// may be a wildcard ending in .*. Conditions aliased to a name match it as
+// well, so observations loaded under an old condition name can be found under
+// the new one; an aliased name itself stands for the name it is aliased to.
 func (cache ConditionCache) ConditionsByName(db orm.DB, conditionName string) ([]Condition, error) {
 	var out []Condition
 
+	aliases, err := LoadConditionAliases(db)
+	if err != nil {
+		return nil, err
+	}
+
 	if strings.HasSuffix(conditionName, ".*") {
 		// Wildcard. Reload cache and find everything that matches.
 		if err := cache.Reload(db); err != nil {
 			return nil, err
 		}
+		prefix := conditionName[:len(conditionName)-1]
 		out = make([]Condition, 0)
 		for cachedName := range cache {
-			if strings.HasPrefix(cachedName, conditionName[:len(conditionName)-1]) {
+			if strings.HasPrefix(cachedName, prefix) || strings.HasPrefix(aliases[cachedName], prefix) {
 				out = append(out, *NewConditionWithID(cache[cachedName], cachedName))
 			}
 		}
 	} else {
-		// No wildcard, just look up by name.
-		if cache[conditionName] == 0 {
-			if err := cache.Reload(db); err != nil {
-				return nil, err
+		// No wildcard, look up by name and by alias.
+		names := []string{conditionName}
+		if name, ok := aliases[conditionName]; ok {
+			names[0] = name
+		}
+		for alias, name := range aliases {
+			if name == names[0] {
+				names = append(names, alias)
 			}
 		}
-		if cache[conditionName] == 0 {
+
+		for _, name := range names {
+			if cache[name] == 0 {
+				if err := cache.Reload(db); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+
+		out = make([]Condition, 0, len(names))
+		for _, name := range names {
+			if cache[name] != 0 {
+				out = append(out, *NewConditionWithID(cache[name], name))
+			}
+		}
+		if len(out) == 0 {
 			return nil, PTOErrorf("unknown condition %s", conditionName).StatusIs(http.StatusBadRequest)
 		}
-		out = make([]Condition, 1)
-		out[0] = *NewConditionWithID(cache[conditionName], conditionName)
 	}
 
 	return out, nil
@@ -163,3 +225,145 @@ func LoadConditionCache(db orm.DB) (ConditionCache, error) {
 	return cache, nil
 
 }
+
+// ConditionAlias maps an old condition name to the name which replaces it, for
+// condition lookup at query time.
+type ConditionAlias struct {
+	Alias string `sql:",pk"`
+	Name  string `sql:",notnull"`
+}
+
+// createConditionAliasTables ensures the table holding condition aliases
+// exists.
+func createConditionAliasTables(db *pg.DB) error {
+	opts := orm.CreateTableOptions{IfNotExists: true}
+
+	if err := db.CreateTable(&ConditionAlias{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// LoadConditionAliases returns all condition aliases in a given database, as a
+// map from old to new condition name.
+func LoadConditionAliases(db orm.DB) (map[string]string, error) {
+	var aliases []ConditionAlias
+
+	if err := db.Model(&aliases).Select(); err != nil && err != pg.ErrNoRows {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make(map[string]string, len(aliases))
+	for _, ca := range aliases {
+		out[ca.Alias] = ca.Name
+	}
+
+	return out, nil
+}
+
+// AliasCondition maps an old condition name to a new one at query time,
+// replacing any existing alias for the old name. Observations of the old
+// condition are not changed; see RenameCondition for that. If the new name is
+// itself an alias, the old name is aliased to its target instead, and aliases
+// to the old name are moved to the new one, so aliases never chain.
+func AliasCondition(db *pg.DB, alias string, name string) error {
+	if alias == "" || name == "" {
+		return PTOErrorf("condition alias and name must not be empty").StatusIs(http.StatusBadRequest)
+	}
+
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		return aliasCondition(tx, alias, name)
+	})
+}
+
+func aliasCondition(tx *pg.Tx, alias string, name string) error {
+	aliases, err := LoadConditionAliases(tx)
+	if err != nil {
+		return err
+	}
+
+	if target, ok := aliases[name]; ok {
+		name = target
+	}
+	if name == alias {
+		return PTOErrorf("cannot alias condition %s to itself", alias).StatusIs(http.StatusBadRequest)
+	}
+
+	ca := ConditionAlias{Alias: alias, Name: name}
+	if _, err := tx.Model(&ca).
+		OnConflict("(alias) DO UPDATE").
+		Set("name = EXCLUDED.name").
+		Insert(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := tx.Exec("UPDATE condition_aliases SET name = ? WHERE name = ?", name, alias); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// UnaliasCondition removes the alias for an old condition name.
+func UnaliasCondition(db orm.DB, alias string) error {
+	res, err := db.Exec("DELETE FROM condition_aliases WHERE alias = ?", alias)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return PTOErrorf("no alias for condition %s", alias).StatusIs(http.StatusNotFound)
+	}
+	return nil
+}
+
+// RenameCondition renames a condition globally. If a condition with the new
+// name already exists, observations and observation sets with the old
+// condition are moved to it and the old condition is removed. The old name is
+// then aliased to the new one, so queries using it continue to work. Running
+// servers cache condition names, and should be restarted after a rename;
+// cached query results are not changed.
+func RenameCondition(db *pg.DB, oldName string, newName string) error {
+	if newName == "" || newName == oldName {
+		return PTOErrorf("bad new name %q for condition %s", newName, oldName).StatusIs(http.StatusBadRequest)
+	}
+
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		var oldCondition, newCondition Condition
+
+		if err := tx.Model(&oldCondition).Where("name = ?", oldName).Select(); err == pg.ErrNoRows {
+			return PTOErrorf("unknown condition %s", oldName).StatusIs(http.StatusNotFound)
+		} else if err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := tx.Model(&newCondition).Where("name = ?", newName).Select(); err == pg.ErrNoRows {
+			// simply rename the condition in place
+			if err := tx.Update(NewConditionWithID(oldCondition.ID, newName)); err != nil {
+				return PTOWrapError(err)
+			}
+		} else if err != nil {
+			return PTOWrapError(err)
+		} else {
+			// merge into the existing condition
+			for _, stmt := range []string{
+				"UPDATE observations SET condition_id = ?0 WHERE condition_id = ?1",
+				"DELETE FROM observation_set_conditions WHERE condition_id = ?1 AND observation_set_id IN " +
+					"(SELECT observation_set_id FROM observation_set_conditions WHERE condition_id = ?0)",
+				"UPDATE observation_set_conditions SET condition_id = ?0 WHERE condition_id = ?1",
+				"DELETE FROM conditions WHERE id = ?1",
+			} {
+				if _, err := tx.Exec(stmt, newCondition.ID, oldCondition.ID); err != nil {
+					return PTOWrapError(err)
+				}
+			}
+		}
+
+		// the new name is now a condition in its own right
+		if _, err := tx.Exec("DELETE FROM condition_aliases WHERE alias = ?", newName); err != nil {
+			return PTOWrapError(err)
+		}
+
+		return aliasCondition(tx, oldName, newName)
+	})
+}
@@ -6,7 +6,9 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-pg/pg"
 )
@@ -21,6 +23,9 @@ type PTOConfiguration struct {
 	// ...this right here is effing annoying but i'm not writing a custom unmarshaler just for that...
 	baseURL *url.URL
 
+	// Address/port to serve the gRPC API on; empty for no gRPC API
+	GRPCBindTo string
+
 	// Access-Control-Allow-Origin header on responses
 	AllowOrigin string
 
@@ -45,21 +50,129 @@ type PTOConfiguration struct {
 	// Filetype registry for RDS.
 	ContentTypes map[string]string
 
+	// Structured filetype registry for RDS, mapping filetype names to their
+	// configuration. Entries here are merged into ContentTypes and
+	// MaxUploadSize when the configuration is loaded.
+	Filetypes map[string]FiletypeConfig
+
+	// Maximum number of campaigns whose metadata is kept in memory; metadata
+	// for least recently used campaigns past this number is unloaded, and
+	// reloaded from disk on access. Zero for no limit.
+	RawMetadataCacheCampaigns int
+
+	// Maximum raw data upload size in bytes by filetype; the "default" key
+	// applies to filetypes not otherwise listed. Zero or missing for no limit.
+	MaxUploadSize map[string]int64
+
+	// Controlled vocabularies for raw metadata, mapping metadata keys to the
+	// values allowed for them; keys not listed may have any value.
+	MetadataVocabularies map[string][]string
+
 	// base path for query cache data store; empty for no query cache.
 	QueryCacheRoot string
 
 	// PostgreSQL options for connection to observation database; leave default for no OBS.
 	ObsDatabase pg.Options
 
+	// Upstream PTOs to mirror observation sets from; empty for no mirroring
+	Upstreams []UpstreamConfig
+
+	// Interval between refreshes of mirrored observation sets, as a duration
+	// string (e.g. "6h"); default 1h
+	MirrorInterval string
+
+	// Interval between refreshes of the observatory statistics served at
+	// /stats, as a duration string (e.g. "1h"); default 15m
+	StatsInterval string
+
+	// Downstream PTOs to push new observation sets to; empty for no
+	// replication
+	Downstreams []DownstreamConfig
+
+	// Reject observation sets whose _sources link to local raw data files or
+	// observation sets which do not exist, instead of logging a warning
+	StrictSources bool
+
+	// Path to MaxMind-format GeoIP country database for annotating paths with
+	// countries at load time; empty for no annotation.
+	GeoIPDatabase string
+
+	// Maximum number of connections in each observation database connection pool
+	ObsDatabasePoolSize int
+
+	// Time after which idle observation database connections are closed, as
+	// a duration string (e.g. "5m"); empty to keep idle connections open
+	ObsDatabaseIdleTimeout string
+
+	// Number of times to retry failed observation database queries
+	ObsDatabaseMaxRetries int
+
+	// Serve observation sets tagged public, and group queries, to clients
+	// without an API key; see doc/API.md
+	PublicAccess bool
+
+	// Maximum number of requests per minute from each client address served
+	// by public access; default 60
+	PublicRequestsPerMinute int
+
+	// Secret key for signing time-limited download URLs; empty to disable
+	// signed URLs
+	ShareSecret string
+
+	// Longest lifetime of a signed URL, as a duration string (e.g. "72h");
+	// default 168h
+	ShareMaxLifetime string
+
 	// Page size for things that can be paginated
 	PageLength int
 
+	// Observation set metadata keys inlined in set listings with detail=1;
+	// default _analyzer, description, __time_start, __time_end, and
+	// __obs_count
+	SetListDetailFields []string
+
 	// Immediate query delay
 	ImmediateQueryDelay int
 
 	// Number of concurrent queries
 	ConcurrentQueries int
 
+	// How long results of queries submitted without a retain parameter are
+	// kept after completion, as a retention period (e.g. "30d"); empty to
+	// keep them indefinitely. Permanent queries are never evicted.
+	QueryRetention string
+
+	// Longest retention period accepted in a query's retain parameter;
+	// default 90d
+	QueryMaxRetention string
+
+	// Interval between evictions of expired query results, as a duration
+	// string (e.g. "10m"); default 1h
+	QueryEvictionInterval string
+
+	// Record generated SQL and execution statistics for each query, for
+	// retrieval by administrators
+	RecordQueryStatistics bool
+
+	// Threshold in milliseconds above which database statements are logged
+	// when query logging is enabled; zero to log every statement. Faster
+	// statements are only counted in the pto_db_statements metrics.
+	SlowQueryThreshold int
+
+	// OTLP/HTTP collector endpoint (host:port) to export OpenTelemetry trace
+	// spans to; empty for no tracing
+	TraceEndpoint string
+
+	// Connect to the trace collector without TLS
+	TraceInsecure bool
+
+	// Service name to report in trace spans; defaults to ptosrv
+	TraceServiceName string
+
+	// Audit log file path, recording mutating operations; empty for no
+	// audit log
+	AuditLogPath string
+
 	// Access logging file path
 	AccessLogPath string
 	accessLogger  *log.Logger
@@ -68,6 +181,55 @@ type PTOConfiguration struct {
 	ConfigFilePath string
 }
 
+// FiletypeConfig configures a single raw data filetype.
+type FiletypeConfig struct {
+	// MIME type of files of this filetype
+	ContentType string
+
+	// Maximum upload size in bytes; zero for the default limit
+	MaxUploadSize int64
+
+	// Name of the validator for files of this filetype, usually the
+	// normalizer which accepts them; advertised to upload clients
+	Validator string
+
+	// Path to a JSON Schema file which the metadata of files of this
+	// filetype must conform to; see MetadataSchema
+	MetadataSchema string
+}
+
+// RawFiletypes returns the filetype registry for the raw data store, sorted
+// by filetype name, for advertising to upload clients.
+func (config *PTOConfiguration) RawFiletypes() []RawFiletype {
+	names := make([]string, 0, len(config.ContentTypes))
+	for name := range config.ContentTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]RawFiletype, len(names))
+	for i, name := range names {
+		out[i] = RawFiletype{
+			Filetype:      name,
+			ContentType:   config.ContentTypes[name],
+			Compressed:    IsCompressedFiletype(name),
+			MaxUploadSize: config.UploadSizeLimit(name),
+			Validator:     config.Filetypes[name].Validator,
+		}
+	}
+
+	return out
+}
+
+// UploadSizeLimit returns the maximum size in bytes of a raw data file of the
+// given filetype that may be uploaded, or zero if there is no limit.
+func (config *PTOConfiguration) UploadSizeLimit(filetype string) int64 {
+	if limit, ok := config.MaxUploadSize[filetype]; ok {
+		return limit
+	}
+	return config.MaxUploadSize["default"]
+}
+
 // LinkTo creates a link to a relative URL from the configuration's base URL
 func (config *PTOConfiguration) LinkTo(relative string) (string, error) {
 	// Make sure relative doesn't start with a '/'. See #119.
@@ -114,16 +276,42 @@ func NewConfigFromJSON(b []byte) (*PTOConfiguration, error) {
 		config.accessLogger = log.New(accessLogFile, "access: ", log.LstdFlags)
 	}
 
+	// merge structured filetype registry into flat maps
+	for name, ftc := range config.Filetypes {
+		if ftc.ContentType != "" {
+			if config.ContentTypes == nil {
+				config.ContentTypes = make(map[string]string)
+			}
+			config.ContentTypes[name] = ftc.ContentType
+		}
+		if ftc.MaxUploadSize > 0 {
+			if config.MaxUploadSize == nil {
+				config.MaxUploadSize = make(map[string]int64)
+			}
+			config.MaxUploadSize[name] = ftc.MaxUploadSize
+		}
+	}
+
 	// default page length is 1000
 	if config.PageLength == 0 {
 		config.PageLength = 1000
 	}
 
+	// default set list detail fields are those needed to summarize a set
+	if config.SetListDetailFields == nil {
+		config.SetListDetailFields = []string{"_analyzer", "description", "__time_start", "__time_end", "__obs_count"}
+	}
+
 	// default immediate query delay is 2s
 	if config.ImmediateQueryDelay == 0 {
 		config.ImmediateQueryDelay = 2000
 	}
 
+	// default trace service name is ptosrv
+	if config.TraceServiceName == "" {
+		config.TraceServiceName = "ptosrv"
+	}
+
 	// default query concurrency is 8
 	if config.ConcurrentQueries == 0 {
 		config.ConcurrentQueries = 8
@@ -134,7 +322,58 @@ func NewConfigFromJSON(b []byte) (*PTOConfiguration, error) {
 	// ptosrv, we have 56 processors, which means that calling pg.Connect
 	// twice will exhaust the maximum number of file descriptors per process,
 	// which is 1024.
-	config.ObsDatabase.PoolSize = 20
+	if config.ObsDatabasePoolSize > 0 {
+		config.ObsDatabase.PoolSize = config.ObsDatabasePoolSize
+	} else if config.ObsDatabase.PoolSize == 0 {
+		config.ObsDatabase.PoolSize = 20
+	}
+
+	if config.ObsDatabaseIdleTimeout != "" {
+		config.ObsDatabase.IdleTimeout, err = time.ParseDuration(config.ObsDatabaseIdleTimeout)
+		if err != nil {
+			return nil, PTOErrorf("bad ObsDatabaseIdleTimeout %s: %v", config.ObsDatabaseIdleTimeout, err)
+		}
+	}
+
+	if config.MirrorInterval != "" {
+		if _, err := time.ParseDuration(config.MirrorInterval); err != nil {
+			return nil, PTOErrorf("bad MirrorInterval %s: %v", config.MirrorInterval, err)
+		}
+	}
+
+	if config.StatsInterval != "" {
+		if _, err := time.ParseDuration(config.StatsInterval); err != nil {
+			return nil, PTOErrorf("bad StatsInterval %s: %v", config.StatsInterval, err)
+		}
+	}
+
+	if config.ShareMaxLifetime != "" {
+		if _, err := time.ParseDuration(config.ShareMaxLifetime); err != nil {
+			return nil, PTOErrorf("bad ShareMaxLifetime %s: %v", config.ShareMaxLifetime, err)
+		}
+	}
+
+	if config.QueryRetention != "" {
+		if _, err := ParseRetention(config.QueryRetention); err != nil {
+			return nil, PTOErrorf("bad QueryRetention %s: %v", config.QueryRetention, err)
+		}
+	}
+
+	if config.QueryMaxRetention != "" {
+		if _, err := ParseRetention(config.QueryMaxRetention); err != nil {
+			return nil, PTOErrorf("bad QueryMaxRetention %s: %v", config.QueryMaxRetention, err)
+		}
+	}
+
+	if config.QueryEvictionInterval != "" {
+		if _, err := time.ParseDuration(config.QueryEvictionInterval); err != nil {
+			return nil, PTOErrorf("bad QueryEvictionInterval %s: %v", config.QueryEvictionInterval, err)
+		}
+	}
+
+	if config.ObsDatabaseMaxRetries > 0 {
+		config.ObsDatabase.MaxRetries = config.ObsDatabaseMaxRetries
+	}
 
 	return &config, nil
 }
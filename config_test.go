@@ -0,0 +1,117 @@
+package pto3_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestSelfCheck(t *testing.T) {
+	rawRoot, err := ioutil.TempDir("", "pto3-test-selfcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rawRoot)
+
+	config, err := pto3.NewConfigFromJSON([]byte(`
+{
+	"BaseURL" : "ptotest.mami-project.eu",
+	"CertificateFile" : "cert.pem",
+	"RawRoot" : "` + rawRoot + `",
+	"QueryCacheRoot" : "` + rawRoot + `/nonexistent"
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectFailed := map[string]bool{
+		"base URL":                true,
+		"TLS configuration":       true,
+		"raw filetype registry":   true,
+		"raw data store writable": false,
+		"query cache database":    true,
+		"query cache writable":    true,
+	}
+
+	results := pto3.SelfCheck(config)
+	if len(results) != len(expectFailed) {
+		t.Fatalf("expected %d self-check results, got %d", len(expectFailed), len(results))
+	}
+
+	for _, res := range results {
+		failed, ok := expectFailed[res.Check]
+		if !ok {
+			t.Fatalf("unexpected self-check %s", res.Check)
+		}
+		if res.Failed() != failed {
+			t.Fatalf("self-check %s: expected failed %v, got %s", res.Check, failed, res.String())
+		}
+	}
+}
+
+func TestSignedLink(t *testing.T) {
+	config, err := pto3.NewConfigFromJSON([]byte(`
+{
+	"BaseURL" : "https://ptotest.mami-project.eu",
+	"ShareSecret" : "not very secret",
+	"ShareMaxLifetime" : "48h"
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MaxShareLifetime() != 48*time.Hour {
+		t.Fatalf("expected maximum share lifetime 48h, got %s", config.MaxShareLifetime())
+	}
+
+	now := time.Now()
+	link, err := config.SignedLink("raw/test/file001.json/data", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/raw/test/file001.json/data" {
+		t.Fatalf("bad signed link %s", link)
+	}
+
+	if err := config.VerifySignedPath(u.Path, u.Query(), now); err != nil {
+		t.Fatalf("signed link %s failed verification: %v", link, err)
+	}
+
+	// signatures are only valid for the signed path, until they expire, under
+	// the secret used to sign them
+	if err := config.VerifySignedPath("/raw/test/file002.json/data", u.Query(), now); err == nil {
+		t.Fatal("signature verified for wrong path")
+	}
+
+	if err := config.VerifySignedPath(u.Path, u.Query(), now.Add(2*time.Hour)); err == nil {
+		t.Fatal("signature verified after expiry")
+	}
+
+	params := u.Query()
+	params.Set("expires", strconv.FormatInt(now.Add(2*time.Hour).Unix(), 10))
+	if err := config.VerifySignedPath(u.Path, params, now); err == nil {
+		t.Fatal("signature verified with extended expiry")
+	}
+
+	other := *config
+	other.ShareSecret = "somewhat more secret"
+	if err := other.VerifySignedPath(u.Path, u.Query(), now); err == nil {
+		t.Fatal("signature verified with wrong secret")
+	}
+
+	// no signed links without a secret
+	other.ShareSecret = ""
+	if _, err := other.SignedLink("raw/test/file001.json/data", now.Add(time.Hour)); err == nil {
+		t.Fatal("signed link created without secret")
+	}
+}
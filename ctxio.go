@@ -0,0 +1,47 @@
+package pto3
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// contextReader wraps a reader, failing with the context's error once the
+// context is done, so that copies from it stop on cancellation.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// contextWriter wraps a writer, failing with the context's error once the
+// context is done, so that copies to it stop on cancellation.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// dbWithContext returns a handle to the given database which cancels
+// statements when the given context is done. Transactions carry the context
+// of the handle that began them, so they are returned unchanged.
+func dbWithContext(ctx context.Context, db orm.DB) orm.DB {
+	if pgdb, ok := db.(*pg.DB); ok {
+		return pgdb.WithContext(ctx)
+	}
+	return db
+}
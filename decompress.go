@@ -0,0 +1,153 @@
+package pto3
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// DecompressorFunc wraps a reader of compressed raw data in a reader of
+// uncompressed raw data.
+type DecompressorFunc func(in io.Reader) (io.ReadCloser, error)
+
+var decompressors = map[string]DecompressorFunc{
+	"-bz2": bzip2Decompressor,
+	"-gz":  gzipDecompressor,
+	"-xz":  xzDecompressor,
+}
+
+var decompressorLock sync.RWMutex
+
+// RegisterDecompressor registers a decompressor for raw data files whose
+// filetype ends with a given suffix (e.g. "-bz2"). Scanning normalizers use
+// registered decompressors to transparently decompress their input. If the
+// suffixes of several decompressors match a filetype, the longest wins.
+func RegisterDecompressor(suffix string, fn DecompressorFunc) {
+	decompressorLock.Lock()
+	defer decompressorLock.Unlock()
+	decompressors[suffix] = fn
+}
+
+// UnregisterDecompressor removes the decompressor registered for a given
+// suffix, if any.
+func UnregisterDecompressor(suffix string) {
+	decompressorLock.Lock()
+	defer decompressorLock.Unlock()
+	delete(decompressors, suffix)
+}
+
+// decompressorFor returns the decompressor registered for the longest suffix
+// of the given filetype, and that suffix, or nil if none matches. Caller must
+// hold the read lock.
+func decompressorFor(filetype string) (DecompressorFunc, string) {
+	var match string
+	var out DecompressorFunc
+	for suffix, fn := range decompressors {
+		if strings.HasSuffix(filetype, suffix) && len(suffix) > len(match) {
+			match = suffix
+			out = fn
+		}
+	}
+	return out, match
+}
+
+// readSeekNopCloser adds a no-op Close method to a ReadSeeker, so that
+// uncompressed input remains seekable.
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+// IsCompressedFiletype returns true if a decompressor is registered for the
+// given filetype's suffix.
+func IsCompressedFiletype(filetype string) bool {
+	decompressorLock.RLock()
+	defer decompressorLock.RUnlock()
+
+	fn, _ := decompressorFor(filetype)
+	return fn != nil
+}
+
+// NewDecompressingReader wraps a reader of raw data of a given filetype in a
+// decompressor, if a decompressor is registered for the filetype's suffix. It
+// returns the decompressing reader and the filetype without the compression
+// suffix. Uncompressed data is returned unwrapped. Closing the returned reader
+// releases decompressor resources but does not close the underlying reader.
+func NewDecompressingReader(filetype string, in io.Reader) (io.ReadCloser, string, error) {
+	decompressorLock.RLock()
+	defer decompressorLock.RUnlock()
+
+	if fn, suffix := decompressorFor(filetype); fn != nil {
+		r, err := fn(in)
+		if err != nil {
+			return nil, "", PTOErrorf("error decompressing %s input: %v", filetype, err)
+		}
+		return r, filetype[0 : len(filetype)-len(suffix)], nil
+	}
+
+	if rs, ok := in.(io.ReadSeeker); ok {
+		return readSeekNopCloser{rs}, filetype, nil
+	}
+	return ioutil.NopCloser(in), filetype, nil
+}
+
+func bzip2Decompressor(in io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bzip2.NewReader(in)), nil
+}
+
+func gzipDecompressor(in io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(in)
+}
+
+// xzReader reads from the output of an external xz process.
+type xzReader struct {
+	cmd  *exec.Cmd
+	out  io.ReadCloser
+	done bool
+}
+
+func (xr *xzReader) Read(b []byte) (int, error) {
+	n, err := xr.out.Read(b)
+	if err == io.EOF && !xr.done {
+		// make sure xz exited cleanly, otherwise the input was bad
+		xr.done = true
+		if werr := xr.cmd.Wait(); werr != nil {
+			return n, PTOErrorf("xz decompression failed: %v", werr)
+		}
+	}
+	return n, err
+}
+
+func (xr *xzReader) Close() error {
+	if !xr.done {
+		xr.done = true
+		xr.out.Close()
+		xr.cmd.Process.Kill()
+		xr.cmd.Wait()
+	}
+	return nil
+}
+
+// xzDecompressor decompresses xz data by piping it through the xz utility,
+// as the standard library has no xz support. The utility must be on the PATH;
+// SelfCheck verifies this when an -xz filetype is configured.
+func xzDecompressor(in io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("xz", "--decompress", "--stdout")
+	cmd.Stdin = in
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &xzReader{cmd: cmd, out: out}, nil
+}
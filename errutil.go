@@ -1,6 +1,7 @@
 package pto3
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,10 +9,35 @@ import (
 	"time"
 )
 
-// PTOError represents an error with an associated status code (usually an HTTP status code)
+// Machine-readable error codes, returned in the code member of problem
+// responses. These are stable: clients may depend on them.
+const (
+	ErrCodeBadRequest           = "bad_request"
+	ErrCodeBadForm              = "bad_form"
+	ErrCodeBadIdentifier        = "bad_identifier"
+	ErrCodeBadMetadata          = "bad_metadata"
+	ErrCodeMissingParameter     = "missing_parameter"
+	ErrCodeMissingMetadata      = "missing_metadata"
+	ErrCodeBadAuthorization     = "bad_authorization"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeExists               = "already_exists"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeTooLarge             = "request_too_large"
+	ErrCodeTooManyRequests      = "too_many_requests"
+	ErrCodeNotImplemented       = "not_implemented"
+	ErrCodeInternal             = "internal_error"
+)
+
+// ProblemContentType is the content type of problem responses
+const ProblemContentType = "application/problem+json"
+
+// PTOError represents an error with an associated status code (usually an HTTP
+// status code) and machine-readable error code
 type PTOError struct {
 	e  string
 	s  int
+	c  string
 	at []byte
 }
 
@@ -43,6 +69,22 @@ func (e *PTOError) StatusIs(status int) *PTOError {
 	return e
 }
 
+// CodeIs sets the machine-readable error code of a PTOError, returning the
+// error.
+func (e *PTOError) CodeIs(code string) *PTOError {
+	e.c = code
+	return e
+}
+
+// Code returns the machine-readable error code associated with a PTOError. If
+// no code has been set, a generic code is derived from the status.
+func (e *PTOError) Code() string {
+	if e.c != "" {
+		return e.c
+	}
+	return codeForStatus(e.s)
+}
+
 // Error returns the error string associated with a PTOError
 func (e *PTOError) Error() string {
 	return e.e
@@ -60,22 +102,91 @@ func (e *PTOError) Stack() []byte {
 
 // PTONotFoundError returns an error for a subject of a given type that does not exist
 func PTONotFoundError(kind string, subject string) *PTOError {
-	return PTOErrorf("%s %s not found", kind, subject).StatusIs(http.StatusNotFound)
+	return PTOErrorf("%s %s not found", kind, subject).StatusIs(http.StatusNotFound).CodeIs(ErrCodeNotFound)
 }
 
 // PTOExistsError returns an error for a subject of a given kind that already exists
 func PTOExistsError(kind string, subject string) *PTOError {
-	return PTOErrorf("%s %s already exists", kind, subject).StatusIs(http.StatusBadRequest)
+	return PTOErrorf("%s %s already exists", kind, subject).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeExists)
 }
 
 // PTOMediaTypeError returns an error for an unsupported MIME type for a given subject
 func PTOMediaTypeError(subject string) *PTOError {
-	return PTOErrorf("media type %s not supported", subject).StatusIs(http.StatusUnsupportedMediaType)
+	return PTOErrorf("media type %s not supported", subject).StatusIs(http.StatusUnsupportedMediaType).CodeIs(ErrCodeUnsupportedMediaType)
 }
 
 // PTOMissingMetadataError returns an error for a missing metadata key in upload.
 func PTOMissingMetadataError(subject string) *PTOError {
-	return PTOErrorf("missing key %s in metadata", subject).StatusIs(http.StatusBadRequest)
+	return PTOErrorf("missing key %s in metadata", subject).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeMissingMetadata)
+}
+
+// codeForStatus returns a generic error code for an HTTP status
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupportedMediaType
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodeTooLarge
+	case http.StatusNotImplemented:
+		return ErrCodeNotImplemented
+	default:
+		return ErrCodeInternal
+	}
+}
+
+// Problem is an RFC 7807 problem details object, with a machine-readable
+// error code as an extension member.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+// NewProblem creates a problem details object for a given status, error
+// code, and human-readable detail.
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   "urn:pto3:error:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Problem returns a problem details object describing this error.
+func (e *PTOError) Problem() *Problem {
+	return NewProblem(e.s, e.Code(), e.e)
+}
+
+// WriteProblemHTTP writes a problem details object as an
+// application/problem+json HTTP response.
+func WriteProblemHTTP(w http.ResponseWriter, p *Problem) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		// can't happen, but don't leave the client hanging
+		b = []byte(fmt.Sprintf(`{"status":%d}`, p.Status))
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// ProblemHTTP writes a problem response with a given status, error code, and
+// human-readable detail.
+func ProblemHTTP(w http.ResponseWriter, status int, code string, detail string) {
+	WriteProblemHTTP(w, NewProblem(status, code, detail))
 }
 
 func logtoken() string {
@@ -89,23 +200,21 @@ func handleInternalServerErrorHTTP(w http.ResponseWriter, during string, errmsg
 		log.Printf("backtrace:\n%s", stack)
 	}
 
-	http.Error(w, fmt.Sprintf("internal error %s: refer to %s in server log", during, token),
-		http.StatusInternalServerError)
+	ProblemHTTP(w, http.StatusInternalServerError, ErrCodeInternal,
+		fmt.Sprintf("internal error %s: refer to %s in server log", during, token))
 }
 
-// HandleErrorHTTP writes an appropriate error message to an HTTP response
+// HandleErrorHTTP writes an appropriate problem response to an HTTP response
 // writer. It automatically determines whether a PTOError was returned, and if
-// so, it extracts the status code therefrom. For internal server errors, it
-// writes the error along with a token to the server log.
+// so, it extracts the status and error codes therefrom. For internal server
+// errors, it writes the error along with a token to the server log.
 func HandleErrorHTTP(w http.ResponseWriter, during string, err error) {
 	switch ev := err.(type) {
 	case *PTOError:
-		m := ev.Error()
-		s := ev.Status()
-		if s == http.StatusInternalServerError {
-			handleInternalServerErrorHTTP(w, during, m, ev.Stack())
+		if ev.Status() == http.StatusInternalServerError {
+			handleInternalServerErrorHTTP(w, during, ev.Error(), ev.Stack())
 		} else {
-			http.Error(w, m, s)
+			WriteProblemHTTP(w, ev.Problem())
 		}
 	default:
 		if err == nil {
@@ -0,0 +1,287 @@
+package pto3
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Metadata keys recording the provenance of mirrored observation sets: the
+// link to the set on the upstream PTO, and its modification time there when
+// it was mirrored.
+const (
+	UpstreamMetadataKey         = "_upstream"
+	UpstreamModifiedMetadataKey = "_upstream_modified"
+)
+
+// defaultMirrorInterval is the interval between refreshes of mirrored
+// observation sets if MirrorInterval is not configured.
+const defaultMirrorInterval = time.Hour
+
+// UpstreamConfig configures an upstream PTO from which observation sets are
+// mirrored into the local observation database.
+type UpstreamConfig struct {
+	// Base URL of the upstream PTO
+	BaseURL string
+
+	// API key to use with the upstream PTO; empty for none
+	APIKey string
+
+	// Metadata filter expressions, as for the meta parameter of
+	// /obs/by_metadata, selecting the observation sets to mirror; all sets
+	// are mirrored if empty
+	Filters []string
+}
+
+// Mirror mirrors observation sets from the upstream PTOs in a configuration
+// into the local observation database. Each mirrored set is loaded as a new
+// local set, with its upstream link and modification time recorded in its
+// _upstream and _upstream_modified metadata. When an upstream set changes,
+// it is mirrored again, and the previous local copy is marked superseded by
+// the new one.
+type Mirror struct {
+	config *PTOConfiguration
+	db     *pg.DB
+	loader *Loader
+
+	// HTTP client used to access upstream PTOs
+	Client *http.Client
+}
+
+// NewMirror creates a Mirror for the upstream PTOs in the given
+// configuration, connecting to its observation database.
+func NewMirror(config *PTOConfiguration) (*Mirror, error) {
+	db := pg.Connect(&config.ObsDatabase)
+
+	loader, err := NewLoader(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mirror{config: config, db: db, loader: loader, Client: http.DefaultClient}, nil
+}
+
+// Refresh mirrors new and changed observation sets from every upstream PTO,
+// and returns the number of sets mirrored. Errors mirroring single sets are
+// logged, and do not stop the refresh.
+func (m *Mirror) Refresh() (int, error) {
+	mirrored := 0
+	for i := range m.config.Upstreams {
+		n, err := m.refreshUpstream(&m.config.Upstreams[i])
+		mirrored += n
+		if err != nil {
+			return mirrored, err
+		}
+	}
+	return mirrored, nil
+}
+
+// RefreshEvery refreshes mirrored sets at the configured MirrorInterval until
+// the given channel is closed, logging the result of each refresh.
+func (m *Mirror) RefreshEvery(stop chan struct{}) {
+	interval := defaultMirrorInterval
+	if m.config.MirrorInterval != "" {
+		if d, err := time.ParseDuration(m.config.MirrorInterval); err == nil {
+			interval = d
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := m.Refresh()
+		if err != nil {
+			log.Printf("error refreshing mirrored observation sets: %v", err)
+		} else if n > 0 {
+			log.Printf("mirrored %d observation sets from upstream", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refreshUpstream mirrors new and changed observation sets from a single
+// upstream PTO.
+func (m *Mirror) refreshUpstream(up *UpstreamConfig) (int, error) {
+	links, err := m.upstreamSetLinks(up)
+	if err != nil {
+		return 0, err
+	}
+
+	mirrored := 0
+	for _, link := range links {
+		ok, err := m.mirrorSet(up, link)
+		if err != nil {
+			log.Printf("error mirroring observation set %s: %v", link, err)
+			continue
+		}
+		if ok {
+			mirrored++
+		}
+	}
+
+	return mirrored, nil
+}
+
+// get retrieves a resource from an upstream PTO, returning the response body
+// to be closed by the caller.
+func (m *Mirror) get(up *UpstreamConfig, link string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if up.APIKey != "" {
+		req.Header.Set("Authorization", "APIKEY "+up.APIKey)
+	}
+
+	res, err := m.Client.Do(req)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, PTOErrorf("upstream returned %s for %s", res.Status, link)
+	}
+
+	return res.Body, nil
+}
+
+// upstreamSetLinks lists the links to observation sets on an upstream PTO
+// selected by its filters, or all of its sets if it has none, following
+// pagination.
+func (m *Mirror) upstreamSetLinks(up *UpstreamConfig) ([]string, error) {
+	link := strings.TrimSuffix(up.BaseURL, "/") + "/obs"
+	if len(up.Filters) > 0 {
+		v := make(url.Values)
+		for _, filter := range up.Filters {
+			v.Add("meta", filter)
+		}
+		link += "/by_metadata?" + v.Encode()
+	}
+
+	var links []string
+	for link != "" {
+		body, err := m.get(up, link)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Sets []string `json:"sets"`
+			Next string   `json:"next"`
+		}
+		err = json.NewDecoder(body).Decode(&page)
+		body.Close()
+		if err != nil {
+			return nil, PTOErrorf("bad set list from %s: %v", link, err)
+		}
+
+		links = append(links, page.Sets...)
+		link = page.Next
+	}
+
+	return links, nil
+}
+
+// CurrentMirror returns the local set mirroring or replicating the upstream
+// set with the given link, as recorded in its _upstream metadata, which has not
+// been superseded, or nil if there is none.
+func CurrentMirror(db orm.DB, link string) (*ObservationSet, error) {
+	setIDs, err := ObservationSetIDsWithMetadataValue(db, UpstreamMetadataKey, link)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(setIDs) - 1; i >= 0; i-- {
+		set := ObservationSet{ID: setIDs[i]}
+		if err := set.SelectByID(db); err != nil {
+			return nil, PTOWrapError(err)
+		}
+		if set.State != ObsSetStateSuperseded {
+			return &set, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// mirrorSet mirrors a single observation set from an upstream PTO, unless it
+// has not changed since it was last mirrored. Returns true if the set was
+// mirrored.
+func (m *Mirror) mirrorSet(up *UpstreamConfig, link string) (bool, error) {
+	// check upstream modification time against the current mirror
+	body, err := m.get(up, link)
+	if err != nil {
+		return false, err
+	}
+	var upmd struct {
+		Modified string `json:"__modified"`
+	}
+	err = json.NewDecoder(body).Decode(&upmd)
+	body.Close()
+	if err != nil {
+		return false, PTOErrorf("bad metadata from %s: %v", link, err)
+	}
+
+	prev, err := CurrentMirror(m.db, link)
+	if err != nil {
+		return false, err
+	}
+	if prev != nil && upmd.Modified != "" && prev.Metadata[UpstreamModifiedMetadataKey] == upmd.Modified {
+		return false, nil
+	}
+
+	// download the bundle to a temporary file for loading
+	body, err = m.get(up, link+"/bundle")
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	tf, err := ioutil.TempFile("", "pto3_mirror")
+	if err != nil {
+		return false, PTOWrapError(err)
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+
+	if _, err := io.Copy(tf, body); err != nil {
+		return false, PTOWrapError(err)
+	}
+
+	// load it as a new set, recording its provenance as it is inserted
+	set, err := m.loader.LoadSetWithMetadata(tf.Name(), map[string]string{
+		UpstreamMetadataKey:         link,
+		UpstreamModifiedMetadataKey: upmd.Modified,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// and supersede the previous mirror
+	if prev != nil {
+		prev.State = ObsSetStateSuperseded
+		prev.SupersededBy = LinkForSetID(m.config, set.ID)
+		if err := prev.Update(m.db); err != nil {
+			return true, err
+		}
+	}
+
+	log.Printf("mirrored observation set %s as %s", link, LinkForSetID(m.config, set.ID))
+	return true, nil
+}
@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package pto3
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLock is an advisory lock held on a lock file, used to coordinate
+// access to on-disk state among multiple processes (e.g. ptosrv and ptoload)
+// sharing a raw data store or query cache.
+type fileLock struct {
+	f *os.File
+}
+
+// lockFile acquires an advisory lock on the file at the given path, creating
+// it if necessary, and blocking until the lock is available. If exclusive is
+// false, acquires a shared lock.
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, PTOWrapError(err)
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+// unlock releases the lock and closes the lock file.
+func (fl *fileLock) unlock() error {
+	defer fl.f.Close()
+	if err := syscall.Flock(int(fl.f.Fd()), syscall.LOCK_UN); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
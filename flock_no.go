@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package pto3
+
+// fileLock is a no-op on platforms without flock; on these platforms, only a
+// single process may safely access a raw data store or query cache.
+type fileLock struct{}
+
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (fl *fileLock) unlock() error {
+	return nil
+}
@@ -0,0 +1,114 @@
+package pto3
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// CountryLookup maps path elements to ISO 3166-1 alpha-2 country codes.
+type CountryLookup interface {
+	// CountryForElement returns the country code for a path element, or the
+	// empty string if the element is not an address or prefix, or its country
+	// is unknown.
+	CountryForElement(element string) string
+}
+
+// GeoIPDatabase looks up countries in a MaxMind-format (GeoIP2 or GeoLite2)
+// country or city database.
+type GeoIPDatabase struct {
+	reader *maxminddb.Reader
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// OpenGeoIPDatabase opens a MaxMind-format database at the given path.
+func OpenGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &GeoIPDatabase{reader: reader}, nil
+}
+
+// CountryForElement returns the country code for a path element which is an
+// IP address or prefix; prefixes are looked up by their network address.
+func (gdb *GeoIPDatabase) CountryForElement(element string) string {
+	if i := strings.Index(element, "/"); i > -1 {
+		element = element[:i]
+	}
+
+	ip := net.ParseIP(element)
+	if ip == nil {
+		return ""
+	}
+
+	var rec geoIPRecord
+	if err := gdb.reader.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+
+	return rec.Country.ISOCode
+}
+
+// Close closes the database.
+func (gdb *GeoIPDatabase) Close() error {
+	return gdb.reader.Close()
+}
+
+var countryLookup CountryLookup
+
+var countryLookupLock sync.RWMutex
+
+// SetCountryLookup installs a country lookup used to annotate the sources and
+// targets of paths with countries as they are added to the observation
+// database. Paths added while no lookup is installed are not annotated.
+func SetCountryLookup(cl CountryLookup) {
+	countryLookupLock.Lock()
+	defer countryLookupLock.Unlock()
+	countryLookup = cl
+}
+
+// EnableGeoIP opens the GeoIP database named in a configuration, if any, and
+// installs it as the country lookup for path annotation.
+func EnableGeoIP(config *PTOConfiguration) error {
+	if config.GeoIPDatabase == "" {
+		return nil
+	}
+
+	gdb, err := OpenGeoIPDatabase(config.GeoIPDatabase)
+	if err != nil {
+		return err
+	}
+
+	SetCountryLookup(gdb)
+	return nil
+}
+
+// countriesForPath returns the source and target countries for a path, using
+// the installed country lookup.
+func countriesForPath(source string, target string) (string, string) {
+	countryLookupLock.RLock()
+	defer countryLookupLock.RUnlock()
+
+	if countryLookup == nil {
+		return "", ""
+	}
+
+	var sourceCountry, targetCountry string
+	if source != "" {
+		sourceCountry = countryLookup.CountryForElement(source)
+	}
+	if target != "" {
+		targetCountry = countryLookup.CountryForElement(target)
+	}
+
+	return sourceCountry, targetCountry
+}
@@ -0,0 +1,48 @@
+package pto3
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/go-pg/pg/orm"
+)
+
+// PingDB checks that a database connection is usable.
+func PingDB(db orm.DB) error {
+	if _, err := db.Exec("SELECT 1"); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// checkWritable checks that a directory exists and that files can be created
+// in it, by creating and removing a probe file.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".pto_health")
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	name := f.Name()
+	f.Close()
+
+	if err := os.Remove(name); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// CheckHealth checks that the raw data store's root directory is writable.
+func (rds *RawDataStore) CheckHealth() error {
+	return checkWritable(rds.path)
+}
+
+// CheckHealth checks that the query cache's database is reachable and that
+// its result directory is writable.
+func (qc *QueryCache) CheckHealth() error {
+	if err := PingDB(qc.db); err != nil {
+		return err
+	}
+	return checkWritable(qc.path)
+}
@@ -0,0 +1,425 @@
+package pto3
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// IPFIX (RFC 7011) support for normalizers. Raw data files of the ipfix
+// filetype contain a stream of IPFIX messages, as in the IPFIX file format of
+// RFC 5655, e.g. as written by QoF or yaf. SplitIPFIXMessages splits such a
+// file into messages for a SerialScanningNormalizer, and IPFIXDecoder decodes
+// the data records in each message using the templates seen so far.
+
+// Filetype and MIME type for raw IPFIX files
+const (
+	IPFIXFiletype    = "ipfix"
+	IPFIXContentType = "application/ipfix"
+)
+
+const (
+	ipfixVersion              = 10
+	ipfixMessageHeaderLen     = 16
+	ipfixSetHeaderLen         = 4
+	ipfixTemplateSetID        = 2
+	ipfixOptionsTemplateSetID = 3
+	ipfixMinDataSetID         = 256
+	ipfixVarLen               = 65535
+	ipfixEnterpriseBit        = 0x8000
+
+	// private enterprise number for RFC 5103 reverse Information Elements
+	ipfixReversePEN = 29305
+)
+
+// IPFIXInformationElement identifies an IPFIX Information Element by
+// enterprise number (zero for IANA-registered elements) and element ID.
+type IPFIXInformationElement struct {
+	Enterprise uint32
+	ID         uint16
+}
+
+// IANA-registered Information Elements commonly used in path transparency
+// analysis
+var (
+	IEOctetDeltaCount          = IPFIXInformationElement{ID: 1}
+	IEPacketDeltaCount         = IPFIXInformationElement{ID: 2}
+	IEProtocolIdentifier       = IPFIXInformationElement{ID: 4}
+	IEIPClassOfService         = IPFIXInformationElement{ID: 5}
+	IETCPControlBits           = IPFIXInformationElement{ID: 6}
+	IESourceTransportPort      = IPFIXInformationElement{ID: 7}
+	IESourceIPv4Address        = IPFIXInformationElement{ID: 8}
+	IEDestinationTransportPort = IPFIXInformationElement{ID: 11}
+	IEDestinationIPv4Address   = IPFIXInformationElement{ID: 12}
+	IESourceIPv6Address        = IPFIXInformationElement{ID: 27}
+	IEDestinationIPv6Address   = IPFIXInformationElement{ID: 28}
+	IEFlowEndReason            = IPFIXInformationElement{ID: 136}
+	IEFlowStartSeconds         = IPFIXInformationElement{ID: 150}
+	IEFlowEndSeconds           = IPFIXInformationElement{ID: 151}
+	IEFlowStartMilliseconds    = IPFIXInformationElement{ID: 152}
+	IEFlowEndMilliseconds      = IPFIXInformationElement{ID: 153}
+)
+
+// Reverse returns the RFC 5103 reverse of an IANA-registered Information
+// Element, as exported for biflows by QoF and yaf.
+func (ie IPFIXInformationElement) Reverse() IPFIXInformationElement {
+	return IPFIXInformationElement{Enterprise: ipfixReversePEN, ID: ie.ID}
+}
+
+// IPFIXFieldSpec is a field specifier in an IPFIX template.
+type IPFIXFieldSpec struct {
+	IPFIXInformationElement
+	// Field length in bytes, or 65535 for variable-length fields
+	Length uint16
+}
+
+// IPFIXTemplate is a template or options template, describing the fields in
+// the data records of sets with its ID.
+type IPFIXTemplate struct {
+	ID     uint16
+	Fields []IPFIXFieldSpec
+	// Number of scope fields, nonzero only for options templates
+	ScopeCount int
+}
+
+// IPFIXField is a single field of a decoded data record.
+type IPFIXField struct {
+	IPFIXInformationElement
+	Value []byte
+}
+
+// IPFIXRecord is a decoded IPFIX data record. Field values refer to the
+// message the record was decoded from, and are only valid until the next
+// message is decoded; copy them to keep them.
+type IPFIXRecord struct {
+	// Export time from the message header
+	ExportTime time.Time
+	// Observation domain ID from the message header
+	ObservationDomain uint32
+	// Template describing this record
+	Template *IPFIXTemplate
+	// Fields in template order
+	Fields []IPFIXField
+}
+
+// Field returns the value of the first field in this record for an
+// Information Element, and true if the record contains it.
+func (rec *IPFIXRecord) Field(ie IPFIXInformationElement) ([]byte, bool) {
+	for i := range rec.Fields {
+		if rec.Fields[i].IPFIXInformationElement == ie {
+			return rec.Fields[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// Uint returns the value of an unsigned integer field, in any of the reduced
+// size encodings RFC 7011 allows, and true if the record contains it.
+func (rec *IPFIXRecord) Uint(ie IPFIXInformationElement) (uint64, bool) {
+	v, ok := rec.Field(ie)
+	if !ok || len(v) == 0 || len(v) > 8 {
+		return 0, false
+	}
+
+	var out uint64
+	for _, b := range v {
+		out = out<<8 | uint64(b)
+	}
+	return out, true
+}
+
+// IP returns the value of an IPv4 or IPv6 address field, and true if the
+// record contains it.
+func (rec *IPFIXRecord) IP(ie IPFIXInformationElement) (net.IP, bool) {
+	v, ok := rec.Field(ie)
+	if !ok || (len(v) != net.IPv4len && len(v) != net.IPv6len) {
+		return nil, false
+	}
+	return net.IP(append([]byte(nil), v...)), true
+}
+
+// Milliseconds returns the value of a dateTimeMilliseconds field, and true if
+// the record contains it.
+func (rec *IPFIXRecord) Milliseconds(ie IPFIXInformationElement) (time.Time, bool) {
+	ms, ok := rec.Uint(ie)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(ms/1000), int64(ms%1000)*int64(time.Millisecond)).UTC(), true
+}
+
+// Seconds returns the value of a dateTimeSeconds field, and true if the
+// record contains it.
+func (rec *IPFIXRecord) Seconds(ie IPFIXInformationElement) (time.Time, bool) {
+	s, ok := rec.Uint(ie)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(s), 0).UTC(), true
+}
+
+// IPFIXFieldFunc extracts the value of a field from a data record.
+type IPFIXFieldFunc func(value []byte) error
+
+// Extract calls the extraction function registered for each field in this
+// record in the given map, in field order, stopping at the first error.
+// Fields without an extraction function are ignored.
+func (rec *IPFIXRecord) Extract(extractors map[IPFIXInformationElement]IPFIXFieldFunc) error {
+	for i := range rec.Fields {
+		if fn, ok := extractors[rec.Fields[i].IPFIXInformationElement]; ok {
+			if err := fn(rec.Fields[i].Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SplitIPFIXMessages is a bufio.SplitFunc splitting a stream of IPFIX
+// messages into single messages.
+func SplitIPFIXMessages(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < ipfixMessageHeaderLen {
+		if atEOF && len(data) > 0 {
+			return 0, nil, PTOErrorf("truncated IPFIX message header")
+		}
+		return 0, nil, nil
+	}
+
+	if version := binary.BigEndian.Uint16(data[0:2]); version != ipfixVersion {
+		return 0, nil, PTOErrorf("bad IPFIX message version %d", version)
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < ipfixMessageHeaderLen {
+		return 0, nil, PTOErrorf("bad IPFIX message length %d", length)
+	}
+
+	if len(data) < length {
+		if atEOF {
+			return 0, nil, PTOErrorf("truncated IPFIX message")
+		}
+		return 0, nil, nil
+	}
+
+	return length, data[:length], nil
+}
+
+// ipfixTemplateKey identifies a template: template IDs are scoped to an
+// observation domain.
+type ipfixTemplateKey struct {
+	domain uint32
+	id     uint16
+}
+
+// IPFIXDecoder decodes IPFIX messages, keeping the templates defined in each
+// for decoding data records in subsequent messages. A decoder must see
+// messages in order, so it is suited to a SerialScanningNormalizer.
+type IPFIXDecoder struct {
+	templates map[ipfixTemplateKey]*IPFIXTemplate
+
+	// Number of data sets skipped because their template was unknown, as
+	// happens when a file does not start with the exporter's templates
+	MissingTemplateSets int
+}
+
+// NewIPFIXDecoder creates a decoder with no templates.
+func NewIPFIXDecoder() *IPFIXDecoder {
+	return &IPFIXDecoder{templates: make(map[ipfixTemplateKey]*IPFIXTemplate)}
+}
+
+// Template returns the template with a given ID in an observation domain, or
+// nil if the decoder has not seen it.
+func (d *IPFIXDecoder) Template(domain uint32, id uint16) *IPFIXTemplate {
+	return d.templates[ipfixTemplateKey{domain, id}]
+}
+
+// Decode decodes an IPFIX message, as split by SplitIPFIXMessages. Templates
+// in the message are added to the decoder, and the given function is called
+// for each data record in the message, in order. Data sets whose template is
+// unknown are skipped.
+func (d *IPFIXDecoder) Decode(msg []byte, fn func(rec *IPFIXRecord) error) error {
+	if len(msg) < ipfixMessageHeaderLen {
+		return PTOErrorf("truncated IPFIX message header")
+	}
+	if version := binary.BigEndian.Uint16(msg[0:2]); version != ipfixVersion {
+		return PTOErrorf("bad IPFIX message version %d", version)
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if length < ipfixMessageHeaderLen || length > len(msg) {
+		return PTOErrorf("bad IPFIX message length %d", length)
+	}
+
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(msg[4:8])), 0).UTC()
+	domain := binary.BigEndian.Uint32(msg[12:16])
+
+	sets := msg[ipfixMessageHeaderLen:length]
+	for len(sets) > 0 {
+		if len(sets) < ipfixSetHeaderLen {
+			return PTOErrorf("truncated IPFIX set header")
+		}
+		setID := binary.BigEndian.Uint16(sets[0:2])
+		setLen := int(binary.BigEndian.Uint16(sets[2:4]))
+		if setLen < ipfixSetHeaderLen || setLen > len(sets) {
+			return PTOErrorf("bad IPFIX set length %d", setLen)
+		}
+		body := sets[ipfixSetHeaderLen:setLen]
+		sets = sets[setLen:]
+
+		var err error
+		switch {
+		case setID == ipfixTemplateSetID:
+			err = d.decodeTemplates(domain, body, false)
+		case setID == ipfixOptionsTemplateSetID:
+			err = d.decodeTemplates(domain, body, true)
+		case setID >= ipfixMinDataSetID:
+			tmpl := d.templates[ipfixTemplateKey{domain, setID}]
+			if tmpl == nil {
+				d.MissingTemplateSets++
+				continue
+			}
+			err = decodeDataSet(tmpl, exportTime, domain, body, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeTemplates decodes the template records in a template or options
+// template set. A template record with no fields withdraws the template.
+func (d *IPFIXDecoder) decodeTemplates(domain uint32, body []byte, options bool) error {
+	hdrLen := 4
+	if options {
+		hdrLen = 6
+	}
+
+	// anything shorter than a template header is padding
+	for len(body) >= hdrLen {
+		tmpl := &IPFIXTemplate{ID: binary.BigEndian.Uint16(body[0:2])}
+		count := int(binary.BigEndian.Uint16(body[2:4]))
+		if options {
+			tmpl.ScopeCount = int(binary.BigEndian.Uint16(body[4:6]))
+		}
+		body = body[hdrLen:]
+
+		if tmpl.ID < ipfixMinDataSetID {
+			return PTOErrorf("bad IPFIX template ID %d", tmpl.ID)
+		}
+
+		if count == 0 {
+			delete(d.templates, ipfixTemplateKey{domain, tmpl.ID})
+			continue
+		}
+
+		tmpl.Fields = make([]IPFIXFieldSpec, count)
+		for i := range tmpl.Fields {
+			if len(body) < 4 {
+				return PTOErrorf("truncated IPFIX template %d", tmpl.ID)
+			}
+			id := binary.BigEndian.Uint16(body[0:2])
+			tmpl.Fields[i].Length = binary.BigEndian.Uint16(body[2:4])
+			body = body[4:]
+
+			if id&ipfixEnterpriseBit != 0 {
+				if len(body) < 4 {
+					return PTOErrorf("truncated IPFIX template %d", tmpl.ID)
+				}
+				tmpl.Fields[i].Enterprise = binary.BigEndian.Uint32(body[0:4])
+				body = body[4:]
+			}
+			tmpl.Fields[i].ID = id &^ ipfixEnterpriseBit
+		}
+
+		d.templates[ipfixTemplateKey{domain, tmpl.ID}] = tmpl
+	}
+
+	return nil
+}
+
+// minRecordLen returns the length of the shortest data record a template can
+// describe, with all variable-length fields empty.
+func (tmpl *IPFIXTemplate) minRecordLen() int {
+	n := 0
+	for _, f := range tmpl.Fields {
+		if f.Length == ipfixVarLen {
+			n++
+		} else {
+			n += int(f.Length)
+		}
+	}
+	return n
+}
+
+// decodeDataSet decodes the data records in a data set, calling a function
+// for each.
+func decodeDataSet(tmpl *IPFIXTemplate, exportTime time.Time, domain uint32, body []byte, fn func(rec *IPFIXRecord) error) error {
+	minLen := tmpl.minRecordLen()
+
+	rec := IPFIXRecord{
+		ExportTime:        exportTime,
+		ObservationDomain: domain,
+		Template:          tmpl,
+		Fields:            make([]IPFIXField, len(tmpl.Fields)),
+	}
+
+	// anything shorter than a record is padding
+	for len(body) >= minLen {
+		for i, f := range tmpl.Fields {
+			length := int(f.Length)
+			if f.Length == ipfixVarLen {
+				if len(body) < 1 {
+					return PTOErrorf("truncated IPFIX record in set %d", tmpl.ID)
+				}
+				length = int(body[0])
+				body = body[1:]
+				if length == 255 {
+					if len(body) < 2 {
+						return PTOErrorf("truncated IPFIX record in set %d", tmpl.ID)
+					}
+					length = int(binary.BigEndian.Uint16(body[0:2]))
+					body = body[2:]
+				}
+			}
+			if len(body) < length {
+				return PTOErrorf("truncated IPFIX record in set %d", tmpl.ID)
+			}
+
+			rec.Fields[i] = IPFIXField{IPFIXInformationElement: f.IPFIXInformationElement, Value: body[:length]}
+			body = body[length:]
+		}
+
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IPFIXNormFunc is a record normalization function for IPFIX data records,
+// called once per record, in order, with the input and output metadata of a
+// SerialScanningNormalizer.
+type IPFIXNormFunc func(rec *IPFIXRecord, mdin *RawMetadata, mdout map[string]interface{}) ([]Observation, error)
+
+// NewIPFIXSerialNormFunc wraps an IPFIX record normalization function in a
+// SerialNormFunc for raw data split by SplitIPFIXMessages. Each message is
+// decoded by an IPFIXDecoder shared by all messages of the file, and the
+// observations for all records in a message are returned together. Use it
+// with a new SerialScanningNormalizer for each file, e.g.
+//
+//	norm.RegisterFiletype(IPFIXFiletype, SplitIPFIXMessages, NewIPFIXSerialNormFunc(fn), nil)
+func NewIPFIXSerialNormFunc(fn IPFIXNormFunc) SerialNormFunc {
+	d := NewIPFIXDecoder()
+
+	return func(msg []byte, mdin *RawMetadata, mdout map[string]interface{}) ([]Observation, error) {
+		var out []Observation
+		err := d.Decode(msg, func(rec *IPFIXRecord) error {
+			obsen, err := fn(rec, mdin, mdout)
+			out = append(out, obsen...)
+			return err
+		})
+		return out, err
+	}
+}
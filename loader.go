@@ -0,0 +1,148 @@
+package pto3
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-pg/pg"
+)
+
+// Loader loads observation files into the database, caching condition and
+// path IDs across files. A Loader may be shared by goroutines loading files
+// concurrently, each in its own transaction: each load works on private
+// copies of the caches, which are merged back only once its transaction has
+// committed, so that no load uses an ID which is not yet visible to it in the
+// database, or which was rolled back.
+type Loader struct {
+	db       *pg.DB
+	lock     sync.RWMutex
+	cidCache ConditionCache
+	pidCache PathCache
+}
+
+// NewLoader creates a new Loader for the given database, with its condition
+// cache filled from the database.
+func NewLoader(db *pg.DB) (*Loader, error) {
+	cidCache, err := LoadConditionCache(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Loader{db: db, cidCache: cidCache, pidCache: make(PathCache)}, nil
+}
+
+// checkout returns private copies of this loader's caches.
+func (l *Loader) checkout() (ConditionCache, PathCache) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	cidCache := make(ConditionCache, len(l.cidCache))
+	for k, v := range l.cidCache {
+		cidCache[k] = v
+	}
+
+	pidCache := make(PathCache, len(l.pidCache))
+	for k, v := range l.pidCache {
+		pidCache[k] = v
+	}
+
+	return cidCache, pidCache
+}
+
+// merge adds the entries in private caches to this loader's caches. Call this
+// only after the transaction adding any new entries has committed.
+func (l *Loader) merge(cidCache ConditionCache, pidCache PathCache) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for k, v := range cidCache {
+		if _, ok := l.cidCache[k]; !ok {
+			l.cidCache[k] = v
+		}
+	}
+
+	for k, v := range pidCache {
+		if _, ok := l.pidCache[k]; !ok {
+			l.pidCache[k] = v
+		}
+	}
+}
+
+// LoadSet creates a new observation set from an observation file at a local
+// path, as with CopySetFromObsFile, and returns it.
+func (l *Loader) LoadSet(filename string) (*ObservationSet, error) {
+	return l.LoadSetContext(context.Background(), filename)
+}
+
+// LoadSetContext works like LoadSet, but stops loading when the given context
+// is done.
+func (l *Loader) LoadSetContext(ctx context.Context, filename string) (*ObservationSet, error) {
+	cidCache, pidCache := l.checkout()
+
+	set, err := CopySetFromObsFileContext(ctx, filename, l.db, cidCache, pidCache)
+	if err != nil {
+		return nil, err
+	}
+
+	l.merge(cidCache, pidCache)
+	return set, nil
+}
+
+// LoadSetWithMetadata works like LoadSet, but adds the given metadata to that
+// in the file, overriding it, before the set is inserted.
+func (l *Loader) LoadSetWithMetadata(filename string, md map[string]string) (*ObservationSet, error) {
+	return l.LoadSetWithMetadataContext(context.Background(), filename, md)
+}
+
+// LoadSetWithMetadataContext works like LoadSetWithMetadata, but stops loading
+// when the given context is done.
+func (l *Loader) LoadSetWithMetadataContext(ctx context.Context, filename string, md map[string]string) (*ObservationSet, error) {
+	cidCache, pidCache := l.checkout()
+
+	set, err := copySetFromObsFile(ctx, filename, l.db, nil, md, cidCache, pidCache)
+	if err != nil {
+		return nil, err
+	}
+
+	l.merge(cidCache, pidCache)
+	return set, nil
+}
+
+// LoadData loads the observations in an observation file at a local path into
+// an existing observation set, as with CopyDataFromObsFile.
+func (l *Loader) LoadData(filename string, set *ObservationSet) error {
+	return l.LoadDataContext(context.Background(), filename, set)
+}
+
+// LoadDataContext works like LoadData, but stops loading when the given
+// context is done.
+func (l *Loader) LoadDataContext(ctx context.Context, filename string, set *ObservationSet) error {
+	cidCache, pidCache := l.checkout()
+
+	if err := CopyDataFromObsFileContext(ctx, filename, l.db, set, cidCache, pidCache); err != nil {
+		return err
+	}
+
+	l.merge(cidCache, pidCache)
+	return nil
+}
+
+// RestoreSet restores an observation set under a given ID from an observation
+// file at a local path, as with RestoreSetFromObsFile, and returns it.
+func (l *Loader) RestoreSet(filename string, setID int) (*ObservationSet, error) {
+	return l.RestoreSetContext(context.Background(), filename, setID)
+}
+
+// RestoreSetContext works like RestoreSet, but stops restoring when the given
+// context is done.
+func (l *Loader) RestoreSetContext(ctx context.Context, filename string, setID int) (*ObservationSet, error) {
+	cidCache, pidCache := l.checkout()
+
+	set, err := RestoreSetFromObsFileContext(ctx, filename, l.db, setID, cidCache, pidCache)
+	if err != nil {
+		return nil, err
+	}
+
+	l.merge(cidCache, pidCache)
+	return set, nil
+}
@@ -0,0 +1,179 @@
+package pto3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MetadataSchema is a JSON Schema constraining the metadata of raw data files
+// of a filetype, so that campaigns keep a consistent metadata vocabulary. It
+// supports the subset of JSON Schema meaningful for raw metadata, whose
+// values are stored as strings: the required, properties, and
+// additionalProperties keywords of an object schema, and the type, enum,
+// pattern, minLength, and maxLength keywords of each property. Metadata is
+// validated including keys inherited from campaign metadata; virtual keys
+// beginning with __ are ignored, and system keys beginning with _ are allowed
+// even if additionalProperties is false.
+type MetadataSchema struct {
+	// Keys which must be present
+	Required []string `json:"required"`
+
+	// Schemas for individual keys
+	Properties map[string]*MetadataPropertySchema `json:"properties"`
+
+	// If false, keys not in Properties are rejected; default true
+	AdditionalProperties *bool `json:"additionalProperties"`
+}
+
+// MetadataPropertySchema constrains the value of a single metadata key.
+type MetadataPropertySchema struct {
+	// JSON type the value must have, or represent if stored as a string:
+	// string, number, integer, or boolean; any type if empty
+	Type string `json:"type"`
+
+	// Values allowed; any value if empty
+	Enum []interface{} `json:"enum"`
+
+	// Regular expression the value must match
+	Pattern string `json:"pattern"`
+
+	// Minimum and maximum length of the value in characters
+	MinLength *int `json:"minLength"`
+	MaxLength *int `json:"maxLength"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadMetadataSchema reads a metadata schema from a JSON Schema file.
+func LoadMetadataSchema(filename string) (*MetadataSchema, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	var schema MetadataSchema
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, PTOErrorf("cannot parse metadata schema %s: %s", filename, err.Error())
+	}
+
+	for k, ps := range schema.Properties {
+		if ps == nil {
+			return nil, PTOErrorf("metadata schema %s: no schema for property %s", filename, k)
+		}
+		switch ps.Type {
+		case "", "string", "number", "integer", "boolean":
+		default:
+			return nil, PTOErrorf("metadata schema %s: unsupported type %s for property %s", filename, ps.Type, k)
+		}
+		if ps.Pattern != "" {
+			if ps.pattern, err = regexp.Compile(ps.Pattern); err != nil {
+				return nil, PTOErrorf("metadata schema %s: bad pattern for property %s: %s", filename, k, err.Error())
+			}
+		}
+	}
+
+	return &schema, nil
+}
+
+// Validate checks raw metadata, including keys inherited from its parent,
+// against this schema, returning an error describing every violation, or nil
+// if there are none.
+func (schema *MetadataSchema) Validate(md *RawMetadata) error {
+	b, err := md.DumpJSONObject(true)
+	if err != nil {
+		return err
+	}
+
+	var jmap map[string]interface{}
+	if err := json.Unmarshal(b, &jmap); err != nil {
+		return PTOWrapError(err)
+	}
+
+	violations := make([]string, 0)
+
+	for _, k := range schema.Required {
+		if _, ok := jmap[k]; !ok {
+			violations = append(violations, "missing required key "+k)
+		}
+	}
+
+	keys := make([]string, 0, len(jmap))
+	for k := range jmap {
+		if !strings.HasPrefix(k, "__") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ps, ok := schema.Properties[k]
+		if !ok {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties && !strings.HasPrefix(k, "_") {
+				violations = append(violations, "key "+k+" not allowed")
+			}
+			continue
+		}
+		if msg := ps.check(AsString(jmap[k])); msg != "" {
+			violations = append(violations, "key "+k+" "+msg)
+		}
+	}
+
+	if len(violations) > 0 {
+		return PTOErrorf("metadata does not conform to schema for filetype %s: %s",
+			md.Filetype(true), strings.Join(violations, "; ")).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadMetadata)
+	}
+
+	return nil
+}
+
+// check returns a description of how a value violates this property schema,
+// or the empty string if it does not.
+func (ps *MetadataPropertySchema) check(v string) string {
+	switch ps.Type {
+	case "number":
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "must be a number"
+		}
+	case "integer":
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return "must be an integer"
+		}
+	case "boolean":
+		if v != "true" && v != "false" {
+			return "must be a boolean"
+		}
+	}
+
+	if len(ps.Enum) > 0 {
+		found := false
+		for _, ev := range ps.Enum {
+			if AsString(ev) == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "must be one of the values allowed by the schema"
+		}
+	}
+
+	if ps.pattern != nil && !ps.pattern.MatchString(v) {
+		return "must match " + ps.Pattern
+	}
+
+	length := utf8.RuneCountInString(v)
+	if ps.MinLength != nil && length < *ps.MinLength {
+		return "is shorter than " + strconv.Itoa(*ps.MinLength) + " characters"
+	}
+	if ps.MaxLength != nil && length > *ps.MaxLength {
+		return "is longer than " + strconv.Itoa(*ps.MaxLength) + " characters"
+	}
+
+	return ""
+}
@@ -0,0 +1,288 @@
+package pto3
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// NamedQuery associates a human-readable name with a query specification, so
+// that the query can be re-executed against the current data on demand.
+type NamedQuery struct {
+	// Reference to cache containing query
+	qc *QueryCache
+
+	// Human-readable name
+	Name string `sql:",pk"`
+	// URL-encoded query specification, with the relative time expressions,
+	// if any, the named query was submitted with
+	Encoded string `sql:",notnull"`
+	// Identifier of the query most recently executed under this name
+	Identifier string `sql:",notnull"`
+	// Timestamps
+	Created  *time.Time
+	Modified *time.Time
+
+	// Executions under this name, most recent first; filled in by
+	// NamedQueryByName
+	History []NamedQueryExecution `sql:"-"`
+}
+
+// NamedQueryExecution records a query executed under a name.
+type NamedQueryExecution struct {
+	ID         int
+	Name       string `sql:",notnull"`
+	Identifier string `sql:",notnull"`
+	Executed   *time.Time
+}
+
+// namedQueryNameRegexp matches valid query names, which must be usable as a
+// path element in a URL without escaping.
+var namedQueryNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// createNamedQueryTables ensures the tables holding named queries and their
+// execution history exist.
+func createNamedQueryTables(db *pg.DB) error {
+	opts := orm.CreateTableOptions{IfNotExists: true}
+
+	for _, model := range []interface{}{&NamedQuery{}, &NamedQueryExecution{}} {
+		if err := db.CreateTable(model, &opts); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// resubmissionEncoded returns a URL-encoded specification which resubmits
+// this query, with times replaced by the relative time expressions the query
+// was submitted with, if any.
+func (q *Query) resubmissionEncoded() string {
+	v, err := url.ParseQuery(q.URLEncoded())
+	if err != nil {
+		// URLEncoded always produces a parseable query
+		panic(err)
+	}
+
+	if expr, ok := q.Metadata["__time_start_expr"]; ok {
+		v.Set("time_start", expr)
+	}
+	if expr, ok := q.Metadata["__time_end_expr"]; ok {
+		v.Set("time_end", expr)
+	}
+
+	return v.Encode()
+}
+
+// NameQuery saves the query with the given identifier under a name,
+// replacing any query previously saved under that name. The query is
+// recorded as the first execution of the name. A query not visible to the
+// given principal is treated as if it did not exist.
+func (qc *QueryCache) NameQuery(name string, identifier string, principal string) (*NamedQuery, error) {
+	if !namedQueryNameRegexp.MatchString(name) {
+		return nil, PTOErrorf("invalid query name %s", name).StatusIs(http.StatusBadRequest)
+	}
+
+	q, err := qc.QueryByIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	} else if q == nil || !q.VisibleTo(principal) {
+		return nil, PTOErrorf("no such query %s", identifier).StatusIs(http.StatusNotFound)
+	}
+
+	now := time.Now()
+	nq := NamedQuery{
+		Name:       name,
+		Encoded:    q.resubmissionEncoded(),
+		Identifier: q.Identifier,
+		Created:    &now,
+		Modified:   &now,
+	}
+
+	if _, err := qc.db.Model(&nq).
+		OnConflict("(name) DO UPDATE").
+		Set("encoded = EXCLUDED.encoded, identifier = EXCLUDED.identifier, modified = EXCLUDED.modified").
+		Insert(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	executed := q.Executed
+	if executed == nil {
+		executed = q.Submitted
+	}
+	if err := qc.recordNamedQueryExecution(name, q.Identifier, executed); err != nil {
+		return nil, err
+	}
+
+	return qc.NamedQueryByName(name)
+}
+
+// recordNamedQueryExecution adds a query to the execution history of a name.
+func (qc *QueryCache) recordNamedQueryExecution(name string, identifier string, executed *time.Time) error {
+	nqe := NamedQueryExecution{Name: name, Identifier: identifier, Executed: executed}
+	if err := qc.db.Insert(&nqe); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// NamedQueryByName retrieves a named query and its execution history,
+// returning nil if no query is saved under the given name.
+func (qc *QueryCache) NamedQueryByName(name string) (*NamedQuery, error) {
+	nq := NamedQuery{Name: name}
+	if err := qc.db.Select(&nq); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, PTOWrapError(err)
+	}
+	nq.qc = qc
+
+	if err := qc.db.Model(&nq.History).
+		Where("name = ?", name).
+		Order("executed DESC", "id DESC").
+		Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &nq, nil
+}
+
+// NamedQueryLinks returns links to all named queries in the cache, sorted by
+// name.
+func (qc *QueryCache) NamedQueryLinks() ([]string, error) {
+	var names []string
+
+	if err := qc.db.Model((*NamedQuery)(nil)).Column("name").Order("name").Select(&names); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make([]string, len(names))
+	for i := range names {
+		out[i], _ = qc.config.LinkTo("query/named/" + names[i])
+	}
+
+	return out, nil
+}
+
+// Form returns the query specification of this named query as a form.
+func (nq *NamedQuery) Form() (url.Values, error) {
+	v, err := url.ParseQuery(nq.Encoded)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return v, nil
+}
+
+// VisibleTo returns true if this named query may be read and executed by the
+// given principal: it names a shared query, or a private query owned by the
+// principal.
+func (nq *NamedQuery) VisibleTo(principal string) bool {
+	form, err := nq.Form()
+	if err != nil {
+		return false
+	}
+	owner := form.Get("owner")
+	return owner == "" || owner == principal
+}
+
+// Execute submits this named query again, resolving any relative times
+// against the current time, and executes it against the current data. If the
+// resulting query is already cached, it is executed again unless it is
+// executing or permanent; it then covers the same observation sets as before,
+// unless repin is set. Execution is traced as part of the trace in the given
+// context. The query is recorded in this name's execution history, and
+// returned.
+func (nq *NamedQuery) Execute(ctx context.Context, done chan struct{}, repin bool) (*Query, error) {
+	form, err := nq.Form()
+	if err != nil {
+		return nil, err
+	}
+
+	q, isNew, err := nq.qc.SubmitQueryFromForm(form)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNew || q.reexecutable() {
+		q.traceCtx = ctx
+		if repin {
+			q.pins = nil
+		}
+		q.ExecuteWaitImmediate(done)
+	} else {
+		close(done)
+	}
+
+	now := time.Now()
+	nq.Identifier = q.Identifier
+	nq.Modified = &now
+	if _, err := nq.qc.db.Model(nq).Column("identifier", "modified").Where("name = ?", nq.Name).Update(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if err := nq.qc.recordNamedQueryExecution(nq.Name, q.Identifier, &now); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (nq *NamedQuery) MarshalJSON() ([]byte, error) {
+	jobj := make(map[string]interface{})
+
+	jobj["name"] = nq.Name
+	jobj["__encoded"] = nq.Encoded
+
+	link, err := nq.qc.config.LinkTo("query/named/" + nq.Name)
+	if err != nil {
+		return nil, err
+	}
+	jobj["__link"] = link
+	jobj["__execute"] = link + "/execute"
+
+	jobj["__query"], err = nq.qc.config.LinkTo("query/" + nq.Identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if nq.Created != nil {
+		jobj["__created"] = nq.Created.Format(time.RFC3339)
+	}
+	if nq.Modified != nil {
+		jobj["__modified"] = nq.Modified.Format(time.RFC3339)
+	}
+
+	history := make([]map[string]string, len(nq.History))
+	for i, nqe := range nq.History {
+		history[i] = make(map[string]string)
+		history[i]["__query"], err = nq.qc.config.LinkTo("query/" + nqe.Identifier)
+		if err != nil {
+			return nil, err
+		}
+		if nqe.Executed != nil {
+			history[i]["__executed"] = nqe.Executed.Format(time.RFC3339)
+		}
+	}
+	jobj["__history"] = history
+
+	return json.Marshal(jobj)
+}
+
+// QueryIdentifierFromLink returns the query identifier from a link to a
+// query, or the argument itself if it is already an identifier.
+func QueryIdentifierFromLink(link string) string {
+	link = strings.TrimSuffix(link, "/")
+	if i := strings.LastIndex(link, "/"); i > -1 {
+		return link[i+1:]
+	}
+	return link
+}
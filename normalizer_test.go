@@ -3,12 +3,18 @@ package pto3_test
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"strconv"
 	"testing"
 	"time"
 
@@ -99,14 +105,12 @@ func TestNormalization(t *testing.T) {
 	nowish := time.Now()
 
 	// create an observation set from this normalized file
-	cidCache, err := pto3.LoadConditionCache(TestDB)
+	loader, err := pto3.NewLoader(TestDB)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pidCache := make(pto3.PathCache)
-
-	set, err := pto3.CopySetFromObsFile(tf.Name(), TestDB, cidCache, pidCache)
+	set, err := loader.LoadSet(tf.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -147,3 +151,642 @@ func TestNormalization(t *testing.T) {
 	}
 
 }
+
+func testCheckpointNormFunc(failAt int) pto3.ParallelNormFunc {
+	return func(rec []byte, rawmeta *pto3.RawMetadata, metachan chan<- map[string]interface{}) ([]pto3.Observation, error) {
+		n, err := strconv.Atoi(string(rec))
+		if err != nil {
+			return nil, err
+		}
+
+		if n == failAt {
+			return nil, fmt.Errorf("simulated failure at record %d", n)
+		}
+
+		metachan <- map[string]interface{}{"last_record_seen": "yes"}
+
+		t := time.Date(2018, 1, 1, 0, 0, n, 0, time.UTC)
+		return []pto3.Observation{pto3.Observation{
+			TimeStart: &t,
+			TimeEnd:   &t,
+			Path:      pto3.NewPath(fmt.Sprintf("10.0.0.1 * 10.0.1.%d", n)),
+			Condition: pto3.NewCondition("pto.test.checkpoint"),
+		}}, nil
+	}
+}
+
+func runCheckpointNormalization(failAt int, in *os.File, out *os.File) error {
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	norm := pto3.NewParallelScanningNormalizer("https://ptotest.mami-project.eu/checkpoint.json", 2)
+	norm.RegisterFiletype("test", bufio.ScanLines, testCheckpointNormFunc(failAt), nil)
+	norm.EnableCheckpoints(2)
+
+	metain := bytes.NewBufferString(`{"_file_type": "test", "_owner": "ptotest"}`)
+	return norm.Normalize(in, metain, out)
+}
+
+// This test simulates a crash in the middle of a checkpointing normalization,
+// and verifies that running the normalization again resumes from the last
+// checkpoint without losing or duplicating observations.
+func TestNormalizationCheckpoint(t *testing.T) {
+	const recordCount = 10
+
+	in, err := ioutil.TempFile("", "pto3-test-checkpoint-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	defer os.Remove(in.Name())
+
+	for i := 1; i <= recordCount; i++ {
+		fmt.Fprintf(in, "%d\n", i)
+	}
+
+	out, err := ioutil.TempFile("", "pto3-test-checkpoint-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer os.Remove(out.Name())
+	defer os.Remove(out.Name() + pto3.CheckpointSuffix)
+
+	// first run fails partway through, leaving a checkpoint behind
+	if err := runCheckpointNormalization(5, in, out); err == nil {
+		t.Fatal("simulated normalization failure did not fail")
+	}
+
+	if _, err := os.Stat(out.Name() + pto3.CheckpointSuffix); err != nil {
+		t.Fatalf("no checkpoint after failed normalization: %v", err)
+	}
+
+	// second run resumes and completes
+	if err := runCheckpointNormalization(0, in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(out.Name() + pto3.CheckpointSuffix); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed after completed normalization: %v", err)
+	}
+
+	// now make sure every observation appears exactly once
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]int)
+	var mdcount int
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		line := s.Text()
+		switch line[0] {
+		case '[':
+			var o pto3.Observation
+			if err := json.Unmarshal([]byte(line), &o); err != nil {
+				t.Fatal(err)
+			}
+			seen[o.Path.String]++
+		case '{':
+			mdcount++
+		}
+	}
+
+	if mdcount != 1 {
+		t.Fatalf("expected one metadata line in resumed output, got %d", mdcount)
+	}
+
+	if len(seen) != recordCount {
+		t.Fatalf("expected %d observations in resumed output, got %d", recordCount, len(seen))
+	}
+
+	for path, count := range seen {
+		if count != 1 {
+			t.Fatalf("observation on path %s appears %d times in resumed output", path, count)
+		}
+	}
+}
+
+func runFailingNormalization(ctx context.Context, norm *pto3.ParallelScanningNormalizer, recordCount int, out *os.File) error {
+	in, err := ioutil.TempFile("", "pto3-test-failure-in")
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	defer os.Remove(in.Name())
+
+	for i := 1; i <= recordCount; i++ {
+		fmt.Fprintf(in, "%d\n", i)
+	}
+
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	metain := bytes.NewBufferString(`{"_file_type": "test", "_owner": "ptotest"}`)
+	return norm.NormalizeContext(ctx, in, metain, out)
+}
+
+// This test verifies that a record failing in the middle of a parallel
+// normalization stops the normalization, reports the failing record, and
+// leaves no partial output behind.
+func TestNormalizationMidStreamFailure(t *testing.T) {
+	const preexisting = "this line was here before normalization\n"
+
+	out, err := ioutil.TempFile("", "pto3-test-failure-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer os.Remove(out.Name())
+
+	if _, err := out.WriteString(preexisting); err != nil {
+		t.Fatal(err)
+	}
+
+	norm := pto3.NewParallelScanningNormalizer("https://ptotest.mami-project.eu/failure.json", 4)
+	norm.RegisterFiletype("test", bufio.ScanLines, testCheckpointNormFunc(37), nil)
+
+	err = runFailingNormalization(context.Background(), norm, 1000, out)
+	if err == nil {
+		t.Fatal("normalization with failing record did not fail")
+	}
+
+	nerr, ok := err.(*pto3.NormalizationError)
+	if !ok {
+		t.Fatalf("expected NormalizationError, got %T: %v", err, err)
+	}
+
+	if nerr.Record != 37 {
+		t.Fatalf("expected failure at record 37, got record %d", nerr.Record)
+	}
+
+	b, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != preexisting {
+		t.Fatalf("partial output not removed after failure; output is %d bytes", len(b))
+	}
+}
+
+// This test verifies that cancelling the context of a parallel normalization
+// stops it and leaves no partial output behind.
+func TestNormalizationCancel(t *testing.T) {
+	out, err := ioutil.TempFile("", "pto3-test-cancel-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	defer os.Remove(out.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	normFunc := testCheckpointNormFunc(0)
+
+	norm := pto3.NewParallelScanningNormalizer("https://ptotest.mami-project.eu/cancel.json", 4)
+	norm.RegisterFiletype("test", bufio.ScanLines,
+		func(rec []byte, rawmeta *pto3.RawMetadata, metachan chan<- map[string]interface{}) ([]pto3.Observation, error) {
+			if string(rec) == "50" {
+				cancel()
+			}
+			return normFunc(rec, rawmeta, metachan)
+		}, nil)
+
+	if err := runFailingNormalization(ctx, norm, 1000, out); err != context.Canceled {
+		t.Fatalf("expected cancelled normalization, got %v", err)
+	}
+
+	fi, err := out.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != 0 {
+		t.Fatalf("partial output not removed after cancellation; output is %d bytes", fi.Size())
+	}
+}
+
+func testSerialNormFunc(rec []byte, mdin *pto3.RawMetadata, mdout map[string]interface{}) ([]pto3.Observation, error) {
+	return testCheckpointNormFunc(0)(rec, mdin, make(chan map[string]interface{}, 1))
+}
+
+// This test verifies that scanning normalizers transparently decompress
+// input according to the filetype suffix.
+func TestNormalizationDecompression(t *testing.T) {
+	const recordCount = 10
+
+	var plain bytes.Buffer
+	for i := 1; i <= recordCount; i++ {
+		fmt.Fprintf(&plain, "%d\n", i)
+	}
+
+	compressed := make(map[string][]byte)
+
+	var gzbuf bytes.Buffer
+	gzw := gzip.NewWriter(&gzbuf)
+	if _, err := gzw.Write(plain.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compressed["test-gz"] = gzbuf.Bytes()
+
+	if _, err := exec.LookPath("xz"); err == nil {
+		xzcmd := exec.Command("xz", "--compress", "--stdout")
+		xzcmd.Stdin = bytes.NewReader(plain.Bytes())
+		xzout, err := xzcmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed["test-xz"] = xzout
+	} else {
+		// xz not installed; nil data skips its subtest
+		compressed["test-xz"] = nil
+	}
+
+	for filetype, data := range compressed {
+		t.Run(filetype, func(t *testing.T) {
+			if data == nil {
+				t.Skip("xz not installed")
+			}
+			testDecompressingNormalization(t, filetype, data, recordCount)
+		})
+	}
+}
+
+func testDecompressingNormalization(t *testing.T, filetype string, data []byte, recordCount int) {
+	in, err := ioutil.TempFile("", "pto3-test-decompress-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	defer os.Remove(in.Name())
+
+	if _, err := in.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	pnorm := pto3.NewParallelScanningNormalizer("https://ptotest.mami-project.eu/decompress.json", 2)
+	pnorm.RegisterFiletype("test", bufio.ScanLines, testCheckpointNormFunc(0), nil)
+
+	snorm := pto3.NewSerialScanningNormalizer("https://ptotest.mami-project.eu/decompress.json")
+	snorm.RegisterFiletype("test", bufio.ScanLines, testSerialNormFunc, nil)
+
+	normalizers := map[string]func(*os.File, io.Reader, io.Writer) error{
+		"parallel": pnorm.Normalize,
+		"serial":   snorm.Normalize,
+	}
+
+	for normname, normalize := range normalizers {
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		metain := bytes.NewBufferString(fmt.Sprintf(`{"_file_type": "%s", "_owner": "ptotest"}`, filetype))
+		if err := normalize(in, metain, &out); err != nil {
+			t.Fatalf("%s normalization of %s failed: %v", normname, filetype, err)
+		}
+
+		obsset, err := observationsInFile(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(obsset) != recordCount {
+			t.Fatalf("%s normalization of %s: expected %d observations, got %d", normname, filetype, recordCount, len(obsset))
+		}
+	}
+}
+
+// This test verifies that the decompressor with the longest matching suffix
+// is chosen when registered suffixes overlap.
+func TestDecompressorSuffixMatch(t *testing.T) {
+	pto3.RegisterDecompressor("-plain-gz", func(in io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(in), nil
+	})
+	defer pto3.UnregisterDecompressor("-plain-gz")
+
+	for i := 0; i < 10; i++ {
+		r, filetype, err := pto3.NewDecompressingReader("test-plain-gz", bytes.NewBufferString("1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+
+		if filetype != "test" {
+			t.Fatalf("expected filetype test after stripping -plain-gz, got %s", filetype)
+		}
+	}
+}
+
+const testObservationSetStream = `{"_owner":"ptotest","_sources":["https://ptotest.mami-project.eu/raw/test.json"],"_analyzer":"https://ptotest.mami-project.eu/analyzer.json","_conditions":["pto.test.one"],"set_name":"first"}
+["a","2018-01-01T00:00:00Z","2018-01-01T00:01:00Z","10.0.0.1 * 10.0.0.2","pto.test.one"]
+["a","2018-01-01T00:02:00Z","2018-01-01T00:03:00Z","10.0.0.1 * 10.0.0.3","pto.test.one"]
+["a","2018-01-01T00:04:00Z","2018-01-01T00:05:00Z","10.0.0.1 * 10.0.0.4","pto.test.one"]
+{"_owner":"ptotest","_sources":["https://ptotest.mami-project.eu/raw/test.json"],"_analyzer":"https://ptotest.mami-project.eu/analyzer.json","_conditions":["pto.test.two"],"set_name":"second"}
+["b","2018-01-01T00:00:00Z","2018-01-01T00:01:00Z","10.0.0.1 * 10.0.0.2","pto.test.two"]
+["b","2018-01-01T00:02:00Z","2018-01-01T00:03:00Z","10.0.0.1 * 10.0.0.3","pto.test.two"]
+`
+
+func TestAnalyzeObservationSets(t *testing.T) {
+	setNames := make(map[int]string)
+	obsCount := make(map[int]int)
+
+	// read all observations in the second set, only the first observation in the first
+	setTable, err := pto3.AnalyzeObservationSets(bytes.NewBufferString(testObservationSetStream),
+		func(set *pto3.ObservationSet, obsen *pto3.ObservationIterator) error {
+			setNames[set.ID] = set.Metadata["set_name"]
+			for obsen.Next() {
+				if obsen.Observation().Set != set {
+					return fmt.Errorf("observation in set %x has wrong set", set.ID)
+				}
+				obsCount[set.ID]++
+				if set.ID == 0xa {
+					break
+				}
+			}
+			return obsen.Err()
+		})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setTable) != 2 || setNames[0xa] != "first" || setNames[0xb] != "second" {
+		t.Fatalf("unexpected sets %v", setNames)
+	}
+
+	if obsCount[0xa] != 1 || obsCount[0xb] != 2 {
+		t.Fatalf("unexpected observation counts %v", obsCount)
+	}
+}
+
+func TestMergeMetadataConflicts(t *testing.T) {
+	st := make(pto3.AnalysisSetTable)
+	st[1] = &pto3.ObservationSet{ID: 1, Metadata: map[string]string{"agree": "yes", "vantage": "zurich"}}
+	st[2] = &pto3.ObservationSet{ID: 2, Metadata: map[string]string{"agree": "yes", "vantage": "london"}}
+	st[3] = &pto3.ObservationSet{ID: 3, Metadata: map[string]string{"agree": "yes", "vantage": "zurich"}}
+
+	mdout, conflicts := st.MergeMetadataWithConflicts()
+
+	if mdout["agree"] != "yes" {
+		t.Fatalf("missing nonconflicting key in merged metadata %v", mdout)
+	}
+
+	if _, ok := mdout["vantage"]; ok {
+		t.Fatalf("conflicting key present in merged metadata %v", mdout)
+	}
+
+	if len(conflicts) != 1 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+
+	vantages := conflicts["vantage"]
+	if len(vantages) != 3 || vantages[1] != "zurich" || vantages[2] != "london" || vantages[3] != "zurich" {
+		t.Fatalf("unexpected conflicting values for vantage %v", vantages)
+	}
+}
+
+// ipfixTestMessage builds an IPFIX message with the given sets, each a set ID
+// followed by its body.
+func ipfixTestMessage(exportTime uint32, sets ...[]byte) []byte {
+	var body []byte
+	for _, set := range sets {
+		hdr := make([]byte, 4)
+		copy(hdr, set[0:2])
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(len(set)+2))
+		body = append(append(body, hdr...), set[2:]...)
+	}
+
+	msg := make([]byte, 16)
+	binary.BigEndian.PutUint16(msg[0:2], 10)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(body)+16))
+	binary.BigEndian.PutUint32(msg[4:8], exportTime)
+	binary.BigEndian.PutUint32(msg[12:16], 1)
+	return append(msg, body...)
+}
+
+func testIPFIXNormFunc(rec *pto3.IPFIXRecord, mdin *pto3.RawMetadata, mdout map[string]interface{}) ([]pto3.Observation, error) {
+	src, _ := rec.IP(pto3.IESourceIPv4Address)
+	dst, _ := rec.IP(pto3.IEDestinationIPv4Address)
+	start, _ := rec.Milliseconds(pto3.IEFlowStartMilliseconds)
+	end, _ := rec.Milliseconds(pto3.IEFlowEndMilliseconds)
+
+	var note string
+	if err := rec.Extract(map[pto3.IPFIXInformationElement]pto3.IPFIXFieldFunc{
+		{Enterprise: 35566, ID: 1}: func(value []byte) error {
+			note = string(value)
+			return nil
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	return []pto3.Observation{{
+		TimeStart: &start,
+		TimeEnd:   &end,
+		Path:      pto3.NewPath(fmt.Sprintf("%s * %s", src, dst)),
+		Condition: pto3.NewCondition("pto.test.ipfix"),
+		Value:     note,
+	}}, nil
+}
+
+func TestIPFIXNormalization(t *testing.T) {
+	// template 256: sourceIPv4Address, destinationIPv4Address,
+	// flowStartMilliseconds, flowEndMilliseconds, and a variable-length
+	// enterprise-specific note
+	template := []byte{0x00, 0x02,
+		0x01, 0x00, 0x00, 0x05,
+		0x00, 0x08, 0x00, 0x04,
+		0x00, 0x0c, 0x00, 0x04,
+		0x00, 0x98, 0x00, 0x08,
+		0x00, 0x99, 0x00, 0x08,
+		0x80, 0x01, 0xff, 0xff, 0x00, 0x00, 0x8a, 0xee,
+	}
+
+	record := func(dst byte, startms uint64, note string) []byte {
+		b := []byte{10, 0, 0, 1, 10, 0, 0, dst}
+		b = append(b, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(b[8:16], startms)
+		binary.BigEndian.PutUint64(b[16:24], startms+1000)
+		return append(append(b, byte(len(note))), note...)
+	}
+
+	data := append([]byte{0x01, 0x00}, record(2, 1514764800000, "first")...)
+	data = append(data, record(3, 1514764860000, "")...)
+	data = append(data, 0, 0, 0) // padding
+
+	// data for an unknown template is skipped
+	unknown := []byte{0x01, 0x01, 1, 2, 3, 4}
+
+	var raw bytes.Buffer
+	raw.Write(ipfixTestMessage(1514764800, template))
+	raw.Write(ipfixTestMessage(1514764900, unknown, data))
+
+	in, err := ioutil.TempFile("", "pto3-test-ipfix-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	defer os.Remove(in.Name())
+	if _, err := in.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	norm := pto3.NewSerialScanningNormalizer("https://ptotest.mami-project.eu/ipfix.json")
+	norm.RegisterFiletype(pto3.IPFIXFiletype, pto3.SplitIPFIXMessages, pto3.NewIPFIXSerialNormFunc(testIPFIXNormFunc), nil)
+
+	var out bytes.Buffer
+	metain := bytes.NewBufferString(`{"_file_type": "ipfix", "_owner": "ptotest"}`)
+	if err := norm.Normalize(in, metain, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var obsen []pto3.Observation
+	s := bufio.NewScanner(&out)
+	for s.Scan() {
+		if line := s.Bytes(); len(line) > 0 && line[0] == '[' {
+			var o pto3.Observation
+			if err := json.Unmarshal(line, &o); err != nil {
+				t.Fatal(err)
+			}
+			obsen = append(obsen, o)
+		}
+	}
+
+	if len(obsen) != 2 {
+		t.Fatalf("expected 2 observations, got %d: %s", len(obsen), out.String())
+	}
+	if obsen[0].Path.String != "10.0.0.1 * 10.0.0.2" || obsen[0].Value != "first" ||
+		!obsen[0].TimeStart.Equal(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)) ||
+		!obsen[0].TimeEnd.Equal(time.Date(2018, 1, 1, 0, 0, 1, 0, time.UTC)) {
+		t.Fatalf("bad first observation %v %v %v %s", obsen[0].TimeStart, obsen[0].TimeEnd, obsen[0].Path.String, obsen[0].Value)
+	}
+	if obsen[1].Path.String != "10.0.0.1 * 10.0.0.3" || obsen[1].Value != "" {
+		t.Fatalf("bad second observation %s %s", obsen[1].Path.String, obsen[1].Value)
+	}
+
+	// a truncated file fails
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Truncate(int64(raw.Len() - 1)); err != nil {
+		t.Fatal(err)
+	}
+	norm = pto3.NewSerialScanningNormalizer("https://ptotest.mami-project.eu/ipfix.json")
+	norm.RegisterFiletype(pto3.IPFIXFiletype, pto3.SplitIPFIXMessages, pto3.NewIPFIXSerialNormFunc(testIPFIXNormFunc), nil)
+	metain = bytes.NewBufferString(`{"_file_type": "ipfix", "_owner": "ptotest"}`)
+	if err := norm.Normalize(in, metain, ioutil.Discard); err == nil {
+		t.Fatal("normalization of truncated IPFIX file succeeded")
+	}
+}
+
+// normalizeToObservations runs a serial normalizer over raw data, returning
+// the observations written by path.
+func normalizeToObservations(t *testing.T, norm *pto3.SerialScanningNormalizer, raw []byte, filetype string) map[string]pto3.Observation {
+	in, err := ioutil.TempFile("", "pto3-test-norm-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	defer os.Remove(in.Name())
+	if _, err := in.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	metain := bytes.NewBufferString(fmt.Sprintf(`{"_file_type": "%s", "_owner": "ptotest"}`, filetype))
+	if err := norm.Normalize(in, metain, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	obsen := make(map[string]pto3.Observation)
+	s := bufio.NewScanner(&out)
+	for s.Scan() {
+		if line := s.Bytes(); len(line) > 0 && line[0] == '[' {
+			var o pto3.Observation
+			if err := json.Unmarshal(line, &o); err != nil {
+				t.Fatal(err)
+			}
+			obsen[o.Path.String] = o
+		}
+	}
+	return obsen
+}
+
+func TestTracerouteNormalization(t *testing.T) {
+	atlas := `{"type": "traceroute", "from": "192.0.2.1", "src_addr": "10.0.0.2", "dst_addr": "198.51.100.1", "timestamp": 1514764800, "endtime": 1514764803, "result": [` +
+		`{"hop": 1, "result": [{"from": "192.0.2.254", "rtt": 1.1}, {"from": "192.0.2.254", "rtt": 1.0}]}, ` +
+		`{"hop": 2, "result": [{"x": "*"}, {"x": "*"}]}, ` +
+		`{"hop": 3, "result": [{"x": "*"}, {"from": "203.0.113.1", "rtt": 9.5}]}, ` +
+		`{"hop": 4, "result": [{"from": "198.51.100.1", "rtt": 10.2}]}]}
+{"type": "traceroute", "src_addr": "10.0.0.3", "dst_addr": "198.51.100.2", "timestamp": 1514764900, "endtime": 1514764905, "result": [` +
+		`{"hop": 1, "result": [{"from": "10.0.0.1", "rtt": 0.5}]}, ` +
+		`{"hop": 2, "result": [{"x": "*"}]}]}
+`
+
+	norm := pto3.NewSerialScanningNormalizer("https://ptotest.mami-project.eu/trace.json")
+	pto3.RegisterTracerouteFiletypes(norm, nil)
+	obsen := normalizeToObservations(t, norm, []byte(atlas), pto3.AtlasTracerouteFiletype)
+
+	if len(obsen) != 2 {
+		t.Fatalf("expected 2 observations, got %d", len(obsen))
+	}
+	if o, ok := obsen["192.0.2.1 192.0.2.254 * 203.0.113.1 198.51.100.1"]; !ok {
+		t.Fatalf("missing reached path in %v", obsen)
+	} else if o.Condition.Name != pto3.TracerouteReachedCondition ||
+		!o.TimeStart.Equal(time.Unix(1514764800, 0)) || !o.TimeEnd.Equal(time.Unix(1514764803, 0)) {
+		t.Fatalf("bad reached observation %s %v %v", o.Condition.Name, o.TimeStart, o.TimeEnd)
+	}
+	if o, ok := obsen["10.0.0.3 10.0.0.1 * 198.51.100.2"]; !ok {
+		t.Fatalf("missing unreached path in %v", obsen)
+	} else if o.Condition.Name != pto3.TracerouteUnreachedCondition {
+		t.Fatalf("bad unreached condition %s", o.Condition.Name)
+	}
+
+	// warts records are passed to the decoder by type; here, a trace record
+	// body is simply a destination address
+	wartsRecord := func(rectype uint16, body []byte) []byte {
+		hdr := make([]byte, 8)
+		binary.BigEndian.PutUint16(hdr[0:2], 0x1205)
+		binary.BigEndian.PutUint16(hdr[2:4], rectype)
+		binary.BigEndian.PutUint32(hdr[4:8], uint32(len(body)))
+		return append(hdr, body...)
+	}
+
+	var warts bytes.Buffer
+	warts.Write(wartsRecord(0x0001, []byte("list")))
+	warts.Write(wartsRecord(pto3.WartsTraceRecType, []byte{198, 51, 100, 3}))
+
+	norm = pto3.NewSerialScanningNormalizer("https://ptotest.mami-project.eu/trace.json")
+	pto3.RegisterTracerouteFiletypes(norm, func(rectype uint16, body []byte) (*pto3.Traceroute, error) {
+		if rectype != pto3.WartsTraceRecType {
+			return nil, nil
+		}
+		dst := net.IP(body)
+		return &pto3.Traceroute{
+			Source:      net.ParseIP("192.0.2.1"),
+			Destination: dst,
+			Start:       time.Unix(1514764800, 0),
+			End:         time.Unix(1514764801, 0),
+			Hops:        []pto3.TracerouteHop{{TTL: 1}, {TTL: 2, Address: dst}},
+		}, nil
+	})
+	obsen = normalizeToObservations(t, norm, warts.Bytes(), pto3.WartsFiletype)
+
+	if o, ok := obsen["192.0.2.1 * 198.51.100.3"]; len(obsen) != 1 || !ok {
+		t.Fatalf("bad warts observations %v", obsen)
+	} else if o.Condition.Name != pto3.TracerouteReachedCondition {
+		t.Fatalf("bad warts condition %s", o.Condition.Name)
+	}
+}
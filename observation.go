@@ -2,16 +2,20 @@ package pto3
 
 import (
 	"bufio"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
@@ -30,8 +34,14 @@ type ObservationSet struct {
 	Analyzer string
 	// Conditions declared to appear in this observation set,
 	Conditions []Condition `pg:",many2many:observation_set_conditions"`
-	// Arbitrary metadata
+	// Arbitrary metadata, stored as a JSONB object
 	Metadata map[string]string
+	// Curation tags, from _tags metadata key
+	Tags []string `pg:",array"`
+	// Lifecycle state, from _state metadata key; empty means active
+	State string
+	// Link to the set superseding this one, from _superseded_by metadata key
+	SupersededBy string
 	// Metadata creation timestamp
 	Created *time.Time
 	// Metadata modification timestamp
@@ -45,6 +55,10 @@ type ObservationSet struct {
 	// system metadata
 	datalink string
 	link     string
+	// creation and modification timestamps from incoming __created and
+	// __modified metadata, used only when restoring a set
+	restoreCreated  *time.Time
+	restoreModified *time.Time
 }
 
 // ObservationSetCondition implements a linking table between observation sets
@@ -99,6 +113,16 @@ func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 		jmap["_conditions"] = conditionNames
 	}
 
+	if len(set.Tags) > 0 {
+		jmap["_tags"] = set.Tags
+	}
+
+	jmap["_state"] = set.LifecycleState()
+
+	if set.SupersededBy != "" {
+		jmap["_superseded_by"] = set.SupersededBy
+	}
+
 	for k, v := range set.Metadata {
 		jmap[k] = v
 	}
@@ -140,10 +164,34 @@ func (set *ObservationSet) UnmarshalJSON(b []byte) error {
 			for i := range conditionNames {
 				set.Conditions[i] = *NewCondition(conditionNames[i])
 			}
+		} else if k == "_tags" {
+			tags, ok := AsStringArray(v)
+			if !ok {
+				return PTOErrorf("_tags not a string array")
+			}
+			for _, tag := range tags {
+				if err := ValidateTag(tag); err != nil {
+					return err
+				}
+			}
+			set.Tags = sortedUniqueStrings(tags)
+		} else if k == "_state" {
+			set.State = AsString(v)
+		} else if k == "_superseded_by" {
+			set.SupersededBy = AsString(v)
 		} else if k == "__link" {
 			set.link = AsString(v)
 		} else if k == "__data_link" {
 			set.datalink = AsString(v)
+		} else if k == "__created" || k == "__modified" {
+			// keep timestamps aside for restoring from a bundle
+			if t, err := AsTime(v); err == nil {
+				if k == "__created" {
+					set.restoreCreated = &t
+				} else {
+					set.restoreModified = &t
+				}
+			}
 		} else if strings.HasPrefix(k, "__") {
 			// Ignore all other incoming __ keys instead of stuffing them in metadata
 		} else {
@@ -165,6 +213,47 @@ func (set *ObservationSet) UnmarshalJSON(b []byte) error {
 		return PTOErrorf("ObservationSet missing _conditions")
 	}
 
+	return set.checkLifecycleState()
+}
+
+// Observation set lifecycle states. Deprecated and superseded sets are
+// excluded from queries by default; a superseded set links to the set
+// replacing it.
+const (
+	ObsSetStateActive     = "active"
+	ObsSetStateDeprecated = "deprecated"
+	ObsSetStateSuperseded = "superseded"
+)
+
+// LifecycleState returns this ObservationSet's lifecycle state.
+func (set *ObservationSet) LifecycleState() string {
+	if set.State == "" {
+		return ObsSetStateActive
+	}
+	return set.State
+}
+
+// checkLifecycleState validates this ObservationSet's lifecycle state, and
+// normalizes it: a set with a _superseded_by link but no state is superseded.
+func (set *ObservationSet) checkLifecycleState() error {
+	if set.State == "" && set.SupersededBy != "" {
+		set.State = ObsSetStateSuperseded
+	}
+
+	switch set.LifecycleState() {
+	case ObsSetStateActive, ObsSetStateDeprecated:
+		if set.SupersededBy != "" {
+			return PTOErrorf("_superseded_by given for %s observation set", set.LifecycleState())
+		}
+	case ObsSetStateSuperseded:
+		if set.SupersededBy == "" {
+			return PTOErrorf("superseded observation set missing _superseded_by")
+		}
+	default:
+		return PTOErrorf("unknown observation set _state %s", set.State)
+	}
+
+	set.State = set.LifecycleState()
 	return nil
 }
 
@@ -191,27 +280,36 @@ func (set *ObservationSet) Insert(db orm.DB, force bool) error {
 		set.Created = &ctime
 		set.Modified = &ctime
 
-		// ensure conditions have IDs
-		if err := set.ensureConditionsInDB(db); err != nil {
-			log.Printf("error ensuring condition is in DB: %v", err)
-			return err
-		}
+		return set.insert(db)
+	}
+	return nil
+}
 
-		// main insertion
-		if err := db.Insert(set); err != nil {
-			log.Printf("error inserting set: %v", err)
-			return PTOWrapError(err)
-		}
+// insert inserts a row for this ObservationSet and its conditions into the
+// database as is: under its ID and with its timestamps if set, otherwise
+// under a newly assigned ID.
+func (set *ObservationSet) insert(db orm.DB) error {
+	// ensure conditions have IDs
+	if err := set.ensureConditionsInDB(db); err != nil {
+		log.Printf("error ensuring condition is in DB: %v", err)
+		return err
+	}
 
-		// TODO file a bug against go-pg or its docs: this should be automatic.
-		for i := range set.Conditions {
-			_, err := db.Exec("INSERT INTO observation_set_conditions VALUES (?, ?)", set.ID, set.Conditions[i].ID)
-			if err != nil {
-				log.Printf("error on INSERT INTO observation_set_conditions: %v", err)
-				return PTOWrapError(err)
-			}
+	// main insertion
+	if err := db.Insert(set); err != nil {
+		log.Printf("error inserting set: %v", err)
+		return PTOWrapError(err)
+	}
+
+	// TODO file a bug against go-pg or its docs: this should be automatic.
+	for i := range set.Conditions {
+		_, err := db.Exec("INSERT INTO observation_set_conditions VALUES (?, ?)", set.ID, set.Conditions[i].ID)
+		if err != nil {
+			log.Printf("error on INSERT INTO observation_set_conditions: %v", err)
+			return PTOWrapError(err)
 		}
 	}
+
 	return nil
 }
 
@@ -224,6 +322,12 @@ func (set *ObservationSet) SelectByID(db orm.DB) error {
 		return err
 	}
 
+	return set.selectConditions(db)
+}
+
+// selectConditions selects this ObservationSet's condition list from the
+// database by its ID.
+func (set *ObservationSet) selectConditions(db orm.DB) error {
 	var conditionIDs []int
 	err := db.Model(&ObservationSetCondition{}).
 		ColumnExpr("array_agg(condition_id)").
@@ -281,10 +385,70 @@ func (set *ObservationSet) Update(db orm.DB) error {
 	return nil
 }
 
+// ValidateTag checks that a string can be used as an observation set tag:
+// tags must be non-empty and may not contain whitespace or commas.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return PTOErrorf("empty observation set tag").StatusIs(http.StatusBadRequest)
+	}
+	if strings.IndexFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == ',' }) >= 0 {
+		return PTOErrorf("observation set tag %q may not contain whitespace or commas", tag).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// HasTag returns true if this ObservationSet carries the given tag.
+func (set *ObservationSet) HasTag(tag string) bool {
+	for _, t := range set.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTags adds tags to this ObservationSet in the database, by ID, and
+// updates its modification timestamp. Tags already present are ignored.
+// Returns pg.ErrNoRows if the set does not exist.
+func (set *ObservationSet) AddTags(db orm.DB, tags []string) error {
+	return set.updateTags(db, "ARRAY(SELECT DISTINCT unnest(COALESCE(tags, '{}') || ?::text[]) ORDER BY 1)", tags)
+}
+
+// RemoveTags removes tags from this ObservationSet in the database, by ID,
+// and updates its modification timestamp. Tags not present are ignored.
+// Returns pg.ErrNoRows if the set does not exist.
+func (set *ObservationSet) RemoveTags(db orm.DB, tags []string) error {
+	return set.updateTags(db, "ARRAY(SELECT unnest(COALESCE(tags, '{}')) EXCEPT SELECT unnest(?::text[]) ORDER BY 1)", tags)
+}
+
+func (set *ObservationSet) updateTags(db orm.DB, expr string, tags []string) error {
+	for _, tag := range tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+
+	mtime := time.Now().UTC()
+	res, err := db.Model(set).
+		Set("tags = "+expr, pg.Array(tags)).
+		Set("modified = ?", mtime).
+		Where("id = ?", set.ID).
+		Returning("tags").
+		Update()
+	if err != nil {
+		return PTOWrapError(err)
+	} else if res.RowsAffected() == 0 {
+		return pg.ErrNoRows
+	}
+
+	set.Modified = &mtime
+	return nil
+}
+
 // LinkForSetID generates a link from given PTO configuration and a set ID. Observation set
 // links are given by set ID as a hexadecimal string.
 func LinkForSetID(config *PTOConfiguration, setid int) string {
-	out, _ := config.LinkTo(fmt.Sprintf("obs/%x", setid))
+	out, _ := config.LinkTo("obs/" + SetID(setid).String())
 	return out
 }
 
@@ -353,6 +517,160 @@ func (set *ObservationSet) CountObservations(db orm.DB) (int, error) {
 	return set.Count, nil
 }
 
+// Recount recomputes this ObservationSet's cached observation count and time
+// interval from the observations in the database, and stores them. This
+// repairs cached values which have become inconsistent with the observations
+// in the set.
+func (set *ObservationSet) Recount(db orm.DB) error {
+	var err error
+	set.Count, err = db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	set.TimeStart = nil
+	set.TimeEnd = nil
+	if set.Count > 0 {
+		err = db.Model(&Observation{}).ColumnExpr("min(time_start)").Where("set_id = ?", set.ID).Select(&set.TimeStart)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+
+		err = db.Model(&Observation{}).ColumnExpr("max(time_end)").Where("set_id = ?", set.ID).Select(&set.TimeEnd)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	if err := db.Update(set); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// ReconcileConditions links this ObservationSet to every condition appearing
+// in its observations, repairing condition lists from which conditions still
+// present in the data were removed by a metadata update. If prune is true,
+// conditions appearing in none of its observations are unlinked as well. It
+// returns the numbers of conditions linked and unlinked, and reloads the
+// set's condition list if either is nonzero.
+func (set *ObservationSet) ReconcileConditions(db orm.DB, prune bool) (int, int, error) {
+	res, err := db.Exec("INSERT INTO observation_set_conditions (observation_set_id, condition_id) "+
+		"SELECT DISTINCT ?0, condition_id FROM observations WHERE set_id = ?0 AND condition_id NOT IN "+
+		"(SELECT condition_id FROM observation_set_conditions WHERE observation_set_id = ?0)", set.ID)
+	if err != nil {
+		return 0, 0, PTOWrapError(err)
+	}
+	linked := res.RowsAffected()
+
+	unlinked := 0
+	if prune {
+		res, err := db.Exec("DELETE FROM observation_set_conditions WHERE observation_set_id = ?0 AND condition_id NOT IN "+
+			"(SELECT DISTINCT condition_id FROM observations WHERE set_id = ?0)", set.ID)
+		if err != nil {
+			return 0, 0, PTOWrapError(err)
+		}
+		unlinked = res.RowsAffected()
+	}
+
+	if linked > 0 || unlinked > 0 {
+		if err := set.selectConditions(db); err != nil {
+			return 0, 0, PTOWrapError(err)
+		}
+	}
+
+	return linked, unlinked, nil
+}
+
+// ObservationTimeBin is a bin in an observation set time histogram
+type ObservationTimeBin struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+// ObservationSetStats summarizes the observations in an observation set
+type ObservationSetStats struct {
+	// Observation count by condition name
+	Conditions map[string]int `json:"conditions"`
+	// Number of distinct path sources
+	Sources int `json:"distinct_sources"`
+	// Number of distinct path targets
+	Targets int `json:"distinct_targets"`
+	// Histogram bin size
+	Granularity string `json:"granularity"`
+	// Observation counts by start time, truncated to the bin size
+	Histogram []ObservationTimeBin `json:"histogram"`
+}
+
+// Stats computes summary statistics for this ObservationSet in the database,
+// with a time histogram rolled up to the given granularity (one of hour, day,
+// week, month, or year).
+func (set *ObservationSet) Stats(db orm.DB, granularity string) (*ObservationSetStats, error) {
+	switch granularity {
+	case "hour", "day", "week", "month", "year":
+	default:
+		return nil, PTOErrorf("unsupported histogram granularity %s", granularity).StatusIs(http.StatusBadRequest)
+	}
+
+	stats := ObservationSetStats{
+		Conditions:  make(map[string]int),
+		Granularity: granularity,
+	}
+
+	// count by condition
+	var conditionCounts []struct {
+		tableName struct{} `sql:"observations,alias:observation"`
+		Name      string
+		Count     int
+	}
+
+	err := db.Model(&conditionCounts).
+		ColumnExpr("condition.name AS name, count(*) AS count").
+		Join("JOIN conditions AS condition ON condition.id = observation.condition_id").
+		Where("observation.set_id = ?", set.ID).
+		Group("condition.name").Select()
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	for _, cc := range conditionCounts {
+		stats.Conditions[cc.Name] = cc.Count
+	}
+
+	// count distinct sources and targets
+	err = db.Model(&Observation{}).
+		ColumnExpr("count(distinct path.source), count(distinct path.target)").
+		Join("JOIN paths AS path ON path.id = observation.path_id").
+		Where("observation.set_id = ?", set.ID).
+		Select(&stats.Sources, &stats.Targets)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	// and build the histogram
+	var bins []struct {
+		tableName struct{} `sql:"observations,alias:observation"`
+		Bin       time.Time
+		Count     int
+	}
+
+	err = db.Model(&bins).
+		ColumnExpr("date_trunc(?, observation.time_start) AS bin, count(*) AS count", granularity).
+		Where("observation.set_id = ?", set.ID).
+		Group("bin").Order("bin").Select()
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	stats.Histogram = make([]ObservationTimeBin, len(bins))
+	for i := range bins {
+		stats.Histogram[i] = ObservationTimeBin{Time: bins[i].Bin.UTC(), Count: bins[i].Count}
+	}
+
+	return &stats, nil
+}
+
 func (set *ObservationSet) verifyConditionSet(conditionNames map[string]struct{}) error {
 	// make a set condition names declared in the condition set
 	conditionDeclared := make(map[string]struct{})
@@ -382,34 +700,48 @@ type Observation struct {
 	ConditionID int
 	Condition   *Condition
 	Value       string
+	// Per-observation metadata, as a JSON object in the metadata field of a
+	// version 2 observation, or the seventh element of a version 1
+	// observation
+	Metadata map[string]interface{}
 }
 
 // MarshalJSON turns this Observation into a JSON array suitable for use as a
-// line in an observation file.
+// line in a version 1 observation file. Per-observation metadata, if present,
+// is the seventh element, following the (possibly empty) value.
 func (obs *Observation) MarshalJSON() ([]byte, error) {
-	jslice := []string{
-		fmt.Sprintf("%x", obs.SetID),
+	jslice := []interface{}{
+		SetID(obs.SetID).String(),
 		obs.TimeStart.UTC().Format(time.RFC3339),
 		obs.TimeEnd.UTC().Format(time.RFC3339),
 		obs.Path.String,
 		obs.Condition.Name,
 	}
 
-	if obs.Value != "" {
-		jslice = append(jslice, fmt.Sprintf("%s", obs.Value))
+	if obs.Value != "" || len(obs.Metadata) > 0 {
+		jslice = append(jslice, obs.Value)
+	}
+
+	if len(obs.Metadata) > 0 {
+		jslice = append(jslice, obs.Metadata)
 	}
 
 	return json.Marshal(&jslice)
 }
 
-// unmarshalStringSlice fills in this observation from a string slice. This is used by both JSON unmarshaling and CSV unmarshaling (in CopyDataToStream)
+// unmarshalStringSlice fills in this observation from a string slice. This is
+// used by both JSON unmarshaling and CSV unmarshaling (in CopyDataToStream);
+// in the latter case, the slice contains per-observation metadata as JSON in a
+// seventh element.
 func (obs *Observation) unmarshalStringSlice(jslice []string, time_format string) error {
 
 	obs.ID = 0
+	obs.Value = ""
+	obs.Metadata = nil
 	if len(jslice[0]) > 0 {
-		setid, err := strconv.ParseUint(jslice[0], 16, 64) // fill in Set ID, will be ignored by force insert
+		setid, err := ParseSetID(jslice[0]) // fill in Set ID, will be ignored by force insert
 		if err != nil {
-			return PTOWrapError(err)
+			return err
 		}
 		obs.SetID = int(setid)
 	} else {
@@ -435,30 +767,33 @@ func (obs *Observation) unmarshalStringSlice(jslice []string, time_format string
 
 	if len(jslice) >= 6 {
 		obs.Value = jslice[5]
-		if err != nil {
-			return err
+	}
+
+	if len(jslice) >= 7 && jslice[6] != "" {
+		if err := json.Unmarshal([]byte(jslice[6]), &obs.Metadata); err != nil {
+			return PTOWrapError(err)
 		}
 	}
 
 	return nil
 }
 
-// UnmarshalJSON fills in this Observation from a JSON array line in an
-// observation file.
+// UnmarshalJSON fills in this Observation from a line in an observation file,
+// in either format.
 func (obs *Observation) UnmarshalJSON(b []byte) error {
-	var jslice []string
-
-	err := json.Unmarshal(b, &jslice)
+	jslice, md, isObs, err := decodeObsLine(b)
 	if err != nil {
 		return err
+	} else if !isObs {
+		return PTOErrorf("line is not an observation")
 	}
 
-	if len(jslice) < 5 {
-		return PTOErrorf("Observation requires at least five elements")
+	if err := obs.unmarshalStringSlice(jslice, time.RFC3339); err != nil {
+		return err
 	}
+	obs.Metadata = md
 
-	return obs.unmarshalStringSlice(jslice, time.RFC3339)
-
+	return nil
 }
 
 // CreateTables insures that the tables used by the ORM exist in the given
@@ -484,10 +819,21 @@ func CreateTables(db *pg.DB) error {
 			return PTOWrapError(err)
 		}
 
+		// add description column to conditions tables created before
+		// condition descriptions
+		if _, err := db.Exec("ALTER TABLE conditions ADD COLUMN IF NOT EXISTS description text"); err != nil {
+			return PTOWrapError(err)
+		}
+
 		if err := db.CreateTable(&Path{}, &opts); err != nil {
 			return PTOWrapError(err)
 		}
 
+		// add country columns to paths tables created before GeoIP support
+		if _, err := db.Exec("ALTER TABLE paths ADD COLUMN IF NOT EXISTS source_country text, ADD COLUMN IF NOT EXISTS target_country text"); err != nil {
+			return PTOWrapError(err)
+		}
+
 		if err := db.CreateTable(&ObservationSet{}, &opts); err != nil {
 			return PTOWrapError(err)
 		}
@@ -500,11 +846,63 @@ func CreateTables(db *pg.DB) error {
 			return PTOWrapError(err)
 		}
 
+		// add tags column to observation set tables created before tagging
+		if _, err := db.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS tags text[]"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// add lifecycle columns to observation set tables created before
+		// deprecation
+		if _, err := db.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS state text, ADD COLUMN IF NOT EXISTS superseded_by text"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// add metadata column to observations tables created before version 2
+		// observation files
+		if _, err := db.Exec("ALTER TABLE observations ADD COLUMN IF NOT EXISTS metadata jsonb"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.CreateTable(&QueryRecord{}, &opts); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := createReplicationTables(db); err != nil {
+			return err
+		}
+
+		if err := createConditionAliasTables(db); err != nil {
+			return err
+		}
+
+		if err := createNamedQueryTables(db); err != nil {
+			return err
+		}
+
+		if err := createQueryTemplateTables(db); err != nil {
+			return err
+		}
+
+		if err := createUsageTables(db); err != nil {
+			return err
+		}
+
 		// index to select observations by set ID
 		if _, err := db.Exec("CREATE INDEX ON observations (set_id)"); err != nil {
 			return PTOWrapError(err)
 		}
 
+		// index to search observation sets by metadata
+		if _, err := db.Exec("CREATE INDEX IF NOT EXISTS observation_sets_metadata_idx ON observation_sets USING GIN (metadata)"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// index to find observation sets derived from a source, e.g. a raw
+		// data file
+		if _, err := db.Exec("CREATE INDEX IF NOT EXISTS observation_sets_sources_idx ON observation_sets USING GIN (sources)"); err != nil {
+			return PTOWrapError(err)
+		}
+
 		return nil
 	})
 }
@@ -513,6 +911,35 @@ func CreateTables(db *pg.DB) error {
 // testing only, please.
 func DropTables(db *pg.DB) error {
 	return db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := db.DropTable(&QueryTemplate{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// named queries refer to query records; drop their history first
+		if err := db.DropTable(&NamedQueryExecution{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&NamedQuery{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&QueryRecord{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ReplicationTask{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&UsageBucket{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ConditionAlias{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
 		if err := db.DropTable(&Observation{}, nil); err != nil {
 			return PTOWrapError(err)
 		}
@@ -537,9 +964,24 @@ func DropTables(db *pg.DB) error {
 	})
 }
 
-type LoggingQueryHook struct{}
+// dbStatementMetrics counts statements seen by logging query hooks: fast and
+// slow give the number of statements under and over the slow query threshold,
+// and fast_ms the total time spent in fast statements.
+var dbStatementMetrics = expvar.NewMap("pto_db_statements")
+
+// LoggingQueryHook logs database statements. If Threshold is zero, every
+// statement is logged as it is issued; otherwise, only statements taking at
+// least Threshold are logged on completion, together with their duration, and
+// faster statements are counted in the pto_db_statements metrics.
+type LoggingQueryHook struct {
+	Threshold time.Duration
+}
 
 func (lqh *LoggingQueryHook) BeforeQuery(qe *pg.QueryEvent) {
+	if lqh.Threshold > 0 {
+		return
+	}
+
 	query, err := qe.FormattedQuery()
 	if err != nil {
 		panic(err)
@@ -547,29 +989,47 @@ func (lqh *LoggingQueryHook) BeforeQuery(qe *pg.QueryEvent) {
 	log.Printf("%s", query)
 }
 
-func (lqh *LoggingQueryHook) AfterQuery(qe *pg.QueryEvent) {}
+func (lqh *LoggingQueryHook) AfterQuery(qe *pg.QueryEvent) {
+	if lqh.Threshold == 0 {
+		return
+	}
+
+	elapsed := time.Since(qe.StartTime)
+	if elapsed < lqh.Threshold {
+		dbStatementMetrics.Add("fast", 1)
+		dbStatementMetrics.Add("fast_ms", int64(elapsed/time.Millisecond))
+		return
+	}
+
+	dbStatementMetrics.Add("slow", 1)
+	query, err := qe.FormattedQuery()
+	if err != nil {
+		log.Printf("slow statement (%v), cannot format: %v", elapsed, err)
+		return
+	}
+	log.Printf("slow statement (%v): %s", elapsed, query)
+}
 
+// EnableQueryLogging logs every statement executed on a database.
 func EnableQueryLogging(db *pg.DB) {
-	lqh := LoggingQueryHook{}
+	EnableSlowQueryLogging(db, 0)
+}
+
+// EnableSlowQueryLogging logs statements executed on a database taking at
+// least the given threshold, or every statement if the threshold is zero.
+func EnableSlowQueryLogging(db *pg.DB, threshold time.Duration) {
+	lqh := LoggingQueryHook{Threshold: threshold}
 	db.AddQueryHook(&lqh)
 }
 
+// WriteObservations writes a slice of observations to a stream in
+// observation file format.
 func WriteObservations(obsdat []Observation, out io.Writer) error {
-	for _, obs := range obsdat {
-		b, err := json.Marshal(&obs)
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		_, err = out.Write(b)
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		_, err = out.Write([]byte("\n"))
-		if err != nil {
-			return PTOWrapError(err)
-		}
+	ow := NewObservationWriter(out)
+	if err := ow.WriteObservations(obsdat); err != nil {
+		return err
 	}
-	return nil
+	return ow.Flush()
 }
 
 // obsFileFirstPass scans a file, getting metadata (in the form of an observation set), a set of paths, and a set of conditions
@@ -589,21 +1049,20 @@ func obsFileFirstPass(r *os.File) (*ObservationSet, map[string]struct{}, map[str
 	for in.Scan() {
 		lineno++
 		line := strings.TrimSpace(in.Text())
-		switch line[0] {
-		case '{':
-			if err := set.UnmarshalJSON([]byte(line)); err != nil {
-				return nil, nil, nil, PTOErrorf("error in metadata at %s line %d: %s", filename, lineno, err.Error())
-			}
-		case '[':
-			var obs []string
-			if err := json.Unmarshal([]byte(line), &obs); err != nil {
+		if line == "" {
+			continue
+		}
+		obs, _, isObs, err := decodeObsLine([]byte(line))
+		if isObs {
+			if err != nil {
 				return nil, nil, nil, PTOErrorf("error looking for path at %s line %d: %s", filename, lineno, err.Error())
 			}
-			if len(obs) < 4 {
-				return nil, nil, nil, PTOErrorf("short observation looking for path at %s line %d", filename, lineno)
-			}
 			pathSeen[obs[3]] = struct{}{}
 			conditionSeen[obs[4]] = struct{}{}
+		} else if line[0] == '{' {
+			if err := set.UnmarshalJSON([]byte(line)); err != nil {
+				return nil, nil, nil, PTOErrorf("error in metadata at %s line %d: %s", filename, lineno, err.Error())
+			}
 		}
 	}
 
@@ -611,22 +1070,83 @@ func obsFileFirstPass(r *os.File) (*ObservationSet, map[string]struct{}, map[str
 	return &set, pathSeen, conditionSeen, nil
 }
 
-// writeObsToCSV writes an unparsed observation to a CSV writer, for COPY FROM
-// loading of observations into a PostgreSQL table.
-func writeObsToCSV(
-	set *ObservationSet,
-	cidCache ConditionCache,
-	pidCache PathCache,
-	line string,
-	out *csv.Writer) error {
+// obsLoadStats accumulates the count and time interval of observations
+// loaded into an observation set, so these can be maintained incrementally.
+type obsLoadStats struct {
+	count     int
+	timeStart *time.Time
+	timeEnd   *time.Time
+}
 
-	var jslice []string
+// addTimes adds an observation's start and end times to these statistics.
+func (ls *obsLoadStats) addTimes(start string, end string) error {
+	starttime, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return err
+	}
 
-	if err := json.Unmarshal([]byte(line), &jslice); err != nil {
+	endtime, err := time.Parse(time.RFC3339, end)
+	if err != nil {
 		return err
 	}
 
-	// add zero value if missing
+	ls.count++
+	if ls.timeStart == nil || starttime.Before(*ls.timeStart) {
+		ls.timeStart = &starttime
+	}
+	if ls.timeEnd == nil || endtime.After(*ls.timeEnd) {
+		ls.timeEnd = &endtime
+	}
+
+	return nil
+}
+
+// addStats adds the count and time interval of loaded observations to the
+// cached count and time interval of this set, and stores them in the
+// database.
+func (set *ObservationSet) addStats(db orm.DB, ls *obsLoadStats) error {
+	if ls.count == 0 {
+		return nil
+	}
+
+	set.Count += ls.count
+	if set.TimeStart == nil || ls.timeStart.Before(*set.TimeStart) {
+		set.TimeStart = ls.timeStart
+	}
+	if set.TimeEnd == nil || ls.timeEnd.After(*set.TimeEnd) {
+		set.TimeEnd = ls.timeEnd
+	}
+
+	if err := db.Update(set); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// writeObsToCSV writes an unparsed observation to a CSV writer, for COPY FROM
+// loading of observations into a PostgreSQL table. Lines which are not
+// observations are skipped.
+func writeObsToCSV(
+	set *ObservationSet,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	stats *obsLoadStats,
+	line string,
+	out *csv.Writer) error {
+
+	jslice, md, isObs, err := decodeObsLine([]byte(line))
+	if err != nil {
+		return err
+	} else if !isObs {
+		return nil
+	}
+
+	if err := stats.addTimes(jslice[1], jslice[2]); err != nil {
+		return err
+	}
+
+	// add zero value if missing
 	if len(jslice) == 5 {
 		jslice = append(jslice, "0")
 	}
@@ -640,18 +1160,33 @@ func writeObsToCSV(
 	// replace condition name with condition ID
 	jslice[4] = fmt.Sprintf("%d", cidCache[jslice[4]])
 
+	// add metadata, if any; an empty field is loaded as NULL
+	mdfield := ""
+	if len(md) > 0 {
+		b, err := json.Marshal(md)
+		if err != nil {
+			return err
+		}
+		mdfield = string(b)
+	}
+	jslice = append(jslice, mdfield)
+
 	// write as CSV to output writer
 	return out.Write(jslice)
 }
 
+// loadObservations loads observations from a file into an observation set,
+// updating the set's condition list, cached count, and time interval within
+// the same transaction.
 func loadObservations(
 	cidCache ConditionCache,
 	pidCache PathCache,
 	t *pg.Tx,
 	set *ObservationSet,
-	r *os.File) error {
+	r io.Reader) error {
 
 	lineno := 0
+	var stats obsLoadStats
 
 	dbpipe, obspipe, err := os.Pipe()
 	if err != nil {
@@ -671,9 +1206,10 @@ func loadObservations(
 		for in.Scan() {
 			lineno++
 			line := strings.TrimSpace(in.Text())
-			if line[0] == '[' {
-				if err := writeObsToCSV(set, cidCache, pidCache, line, out); err != nil {
+			if line != "" {
+				if err := writeObsToCSV(set, cidCache, pidCache, &stats, line, out); err != nil {
 					converr <- PTOWrapError(err)
+					return
 				}
 			}
 		}
@@ -682,23 +1218,87 @@ func loadObservations(
 	}()
 
 	// now copy from the CSV pipe
-	if _, err := t.CopyFrom(dbpipe, "COPY observations (set_id, time_start, time_end, path_id, condition_id, value) FROM STDIN WITH CSV"); err != nil {
+	if _, err := t.CopyFrom(dbpipe, "COPY observations (set_id, time_start, time_end, path_id, condition_id, value, metadata) FROM STDIN WITH CSV"); err != nil {
 		return PTOWrapError(err)
 	}
 
 	// wait on the converter goroutine
-	return <-converr
+	if err := <-converr; err != nil {
+		return err
+	}
+
+	// link any conditions in the set's data missing from its condition list
+	if _, _, err := set.ReconcileConditions(t, false); err != nil {
+		return err
+	}
+
+	// and update count and time interval
+	return set.addStats(t, &stats)
 }
 
 // CopySetFromObsFile loads an observation file from a local path into the
 // database. It uses given caches to cache condition and path IDs, and creates the
-// ObservationSet from the metadata found in the file. This is used by ptoload
-// to load observation sets created by local analysis into the database.
+// ObservationSet from the metadata found in the file. Most callers should use
+// a Loader, which manages the caches, instead.
 func CopySetFromObsFile(
 	filename string,
 	db *pg.DB,
 	cidCache ConditionCache,
 	pidCache PathCache) (*ObservationSet, error) {
+	return copySetFromObsFile(context.Background(), filename, db, nil, nil, cidCache, pidCache)
+}
+
+// CopySetFromObsFileContext works like CopySetFromObsFile, but stops loading
+// and rolls back the transaction when the given context is done.
+func CopySetFromObsFileContext(
+	ctx context.Context,
+	filename string,
+	db *pg.DB,
+	cidCache ConditionCache,
+	pidCache PathCache) (*ObservationSet, error) {
+	return copySetFromObsFile(ctx, filename, db, nil, nil, cidCache, pidCache)
+}
+
+// RestoreSetFromObsFile loads an observation file from a local path into the
+// database as with CopySetFromObsFile, but restores the observation set under
+// the given ID, with the creation and modification times in the file's
+// metadata, as when restoring a backup of another PTO. It fails if a set with
+// the given ID already exists. Most callers should use a Loader, which
+// manages the caches, instead.
+func RestoreSetFromObsFile(
+	filename string,
+	db *pg.DB,
+	setID int,
+	cidCache ConditionCache,
+	pidCache PathCache) (*ObservationSet, error) {
+	return copySetFromObsFile(context.Background(), filename, db, &setID, nil, cidCache, pidCache)
+}
+
+// RestoreSetFromObsFileContext works like RestoreSetFromObsFile, but stops
+// loading and rolls back the transaction when the given context is done.
+func RestoreSetFromObsFileContext(
+	ctx context.Context,
+	filename string,
+	db *pg.DB,
+	setID int,
+	cidCache ConditionCache,
+	pidCache PathCache) (*ObservationSet, error) {
+	return copySetFromObsFile(ctx, filename, db, &setID, nil, cidCache, pidCache)
+}
+
+// copySetFromObsFile implements CopySetFromObsFile and RestoreSetFromObsFile:
+// if restoreID is nil, the set is created under a new ID, otherwise it is
+// restored under the given ID. Metadata in md, if any, overrides that in the
+// file, and is inserted along with the set. Statements and reading from the
+// file stop when the given context is done.
+func copySetFromObsFile(
+	ctx context.Context,
+	filename string,
+	db *pg.DB,
+	restoreID *int,
+	md map[string]string,
+	cidCache ConditionCache,
+	pidCache PathCache) (*ObservationSet, error) {
 
 	obsfile, err := os.Open(filename)
 	if err != nil {
@@ -714,6 +1314,13 @@ func CopySetFromObsFile(
 		return nil, err
 	}
 
+	if set.Metadata == nil && len(md) > 0 {
+		set.Metadata = make(map[string]string, len(md))
+	}
+	for k, v := range md {
+		set.Metadata[k] = v
+	}
+
 	// ensure every condition is declared
 	if err := set.verifyConditionSet(conditionSet); err != nil {
 		log.Printf("error on verifying conditions of \"%s\": %v", filename, err)
@@ -727,7 +1334,7 @@ func CopySetFromObsFile(
 	}
 
 	// spin up a transaction
-	err = db.RunInTransaction(func(t *pg.Tx) error {
+	err = db.WithContext(ctx).RunInTransaction(func(t *pg.Tx) error {
 
 		// make sure conditions are inserted
 		if err := cidCache.FillConditionIDsInSet(t, set); err != nil {
@@ -742,26 +1349,21 @@ func CopySetFromObsFile(
 		}
 
 		// insert the set
-		if err := set.Insert(t, true); err != nil {
-			log.Printf("error on inserting set of \"%s\": %v", filename, err)
-			return err
-		}
-
-		// now insert the observations
-		if err := loadObservations(cidCache, pidCache, t, set, obsfile); err != nil {
-			log.Printf("error on loading observations of \"%s\": %v", filename, err)
-			return err
+		var err error
+		if restoreID == nil {
+			err = set.Insert(t, true)
+		} else {
+			err = set.restore(t, *restoreID)
 		}
-
-		// Force the observation set count and time interval to update
-		if _, err := set.CountObservations(t); err != nil {
-			log.Printf("error on counting observations of \"%s\": %v", filename, err)
+		if err != nil {
+			log.Printf("error on inserting set of \"%s\": %v", filename, err)
 			return err
 		}
 
-		_, _, err := set.TimeInterval(t)
+		// now insert the observations, updating count and time interval
+		err = loadObservations(cidCache, pidCache, t, set, &contextReader{ctx: ctx, r: obsfile})
 		if err != nil {
-			log.Printf("error on setting time interval of \"%s\": %v", filename, err)
+			log.Printf("error on loading observations of \"%s\": %v", filename, err)
 		}
 		return err
 	})
@@ -774,16 +1376,66 @@ func CopySetFromObsFile(
 	return set, nil
 }
 
+// restore inserts this ObservationSet under the given ID, with the creation
+// and modification times recorded in its metadata, then advances the set ID
+// sequence past it so that sets created later do not collide with it.
+func (set *ObservationSet) restore(db orm.DB, setID int) error {
+	set.ID = setID
+	set.Created = set.restoreCreated
+	set.Modified = set.restoreModified
+	if set.Created == nil {
+		ctime := time.Now().UTC()
+		set.Created = &ctime
+	}
+	if set.Modified == nil {
+		set.Modified = set.Created
+	}
+
+	if err := set.insert(db); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("SELECT setval(pg_get_serial_sequence('observation_sets', 'id'), (SELECT max(id) FROM observation_sets))"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// ReadObsFileMetadata reads the observation set metadata from an observation
+// file at a local path, without loading it into the database.
+func ReadObsFileMetadata(filename string) (*ObservationSet, error) {
+	obsfile, err := os.Open(filename)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	defer obsfile.Close()
+
+	set, _, _, err := obsFileFirstPass(obsfile)
+	return set, err
+}
+
 // CopyDataFromObsFile loads an observation file from a local path into the
 // database. It requires an ObservationSet to already exist in the database.
 // It uses given caches to cache condition and path IDs, and checks conditions
-// against those declared. This is used by ptoload to load observation sets
-// created by local analysis into the database.
+// against those declared. Most callers should use a Loader, which manages the
+// caches, instead.
 func CopyDataFromObsFile(
 	filename string,
 	db *pg.DB, set *ObservationSet,
 	cidCache ConditionCache,
 	pidCache PathCache) error {
+	return CopyDataFromObsFileContext(context.Background(), filename, db, set, cidCache, pidCache)
+}
+
+// CopyDataFromObsFileContext works like CopyDataFromObsFile, but stops
+// loading and rolls back the transaction when the given context is done.
+func CopyDataFromObsFileContext(
+	ctx context.Context,
+	filename string,
+	db *pg.DB, set *ObservationSet,
+	cidCache ConditionCache,
+	pidCache PathCache) error {
 
 	obsfile, err := os.Open(filename)
 	if err != nil {
@@ -808,7 +1460,7 @@ func CopyDataFromObsFile(
 	}
 
 	// spin up a transaction
-	return db.RunInTransaction(func(t *pg.Tx) error {
+	return db.WithContext(ctx).RunInTransaction(func(t *pg.Tx) error {
 
 		// make sure paths are inserted
 		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
@@ -816,13 +1468,175 @@ func CopyDataFromObsFile(
 		}
 
 		// now insert the observations
-		return loadObservations(cidCache, pidCache, t, set, obsfile)
+		return loadObservations(cidCache, pidCache, t, set, &contextReader{ctx: ctx, r: obsfile})
 	})
 }
 
+// copyDataFlushInterval is the number of observations between flushes of
+// output when copying observation set data to a stream.
+const copyDataFlushInterval = 1000
+
+// ObservationFilter selects a slice of the observations in a set, for
+// CopyFilteredDataToStream. Zero-valued fields do not restrict the selection.
+type ObservationFilter struct {
+	// Select only observations starting at or after this time
+	TimeStart *time.Time
+	// Select only observations ending at or before this time
+	TimeEnd *time.Time
+	// Select only observations of these conditions. A name ending in .* selects
+	// all conditions with the given prefix.
+	Conditions []string
+	// Select only observations added to the set after the given sequence
+	// marker, as returned by LastSequence
+	AfterSequence int
+	// Select only observations added to the set up to and including the given
+	// sequence marker
+	ThroughSequence int
+}
+
+// whereClause returns a SQL condition selecting the observations in a given
+// set matching this filter, with parameters for its placeholders. The
+// condition assumes observations are joined with conditions.
+func (f *ObservationFilter) whereClause(setID int) (string, []interface{}) {
+	clauses := []string{"set_id = ?"}
+	params := []interface{}{setID}
+
+	if f == nil {
+		return clauses[0], params
+	}
+
+	if f.TimeStart != nil {
+		clauses = append(clauses, "time_start >= ?")
+		params = append(params, *f.TimeStart)
+	}
+
+	if f.TimeEnd != nil {
+		clauses = append(clauses, "time_end <= ?")
+		params = append(params, *f.TimeEnd)
+	}
+
+	if f.AfterSequence > 0 {
+		clauses = append(clauses, "observations.id > ?")
+		params = append(params, f.AfterSequence)
+	}
+
+	if f.ThroughSequence > 0 {
+		clauses = append(clauses, "observations.id <= ?")
+		params = append(params, f.ThroughSequence)
+	}
+
+	if len(f.Conditions) > 0 {
+		var exact []string
+		var conditionClauses []string
+		for _, name := range f.Conditions {
+			if strings.HasSuffix(name, ".*") {
+				prefix := name[:len(name)-1]
+				conditionClauses = append(conditionClauses, "left(conditions.name, ?) = ?")
+				params = append(params, len(prefix), prefix)
+			} else {
+				exact = append(exact, name)
+			}
+		}
+		if len(exact) > 0 {
+			conditionClauses = append(conditionClauses, "conditions.name IN (?)")
+			params = append(params, pg.In(exact))
+		}
+		clauses = append(clauses, "("+strings.Join(conditionClauses, " OR ")+")")
+	}
+
+	return strings.Join(clauses, " AND "), params
+}
+
+// LastSequence returns a sequence marker for the observations in this set:
+// observations added to the set later are selected by an ObservationFilter
+// with this as AfterSequence. Sequence markers are observation IDs, which
+// increase as observations are loaded. It returns 0 for an empty set.
+func (set *ObservationSet) LastSequence(db orm.DB) (int, error) {
+	var seq int
+	if _, err := db.QueryOne(pg.Scan(&seq),
+		"SELECT coalesce(max(id), 0) FROM observations WHERE set_id = ?", set.ID); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	return seq, nil
+}
+
+// HasObservations returns true if this observation set contains any
+// observations selected by a filter, which may be nil. It stops at the first
+// matching observation, so it is much cheaper than counting or copying them.
+func (set *ObservationSet) HasObservations(db orm.DB, filter *ObservationFilter) (bool, error) {
+	where, params := filter.whereClause(set.ID)
+
+	from := "observations"
+	if filter != nil && len(filter.Conditions) > 0 {
+		from += " JOIN conditions ON conditions.id = observations.condition_id"
+	}
+
+	var exists bool
+	if _, err := db.QueryOne(pg.Scan(&exists),
+		"SELECT EXISTS (SELECT 1 FROM "+from+" WHERE "+where+")", params...); err != nil {
+		return false, PTOWrapError(err)
+	}
+
+	return exists, nil
+}
+
 // CopyDataToStream copies all the observations in this observation set in
-// observation file format to the given stream
+// version 1 observation file format to the given stream
 func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
+	return set.CopyFilteredDataToStream(db, out, nil)
+}
+
+// CopyDataToStreamContext works like CopyDataToStream, but stops copying when
+// the given context is done.
+func (set *ObservationSet) CopyDataToStreamContext(ctx context.Context, db orm.DB, out io.Writer) error {
+	return set.CopyFormattedDataToStreamContext(ctx, db, out, nil, ObsFormatV1)
+}
+
+// CopyBundleToStream copies this observation set to the given stream as an
+// observation file, as loaded by CopySetFromObsFile: a line of metadata
+// followed by all of its observations in the given observation file format.
+func (set *ObservationSet) CopyBundleToStream(db orm.DB, out io.Writer, format int) error {
+	return set.CopyBundleToStreamContext(context.Background(), db, out, format)
+}
+
+// CopyBundleToStreamContext works like CopyBundleToStream, but stops copying
+// when the given context is done.
+func (set *ObservationSet) CopyBundleToStreamContext(ctx context.Context, db orm.DB, out io.Writer, format int) error {
+	b, err := json.Marshal(set)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return set.CopyFormattedDataToStreamContext(ctx, db, out, nil, format)
+}
+
+// CopyFilteredDataToStream copies the observations in this observation set
+// selected by a filter in version 1 observation file format to the given
+// stream. If the filter is nil, copies all observations. Filtering is done in
+// the database.
+func (set *ObservationSet) CopyFilteredDataToStream(db orm.DB, out io.Writer, filter *ObservationFilter) error {
+	return set.CopyFormattedDataToStream(db, out, filter, ObsFormatV1)
+}
+
+// CopyFormattedDataToStream copies the observations in this observation set
+// selected by a filter, which may be nil, in the given observation file
+// format to the given stream.
+func (set *ObservationSet) CopyFormattedDataToStream(db orm.DB, out io.Writer, filter *ObservationFilter, format int) error {
+	return set.CopyFormattedDataToStreamContext(context.Background(), db, out, filter, format)
+}
+
+// CopyFormattedDataToStreamContext works like CopyFormattedDataToStream, but
+// stops copying when the given context is done: statements on a database
+// handle are cancelled, and writes to the stream fail with the context's
+// error, which ends the copy from the database.
+func (set *ObservationSet) CopyFormattedDataToStreamContext(ctx context.Context, db orm.DB, out io.Writer, filter *ObservationFilter, format int) error {
+	db = dbWithContext(ctx, db)
+	out = &contextWriter{ctx: ctx, w: out}
+	where, params := filter.whereClause(set.ID)
 
 	// create some pipes
 	obspipe, dbpipe, err := os.Pipe()
@@ -837,11 +1651,30 @@ func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
 	in := csv.NewReader(obspipe)
 
 	// COPY TO STDOUT doesn't seem to close the pipe, so we need to know when to stop.
-	obscount, err := set.CountObservations(db)
-	if err != nil {
-		return err
+	var obscount int
+	if filter == nil {
+		obscount, err = set.CountObservations(db)
+		if err != nil {
+			return err
+		}
+	} else {
+		if _, err := db.QueryOne(pg.Scan(&obscount),
+			"SELECT count(*) FROM observations JOIN conditions ON conditions.id = observations.condition_id WHERE "+where, params...); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	// nothing to copy
+	if obscount == 0 {
+		obspipe.Close()
+		return nil
 	}
 
+	// buffer output, but flush periodically so clients see progress
+	ow := NewObservationWriter(out)
+	ow.FlushEvery(copyDataFlushInterval)
+	ow.UseFormat(format)
+
 	// set up goroutine to parse observations and dump them to the writer as JSON
 	go func() {
 		defer obspipe.Close()
@@ -861,29 +1694,25 @@ func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
 				return
 			}
 
-			b, err := obs.MarshalJSON()
-			if err != nil {
+			if err := ow.WriteObservation(&obs); err != nil {
 				converr <- err
 				return
 			}
 
-			if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
-				converr <- PTOWrapError(err)
-				return
-			}
-
 			i++
 			if i >= obscount {
-				converr <- nil
-				return
+				break
 			}
 		}
 
-		converr <- nil
+		converr <- ow.Flush()
 	}()
 
 	// now kick off a copy query
-	if _, err := db.CopyTo(dbpipe, "COPY (SELECT set_id, time_start, time_end, string, name, value from observations JOIN conditions ON conditions.id = observations.condition_id JOIN paths ON paths.id = observations.path_id WHERE set_id = ?) TO STDOUT WITH CSV", set.ID); err != nil {
+	if _, err := db.CopyTo(dbpipe, "COPY (SELECT set_id, time_start, time_end, string, name, value, metadata from observations JOIN conditions ON conditions.id = observations.condition_id JOIN paths ON paths.id = observations.path_id WHERE "+where+") TO STDOUT WITH CSV", params...); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return PTOWrapError(err)
 	}
 
@@ -891,6 +1720,329 @@ func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
 	return <-converr
 }
 
+// ObservationPage is a page of observations from an observation set, as
+// returned by SelectObservationPage.
+type ObservationPage struct {
+	// Observations on this page, in database order
+	Observations []Observation
+	// True if there are observations after this page
+	HasNext bool
+	// Cursor selecting the next page, if HasNext
+	Next int
+	// True if there are observations before this page
+	HasPrev bool
+	// Cursor selecting the previous page, if HasPrev
+	Prev int
+}
+
+// observationPageRow is a single observation as selected for a page, with
+// path and condition joined in.
+type observationPageRow struct {
+	ID        int
+	SetID     int
+	TimeStart *time.Time
+	TimeEnd   *time.Time
+	Path      string
+	Condition string
+	Value     string
+}
+
+// SelectObservationPage selects up to count observations in this set matching
+// a filter (which may be nil), following the observation at the given cursor.
+// Cursors are observation IDs; a cursor of 0 selects the first page. Paging by
+// cursor rather than by offset keeps selection cheap for pages deep into large
+// sets.
+func (set *ObservationSet) SelectObservationPage(db orm.DB, filter *ObservationFilter, cursor int, count int) (*ObservationPage, error) {
+	if count < 1 {
+		return nil, PTOErrorf("bad page count %d", count).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadForm)
+	}
+
+	where, params := filter.whereClause(set.ID)
+	from := " FROM observations JOIN conditions ON conditions.id = observations.condition_id JOIN paths ON paths.id = observations.path_id WHERE " + where
+
+	// select one more row than needed to see if there is a next page
+	var rows []observationPageRow
+	if _, err := db.Query(&rows,
+		"SELECT observations.id, set_id, time_start, time_end, paths.string AS path, conditions.name AS condition, value"+
+			from+" AND observations.id > ? ORDER BY observations.id LIMIT ?",
+		append(params, cursor, count+1)...); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := new(ObservationPage)
+	if len(rows) > count {
+		rows = rows[:count]
+		out.HasNext = true
+		out.Next = rows[count-1].ID
+	}
+
+	out.Observations = make([]Observation, len(rows))
+	for i, row := range rows {
+		out.Observations[i] = Observation{
+			ID:        row.ID,
+			SetID:     row.SetID,
+			TimeStart: row.TimeStart,
+			TimeEnd:   row.TimeEnd,
+			Path:      &Path{String: row.Path},
+			Condition: &Condition{Name: row.Condition},
+			Value:     row.Value,
+		}
+	}
+
+	// the previous page starts after the observation count observations back
+	// from the cursor, or at the beginning of the set if there are fewer.
+	if cursor > 0 {
+		var prev int
+		_, err := db.QueryOne(pg.Scan(&prev),
+			"SELECT observations.id"+from+" AND observations.id <= ? ORDER BY observations.id DESC LIMIT 1 OFFSET ?",
+			append(params, cursor, count)...)
+		if err != nil && err != pg.ErrNoRows {
+			return nil, PTOWrapError(err)
+		}
+		out.HasPrev = true
+		out.Prev = prev
+	}
+
+	return out, nil
+}
+
+// MergeObservationSets creates a new observation set containing copies of all
+// the observations in the sets with the given IDs. Metadata for the new set is
+// merged from the input sets as in AnalysisSetTable.MergeMetadata, its
+// conditions are the union of the input sets' conditions, and its sources are
+// links to the input sets. If analyzer is empty, the input sets must all have
+// the same analyzer, which is inherited by the new set. Observations are
+// copied within the database. As with SelectByID, a missing input set can be
+// detected by comparing the returned error against pg.ErrNoRows.
+func MergeObservationSets(db orm.DB, config *PTOConfiguration, setIDs []int, analyzer string) (*ObservationSet, error) {
+	if len(setIDs) == 0 {
+		return nil, PTOErrorf("no observation sets to merge").StatusIs(http.StatusBadRequest)
+	}
+
+	// retrieve input sets
+	st := make(AnalysisSetTable)
+	hasCondition := make(map[int]Condition)
+	inheritAnalyzer := analyzer == ""
+	for _, setid := range setIDs {
+		set := &ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			return nil, err
+		}
+		set.LinkVia(config)
+		st[setid] = set
+
+		for _, c := range set.Conditions {
+			hasCondition[c.ID] = c
+		}
+
+		if inheritAnalyzer {
+			if analyzer == "" {
+				analyzer = set.Analyzer
+			} else if set.Analyzer != analyzer {
+				return nil, PTOErrorf("cannot merge sets with different analyzers without explicit analyzer").StatusIs(http.StatusBadRequest)
+			}
+		}
+	}
+
+	// merge metadata
+	out := &ObservationSet{
+		Analyzer: analyzer,
+		Metadata: make(map[string]string),
+	}
+
+	for k, v := range st.MergeMetadata() {
+		if k == "_sources" {
+			out.Sources = v.([]string)
+		} else {
+			out.Metadata[k] = AsString(v)
+		}
+	}
+	sort.Strings(out.Sources)
+
+	for _, c := range hasCondition {
+		out.Conditions = append(out.Conditions, c)
+	}
+
+	// insert the new set
+	if err := out.Insert(db, true); err != nil {
+		return nil, err
+	}
+
+	// and copy observations into it
+	_, err := db.Exec("INSERT INTO observations (set_id, time_start, time_end, path_id, condition_id, value, metadata) "+
+		"SELECT ?, time_start, time_end, path_id, condition_id, value, metadata FROM observations WHERE set_id IN (?)",
+		out.ID, pg.In(setIDs))
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	// count and interval follow from those of the inputs
+	var stats obsLoadStats
+	for _, set := range st {
+		if _, err := set.CountObservations(db); err != nil {
+			return nil, err
+		}
+		if _, _, err := set.TimeInterval(db); err != nil {
+			return nil, err
+		}
+		if set.Count == 0 {
+			continue
+		}
+
+		stats.count += set.Count
+		if stats.timeStart == nil || set.TimeStart.Before(*stats.timeStart) {
+			stats.timeStart = set.TimeStart
+		}
+		if stats.timeEnd == nil || set.TimeEnd.After(*stats.timeEnd) {
+			stats.timeEnd = set.TimeEnd
+		}
+	}
+
+	if err := out.addStats(db, &stats); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// conditionTransitionSQL selects, for each path and condition aspect observed
+// in both of two observation sets, the state (the last component of the
+// condition name) of the last observation of that aspect on that path in the
+// first set, and that of the last observation in the second set, together
+// with the start time of the former and the end time of the latter.
+const conditionTransitionSQL = "WITH " +
+	"b AS (SELECT DISTINCT ON (o.path_id, c.aspect) o.path_id, c.aspect, substr(c.name, length(c.aspect) + 2) AS state, o.time_start " +
+	"FROM observations AS o JOIN conditions AS c ON c.id = o.condition_id " +
+	"WHERE o.set_id = ? AND c.aspect <> '' ORDER BY o.path_id, c.aspect, o.time_end DESC), " +
+	"a AS (SELECT DISTINCT ON (o.path_id, c.aspect) o.path_id, c.aspect, substr(c.name, length(c.aspect) + 2) AS state, o.time_end " +
+	"FROM observations AS o JOIN conditions AS c ON c.id = o.condition_id " +
+	"WHERE o.set_id = ? AND c.aspect <> '' ORDER BY o.path_id, c.aspect, o.time_end DESC) " +
+	"SELECT b.path_id, b.aspect, b.state AS before_state, a.state AS after_state, b.time_start, a.time_end " +
+	"FROM b JOIN a ON a.path_id = b.path_id AND a.aspect = b.aspect"
+
+// TransitionConditionName returns the name of the condition recording a
+// transition of a condition aspect from one state to another, as
+// aspect.transition.before.after.
+func TransitionConditionName(aspect string, before string, after string) string {
+	return aspect + ".transition." + before + "." + after
+}
+
+// ComputeConditionTransitions creates a new observation set derived from two
+// existing sets, before and after, recording for each path on which the same
+// condition aspect was observed in both sets how the condition changed
+// between them. The derived set holds one observation per such path and
+// aspect, with the condition named by TransitionConditionName for the states
+// of the last observations of the aspect on the path in each set (e.g.
+// ecn.connectivity.transition.works.broken), spanning the time from the start
+// of the former to the end of the latter. Per-transition counts are therefore
+// the observation counts by condition of the derived set. Metadata, sources,
+// and analyzer are determined as in MergeObservationSets. As with SelectByID, a
+// missing input set can be detected by comparing the returned error against
+// pg.ErrNoRows.
+func ComputeConditionTransitions(db orm.DB, config *PTOConfiguration, beforeID int, afterID int, analyzer string) (*ObservationSet, error) {
+	if beforeID == afterID {
+		return nil, PTOErrorf("cannot compute transitions from observation set %x to itself", beforeID).StatusIs(http.StatusBadRequest)
+	}
+
+	// retrieve input sets
+	st := make(AnalysisSetTable)
+	for _, setid := range []int{beforeID, afterID} {
+		set := &ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			return nil, err
+		}
+		set.LinkVia(config)
+		st[setid] = set
+	}
+
+	if analyzer == "" {
+		if st[beforeID].Analyzer != st[afterID].Analyzer {
+			return nil, PTOErrorf("cannot compute transitions between sets with different analyzers without explicit analyzer").StatusIs(http.StatusBadRequest)
+		}
+		analyzer = st[beforeID].Analyzer
+	}
+
+	// merge metadata
+	out := &ObservationSet{
+		Analyzer: analyzer,
+		Metadata: make(map[string]string),
+	}
+
+	for k, v := range st.MergeMetadata() {
+		if k == "_sources" {
+			out.Sources = v.([]string)
+		} else {
+			out.Metadata[k] = AsString(v)
+		}
+	}
+	sort.Strings(out.Sources)
+
+	// determine which transitions occur, to declare their conditions
+	var transitions []struct {
+		Aspect      string
+		BeforeState string
+		AfterState  string
+	}
+
+	_, err := db.Query(&transitions, "SELECT DISTINCT aspect, before_state, after_state FROM ("+conditionTransitionSQL+") AS t",
+		beforeID, afterID)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	for _, t := range transitions {
+		out.Conditions = append(out.Conditions, *NewCondition(TransitionConditionName(t.Aspect, t.BeforeState, t.AfterState)))
+	}
+
+	// insert the new set
+	if err := out.Insert(db, true); err != nil {
+		return nil, err
+	}
+
+	// and compute transition observations into it
+	_, err = db.Exec("INSERT INTO observations (set_id, time_start, time_end, path_id, condition_id, value) "+
+		"SELECT ?, t.time_start, t.time_end, t.path_id, c.id, '' FROM ("+conditionTransitionSQL+") AS t "+
+		"JOIN conditions AS c ON c.name = t.aspect || '.transition.' || t.before_state || '.' || t.after_state",
+		out.ID, beforeID, afterID)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if err := out.Recount(db); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// ObservationSetsByID retrieves the observation sets with the given IDs,
+// without their conditions, in the order of the IDs given. IDs of sets not in
+// the database are skipped.
+func ObservationSetsByID(db orm.DB, setIds []int) ([]ObservationSet, error) {
+	if len(setIds) == 0 {
+		return make([]ObservationSet, 0), nil
+	}
+
+	var sets []ObservationSet
+	if err := db.Model(&sets).Where("id IN (?)", pg.In(setIds)).Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	byID := make(map[int]*ObservationSet, len(sets))
+	for i := range sets {
+		byID[sets[i].ID] = &sets[i]
+	}
+
+	out := make([]ObservationSet, 0, len(sets))
+	for _, id := range setIds {
+		if set, ok := byID[id]; ok {
+			out = append(out, *set)
+		}
+	}
+
+	return out, nil
+}
+
 // AllObservationSetIDs lists all observation set IDs in the database.
 func AllObservationSetIDs(db orm.DB) ([]int, error) {
 	var setIds []int
@@ -907,6 +2059,141 @@ func AllObservationSetIDs(db orm.DB) ([]int, error) {
 	return setIds, nil
 }
 
+// observationSetOrderColumns maps the properties by which observation set IDs
+// can be ordered to the columns holding them.
+var observationSetOrderColumns = map[string]string{
+	"created":    "created",
+	"modified":   "modified",
+	"time_start": "time_start",
+	"count":      "count",
+	"analyzer":   "analyzer",
+}
+
+// ObservationSetOrders lists the properties by which observation set IDs can
+// be ordered by OrderedObservationSetIDs, sorted.
+func ObservationSetOrders() []string {
+	out := make([]string, 0, len(observationSetOrderColumns))
+	for order := range observationSetOrderColumns {
+		out = append(out, order)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// OrderedObservationSetIDs lists all observation set IDs in the database,
+// ordered by the given property of the sets (one of ObservationSetOrders),
+// ascending or descending. Sets without a value for the property, e.g. a
+// start time for an empty set, come last; sets with equal values are ordered
+// by ID.
+func OrderedObservationSetIDs(db orm.DB, order string, descending bool) ([]int, error) {
+	column, ok := observationSetOrderColumns[order]
+	if !ok {
+		return nil, PTOErrorf("unsupported set order %s; must be one of %s", order, strings.Join(ObservationSetOrders(), ", ")).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadForm)
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+
+	var setIds []int
+	err := db.Model(&ObservationSet{}).ColumnExpr("id").
+		OrderExpr(fmt.Sprintf("%q %s NULLS LAST, id %s", column, direction, direction)).
+		Select(&setIds)
+	if err == pg.ErrNoRows || (err == nil && setIds == nil) {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return setIds, nil
+}
+
+// ObservationSetIDPage is a page of observation set IDs, as returned by
+// SelectObservationSetIDPage.
+type ObservationSetIDPage struct {
+	// Set IDs on this page, in ascending order
+	IDs []int
+	// True if there are sets after this page
+	HasNext bool
+	// Cursor selecting the next page, if HasNext
+	Next int
+	// True if there are sets before this page
+	HasPrev bool
+	// Cursor selecting the previous page, if HasPrev
+	Prev int
+}
+
+// SelectObservationSetIDPage selects up to count observation set IDs in
+// ascending order, following the set ID at the given cursor. As with
+// SelectObservationPage, cursors are IDs, and a cursor of 0 selects the first
+// page, so that listing all sets a page at a time need not load all set IDs.
+func SelectObservationSetIDPage(db orm.DB, cursor int, count int) (*ObservationSetIDPage, error) {
+	if count < 1 {
+		return nil, PTOErrorf("bad page count %d", count).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadForm)
+	}
+
+	// select one more ID than needed to see if there is a next page
+	out := new(ObservationSetIDPage)
+	err := db.Model(&ObservationSet{}).ColumnExpr("id").
+		Where("id > ?", cursor).Order("id").Limit(count + 1).
+		Select(&out.IDs)
+	if err != nil && err != pg.ErrNoRows {
+		return nil, PTOWrapError(err)
+	}
+
+	if len(out.IDs) > count {
+		out.IDs = out.IDs[:count]
+		out.HasNext = true
+		out.Next = out.IDs[count-1]
+	}
+	if out.IDs == nil {
+		out.IDs = make([]int, 0)
+	}
+
+	// the previous page starts after the set count sets back from the
+	// cursor, or at the beginning if there are fewer.
+	if cursor > 0 {
+		var prev int
+		err := db.Model(&ObservationSet{}).ColumnExpr("id").
+			Where("id <= ?", cursor).Order("id DESC").Offset(count).Limit(1).
+			Select(&prev)
+		if err != nil && err != pg.ErrNoRows {
+			return nil, PTOWrapError(err)
+		}
+		out.HasPrev = true
+		out.Prev = prev
+	}
+
+	return out, nil
+}
+
+// ObservationSetIDsInTimeRange lists all observation set IDs in the database
+// whose cached observation time interval overlaps the given time range. Either
+// end of the range may be nil, leaving it open.
+func ObservationSetIDsInTimeRange(db orm.DB, start *time.Time, end *time.Time) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)")
+	if start != nil {
+		q = q.Where("time_end >= ?", *start)
+	}
+	if end != nil {
+		q = q.Where("time_start <= ?", *end)
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
 // ObservationSetIDsWithMetadata lists all observation set IDs in the database
 // where a given metadata key is present.
 func ObservationSetIDsWithMetadata(db orm.DB, k string) ([]int, error) {
@@ -944,6 +2231,138 @@ func ObservationSetIDsWithMetadataValue(db orm.DB, k string, v string) ([]int, e
 	return setIds, nil
 }
 
+// MetadataFilter selects observation sets, or observations in queries, by the
+// presence or value of a metadata key.
+type MetadataFilter struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// metadataNumericPattern matches metadata values which can be compared
+// numerically; it avoids ? so as not to confuse the query formatter.
+const metadataNumericPattern = "^-{0,1}[0-9]+([.][0-9]+){0,1}$"
+
+// ParseMetadataFilter parses a metadata filter expression. An expression
+// consisting of a key alone selects sets with that key present. An expression
+// of the form key=value selects sets with the given value for the key, where
+// the value may contain * as a wildcard. Expressions of the form key<n,
+// key<=n, key>n, and key>=n select sets for which the key has a numeric value
+// in the given range.
+func ParseMetadataFilter(expr string) (*MetadataFilter, error) {
+	i := strings.IndexAny(expr, "<>=")
+	if i < 0 {
+		return &MetadataFilter{Key: expr}, nil
+	} else if i == 0 {
+		return nil, PTOErrorf("metadata filter %s missing key", expr).StatusIs(http.StatusBadRequest)
+	}
+
+	mf := MetadataFilter{Key: expr[:i], Op: expr[i : i+1]}
+	if mf.Op != "=" && i+1 < len(expr) && expr[i+1] == '=' {
+		mf.Op += "="
+	}
+	mf.Value = expr[i+len(mf.Op):]
+
+	if mf.Op != "=" {
+		if _, err := strconv.ParseFloat(mf.Value, 64); err != nil {
+			return nil, PTOErrorf("metadata filter %s requires a numeric value", expr).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	return &mf, nil
+}
+
+// String returns the expression this filter was parsed from.
+func (mf MetadataFilter) String() string {
+	return mf.Key + mf.Op + mf.Value
+}
+
+// whereClause adds a WHERE clause for this filter to a query on observation
+// sets or observations.
+func (mf *MetadataFilter) whereClause(q *orm.Query) *orm.Query {
+	switch mf.Op {
+	case "":
+		return q.Where("metadata->? IS NOT NULL", mf.Key)
+	case "=":
+		if strings.Contains(mf.Value, "*") {
+			pattern := strings.NewReplacer("%", "\\%", "_", "\\_", "*", "%").Replace(mf.Value)
+			return q.Where("metadata->>? LIKE ?", mf.Key, pattern)
+		}
+		return q.Where("metadata->>? = ?", mf.Key, mf.Value)
+	default:
+		// only compare values which look like numbers, to avoid cast errors
+		return q.Where("(CASE WHEN metadata->>? ~ '"+metadataNumericPattern+"' THEN (metadata->>?)::numeric END) "+mf.Op+" ?::numeric",
+			mf.Key, mf.Key, mf.Value)
+	}
+}
+
+// ObservationSetIDsWithMetadataFilters lists all observation set IDs in the
+// database matching all the given metadata filters.
+func ObservationSetIDsWithMetadataFilters(db orm.DB, filters []MetadataFilter) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)")
+	for i := range filters {
+		q = filters[i].whereClause(q)
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetIDsWithTags lists all observation set IDs in the database
+// tagged with all of the given tags.
+func ObservationSetIDsWithTags(db orm.DB, tags []string) ([]int, error) {
+	var setIds []int
+
+	err := db.Model(&ObservationSet{}).
+		ColumnExpr("array_agg(id)").
+		Where("tags @> ?::text[]", pg.Array(tags)).
+		Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetStates returns the lifecycle states of those of the
+// observation sets with the given IDs which are not active, by set ID.
+func ObservationSetStates(db orm.DB, setIds []int) (map[int]string, error) {
+	out := make(map[int]string)
+	if len(setIds) == 0 {
+		return out, nil
+	}
+
+	var sets []ObservationSet
+	err := db.Model(&sets).
+		Column("id", "state").
+		Where("id IN (?)", pg.In(setIds)).
+		Where("state IN (?, ?)", ObsSetStateDeprecated, ObsSetStateSuperseded).
+		Select()
+	if err != nil && err != pg.ErrNoRows {
+		return nil, PTOWrapError(err)
+	}
+
+	for i := range sets {
+		out[sets[i].ID] = sets[i].State
+	}
+
+	return out, nil
+}
+
 // ObservationSetIDsWithSource lists all observation set IDs in the database
 // where the given source is present in the sources list. The source must be
 // given as a fully qualified analyzer URL.
@@ -1,9 +1,15 @@
 package pto3_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/obsgen"
 )
 
 func TestObsetQuery(t *testing.T) {
@@ -63,3 +69,519 @@ func TestObsetQuery(t *testing.T) {
 	}
 
 }
+
+func TestLoaderRollback(t *testing.T) {
+	loader, err := pto3.NewLoader(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeObsFile := func(start string) string {
+		tf, err := ioutil.TempFile("", "pto3-test-loader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tf.Close()
+
+		if _, err := tf.WriteString(`{"_analyzer":"https://localhost:8383/loader_test_analyzer.json",` +
+			`"_sources":["https://localhost:8383/raw/test1/test1-0-obs.ndjson"],` +
+			`"_conditions":["pto.test.loader.rollback"]}` + "\n" +
+			`["", "` + start + `", "2018-01-01T00:00:01Z", "10.0.0.1 * 10.99.0.1", "pto.test.loader.rollback"]` + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		return tf.Name()
+	}
+
+	// a file with a bad time fails after inserting its new condition and path
+	badfile := writeObsFile("not a time")
+	defer os.Remove(badfile)
+	if _, err := loader.LoadSet(badfile); err == nil {
+		t.Fatal("loading observation file with bad time should fail")
+	}
+
+	// so loading the same condition and path again must not use the IDs
+	// rolled back with the failed file
+	goodfile := writeObsFile("2018-01-01T00:00:00Z")
+	defer os.Remove(goodfile)
+	set, err := loader.LoadSet(goodfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set.Count != 1 {
+		t.Fatalf("loaded set has %d observations, expected 1", set.Count)
+	}
+}
+
+func TestConditionAliases(t *testing.T) {
+	tf, err := ioutil.TempFile("", "pto3-test-alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tf.Name())
+	if _, err := tf.WriteString(`{"_analyzer":"https://localhost:8383/alias_test_analyzer.json",` +
+		`"_sources":["https://localhost:8383/raw/test1/test1-0-obs.ndjson"],` +
+		`"_conditions":["pto.test.alias.old"]}` + "\n" +
+		`["", "2018-01-01T00:00:00Z", "2018-01-01T00:00:01Z", "10.0.0.1 * 10.98.0.1", "pto.test.alias.old"]` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	loader, err := pto3.NewLoader(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := loader.LoadSet(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setsWith := func(condition string) []int {
+		cidCache, err := pto3.LoadConditionCache(TestDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setIds, err := pto3.ObservationSetIDsWithCondition(TestDB, cidCache, condition)
+		if err != nil {
+			t.Fatalf("looking up sets with %s: %v", condition, err)
+		}
+		return setIds
+	}
+
+	hasSet := func(condition string) bool {
+		for _, setID := range setsWith(condition) {
+			if setID == set.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// an alias makes the old condition visible under the new name, exactly
+	// and by wildcard
+	if err := pto3.AliasCondition(TestDB, "pto.test.alias.old", "pto.test.renamed.new"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasSet("pto.test.renamed.new") || !hasSet("pto.test.renamed.*") || !hasSet("pto.test.alias.old") {
+		t.Fatal("aliased condition not found under new name")
+	}
+
+	// renaming moves the observations, and keeps the old name queryable
+	if err := pto3.RenameCondition(TestDB, "pto.test.alias.old", "pto.test.renamed.new"); err != nil {
+		t.Fatal(err)
+	}
+	if set.SelectByID(TestDB) != nil || len(set.Conditions) != 1 || set.Conditions[0].Name != "pto.test.renamed.new" {
+		t.Fatalf("renamed condition not in set: %v", set.Conditions)
+	}
+	if !hasSet("pto.test.renamed.new") || !hasSet("pto.test.alias.old") {
+		t.Fatal("renamed condition not found")
+	}
+
+	// without the alias, the old name is gone
+	if err := pto3.UnaliasCondition(TestDB, "pto.test.alias.old"); err != nil {
+		t.Fatal(err)
+	}
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cidCache.ConditionsByName(TestDB, "pto.test.alias.old"); err == nil {
+		t.Fatal("old condition name found after rename and unalias")
+	}
+}
+
+func TestReconcileConditions(t *testing.T) {
+	writeObsFile := func(conditions string, obs string) string {
+		tf, err := ioutil.TempFile("", "pto3-test-reconcile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tf.Close()
+
+		if _, err := tf.WriteString(`{"_analyzer":"https://localhost:8383/reconcile_test_analyzer.json",` +
+			`"_sources":["https://localhost:8383/raw/test1/test1-0-obs.ndjson"],` +
+			`"_conditions":[` + conditions + `]}` + "\n" + obs); err != nil {
+			t.Fatal(err)
+		}
+		return tf.Name()
+	}
+
+	loader, err := pto3.NewLoader(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setfile := writeObsFile(`"pto.test.reconcile.kept","pto.test.reconcile.dropped"`,
+		`["", "2018-01-01T00:00:00Z", "2018-01-01T00:00:01Z", "10.0.0.1 * 10.97.0.1", "pto.test.reconcile.kept"]`+"\n"+
+			`["", "2018-01-01T00:00:00Z", "2018-01-01T00:00:01Z", "10.0.0.1 * 10.97.0.1", "pto.test.reconcile.dropped"]`+"\n")
+	defer os.Remove(setfile)
+	set, err := loader.LoadSet(setfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasCondition := func(name string) bool {
+		if err := set.SelectByID(TestDB); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range set.Conditions {
+			if c.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// drop a condition still in the data from the set's metadata
+	dropCondition := func() {
+		if err := set.SelectByID(TestDB); err != nil {
+			t.Fatal(err)
+		}
+		kept := set.Conditions[:0]
+		for _, c := range set.Conditions {
+			if c.Name != "pto.test.reconcile.dropped" {
+				kept = append(kept, c)
+			}
+		}
+		set.Conditions = kept
+		if err := set.Update(TestDB); err != nil {
+			t.Fatal(err)
+		}
+		if hasCondition("pto.test.reconcile.dropped") {
+			t.Fatal("condition not dropped by metadata update")
+		}
+	}
+
+	// loading more data restores it
+	dropCondition()
+	datafile := writeObsFile(`"pto.test.reconcile.kept"`,
+		`["", "2018-01-01T00:00:02Z", "2018-01-01T00:00:03Z", "10.0.0.1 * 10.97.0.2", "pto.test.reconcile.kept"]`+"\n")
+	defer os.Remove(datafile)
+	if err := loader.LoadData(datafile, set); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCondition("pto.test.reconcile.dropped") {
+		t.Fatal("condition in data not restored to set after loading data")
+	}
+
+	// as does explicit reconciliation
+	dropCondition()
+	linked, unlinked, err := set.ReconcileConditions(TestDB, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked != 1 || unlinked != 0 || !hasCondition("pto.test.reconcile.dropped") {
+		t.Fatalf("reconciliation linked %d and unlinked %d conditions, expected 1 and 0", linked, unlinked)
+	}
+
+	// pruning removes declared conditions not in the data
+	set.Conditions = append(set.Conditions, *pto3.NewCondition("pto.test.reconcile.unused"))
+	if err := set.Update(TestDB); err != nil {
+		t.Fatal(err)
+	}
+	linked, unlinked, err = set.ReconcileConditions(TestDB, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked != 0 || unlinked != 1 || hasCondition("pto.test.reconcile.unused") {
+		t.Fatalf("pruning reconciliation linked %d and unlinked %d conditions, expected 0 and 1", linked, unlinked)
+	}
+}
+
+func TestRawDerivedSets(t *testing.T) {
+	tf, err := ioutil.TempFile("", "pto3-test-derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tf.Name())
+
+	if _, err := tf.WriteString(`{"_analyzer":"https://localhost:8383/derived_test_analyzer.json",` +
+		`"_sources":["https://ptotest.mami-project.eu/raw/derivedtest/file001.ndjson/data"],` +
+		`"_conditions":["pto.test.derived"]}` + "\n" +
+		`["", "2018-01-01T00:00:00Z", "2018-01-01T00:00:01Z", "10.0.0.1 * 10.98.0.1", "pto.test.derived"]` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	loader, err := pto3.NewLoader(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := loader.LoadSet(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setIds, err := pto3.ObservationSetIDsDerivedFromRawFile(TestConfig, TestDB, "derivedtest", "file001.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setIds) != 1 || setIds[0] != set.ID {
+		t.Fatalf("expected set %d derived from raw file, got %v", set.ID, setIds)
+	}
+
+	setIds, err = pto3.ObservationSetIDsDerivedFromRawFile(TestConfig, TestDB, "derivedtest", "file002.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setIds) != 0 {
+		t.Fatalf("expected no sets derived from other raw file, got %v", setIds)
+	}
+}
+
+func TestObservationFormatV2(t *testing.T) {
+	var obs pto3.Observation
+
+	line := `{"set": "2a", "time_start": "2018-01-01T00:00:00Z", "time_end": "2018-01-01T00:01:00Z", ` +
+		`"path": "10.0.0.1 * 10.0.0.2", "condition": "pto.test.v2", "value": 42, "metadata": {"probe": "p1"}}`
+	if err := json.Unmarshal([]byte(line), &obs); err != nil {
+		t.Fatal(err)
+	}
+	if obs.SetID != 0x2a || obs.Value != "42" || obs.Condition.Name != "pto.test.v2" || obs.Metadata["probe"] != "p1" {
+		t.Fatalf("unexpected observation from version 2 record %+v", obs)
+	}
+
+	// version 2 records keep typed values and metadata
+	b, err := obs.MarshalJSONV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"] != float64(42) || rec["set"] != "2a" || rec["metadata"] == nil {
+		t.Fatalf("unexpected version 2 record %s", b)
+	}
+
+	obs.Value = "green"
+	b, err = obs.MarshalJSONV2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["value"] != "green" {
+		t.Fatalf("unexpected version 2 record %s", b)
+	}
+
+	// metadata and non-scalar values are not observations
+	if err := json.Unmarshal([]byte(`{"_analyzer": "https://localhost:8383/analyzer.json"}`), &obs); err == nil {
+		t.Fatal("metadata parsed as observation")
+	}
+	if err := json.Unmarshal([]byte(`{"time_start": "2018-01-01T00:00:00Z", "time_end": "2018-01-01T00:01:00Z", `+
+		`"path": "*", "condition": "pto.test.v2", "value": [1]}`), &obs); err == nil {
+		t.Fatal("observation with array value parsed")
+	}
+
+	// both formats may be mixed in a stream
+	stream := `{"_analyzer": "https://localhost:8383/analyzer.json", "_sources": ["https://localhost:8383/raw/test1/test1-0-obs.ndjson"], "_conditions": ["pto.test.v2"]}
+["2a", "2018-01-01T00:00:00Z", "2018-01-01T00:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.v2"]
+` + line + "\n"
+
+	count := 0
+	if _, err := pto3.AnalyzeObservationStream(bytes.NewBufferString(stream), func(obs *pto3.Observation) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 observations in mixed stream, got %d", count)
+	}
+}
+
+func TestObservationMetadataV1(t *testing.T) {
+	var obs pto3.Observation
+
+	line := `["2a", "2018-01-01T00:00:00Z", "2018-01-01T00:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.v1", "", {"rtt": [12, 14]}]`
+	if err := json.Unmarshal([]byte(line), &obs); err != nil {
+		t.Fatal(err)
+	}
+	if obs.Value != "" || obs.Metadata["rtt"] == nil {
+		t.Fatalf("unexpected observation from version 1 array with metadata %+v", obs)
+	}
+
+	// metadata survives a round trip, after an empty value
+	b, err := json.Marshal(&obs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var elements []interface{}
+	if err := json.Unmarshal(b, &elements); err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 7 || elements[5] != "" {
+		t.Fatalf("unexpected version 1 array %s", b)
+	}
+
+	if err := json.Unmarshal([]byte(`["2a", "2018-01-01T00:00:00Z", "2018-01-01T00:01:00Z", "*", "pto.test.v1", "", "rtt"]`), &obs); err == nil {
+		t.Fatal("observation with non-object metadata parsed")
+	}
+}
+
+func TestObservationWriterSorting(t *testing.T) {
+	base := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	offsets := []int{3, 1, 2, 1, 0}
+
+	obsdat := make([]pto3.Observation, len(offsets))
+	for i, off := range offsets {
+		start := base.Add(time.Duration(off) * time.Hour)
+		end := start.Add(time.Minute)
+		obsdat[i] = pto3.Observation{
+			SetID:     i,
+			TimeStart: &start,
+			TimeEnd:   &end,
+			Path:      &pto3.Path{String: "10.0.0.1 * 10.0.0.2"},
+			Condition: &pto3.Condition{Name: "pto.test.sorting"},
+		}
+	}
+
+	var out bytes.Buffer
+	ow := pto3.NewObservationWriter(&out)
+	ow.SortByTimeStart()
+	if err := ow.WriteObservations(obsdat); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Len() != 0 {
+		t.Fatalf("sorting writer wrote %d bytes before flush", out.Len())
+	}
+
+	if err := ow.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// sort must be stable: set IDs 1 and 3 share a start time
+	expectedSetIDs := []int{4, 1, 3, 2, 0}
+	dec := json.NewDecoder(&out)
+	for i, setID := range expectedSetIDs {
+		var obs pto3.Observation
+		if err := dec.Decode(&obs); err != nil {
+			t.Fatal(err)
+		}
+		if obs.SetID != setID {
+			t.Fatalf("observation %d has set ID %d, expected %d", i, obs.SetID, setID)
+		}
+	}
+}
+
+func TestParseMetadataFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		mf   pto3.MetadataFilter
+	}{
+		{"vantage", pto3.MetadataFilter{Key: "vantage"}},
+		{"vantage=eu-*", pto3.MetadataFilter{Key: "vantage", Op: "=", Value: "eu-*"}},
+		{"version>=2", pto3.MetadataFilter{Key: "version", Op: ">=", Value: "2"}},
+		{"version<2.5", pto3.MetadataFilter{Key: "version", Op: "<", Value: "2.5"}},
+		{"note=a=b", pto3.MetadataFilter{Key: "note", Op: "=", Value: "a=b"}},
+	}
+
+	for _, test := range tests {
+		mf, err := pto3.ParseMetadataFilter(test.expr)
+		if err != nil {
+			t.Fatalf("error parsing %s: %v", test.expr, err)
+		}
+		if *mf != test.mf {
+			t.Fatalf("parsing %s: expected %v got %v", test.expr, test.mf, *mf)
+		}
+	}
+
+	for _, expr := range []string{"=value", "version>two", "version<="} {
+		if _, err := pto3.ParseMetadataFilter(expr); err == nil {
+			t.Fatalf("parsing %s should have failed", expr)
+		}
+	}
+}
+
+func TestParseSetID(t *testing.T) {
+	id, err := pto3.ParseSetID("1a2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(id) != 0x1a2b {
+		t.Fatalf("set ID 1a2b parsed as %d", id)
+	}
+	if id.String() != "1a2b" {
+		t.Fatalf("set ID 1a2b formatted as %s", id.String())
+	}
+
+	if id, err = pto3.ParseSetID("1A2B"); err != nil || id.String() != "1a2b" {
+		t.Fatalf("set ID 1A2B parsed as %v (%v)", id, err)
+	}
+
+	for _, s := range []string{"", "0x1a", "0X1a", "-1", "+1", "xyz", "1a 2b", "10000000000000000"} {
+		if _, err := pto3.ParseSetID(s); err == nil {
+			t.Errorf("set ID %q parsed without error", s)
+		} else if perr, ok := err.(*pto3.PTOError); !ok || perr.Status() != 400 {
+			t.Errorf("set ID %q rejected with unexpected error %v", s, err)
+		}
+	}
+}
+
+// BenchmarkObservationInsertion compares loading observations with COPY, as
+// all ingestion paths do, against inserting them one row at a time in a
+// transaction. Each operation inserts the same 10000 observations.
+func BenchmarkObservationInsertion(b *testing.B) {
+	const count = 10000
+
+	spec := obsgen.DefaultSpecs()[0]
+	spec.Count = count
+	spec.Start = "2016-01-01T00:00:00Z"
+	spec.Analyzer = "https://localhost:8383/bench_analyzer.json"
+	spec.Seed = 42
+
+	tf, err := ioutil.TempFile("", "pto3-bench-insert")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(tf.Name())
+	err = spec.Generate(tf, true)
+	tf.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	loader, err := pto3.NewLoader(TestDB)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// load once to resolve conditions and paths for row-by-row insertion
+	set, err := loader.LoadSet(tf.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	var obsdata []pto3.Observation
+	if err := TestDB.Model(&obsdata).Where("set_id = ?", set.ID).Select(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := loader.LoadSet(tf.Name()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("rows", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tx, err := TestDB.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for j := range obsdata {
+				obs := obsdata[j]
+				obs.ID = 0
+				if err := tx.Insert(&obs); err != nil {
+					tx.Rollback()
+					b.Fatal(err)
+				}
+			}
+			tx.Rollback()
+		}
+	})
+}
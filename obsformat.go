@@ -0,0 +1,190 @@
+package pto3
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Observation file formats. In both formats, each line of an observation file
+// is a JSON value: observation set metadata is a JSON object, and each
+// observation is either a JSON array of strings, optionally followed by a
+// per-observation metadata object (version 1), or a JSON object with named
+// fields (version 2). Version 2 objects are distinguished from
+// metadata objects by the presence of any of the keys time_start, time_end,
+// path, or condition, which therefore must not appear in set metadata. Both
+// formats may be mixed within a file.
+const (
+	ObsFormatV1 = 1
+	ObsFormatV2 = 2
+)
+
+// obsRecordKeys are the keys marking a JSON object as a version 2
+// observation rather than metadata.
+var obsRecordKeys = []string{"time_start", "time_end", "path", "condition"}
+
+// obsRecordV2 is a single observation in version 2 observation file format.
+// Values are typed: numeric and boolean values are JSON numbers and booleans,
+// and all other values are strings.
+type obsRecordV2 struct {
+	Set       string                 `json:"set,omitempty"`
+	TimeStart string                 `json:"time_start"`
+	TimeEnd   string                 `json:"time_end"`
+	Path      string                 `json:"path"`
+	Condition string                 `json:"condition"`
+	Value     json.RawMessage        `json:"value,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// decodeObsLine decodes an observation file line containing an observation in
+// either format into a version 1 string slice (set ID, start time, end time,
+// path, condition, and value if present), and per-observation metadata, if
+// any. It returns false if the line is not an observation (i.e., it is
+// metadata).
+func decodeObsLine(line []byte) ([]string, map[string]interface{}, bool, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil, false, nil
+	}
+
+	switch line[0] {
+	case '[':
+		var elements []json.RawMessage
+		if err := json.Unmarshal(line, &elements); err != nil {
+			return nil, nil, true, err
+		}
+		if len(elements) < 5 {
+			return nil, nil, true, PTOErrorf("Observation requires at least five elements")
+		}
+
+		var md map[string]interface{}
+		if len(elements) > 6 {
+			if err := json.Unmarshal(elements[6], &md); err != nil {
+				return nil, nil, true, PTOErrorf("Observation metadata must be a JSON object")
+			}
+			elements = elements[:6]
+		}
+
+		jslice := make([]string, len(elements))
+		for i := range elements {
+			if err := json.Unmarshal(elements[i], &jslice[i]); err != nil {
+				return nil, nil, true, err
+			}
+		}
+		return jslice, md, true, nil
+
+	case '{':
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(line, &fields); err != nil {
+			return nil, nil, false, err
+		}
+
+		isObs := false
+		for _, k := range obsRecordKeys {
+			if _, ok := fields[k]; ok {
+				isObs = true
+				break
+			}
+		}
+		if !isObs {
+			return nil, nil, false, nil
+		}
+
+		var rec obsRecordV2
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, nil, true, err
+		}
+		if rec.TimeStart == "" || rec.TimeEnd == "" || rec.Path == "" || rec.Condition == "" {
+			return nil, nil, true, PTOErrorf("Observation requires time_start, time_end, path, and condition")
+		}
+
+		jslice := []string{rec.Set, rec.TimeStart, rec.TimeEnd, rec.Path, rec.Condition}
+		if len(rec.Value) > 0 {
+			value, err := decodeObsValue(rec.Value)
+			if err != nil {
+				return nil, nil, true, err
+			}
+			if value != "" {
+				jslice = append(jslice, value)
+			}
+		}
+
+		return jslice, rec.Metadata, true, nil
+	}
+
+	return nil, nil, false, nil
+}
+
+// isObservationLine returns true if an observation file line contains an
+// observation in either format, as opposed to metadata.
+func isObservationLine(line []byte) bool {
+	_, _, isObs, _ := decodeObsLine(line)
+	return isObs
+}
+
+// decodeObsValue converts a typed version 2 observation value to its string
+// representation.
+func decodeObsValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+
+	switch tv := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return tv, nil
+	case float64, bool:
+		return string(bytes.TrimSpace(raw)), nil
+	default:
+		return "", PTOErrorf("observation value must be a string, number, or boolean")
+	}
+}
+
+// encodeObsValue converts an observation value to a typed version 2 value:
+// values which are JSON numbers or booleans are encoded as such, and all
+// others as strings.
+func encodeObsValue(value string) (json.RawMessage, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	if value == strings.TrimSpace(value) {
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err == nil {
+			switch v.(type) {
+			case float64, bool:
+				return json.RawMessage(value), nil
+			}
+		}
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(b), nil
+}
+
+// MarshalJSONV2 turns this Observation into a JSON object suitable for use as
+// a line in a version 2 observation file.
+func (obs *Observation) MarshalJSONV2() ([]byte, error) {
+	value, err := encodeObsValue(obs.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := obsRecordV2{
+		Set:       SetID(obs.SetID).String(),
+		TimeStart: obs.TimeStart.UTC().Format(time.RFC3339),
+		TimeEnd:   obs.TimeEnd.UTC().Format(time.RFC3339),
+		Path:      obs.Path.String,
+		Condition: obs.Condition.Name,
+		Value:     value,
+		Metadata:  obs.Metadata,
+	}
+
+	return json.Marshal(&rec)
+}
@@ -0,0 +1,333 @@
+// Package obsgen generates synthetic observation files, for testing,
+// benchmarking, and demonstrating a PTO. Each observation set is described by
+// a Spec, which may be read from JSON; for example,
+//
+//	[{
+//	    "source4": "10.33.44.55",
+//	    "target4_prefixes": ["10.11.12.", "10.13.14."],
+//	    "conditions": {"pto.test.color.red": 3, "pto.test.color.blue": 1},
+//	    "values": {"0": 9, "1": 1},
+//	    "count": 1000,
+//	    "start": "2018-01-01T00:00:00Z",
+//	    "rate": 0.1,
+//	    "seed": 42
+//	}]
+//
+// describes a set of 1000 observations from a single IPv4 source, starting
+// at the beginning of 2018, about one every ten seconds. The obsgen command
+// writes observation files from such a list of specs.
+package obsgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// DefaultAnalyzer is the analyzer metadata link given in generated
+// observation set metadata, unless the spec gives another.
+const DefaultAnalyzer = "https://raw.githubusercontent.com/mami-project/pto3-go/master/obsgen/ptoanalyzer.json"
+
+// Spec describes a synthetic observation set: observations of paths from a
+// single IPv4 or IPv6 source to random targets in the given prefixes, with
+// conditions and values drawn with the given relative prevalence, starting
+// at a given time at a given average rate. Specs are read from JSON, with
+// the keys given below.
+type Spec struct {
+	// Source addresses of IPv4 and IPv6 paths
+	Source4 string `json:"source4"`
+	Source6 string `json:"source6"`
+
+	// Chance out of 256 that a path is IPv4; if no IPv6 source is given,
+	// all paths are IPv4, and vice versa
+	IP4Bias int `json:"ip4_bias"`
+
+	// Target prefixes, to which a random final octet (IPv4) or hextet
+	// (IPv6) is appended
+	Target4Prefixes []string `json:"target4_prefixes"`
+	Target6Prefixes []string `json:"target6_prefixes"`
+
+	// Relative prevalence of each condition
+	Conditions map[string]int `json:"conditions"`
+
+	// Relative prevalence of each value; observations have no value if
+	// empty
+	Values map[string]int `json:"values,omitempty"`
+
+	// Number of observations to generate
+	Count int `json:"count"`
+
+	// Start time of the first observation, in RFC3339 format; default now
+	Start string `json:"start,omitempty"`
+
+	// Average number of observations started per second; default 2
+	Rate float64 `json:"rate,omitempty"`
+
+	// Maximum duration of an observation, as a Go duration; default 2s
+	MaxDuration string `json:"max_duration,omitempty"`
+
+	// Analyzer metadata link; default DefaultAnalyzer
+	Analyzer string `json:"analyzer,omitempty"`
+
+	// Random seed; if zero, a seed is chosen from the current time
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// DefaultSpecs returns the specs used to generate the PTO's test data: one
+// for each of six sources, each observing 14400 test color conditions on
+// paths to targets in documentation prefixes.
+func DefaultSpecs() []Spec {
+	sources4 := []string{
+		"10.33.44.55",
+		"10.33.44.66",
+		"10.33.44.77",
+		"10.33.44.88",
+		"10.33.44.99",
+		"10.33.44.121",
+	}
+	sources6 := []string{
+		"2001:db8:e55:5::33",
+		"2001:db8:e66:6::33",
+		"2001:db8:e77:7::33",
+		"2001:db8:e88:8::33",
+		"2001:db8:e99:9::33",
+		"2001:db8:eaa:a::33",
+	}
+
+	out := make([]Spec, len(sources4))
+	for i := range sources4 {
+		out[i] = Spec{
+			Source4: sources4[i],
+			Source6: sources6[i],
+			IP4Bias: 200,
+			Target4Prefixes: []string{
+				"10.11.12.",
+				"10.13.14.",
+				"10.15.16.",
+				"10.17.18.",
+				"10.19.20.",
+			},
+			Target6Prefixes: []string{
+				"2001:db8:82:83::",
+				"2001:db8:84:8a::",
+			},
+			Conditions: map[string]int{
+				"pto.test.color.red":             8,
+				"pto.test.color.orange":          7,
+				"pto.test.color.yellow":          6,
+				"pto.test.color.green":           5,
+				"pto.test.color.blue":            4,
+				"pto.test.color.indigo":          3,
+				"pto.test.color.violet":          2,
+				"pto.test.color.none_more_black": 1,
+			},
+			Count: 14400,
+		}
+	}
+
+	return out
+}
+
+// LoadSpecs reads a JSON array of specs from a file.
+func LoadSpecs(filename string) ([]Spec, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, pto3.PTOWrapError(err)
+	}
+
+	var specs []Spec
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, pto3.PTOErrorf("cannot parse specs in %s: %s", filename, err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	for i := range specs {
+		if err := specs[i].validate(); err != nil {
+			return nil, pto3.PTOErrorf("spec %d in %s: %s", i, filename, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	return specs, nil
+}
+
+func (spec *Spec) validate() error {
+	if spec.Source4 == "" && spec.Source6 == "" {
+		return pto3.PTOErrorf("no source address")
+	}
+	if spec.Source4 != "" && len(spec.Target4Prefixes) == 0 {
+		return pto3.PTOErrorf("IPv4 source without IPv4 target prefixes")
+	}
+	if spec.Source6 != "" && len(spec.Target6Prefixes) == 0 {
+		return pto3.PTOErrorf("IPv6 source without IPv6 target prefixes")
+	}
+	if len(spec.Conditions) == 0 {
+		return pto3.PTOErrorf("no conditions")
+	}
+	if spec.Count < 0 {
+		return pto3.PTOErrorf("negative count")
+	}
+	if spec.Rate < 0 {
+		return pto3.PTOErrorf("negative rate")
+	}
+	if spec.Start != "" {
+		if _, err := time.Parse(time.RFC3339, spec.Start); err != nil {
+			return pto3.PTOErrorf("bad start time %s: %s", spec.Start, err.Error())
+		}
+	}
+	if spec.MaxDuration != "" {
+		if d, err := time.ParseDuration(spec.MaxDuration); err != nil {
+			return pto3.PTOErrorf("bad max_duration %s: %s", spec.MaxDuration, err.Error())
+		} else if d <= 0 {
+			return pto3.PTOErrorf("max_duration must be positive")
+		}
+	}
+	return nil
+}
+
+// weightedChoice picks keys from a map at random, with probability
+// proportional to their values.
+type weightedChoice []string
+
+func newWeightedChoice(weights map[string]int) weightedChoice {
+	keys := make([]string, 0, len(weights))
+	for k := range weights {
+		keys = append(keys, k)
+	}
+	// sort so that generation is reproducible for a given seed
+	sort.Strings(keys)
+
+	out := make(weightedChoice, 0)
+	for _, k := range keys {
+		for j := 0; j < weights[k]; j++ {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func (wc weightedChoice) pick(r *rand.Rand) string {
+	return wc[r.Intn(len(wc))]
+}
+
+// distinct returns the distinct choices, in order.
+func (wc weightedChoice) distinct() []string {
+	out := make([]string, 0)
+	for _, k := range wc {
+		if len(out) == 0 || out[len(out)-1] != k {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// Generate writes the observations described by this spec to a writer in
+// observation file format. If withMetadata is true, the observations are
+// preceded by a line of observation set metadata, so that the output can be
+// loaded as a new observation set.
+func (spec *Spec) Generate(out io.Writer, withMetadata bool) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	seed := spec.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+
+	conditions := newWeightedChoice(spec.Conditions)
+	if len(conditions) == 0 {
+		return pto3.PTOErrorf("no condition has positive prevalence")
+	}
+	var values weightedChoice
+	if len(spec.Values) > 0 {
+		values = newWeightedChoice(spec.Values)
+		if len(values) == 0 {
+			return pto3.PTOErrorf("no value has positive prevalence")
+		}
+	}
+
+	// emit metadata record
+	if withMetadata {
+		md := map[string]interface{}{
+			"_analyzer":   spec.Analyzer,
+			"_sources":    []string{},
+			"_conditions": conditions.distinct(),
+		}
+		if spec.Analyzer == "" {
+			md["_analyzer"] = DefaultAnalyzer
+		}
+		b, err := json.Marshal(md)
+		if err != nil {
+			return pto3.PTOWrapError(err)
+		}
+		if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+			return pto3.PTOWrapError(err)
+		}
+	}
+
+	// start the clock
+	clock := time.Now().UTC()
+	if spec.Start != "" {
+		clock, _ = time.Parse(time.RFC3339, spec.Start)
+		clock = clock.UTC()
+	}
+
+	rate := spec.Rate
+	if rate == 0 {
+		rate = 2
+	}
+	maxInterval := int64(2 * float64(time.Second) / rate)
+	if maxInterval < 1 {
+		maxInterval = 1
+	}
+
+	maxDuration := 2 * time.Second
+	if spec.MaxDuration != "" {
+		maxDuration, _ = time.ParseDuration(spec.MaxDuration)
+	}
+
+	// now emit some observations as ndjson
+	for i := 0; i < spec.Count; i++ {
+
+		// generate v4 or v6 path
+		var path string
+		if spec.Source6 == "" || (spec.Source4 != "" && r.Intn(256) < spec.IP4Bias) {
+			path = fmt.Sprintf("%s * %s%d",
+				spec.Source4,
+				spec.Target4Prefixes[r.Intn(len(spec.Target4Prefixes))],
+				r.Intn(256))
+		} else {
+			path = fmt.Sprintf("%s * %s%x",
+				spec.Source6,
+				spec.Target6Prefixes[r.Intn(len(spec.Target6Prefixes))],
+				r.Intn(65536))
+		}
+
+		// get start and end times and advance the clock
+		start := clock
+		end := start.Add(time.Duration(r.Int63n(int64(maxDuration))))
+		clock = clock.Add(time.Duration(r.Int63n(maxInterval)))
+
+		// now print a row, with a value if we have them
+		row := []string{"", start.Format(time.RFC3339), end.Format(time.RFC3339), path, conditions.pick(r)}
+		if values != nil {
+			row = append(row, values.pick(r))
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			return pto3.PTOWrapError(err)
+		}
+		if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+			return pto3.PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package obsgen_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/obsgen"
+)
+
+func TestGenerate(t *testing.T) {
+	spec := obsgen.Spec{
+		Source4:         "10.33.44.55",
+		Target4Prefixes: []string{"10.11.12."},
+		Conditions:      map[string]int{"pto.test.color.red": 3, "pto.test.color.blue": 1},
+		Values:          map[string]int{"0": 1, "1": 1},
+		Count:           100,
+		Start:           "2018-01-01T00:00:00Z",
+		Rate:            0.1,
+		Seed:            42,
+	}
+
+	out := new(bytes.Buffer)
+	if err := spec.Generate(out, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// generation is reproducible for a given seed
+	again := new(bytes.Buffer)
+	if err := spec.Generate(again, true); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), again.Bytes()) {
+		t.Fatal("generation with the same seed produced different output")
+	}
+
+	in := bufio.NewScanner(out)
+	if !in.Scan() {
+		t.Fatal("no metadata line")
+	}
+	var md map[string]interface{}
+	if err := json.Unmarshal(in.Bytes(), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md["_analyzer"] != obsgen.DefaultAnalyzer {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+	if conditions, ok := md["_conditions"].([]interface{}); !ok || len(conditions) != 2 {
+		t.Fatalf("unexpected conditions in metadata %v", md)
+	}
+
+	start, _ := time.Parse(time.RFC3339, spec.Start)
+	n := 0
+	for in.Scan() {
+		var obs pto3.Observation
+		if err := json.Unmarshal(in.Bytes(), &obs); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := spec.Conditions[obs.Condition.Name]; !ok {
+			t.Fatalf("unexpected condition %s", obs.Condition.Name)
+		}
+		if _, ok := spec.Values[obs.Value]; !ok {
+			t.Fatalf("unexpected value %s", obs.Value)
+		}
+		if obs.TimeStart.Before(start) || obs.TimeEnd.Before(*obs.TimeStart) {
+			t.Fatalf("bad observation times %v to %v", obs.TimeStart, obs.TimeEnd)
+		}
+		n++
+	}
+	if n != spec.Count {
+		t.Fatalf("generated %d observations, expected %d", n, spec.Count)
+	}
+}
+
+func TestLoadSpecs(t *testing.T) {
+	specfile, err := ioutil.TempFile("", "obsgen-specs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(specfile.Name())
+
+	if _, err := specfile.WriteString(`[{"source6": "2001:db8::1", "target6_prefixes": ["2001:db8:1::"], "conditions": {"pto.test.ok": 1}, "count": 10}, {"source4": "10.0.0.1", "conditions": {"pto.test.ok": 1}}]`); err != nil {
+		t.Fatal(err)
+	}
+	specfile.Close()
+
+	if _, err := obsgen.LoadSpecs(specfile.Name()); err == nil {
+		t.Fatal("spec with IPv4 source and no IPv4 target prefixes loaded without error")
+	}
+
+	if err := ioutil.WriteFile(specfile.Name(), []byte(`[{"source6": "2001:db8::1", "target6_prefixes": ["2001:db8:1::"], "conditions": {"pto.test.ok": 1}, "count": 10}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	specs, err := obsgen.LoadSpecs(specfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Count != 10 || specs[0].Source6 != "2001:db8::1" {
+		t.Fatalf("unexpected specs %v", specs)
+	}
+
+	out := new(bytes.Buffer)
+	if err := specs[0].Generate(out, false); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != 10 {
+		t.Fatalf("generated %d lines, expected 10", lines)
+	}
+}
@@ -0,0 +1,120 @@
+package pto3
+
+import (
+	"bufio"
+	"io"
+	"sort"
+)
+
+// ObservationWriter writes observations to a stream in observation file
+// format, buffering output to reduce the number of writes to the underlying
+// stream. Observations written to an ObservationWriter are not guaranteed to
+// reach the underlying stream until Flush is called.
+type ObservationWriter struct {
+	out        *bufio.Writer
+	sorted     bool
+	format     int
+	pending    []Observation
+	flushEvery int
+	unflushed  int
+}
+
+// NewObservationWriter creates a new ObservationWriter writing to the given
+// stream.
+func NewObservationWriter(out io.Writer) *ObservationWriter {
+	return &ObservationWriter{out: bufio.NewWriter(out)}
+}
+
+// SortByTimeStart causes this writer to hold observations until the next
+// flush, then write them stably sorted by start time. Observations are only
+// sorted with respect to other observations written since the last flush.
+func (ow *ObservationWriter) SortByTimeStart() {
+	ow.sorted = true
+}
+
+// FlushEvery causes this writer to flush automatically after every n
+// observations. A value of zero or less disables automatic flushing.
+func (ow *ObservationWriter) FlushEvery(n int) {
+	ow.flushEvery = n
+}
+
+// UseFormat causes this writer to write observations in the given observation
+// file format (ObsFormatV1 or ObsFormatV2). Writers use ObsFormatV1 by
+// default.
+func (ow *ObservationWriter) UseFormat(format int) {
+	ow.format = format
+}
+
+func (ow *ObservationWriter) writeLine(obs *Observation) error {
+	var b []byte
+	var err error
+	if ow.format == ObsFormatV2 {
+		b, err = obs.MarshalJSONV2()
+	} else {
+		b, err = obs.MarshalJSON()
+	}
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := ow.out.Write(b); err != nil {
+		return PTOWrapError(err)
+	}
+	if err := ow.out.WriteByte('\n'); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// WriteObservation writes a single observation.
+func (ow *ObservationWriter) WriteObservation(obs *Observation) error {
+	if ow.sorted {
+		ow.pending = append(ow.pending, *obs)
+	} else if err := ow.writeLine(obs); err != nil {
+		return err
+	}
+
+	ow.unflushed++
+	if ow.flushEvery > 0 && ow.unflushed >= ow.flushEvery {
+		return ow.Flush()
+	}
+
+	return nil
+}
+
+// WriteObservations writes a slice of observations.
+func (ow *ObservationWriter) WriteObservations(obsdat []Observation) error {
+	for i := range obsdat {
+		if err := ow.WriteObservation(&obsdat[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes all pending observations to the underlying stream, sorting
+// them first if sorting is enabled.
+func (ow *ObservationWriter) Flush() error {
+	if ow.sorted {
+		sort.SliceStable(ow.pending, func(i, j int) bool {
+			a, b := ow.pending[i].TimeStart, ow.pending[j].TimeStart
+			if a == nil || b == nil {
+				return a == nil && b != nil
+			}
+			return a.Before(*b)
+		})
+
+		for i := range ow.pending {
+			if err := ow.writeLine(&ow.pending[i]); err != nil {
+				return err
+			}
+		}
+		ow.pending = ow.pending[:0]
+	}
+
+	ow.unflushed = 0
+
+	if err := ow.out.Flush(); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package papi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// requestIDHeader is the response header carrying the identifier under which
+// a request is recorded in the audit log.
+const requestIDHeader = "X-Request-ID"
+
+// readOnlyOperations are operations using methods other than GET and HEAD
+// which do not change the observatory, and are therefore not audited.
+var readOnlyOperations = map[string]bool{
+	"POST /obs/by_metadata":              true,
+	"POST /query/sql":                    true,
+	"GET /query/submit":                  true,
+	"POST /query/submit":                 true,
+	"POST /query/retrieve":               true,
+	"POST /query/named/{name}/execute":   true,
+	"POST /query/template/{name}/submit": true,
+}
+
+// RequestPrincipal returns the principal recorded in the audit log for a
+// request: the fingerprint of the API key presented with it, or
+// pto3.AnonymousPrincipal if none was presented.
+func RequestPrincipal(r *http.Request) string {
+	return pto3.APIKeyPrincipal(apiKeyForRequest(r))
+}
+
+// AuditAPI records mutating operations in the audit log, and serves the log
+// to administrators.
+type AuditAPI struct {
+	config *pto3.PTOConfiguration
+	azr    Authorizer
+	log    *pto3.AuditLog
+}
+
+// mutating returns true if a request may change the observatory.
+func mutating(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return !readOnlyOperations[r.Method+" "+routeName(r)]
+}
+
+// audit is middleware which assigns an identifier to each request routed by
+// the router, and records each mutating request in the audit log once it has
+// been handled.
+func (aa *AuditAPI) audit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqid := pto3.NewRequestID()
+		w.Header().Set(requestIDHeader, reqid)
+
+		if !mutating(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		lw := LoggingResponseWriter{w: w}
+		next.ServeHTTP(&lw, r)
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		if err := aa.log.Record(&pto3.AuditRecord{
+			Principal: RequestPrincipal(r),
+			Operation: r.Method + " " + routeName(r),
+			Target:    r.URL.Path,
+			RequestID: reqid,
+			Status:    status,
+		}); err != nil {
+			log.Printf("failed to record request %s in audit log: %v", reqid, err)
+		}
+	})
+}
+
+type auditReport struct {
+	Records []pto3.AuditRecord `json:"records"`
+}
+
+// handleAudit handles GET /admin/audit. It takes optional time_start and
+// time_end parameters (RFC3339), principal, and target (a path prefix), and
+// returns the matching audit records in the order they were recorded.
+func (aa *AuditAPI) handleAudit(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	start, end, err := parseTimeRange(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing time range", err)
+		return
+	}
+
+	records, err := aa.log.Records(&pto3.AuditFilter{
+		Start:     start,
+		End:       end,
+		Principal: r.Form.Get("principal"),
+		Target:    r.Form.Get("target"),
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading audit log", err)
+		return
+	}
+
+	b, err := json.Marshal(auditReport{Records: records})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling audit records", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func (aa *AuditAPI) additionalHeaders(w http.ResponseWriter) {
+	if aa.config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", aa.config.AllowOrigin)
+	}
+}
+
+func (aa *AuditAPI) addRoutes(r *mux.Router, l *log.Logger) {
+	r.HandleFunc("/admin/audit", LogAccess(l, aa.handleAudit)).Methods("GET")
+}
+
+// NewAuditAPI creates an audit API, recording all mutating requests routed by
+// the given router. It returns nil if no audit log is configured.
+func NewAuditAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*AuditAPI, error) {
+	al, err := pto3.NewAuditLog(config)
+	if err != nil || al == nil {
+		return nil, err
+	}
+
+	aa := new(AuditAPI)
+	aa.config = config
+	aa.azr = azr
+	aa.log = al
+
+	r.Use(aa.audit)
+	aa.addRoutes(r, config.AccessLogger())
+
+	return aa, nil
+}
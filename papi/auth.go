@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+
+	pto3 "github.com/mami-project/pto3-go"
 )
 
 // For now, all capabilities are authorized.
@@ -49,7 +51,7 @@ func (azr *APIKeyAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request
 		authfield := strings.Fields(authhdr)
 
 		if len(authfield) < 2 {
-			http.Error(w, fmt.Sprintf("malformed Authorization header: %v", authhdr), http.StatusBadRequest)
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadAuthorization, fmt.Sprintf("malformed Authorization header: %v", authhdr))
 			return false
 		} else if authfield[0] == "APIKEY" {
 			keyperms := azr.APIKeys[authfield[1]]
@@ -60,7 +62,7 @@ func (azr *APIKeyAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request
 				}
 			}
 		} else {
-			http.Error(w, fmt.Sprintf("unsupported authorization type %s", authfield[0]), http.StatusBadRequest)
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadAuthorization, fmt.Sprintf("unsupported authorization type %s", authfield[0]))
 			return false
 		}
 	}
@@ -68,12 +70,34 @@ func (azr *APIKeyAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request
 	if perms[permission] {
 		return true
 	} else {
-		http.Error(w, fmt.Sprintf("not authorized for %s", permission), http.StatusForbidden)
+		pto3.ProblemHTTP(w, http.StatusForbidden, pto3.ErrCodeForbidden, fmt.Sprintf("not authorized for %s", permission))
 		return false
 	}
 
 }
 
+// KnowsAPIKey returns true if the given API key is configured in this
+// authorizer.
+func (azr *APIKeyAuthorizer) KnowsAPIKey(key string) bool {
+	if key == "default" {
+		return false
+	}
+	_, ok := azr.APIKeys[key]
+	return ok
+}
+
+// apiKeyKnower is implemented by authorizers which can tell whether an API
+// key is configured.
+type apiKeyKnower interface {
+	KnowsAPIKey(key string) bool
+}
+
+// knownAPIKey returns true if an authorizer recognizes an API key.
+func knownAPIKey(azr Authorizer, key string) bool {
+	k, ok := azr.(apiKeyKnower)
+	return ok && k.KnowsAPIKey(key)
+}
+
 func LoadAPIKeys(filename string) (*APIKeyAuthorizer, error) {
 	var azr APIKeyAuthorizer
 
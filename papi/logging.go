@@ -3,7 +3,16 @@ package papi
 import (
 	"log"
 	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LoggingResponseWriter struct {
@@ -31,12 +40,59 @@ func (lw *LoggingResponseWriter) Write(b []byte) (int, error) {
 
 type HandlerFunc func(http.ResponseWriter, *http.Request)
 
+// LogAccess wraps a handler to log each request it handles to the given
+// logger, and to record a trace span for it, continuing any trace whose
+// context is given in the request headers.
 func LogAccess(l *log.Logger, handler HandlerFunc) HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		lw := LoggingResponseWriter{w: w}
 		start := time.Now()
-		handler(&lw, r)
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := pto3.Tracer().Start(ctx, r.Method+" "+routeName(r),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", redactedURL(r.URL).RequestURI())))
+		defer span.End()
+
+		handler(&lw, r.WithContext(ctx))
 		duration := time.Since(start)
-		l.Printf("%s %s %d %d %v", r.Method, r.URL.String(), lw.length, lw.status, duration)
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+
+		l.Printf("%s %s %d %d %v", r.Method, redactedURL(r.URL).String(), lw.length, lw.status, duration)
+	}
+}
+
+// redactedURL returns a URL without the signature parameter of shared links,
+// which grants access to the shared resource and must not be logged.
+func redactedURL(u *url.URL) *url.URL {
+	params := u.Query()
+	if params.Get("signature") == "" {
+		return u
+	}
+	params.Del("signature")
+
+	out := *u
+	out.RawQuery = params.Encode()
+	return &out
+}
+
+// routeName returns the path template of the route matching a request, or
+// its path if no route matched.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
 	}
+	return r.URL.Path
 }
@@ -1,14 +1,19 @@
 package papi
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/gorilla/mux"
@@ -19,6 +24,7 @@ type ObsAPI struct {
 	config *pto3.PTOConfiguration
 	azr    Authorizer
 	db     *pg.DB
+	rds    pto3.RawStore
 }
 
 func (oa *ObsAPI) writeMetadataResponse(w http.ResponseWriter, set *pto3.ObservationSet, status int) {
@@ -37,11 +43,26 @@ func (oa *ObsAPI) writeMetadataResponse(w http.ResponseWriter, set *pto3.Observa
 	w.Write(b)
 }
 
+// enqueueReplication queues a newly loaded or appended observation set for
+// pushing to the configured downstream PTOs. Failure to queue is logged, but does not fail
+// the request, as the set itself has been loaded.
+func (oa *ObsAPI) enqueueReplication(set *pto3.ObservationSet) {
+	if len(oa.config.Downstreams) == 0 {
+		return
+	}
+
+	if err := pto3.EnqueueReplication(oa.config, oa.db, set.ID); err != nil {
+		log.Printf("error queueing replication of set %x: %v", set.ID, err)
+	}
+}
+
 type setList struct {
-	Sets       []string `json:"sets"`
-	Next       string   `json:"next"`
-	Prev       string   `json:"prev"`
-	TotalCount int      `json:"total_count"`
+	Sets       []string                          `json:"sets"`
+	States     map[string]string                 `json:"states"`
+	Details    map[string]map[string]interface{} `json:"details"`
+	Next       string                            `json:"next"`
+	Prev       string                            `json:"prev"`
+	TotalCount int                               `json:"total_count"`
 }
 
 func (sl *setList) MarshalJSON() ([]byte, error) {
@@ -49,6 +70,14 @@ func (sl *setList) MarshalJSON() ([]byte, error) {
 
 	out["sets"] = sl.Sets
 
+	if len(sl.States) > 0 {
+		out["states"] = sl.States
+	}
+
+	if sl.Details != nil {
+		out["details"] = sl.Details
+	}
+
 	if sl.Next != "" {
 		out["next"] = sl.Next
 	}
@@ -60,24 +89,96 @@ func (sl *setList) MarshalJSON() ([]byte, error) {
 	return json.Marshal(out)
 }
 
-func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, pageVal string) {
+// setListCursorPrefix distinguishes set list cursor tokens from other values.
+const setListCursorPrefix = "sets:"
+
+// encodeSetListCursor encodes a set ID cursor as an opaque token for use in
+// set list links.
+func encodeSetListCursor(cursor int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(setListCursorPrefix + strconv.Itoa(cursor)))
+}
+
+// decodeSetListCursor decodes a set list cursor token.
+func decodeSetListCursor(token string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || !strings.HasPrefix(string(b), setListCursorPrefix) {
+		return 0, pto3.PTOErrorf("bad cursor %s", token).StatusIs(http.StatusBadRequest).CodeIs(pto3.ErrCodeBadForm)
+	}
+
+	cursor, err := strconv.ParseUint(strings.TrimPrefix(string(b), setListCursorPrefix), 10, 63)
+	if err != nil {
+		return 0, pto3.PTOErrorf("bad cursor %s", token).StatusIs(http.StatusBadRequest).CodeIs(pto3.ErrCodeBadForm)
+	}
+
+	return int(cursor), nil
+}
+
+// writeSetListPage writes a page of the list of all observation sets,
+// selected by the cursor parameter in the given form, with links to the next
+// and previous pages. Unlike writeSetListResponse, it selects only the set
+// IDs on the page from the database.
+func (oa *ObsAPI) writeSetListPage(w http.ResponseWriter, form url.Values) {
+	cursor := 0
+	if s := form.Get("cursor"); s != "" {
+		var err error
+		if cursor, err = decodeSetListCursor(s); err != nil {
+			pto3.HandleErrorHTTP(w, "parsing cursor", err)
+			return
+		}
+	}
+
+	page, err := pto3.SelectObservationSetIDPage(oa.db, cursor, oa.config.PageLength)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "listing set IDs", err)
+		return
+	}
+
+	// carry detail through to the next and previous pages
+	var detailParam string
+	if detail, _ := strconv.ParseBool(form.Get("detail")); detail {
+		detailParam = "&detail=1"
+	}
+
+	var out setList
+	if page.HasNext {
+		out.Next, _ = oa.config.LinkTo("/obs?cursor=" + encodeSetListCursor(page.Next) + detailParam)
+	}
+	if page.HasPrev {
+		out.Prev, _ = oa.config.LinkTo("/obs?cursor=" + encodeSetListCursor(page.Prev) + detailParam)
+	}
+
+	oa.writeSetList(w, &out, page.IDs, form)
+}
+
+func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, form url.Values, path string) {
 	// slice the array based on page
-	page64, _ := strconv.ParseInt(pageVal, 10, 64)
+	page64, _ := strconv.ParseInt(form.Get("page"), 10, 64)
 	page := int(page64)
 	offset := page * oa.config.PageLength
 
+	// links keep the form, and move the page
+	linkTo := func(page int) string {
+		v := url.Values{}
+		for k, vv := range form {
+			v[k] = vv
+		}
+		v.Set("page", strconv.Itoa(page))
+		link, _ := oa.config.LinkTo(path + "?" + v.Encode())
+		return link
+	}
+
 	var out setList
 
 	// paginate if we need to
 	if page > 0 || len(setIds) > (page+1)*oa.config.PageLength {
 
 		if len(setIds) > (page+1)*oa.config.PageLength {
-			out.Next, _ = oa.config.LinkTo(fmt.Sprintf("/obs?page=%d", page+1))
+			out.Next = linkTo(page + 1)
 			out.TotalCount = len(setIds)
 		}
 
 		if page > 0 {
-			out.Prev, _ = oa.config.LinkTo(fmt.Sprintf("/obs?page=%d", page-1))
+			out.Prev = linkTo(page - 1)
 			out.TotalCount = len(setIds)
 		}
 
@@ -89,13 +190,72 @@ func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, page
 		setIds = setIds[offset:endOffset]
 	}
 
+	oa.writeSetList(w, &out, setIds, form)
+}
+
+// setListDetails returns the configured detail fields of the metadata of each
+// of the sets with the given IDs, by set link.
+func (oa *ObsAPI) setListDetails(setIds []int) (map[string]map[string]interface{}, error) {
+	sets, err := pto3.ObservationSetsByID(oa.db, setIds)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]map[string]interface{}, len(sets))
+	for i := range sets {
+		b, err := json.Marshal(&sets[i])
+		if err != nil {
+			return nil, pto3.PTOWrapError(err)
+		}
+
+		var meta map[string]interface{}
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return nil, pto3.PTOWrapError(err)
+		}
+
+		detail := make(map[string]interface{})
+		for _, k := range oa.config.SetListDetailFields {
+			if v, ok := meta[k]; ok {
+				detail[k] = v
+			}
+		}
+		out[pto3.LinkForSetID(oa.config, sets[i].ID)] = detail
+	}
+
+	return out, nil
+}
+
+// writeSetList writes a set list response for a page of set IDs, with
+// pagination links already filled in. If the detail parameter in the given
+// form is true, the configured detail fields of each set's metadata are
+// included in the response.
+func (oa *ObsAPI) writeSetList(w http.ResponseWriter, out *setList, setIds []int, form url.Values) {
 	// linkify set IDs
 	out.Sets = make([]string, len(setIds))
 	for i, id := range setIds {
 		out.Sets[i] = pto3.LinkForSetID(oa.config, id)
 	}
 
-	outb, err := json.Marshal(&out)
+	// note sets which are not active
+	states, err := pto3.ObservationSetStates(oa.db, setIds)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set states", err)
+		return
+	}
+	out.States = make(map[string]string, len(states))
+	for id, state := range states {
+		out.States[pto3.LinkForSetID(oa.config, id)] = state
+	}
+
+	// inline metadata if requested
+	if detail, _ := strconv.ParseBool(form.Get("detail")); detail {
+		if out.Details, err = oa.setListDetails(setIds); err != nil {
+			pto3.HandleErrorHTTP(w, "retrieving set details", err)
+			return
+		}
+	}
+
+	outb, err := json.Marshal(out)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "marshaling set list", err)
 		return
@@ -109,6 +269,9 @@ func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, page
 
 // handleListSets handles GET /obs.
 // It returns a JSON object with links to current observation sets in the sets key.
+// The optional time_start and time_end parameters restrict the list to sets
+// with observations in the given time range, and any number of tag parameters
+// to sets with all the given tags.
 func (oa *ObsAPI) handleListSets(w http.ResponseWriter, r *http.Request) {
 
 	// fail if not authorized
@@ -117,17 +280,162 @@ func (oa *ObsAPI) handleListSets(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+	}
+
+	// page through all sets by cursor unless filtering, ordering, or paging
+	// by number
+	order := r.Form.Get("order")
+	if r.Form.Get("page") == "" && r.Form.Get("time_start") == "" && r.Form.Get("time_end") == "" &&
+		len(r.Form["tag"]) == 0 && order == "" && !publicOnly(oa.azr, r, "read_obs") {
+		oa.writeSetListPage(w, r.Form)
+		return
 	}
 
-	// select set IDs into an array
-	setIds, err := pto3.AllObservationSetIDs(oa.db)
+	// select set IDs into an array, in order if requested
+	var setIds []int
+	var err error
+	if order != "" {
+		var descending bool
+		switch r.Form.Get("direction") {
+		case "", "asc":
+		case "desc":
+			descending = true
+		default:
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad direction %s; must be asc or desc", r.Form.Get("direction")))
+			return
+		}
+		setIds, err = pto3.OrderedObservationSetIDs(oa.db, order, descending)
+	} else {
+		setIds, err = pto3.AllObservationSetIDs(oa.db)
+	}
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "listing set IDs", err)
 		return
 	}
 
-	oa.writeSetListResponse(w, setIds, r.Form.Get("page"))
+	// filter by time range if requested, keeping order
+	timeSetIds, ok, err := oa.setIdsInTimeRange(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting set IDs by time range", err)
+		return
+	} else if ok {
+		setIds = intersectSetIds(timeSetIds, setIds, true)
+	}
+
+	// filter by tags if requested
+	if tags := r.Form["tag"]; len(tags) > 0 {
+		tagSetIds, err := pto3.ObservationSetIDsWithTags(oa.db, tags)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by tag", err)
+			return
+		}
+		setIds = intersectSetIds(tagSetIds, setIds, true)
+	}
+
+	// list only public sets to requests allowed by public access
+	if publicOnly(oa.azr, r, "read_obs") {
+		publicSetIds, err := pto3.ObservationSetIDsWithTags(oa.db, []string{PublicTag})
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting public set IDs", err)
+			return
+		}
+		setIds = intersectSetIds(publicSetIds, setIds, true)
+	}
+
+	oa.writeSetListResponse(w, setIds, r.Form, "/obs")
+}
+
+// handleRawDerived handles GET /raw/<campaign>/<file>/derived, listing the
+// observation sets derived from a raw data file, i.e. whose _sources link to
+// the file. It returns a set list as handleListSets does, and takes the same
+// page and detail parameters. If sources are checked against a raw data
+// store, the file must exist.
+func (oa *ObsAPI) handleRawDerived(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
+		return
+	}
+
+	filename, ok := vars["file"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
+		return
+	}
+
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	// make sure the file exists, if we can
+	if oa.rds != nil {
+		if _, err := oa.rds.GetFileMetadata(camname, filename); err != nil {
+			pto3.HandleErrorHTTP(w, "retrieving file metadata", err)
+			return
+		}
+	}
+
+	setIds, err := pto3.ObservationSetIDsDerivedFromRawFile(oa.config, oa.db, camname, filename)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting set IDs by raw file", err)
+		return
+	}
+
+	oa.writeSetListResponse(w, setIds, r.Form, "/raw/"+camname+"/"+filename+"/derived")
+}
+
+// setIdsInTimeRange selects set IDs whose time interval overlaps the range
+// given by the time_start and time_end form parameters. It returns false if
+// neither parameter is present.
+func (oa *ObsAPI) setIdsInTimeRange(form url.Values) ([]int, bool, error) {
+	start, end, err := parseTimeRange(form)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if start == nil && end == nil {
+		return nil, false, nil
+	}
+
+	setIds, err := pto3.ObservationSetIDsInTimeRange(oa.db, start, end)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return setIds, true, nil
+}
+
+// parseTimeRange parses the optional time_start and time_end parameters from a
+// form, returning nil for each one not present.
+func parseTimeRange(form url.Values) (*time.Time, *time.Time, error) {
+	var start, end *time.Time
+
+	if s := form.Get("time_start"); s != "" {
+		t, err := pto3.ParseTime(s)
+		if err != nil {
+			return nil, nil, pto3.PTOErrorf("Error parsing time_start: %s", err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		start = &t
+	}
+
+	if s := form.Get("time_end"); s != "" {
+		t, err := pto3.ParseTime(s)
+		if err != nil {
+			return nil, nil, pto3.PTOErrorf("Error parsing time_end: %s", err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		end = &t
+	}
+
+	return start, end, nil
 }
 
 func intersectSetIds(a []int, b []int, hasSets bool) []int {
@@ -150,7 +458,9 @@ func intersectSetIds(a []int, b []int, hasSets bool) []int {
 
 // handleMetadataQuery handles GET/POST /obs/by_metadata. It requires two
 // URL/form parameters: 'k', the key to search for, and 'v', the value to
-// search for.
+// search for. Any number of 'meta' parameters may additionally be given as
+// metadata filter expressions (see pto3.ParseMetadataFilter), and any number
+// of 'tag' parameters to select sets with all the given tags.
 
 func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
@@ -159,7 +469,7 @@ func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
 	}
 
 	setIds := make([]int, 0)
@@ -232,12 +542,54 @@ func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	timeSetIds, ok, err := oa.setIdsInTimeRange(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting set IDs by time range", err)
+		return
+	} else if ok {
+		setIds = intersectSetIds(setIds, timeSetIds, queryActive)
+		queryActive = true
+	}
+
+	metaExprs := r.Form["meta"]
+	if len(metaExprs) > 0 {
+		filters := make([]pto3.MetadataFilter, len(metaExprs))
+		for i := range metaExprs {
+			mf, err := pto3.ParseMetadataFilter(metaExprs[i])
+			if err != nil {
+				pto3.HandleErrorHTTP(w, "parsing metadata filter", err)
+				return
+			}
+			filters[i] = *mf
+		}
+
+		// handle metadata filter query
+		filterSetIds, err := pto3.ObservationSetIDsWithMetadataFilters(oa.db, filters)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by metadata filter", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, filterSetIds, queryActive)
+		queryActive = true
+	}
+
+	if tags := r.Form["tag"]; len(tags) > 0 {
+		// handle tag query
+		tagSetIds, err := pto3.ObservationSetIDsWithTags(oa.db, tags)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "selecting set IDs by tag", err)
+			return
+		}
+		setIds = intersectSetIds(setIds, tagSetIds, queryActive)
+		queryActive = true
+	}
+
 	if queryActive == false {
-		http.Error(w, "no query parameters given", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "no query parameters given")
 		return
 	}
 
-	oa.writeSetListResponse(w, setIds, r.Form.Get("page"))
+	oa.writeSetListResponse(w, setIds, r.Form, "/obs/by_metadata")
 }
 
 // handleConditionQuery handles GET /obs/conditions. It requires two
@@ -274,6 +626,85 @@ func (oa *ObsAPI) handleConditionQuery(w http.ResponseWriter, r *http.Request) {
 	w.Write(outb)
 }
 
+// conditionSpec specifies a condition to create, either as a bare name or as
+// an object with name and description keys.
+type conditionSpec struct {
+	ID          int    `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func (cs *conditionSpec) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &cs.Name); err == nil {
+		return nil
+	}
+
+	type plainSpec conditionSpec
+	return json.Unmarshal(b, (*plainSpec)(cs))
+}
+
+// handleCreateConditions handles POST /obs/conditions. It requires a JSON
+// object with a conditions key containing an array of conditions to create,
+// each either a condition name or an object with name and optional
+// description keys. Conditions are created in a single transaction; existing
+// conditions are left as they are, but for their descriptions. It writes a
+// response listing the conditions with their IDs.
+func (oa *ObsAPI) handleCreateConditions(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for condition creation must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	var creq struct {
+		Conditions []conditionSpec `json:"conditions"`
+	}
+	if err := json.Unmarshal(b, &creq); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	conditions := make([]pto3.Condition, len(creq.Conditions))
+	for i, cs := range creq.Conditions {
+		conditions[i] = pto3.Condition{Name: cs.Name, Description: cs.Description}
+	}
+
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		return pto3.CreateConditions(t, conditions)
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "creating conditions", err)
+		return
+	}
+
+	for i := range conditions {
+		creq.Conditions[i] = conditionSpec{ID: conditions[i].ID, Name: conditions[i].Name, Description: conditions[i].Description}
+	}
+
+	outb, err := json.Marshal(&creq)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
 // handleCreateSet handles POST /obs/create. It requires a JSON object with
 // observation set metadata in the request. It echoes back the metadata as a
 // JSON object in the response, with a link to the created object in the __link
@@ -286,23 +717,37 @@ func (oa *ObsAPI) handleCreateSet(w http.ResponseWriter, r *http.Request) {
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
 		return
 	}
 
 	// fill in an observation set from supplied metadata
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
 		return
 	}
 
 	var set pto3.ObservationSet
 	if err := json.Unmarshal(b, &set); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, err.Error())
+		return
+	}
+
+	// check local provenance links
+	dangling, err := set.DanglingSources(oa.config, oa.db, oa.rds)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "checking sources", err)
 		return
 	}
+	if len(dangling) > 0 {
+		if oa.config.StrictSources {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, fmt.Sprintf("_sources links to missing resources %v", dangling))
+			return
+		}
+		log.Printf("creating observation set with dangling _sources %v", dangling)
+	}
 
 	// now insert the set in the database
 	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
@@ -329,22 +774,28 @@ func (oa *ObsAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	// get set ID
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	setid, err := pto3.ParseSetID(vars["set"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
 		return
 	}
 
 	set := pto3.ObservationSet{ID: int(setid)}
 	if err = set.SelectByID(oa.db); err != nil {
 		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
 		} else {
 			pto3.HandleErrorHTTP(w, "retrieving set", err)
 		}
 		return
 	}
 
+	// sets not tagged public don't exist for requests allowed by public access
+	if publicOnly(oa.azr, r, "read_obs") && !set.HasTag(PublicTag) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		return
+	}
+
 	// force observation count (ignoring error)
 	set.CountObservations(oa.db)
 	// force interval update (ignoring error)
@@ -365,29 +816,29 @@ func (oa *ObsAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	// fill in set ID from URL
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	setid, err := pto3.ParseSetID(vars["set"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
 		return
 	}
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
 		return
 	}
 
 	// fill in an observation set from supplied metadata
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
 		return
 	}
 
 	var set pto3.ObservationSet
 	if err := json.Unmarshal(b, &set); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, err.Error())
 		return
 	}
 	set.ID = int(setid)
@@ -398,7 +849,7 @@ func (oa *ObsAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	})
 	if err != nil {
 		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
 		} else {
 			pto3.HandleErrorHTTP(w, "updating set metadata", err)
 		}
@@ -408,93 +859,460 @@ func (oa *ObsAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	oa.writeMetadataResponse(w, &set, http.StatusCreated)
 }
 
-// handleDownload handles GET /obs/<set>/data. It requires  Set IDs in the
-// input are ignored. It writes a response containing the all the observations
-// in the set as a newline-delimited JSON stream (of content-type
-// application/vnd.mami.ndjson) in observation set file format.
-
-func (oa *ObsAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
+// handleTag handles PUT and DELETE /obs/<set>/tags/<tag>, adding the tag to
+// or removing it from the set. It writes the set's updated metadata as a JSON
+// object in the response.
+func (oa *ObsAPI) handleTag(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "read_obs_data") {
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
 		return
 	}
 
 	vars := mux.Vars(r)
 
-	// fill in set ID from URL
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	// get set ID
+	setid, err := pto3.ParseSetID(vars["set"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
 		return
 	}
 
-	// retrieve set metadata
 	set := pto3.ObservationSet{ID: int(setid)}
-	if err = set.SelectByID(oa.db); err != nil {
-		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		if r.Method == "DELETE" {
+			err = set.RemoveTags(t, []string{vars["tag"]})
 		} else {
-			pto3.HandleErrorHTTP(w, "retrieving set", err)
+			err = set.AddTags(t, []string{vars["tag"]})
 		}
-		return
-	}
-
-	// fail if no observations exist
-	obscount, err := set.CountObservations(oa.db)
+		if err != nil {
+			return err
+		}
+		return set.SelectByID(t)
+	})
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "counting observations", err)
-		return
-	} else if obscount == 0 {
-		http.Error(w, fmt.Sprintf("Observation set %s has no observations", vars["set"]), http.StatusNotFound)
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		} else {
+			pto3.HandleErrorHTTP(w, "updating set tags", err)
+		}
 		return
 	}
 
-	w.Header().Set("Content-type", "application/vnd.mami.ndjson")
-	oa.additionalHeaders(w)
-	w.WriteHeader(http.StatusOK)
-	if err := set.CopyDataToStream(oa.db, w); err != nil {
-		pto3.HandleErrorHTTP(w, "downloading observation set", err)
-		w.Write([]byte("\n\"error during download\"\n"))
-	}
+	oa.writeMetadataResponse(w, &set, http.StatusOK)
 }
 
-// handleUpload handles PUT /obs/<set>/data. It requires a newline-delimited
-// JSON stream (of content-type application/vnd.mami.ndjson) in observation set
-// file format. Set IDs in the input are ignored. It writes a response
-// containing the set's metadata.
-func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
+// handleDownload handles GET /obs/<set>/data. It writes a response
+// containing the all the observations in the set as a newline-delimited JSON
+// stream (of content-type application/vnd.mami.ndjson) in observation set file
+// format. The optional time_start and time_end parameters, and any number of
+// condition parameters, restrict the download to a slice of the set. If an
+// offset or count parameter is given, it instead writes a single page of
+// observations as a JSON object, as in writeObservationPage. HEAD /obs/<set>/data,
+// or GET with exists_only=1, only checks whether the slice has any
+// observations, as in writeExistence.
+//
+// Full downloads carry the set's sequence marker in the PTO-Sequence header;
+// passing it back as the since parameter downloads only the observations
+// appended to the set after it. Requests with an If-Modified-Since header
+// for a set not modified since receive an empty 304 response. Requests with a
+// valid signature (see handleShare) need no API key.
+
+func (oa *ObsAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+	authorized, signed := authorizeSigned(oa.config, oa.azr, w, r, "read_obs_data")
+	if !authorized {
 		return
 	}
 
 	vars := mux.Vars(r)
 
 	// fill in set ID from URL
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	setid, err := pto3.ParseSetID(vars["set"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
 		return
 	}
 
 	// retrieve set metadata
 	set := pto3.ObservationSet{ID: int(setid)}
-	if err := set.SelectByID(oa.db); err != nil {
+	if err = set.SelectByID(oa.db); err != nil {
 		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
 		} else {
-			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
 		}
 		return
 	}
 
-	// fail if observations exist
+	// sets not tagged public don't exist for requests allowed by public access
+	if !signed && publicOnly(oa.azr, r, "read_obs_data") && !set.HasTag(PublicTag) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		return
+	}
+
+	// parse filters
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	var filter *pto3.ObservationFilter
+	start, end, err := parseTimeRange(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing time range", err)
+		return
+	}
+	var since int
+	if s := r.Form.Get("since"); s != "" {
+		seq, err := strconv.ParseUint(s, 10, 63)
+		if err != nil {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad sequence marker %s", s))
+			return
+		}
+		since = int(seq)
+	}
+	if start != nil || end != nil || len(r.Form["condition"]) > 0 || since > 0 {
+		filter = &pto3.ObservationFilter{
+			TimeStart:     start,
+			TimeEnd:       end,
+			Conditions:    r.Form["condition"],
+			AfterSequence: since,
+		}
+	}
+
+	// answer conditional requests without selecting observations
+	if set.Modified != nil {
+		if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil &&
+			!set.Modified.Truncate(time.Second).After(ims) {
+			oa.additionalHeaders(w)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// answer existence checks without selecting observations
+	if r.Method == "HEAD" || r.Form.Get("exists_only") == "1" {
+		oa.writeExistence(w, r, &set, filter)
+		return
+	}
+
+	// fail if no observations exist
 	obscount, err := set.CountObservations(oa.db)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "counting observations", err)
 		return
-	} else if obscount != 0 {
-		http.Error(w, fmt.Sprintf("Observation set %s already uploaded", vars["set"]), http.StatusBadRequest)
+	} else if obscount == 0 {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s has no observations", vars["set"]))
+		return
+	}
+
+	// return a JSON page if requested, otherwise the whole stream
+	if r.Form.Get("offset") != "" || r.Form.Get("count") != "" {
+		oa.writeObservationPage(w, &set, filter, r.Form)
+		return
+	}
+
+	format, contentType, err := negotiateObsFormat(r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "negotiating observation file format", err)
+		return
+	}
+
+	// bound the download by the current sequence marker, so that observations
+	// appended during the download are left to the next delta
+	seq, err := set.LastSequence(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "finding sequence marker", err)
+		return
+	}
+	if filter == nil {
+		filter = new(pto3.ObservationFilter)
+	}
+	filter.ThroughSequence = seq
+
+	w.Header().Set("Content-type", contentType)
+	w.Header().Set(sequenceHeader, strconv.Itoa(seq))
+	w.Header().Set("Access-Control-Expose-Headers", sequenceHeader)
+	if set.Modified != nil {
+		w.Header().Set("Last-Modified", set.Modified.UTC().Format(http.TimeFormat))
+	}
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	if err := set.CopyFormattedDataToStreamContext(r.Context(), oa.db, w, filter, format); err != nil {
+		pto3.HandleErrorHTTP(w, "downloading observation set", err)
+		w.Write([]byte("\n\"error during download\"\n"))
+	}
+}
+
+// sequenceHeader is the response header carrying the sequence marker of a
+// download, for later delta downloads.
+const sequenceHeader = "PTO-Sequence"
+
+// obsFileContentType is the MIME type of observation files.
+const obsFileContentType = "application/vnd.mami.ndjson"
+
+// negotiateObsFormat determines the observation file format for a download,
+// from the format form parameter if given, otherwise from the version
+// parameter on an observation file media type in the Accept header. It
+// returns the format and the content type to serve it as.
+func negotiateObsFormat(r *http.Request) (int, string, error) {
+	format := pto3.ObsFormatV1
+
+	switch r.Form.Get("format") {
+	case "":
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+			if err == nil && mt == obsFileContentType && params["version"] == "2" {
+				format = pto3.ObsFormatV2
+				break
+			}
+		}
+	case "1":
+		format = pto3.ObsFormatV1
+	case "2":
+		format = pto3.ObsFormatV2
+	default:
+		return 0, "", pto3.PTOErrorf("unsupported observation file format %s", r.Form.Get("format")).
+			StatusIs(http.StatusBadRequest).CodeIs(pto3.ErrCodeBadForm)
+	}
+
+	if format == pto3.ObsFormatV2 {
+		return format, obsFileContentType + "; version=2", nil
+	}
+	return format, obsFileContentType, nil
+}
+
+// maxObsPageCount is the largest number of observations returned in a single
+// page of observation set data.
+const maxObsPageCount = 10000
+
+type obsPage struct {
+	Observations []pto3.Observation `json:"obs"`
+	Count        int                `json:"count"`
+	Next         string             `json:"next,omitempty"`
+	Prev         string             `json:"prev,omitempty"`
+}
+
+// writeExistence answers whether a set has any observations selected by a
+// filter, which may be nil: for HEAD requests, with an empty 200 response if
+// so and an empty 404 response if not, and otherwise with a JSON object whose
+// exists key is true or false.
+func (oa *ObsAPI) writeExistence(w http.ResponseWriter, r *http.Request, set *pto3.ObservationSet, filter *pto3.ObservationFilter) {
+	exists, err := set.HasObservations(oa.db, filter)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "checking for observations", err)
+		return
+	}
+
+	oa.additionalHeaders(w)
+
+	if r.Method == "HEAD" {
+		if exists {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
+	outb, err := json.Marshal(map[string]bool{"exists": exists})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling existence response", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// writeObservationPage writes a JSON object containing a page of observations
+// from a set, selected by the offset and count parameters in the given form,
+// with links to the next and previous pages. The offset is a cursor taken from
+// a next or prev link; it defaults to the start of the set. The count defaults
+// to the configured page length.
+func (oa *ObsAPI) writeObservationPage(w http.ResponseWriter, set *pto3.ObservationSet, filter *pto3.ObservationFilter, form url.Values) {
+	cursor := 0
+	if s := form.Get("offset"); s != "" {
+		c, err := strconv.ParseUint(s, 10, 63)
+		if err != nil {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad offset %s", s))
+			return
+		}
+		cursor = int(c)
+	}
+
+	count := oa.config.PageLength
+	if s := form.Get("count"); s != "" {
+		c, err := strconv.Atoi(s)
+		if err != nil || c < 1 || c > maxObsPageCount {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad count %s; must be between 1 and %d", s, maxObsPageCount))
+			return
+		}
+		count = c
+	}
+
+	page, err := set.SelectObservationPage(oa.db, filter, cursor, count)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting observations", err)
+		return
+	}
+
+	// links keep the filter and count, and move the offset
+	linkTo := func(cursor int) string {
+		v := url.Values{}
+		for k, vv := range form {
+			v[k] = vv
+		}
+		v.Set("offset", strconv.Itoa(cursor))
+		v.Set("count", strconv.Itoa(count))
+		link, _ := oa.config.LinkTo(fmt.Sprintf("/obs/%s/data?%s", pto3.SetID(set.ID), v.Encode()))
+		return link
+	}
+
+	out := obsPage{Observations: page.Observations, Count: len(page.Observations)}
+	if page.HasNext {
+		out.Next = linkTo(page.Next)
+	}
+	if page.HasPrev {
+		out.Prev = linkTo(page.Prev)
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling observation page", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleShare handles POST /obs/<set>/share, returning a signed URL for the
+// set's data, granting access to it without an API key for the lifetime
+// given in the expires_in parameter. Filter parameters may be added to the
+// signed URL to download slices of the set.
+func (oa *ObsAPI) handleShare(w http.ResponseWriter, r *http.Request) {
+	// only those who may read a set's data may share it
+	if !oa.azr.IsAuthorized(w, r, "read_obs_data") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	setid, err := pto3.ParseSetID(vars["set"])
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	writeShareResponse(oa.config, w, r, fmt.Sprintf("obs/%s/data", pto3.SetID(set.ID)))
+}
+
+// handleStats handles GET /obs/<set>/stats. It writes a JSON object with
+// per-condition observation counts, distinct source and target counts, and a
+// time histogram for the set. The histogram bin size is given by the
+// granularity query parameter (hour, day, week, month, or year; default day).
+func (oa *ObsAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := pto3.ParseSetID(vars["set"])
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+
+	stats, err := set.Stats(oa.db, granularity)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "computing set statistics", err)
+		return
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling set statistics", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleUpload handles PUT /obs/<set>/data. It requires a newline-delimited
+// JSON stream (of content-type application/vnd.mami.ndjson) in observation set
+// file format. Set IDs in the input are ignored. It writes a response
+// containing the set's metadata. POST /obs/<set>/data appends the
+// observations to a set which already has data instead, updating its
+// modification time.
+func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := pto3.ParseSetID(vars["set"])
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
+		return
+	}
+
+	// retrieve set metadata
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err := set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+		}
+		return
+	}
+
+	// fail if observations exist, unless appending
+	appending := r.Method == "POST"
+	obscount, err := set.CountObservations(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "counting observations", err)
+		return
+	} else if obscount != 0 && !appending {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeExists, fmt.Sprintf("Observation set %s already uploaded", vars["set"]))
 		return
 	}
 
@@ -514,20 +1332,31 @@ func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	tf.Sync()
 
-	// create condition and path caches
-	cidCache, err := pto3.LoadConditionCache(oa.db)
+	// now insert the tempfile into the database
+	loader, err := pto3.NewLoader(oa.db)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "loading condition cache", err)
 		return
 	}
-	pidCache := make(pto3.PathCache)
-
-	// now insert the tempfile into the database
-	if err := pto3.CopyDataFromObsFile(tf.Name(), oa.db, &set, cidCache, pidCache); err != nil {
+	if err := loader.LoadData(tf.Name(), &set); err != nil {
 		pto3.HandleErrorHTTP(w, "inserting observations", err)
 		return
 	}
 
+	// appending changes the set, and invalidates its cached count and time
+	// interval
+	if appending {
+		mtime := time.Now().UTC()
+		set.Modified = &mtime
+		if err := set.Recount(oa.db); err != nil {
+			pto3.HandleErrorHTTP(w, "updating observation count", err)
+			return
+		}
+		oa.enqueueReplication(&set)
+		oa.writeMetadataResponse(w, &set, http.StatusOK)
+		return
+	}
+
 	// now update observation count
 	if _, err = set.CountObservations(oa.db); err != nil {
 		pto3.HandleErrorHTTP(w, "updating observation count", err)
@@ -540,10 +1369,220 @@ func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// push to downstream PTOs
+	oa.enqueueReplication(&set)
+
 	// and write
 	oa.writeMetadataResponse(w, &set, http.StatusCreated)
 }
 
+// handleGetBundle handles GET /obs/<set>/bundle. It writes the set as an
+// observation file: a line of metadata followed by all of its observations,
+// suitable for POST /obs/bundle on this or another PTO, or for ptoload.
+func (oa *ObsAPI) handleGetBundle(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs_data") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := pto3.ParseSetID(vars["set"])
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing set ID", err)
+		return
+	}
+
+	// retrieve set metadata
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("Observation set %s not found", vars["set"]))
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	format, contentType, err := negotiateObsFormat(r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "negotiating observation file format", err)
+		return
+	}
+
+	w.Header().Set("Content-type", contentType)
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	if err := set.CopyBundleToStreamContext(r.Context(), oa.db, w, format); err != nil {
+		pto3.HandleErrorHTTP(w, "downloading observation set bundle", err)
+		w.Write([]byte("\n\"error during download\"\n"))
+	}
+}
+
+// handlePostBundle handles POST /obs/bundle. It requires an observation file
+// (as produced by GET /obs/<set>/bundle or loaded by ptoload) in the request,
+// and creates a new observation set from its metadata containing its
+// observations. It writes a response containing the new set's metadata. If
+// the bundle carries _upstream metadata, as when pushed by a replicating PTO,
+// and the same version of that upstream set has already been loaded, the
+// existing set is written instead.
+func (oa *ObsAPI) handlePostBundle(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// create a temporary file to hold the bundle
+	tf, err := ioutil.TempFile("", "pto3_bundle")
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "creating temporary bundle file", err)
+		return
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	// copy the bundle to the tempfile
+	if _, err := io.Copy(tf, r.Body); err != nil {
+		pto3.HandleErrorHTTP(w, "uploading to temporary bundle file", err)
+		return
+	}
+	tf.Sync()
+
+	// check metadata and local provenance links before loading
+	meta, err := pto3.ReadObsFileMetadata(tf.Name())
+	if err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, err.Error())
+		return
+	}
+	if meta.Sources == nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingMetadata, "bundle contains no observation set metadata")
+		return
+	}
+
+	// a set pushed by an upstream PTO is loaded once per upstream version, so
+	// that a retried push does not create a second copy
+	var prev *pto3.ObservationSet
+	if upstream := meta.Metadata[pto3.UpstreamMetadataKey]; upstream != "" {
+		if prev, err = pto3.CurrentMirror(oa.db, upstream); err != nil {
+			pto3.HandleErrorHTTP(w, "looking up previous copy of upstream set", err)
+			return
+		}
+		if prev != nil && prev.Metadata[pto3.UpstreamModifiedMetadataKey] == meta.Metadata[pto3.UpstreamModifiedMetadataKey] {
+			oa.writeMetadataResponse(w, prev, http.StatusCreated)
+			return
+		}
+	}
+
+	dangling, err := meta.DanglingSources(oa.config, oa.db, oa.rds)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "checking sources", err)
+		return
+	}
+	if len(dangling) > 0 {
+		if oa.config.StrictSources {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, fmt.Sprintf("_sources links to missing resources %v", dangling))
+			return
+		}
+		log.Printf("creating observation set with dangling _sources %v", dangling)
+	}
+
+	// now create the set and load the bundle into it
+	loader, err := pto3.NewLoader(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "loading condition cache", err)
+		return
+	}
+	set, err := loader.LoadSet(tf.Name())
+	if err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, fmt.Sprintf("error loading bundle: %s", err.Error()))
+		return
+	}
+
+	// a newer version of an upstream set supersedes the previous copy
+	if prev != nil {
+		prev.State = pto3.ObsSetStateSuperseded
+		prev.SupersededBy = pto3.LinkForSetID(oa.config, set.ID)
+		if err := prev.Update(oa.db); err != nil {
+			pto3.HandleErrorHTTP(w, "superseding previous copy of upstream set", err)
+			return
+		}
+	}
+
+	oa.enqueueReplication(set)
+
+	oa.writeMetadataResponse(w, set, http.StatusCreated)
+}
+
+// handleMerge handles POST /obs/merge. It requires a JSON object with a sets
+// key containing an array of observation set IDs to merge, and optionally an
+// _analyzer key with the analyzer URL for the merged set. It creates a new
+// observation set containing all the observations in the given sets, and
+// writes a response containing the new set's metadata.
+func (oa *ObsAPI) handleMerge(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for merge request must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	var mreq struct {
+		Sets     []string `json:"sets"`
+		Analyzer string   `json:"_analyzer"`
+	}
+	if err := json.Unmarshal(b, &mreq); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	setIDs := make([]int, len(mreq.Sets))
+	for i := range mreq.Sets {
+		setid, err := pto3.ParseSetID(mreq.Sets[i])
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "parsing set ID", err)
+			return
+		}
+		setIDs[i] = int(setid)
+	}
+
+	// now merge in a single transaction
+	var set *pto3.ObservationSet
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		set, err = pto3.MergeObservationSets(t, oa.config, setIDs, mreq.Analyzer)
+		return err
+	})
+	if err != nil {
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, "Observation set to merge not found")
+		} else {
+			pto3.HandleErrorHTTP(w, "merging observation sets", err)
+		}
+		return
+	}
+
+	oa.enqueueReplication(set)
+
+	oa.writeMetadataResponse(w, set, http.StatusCreated)
+}
+
 func (oa *ObsAPI) CreateTables() error {
 	return pto3.CreateTables(oa.db)
 }
@@ -556,21 +1595,111 @@ func (oa *ObsAPI) EnableQueryLogging() {
 	pto3.EnableQueryLogging(oa.db)
 }
 
+func (oa *ObsAPI) EnableSlowQueryLogging() {
+	pto3.EnableSlowQueryLogging(oa.db, time.Duration(oa.config.SlowQueryThreshold)*time.Millisecond)
+}
+
+// CheckSourcesIn causes links to raw data files in the _sources of new
+// observation sets to be checked against the given raw data store.
+func (oa *ObsAPI) CheckSourcesIn(rds pto3.RawStore) {
+	oa.rds = rds
+}
+
 func (oa *ObsAPI) additionalHeaders(w http.ResponseWriter) {
 	if oa.config.AllowOrigin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", oa.config.AllowOrigin)
 	}
 }
 
+// handleTransitions handles POST /obs/transitions. It requires a JSON object
+// with before and after keys containing the IDs of two observation sets, and
+// optionally an _analyzer key with the analyzer URL for the derived set. It
+// creates a new observation set recording, for each path and condition aspect
+// observed in both sets, the transition between the conditions observed before
+// and after, and writes a response containing the new set's metadata.
+func (oa *ObsAPI) handleTransitions(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for transition request must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	var treq struct {
+		Before   string `json:"before"`
+		After    string `json:"after"`
+		Analyzer string `json:"_analyzer"`
+	}
+	if err := json.Unmarshal(b, &treq); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	setIDs := make([]int, 2)
+	for i, s := range []string{treq.Before, treq.After} {
+		setid, err := pto3.ParseSetID(s)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "parsing set ID", err)
+			return
+		}
+		setIDs[i] = int(setid)
+	}
+
+	// now compute transitions in a single transaction
+	var set *pto3.ObservationSet
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		set, err = pto3.ComputeConditionTransitions(t, oa.config, setIDs[0], setIDs[1], treq.Analyzer)
+		return err
+	})
+	if err != nil {
+		if err == pg.ErrNoRows {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, "Observation set to compare not found")
+		} else {
+			pto3.HandleErrorHTTP(w, "computing condition transitions", err)
+		}
+		return
+	}
+
+	oa.enqueueReplication(set)
+
+	oa.writeMetadataResponse(w, set, http.StatusCreated)
+}
+
 func (oa *ObsAPI) addRoutes(r *mux.Router, l *log.Logger) {
 	r.HandleFunc("/obs", LogAccess(l, oa.handleListSets)).Methods("GET")
 	r.HandleFunc("/obs/by_metadata", LogAccess(l, oa.handleMetadataQuery)).Methods("GET", "POST")
 	r.HandleFunc("/obs/conditions", LogAccess(l, oa.handleConditionQuery)).Methods("GET")
+	r.HandleFunc("/obs/conditions", LogAccess(l, oa.handleCreateConditions)).Methods("POST")
 	r.HandleFunc("/obs/create", LogAccess(l, oa.handleCreateSet)).Methods("POST")
+	r.HandleFunc("/obs/merge", LogAccess(l, oa.handleMerge)).Methods("POST")
+	r.HandleFunc("/obs/transitions", LogAccess(l, oa.handleTransitions)).Methods("POST")
+	r.HandleFunc("/obs/bundle", LogAccess(l, oa.handlePostBundle)).Methods("POST")
 	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handleGetMetadata)).Methods("GET")
 	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handlePutMetadata)).Methods("PUT")
-	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleDownload)).Methods("GET")
-	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleUpload)).Methods("PUT")
+	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleDownload)).Methods("GET", "HEAD")
+	r.HandleFunc("/obs/{set}/stats", LogAccess(l, oa.handleStats)).Methods("GET")
+	r.HandleFunc("/obs/{set}/bundle", LogAccess(l, oa.handleGetBundle)).Methods("GET")
+	r.HandleFunc("/obs/{set}/tags/{tag}", LogAccess(l, oa.handleTag)).Methods("PUT", "DELETE")
+	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleUpload)).Methods("PUT", "POST")
+	r.HandleFunc("/obs/{set}/share", LogAccess(l, oa.handleShare)).Methods("POST")
+	r.HandleFunc("/raw/{campaign}/{file}/derived", LogAccess(l, oa.handleRawDerived)).Methods("GET")
+}
+
+// CheckHealth checks that the observation database is reachable.
+func (oa *ObsAPI) CheckHealth() error {
+	return pto3.PingDB(oa.db)
 }
 
 func NewObsAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *ObsAPI {
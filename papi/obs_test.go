@@ -7,9 +7,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-pg/pg"
 	pto3 "github.com/mami-project/pto3-go"
 )
 
@@ -309,3 +316,1109 @@ func TestObsQuery(t *testing.T) {
 	}
 
 }
+
+func TestObsListCursor(t *testing.T) {
+	// make sure there is more than one page of sets
+	for i := 0; i <= TestConfig.PageLength; i++ {
+		executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+			ClientObservationSet{
+				Analyzer:   "https://ptotest.mami-project.eu/analysis/passthrough",
+				Sources:    []string{"https://ptotest.mami-project.eu/raw/cursor.json"},
+				Conditions: []string{"pto.test.succeeded"},
+			}, GoodAPIKey, http.StatusCreated)
+	}
+
+	getList := func(link string) ClientSetList {
+		res := executeRequest(TestRouter, t, "GET", link, nil, "", GoodAPIKey, http.StatusOK)
+		var setlist ClientSetList
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+		return setlist
+	}
+
+	first := getList("https://ptotest.mami-project.eu/obs")
+	if len(first.Sets) != TestConfig.PageLength || first.Next == "" || first.Prev != "" {
+		t.Fatalf("bad first page: %d sets, next %q, prev %q", len(first.Sets), first.Next, first.Prev)
+	}
+
+	// walk all pages, which list each set once, in order
+	seen := make(map[string]bool)
+	lastID := uint64(0)
+	for page := first; ; page = getList(page.Next) {
+		for _, link := range page.Sets {
+			id, err := strconv.ParseUint(link[strings.LastIndex(link, "/")+1:], 16, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[link] || id <= lastID {
+				t.Fatalf("set %s listed out of order or twice", link)
+			}
+			seen[link] = true
+			lastID = id
+		}
+		if page.Next == "" {
+			break
+		}
+	}
+
+	// the previous page of the second page is the first page
+	second := getList(first.Next)
+	if second.Prev == "" || !reflect.DeepEqual(getList(second.Prev).Sets, first.Sets) {
+		t.Fatalf("previous page %q of second page is not the first page", second.Prev)
+	}
+
+	// cursors are opaque, and checked
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?cursor=50", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsListOrder(t *testing.T) {
+	newest := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:   "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:    []string{"https://ptotest.mami-project.eu/raw/order.json"},
+		Conditions: []string{"pto.test.succeeded"},
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	getList := func(link string) ClientSetList {
+		res := executeRequest(TestRouter, t, "GET", link, nil, "", GoodAPIKey, http.StatusOK)
+		var setlist ClientSetList
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+		return setlist
+	}
+
+	// newest sets first
+	setlist := getList("https://ptotest.mami-project.eu/obs?order=created&direction=desc")
+	if len(setlist.Sets) == 0 || setlist.Sets[0] != newest.Link {
+		t.Fatalf("newest set %s not listed first: %v", newest.Link, setlist.Sets)
+	}
+
+	// largest sets first, with the order kept in page links
+	setlist = getList("https://ptotest.mami-project.eu/obs?order=count&direction=desc")
+	if setlist.Next != "" && !strings.Contains(setlist.Next, "order=count") {
+		t.Fatalf("next link %s does not keep order", setlist.Next)
+	}
+
+	lastCount := -1
+	for i, link := range setlist.Sets {
+		if i == 10 {
+			break
+		}
+		res := executeRequest(TestRouter, t, "GET", link, nil, "", GoodAPIKey, http.StatusOK)
+		var set ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+			t.Fatal(err)
+		}
+		if lastCount >= 0 && set.Count > lastCount {
+			t.Fatalf("set %s with %d observations listed after set with %d", link, set.Count, lastCount)
+		}
+		lastCount = set.Count
+	}
+
+	// ordering combines with filters
+	setlist = getList("https://ptotest.mami-project.eu/obs?order=time_start&time_start=2017-10-01&time_end=2017-10-02")
+	found := false
+	for _, link := range setlist.Sets {
+		if link == newest.Link {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("set %s not listed by time range in order", newest.Link)
+	}
+
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?order=color", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?order=created&direction=sideways", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsListDetail(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/detail.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set to list in detail",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	var setlist struct {
+		Sets    []string                          `json:"sets"`
+		Details map[string]map[string]interface{} `json:"details"`
+	}
+
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?order=created&direction=desc&detail=1", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setlist.Details) != len(setlist.Sets) {
+		t.Fatalf("%d details for %d sets", len(setlist.Details), len(setlist.Sets))
+	}
+
+	detail := setlist.Details[set.Link]
+	if detail["description"] != set.Description || detail["_analyzer"] != set.Analyzer ||
+		detail["__obs_count"] != float64(1) || detail["__time_start"] == nil {
+		t.Fatalf("unexpected detail for set %s: %v", set.Link, detail)
+	}
+
+	// only configured fields are inlined
+	if _, ok := detail["_sources"]; ok {
+		t.Fatalf("unconfigured field _sources inlined for set %s", set.Link)
+	}
+
+	// and details are only given on request
+	setlist.Details = nil
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if setlist.Details != nil {
+		t.Fatal("details given without detail parameter")
+	}
+
+	// make sure there is more than one page of sets, and check that details
+	// are still given when following a cursor link
+	for i := 0; i <= TestConfig.PageLength; i++ {
+		executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+			ClientObservationSet{
+				Analyzer:   "https://ptotest.mami-project.eu/analysis/passthrough",
+				Sources:    []string{"https://ptotest.mami-project.eu/raw/detail.json"},
+				Conditions: []string{"pto.test.succeeded"},
+			}, GoodAPIKey, http.StatusCreated)
+	}
+
+	var first ClientSetList
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?detail=1", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Next == "" {
+		t.Fatal("no next link on first page of sets")
+	}
+
+	setlist.Sets = nil
+	setlist.Details = nil
+	res = executeRequest(TestRouter, t, "GET", first.Next, nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) == 0 || len(setlist.Details) != len(setlist.Sets) {
+		t.Fatalf("%d details for %d sets on page %s", len(setlist.Details), len(setlist.Sets), first.Next)
+	}
+}
+
+func createObsSetWithData(t *testing.T, setUp ClientObservationSet, obsdata string) ClientObservationSet {
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	res = executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBufferString(obsdata),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	return setDown
+}
+
+func TestObsMerge(t *testing.T) {
+	setA := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/merge_a.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "First observation set to merge",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T10:06:01Z", "2017-10-01T10:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]`)
+
+	setB := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/merge_b.json"},
+		Conditions:  []string{"pto.test.failed"},
+		Description: "Second observation set to merge",
+	}, `["0", "2017-10-01T10:07:00Z", "2017-10-01T10:07:00Z", "10.0.0.1 * 10.0.0.4", "pto.test.failed"]`)
+
+	setIDs := make([]string, 2)
+	for i, link := range []string{setA.Link, setB.Link} {
+		setIDs[i] = link[strings.LastIndex(link, "/")+1:]
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/merge",
+		map[string]interface{}{"sets": setIDs}, GoodAPIKey, http.StatusCreated)
+
+	merged := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &merged); err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Count != setA.Count+setB.Count {
+		t.Fatalf("merged set has %d observations, expected %d", merged.Count, setA.Count+setB.Count)
+	}
+
+	if merged.Analyzer != setA.Analyzer {
+		t.Fatalf("merged set has analyzer %s, expected %s", merged.Analyzer, setA.Analyzer)
+	}
+
+	if len(merged.Sources) != 2 || len(merged.Conditions) != 2 {
+		t.Fatalf("merged set has unexpected sources %v or conditions %v", merged.Sources, merged.Conditions)
+	}
+
+	if merged.Description != "" {
+		t.Fatalf("merged set inherited conflicting description %s", merged.Description)
+	}
+
+	// merging a nonexistent set fails
+	executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/merge",
+		map[string]interface{}{"sets": []string{setIDs[0], "ffffffff"}}, GoodAPIKey, http.StatusNotFound)
+}
+
+func TestCreateConditions(t *testing.T) {
+	var created struct {
+		Conditions []struct {
+			ID          int    `json:"id"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		} `json:"conditions"`
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/conditions",
+		map[string]interface{}{"conditions": []interface{}{
+			"pto.test.bulk.one",
+			map[string]string{"name": "pto.test.bulk.two", "description": "second bulk condition"},
+		}}, GoodAPIKey, http.StatusOK)
+
+	if err := json.Unmarshal(res.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(created.Conditions) != 2 || created.Conditions[0].ID == 0 || created.Conditions[1].ID == 0 ||
+		created.Conditions[1].Description != "second bulk condition" {
+		t.Fatalf("unexpected created conditions %+v", created.Conditions)
+	}
+	ids := []int{created.Conditions[0].ID, created.Conditions[1].ID}
+
+	// creation is idempotent, and keeps descriptions
+	res = executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/conditions",
+		map[string]interface{}{"conditions": []string{"pto.test.bulk.two", "pto.test.bulk.one"}}, GoodAPIKey, http.StatusOK)
+
+	if err := json.Unmarshal(res.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	if created.Conditions[0].ID != ids[1] || created.Conditions[1].ID != ids[0] ||
+		created.Conditions[0].Description != "second bulk condition" {
+		t.Fatalf("conditions not created idempotently: %+v", created.Conditions)
+	}
+
+	// wildcards are not conditions
+	executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/conditions",
+		map[string]interface{}{"conditions": []string{"pto.test.bulk.*"}}, GoodAPIKey, http.StatusBadRequest)
+
+	// and creating conditions requires write permission
+	executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/conditions",
+		map[string]interface{}{"conditions": []string{"pto.test.bulk.three"}}, "", http.StatusForbidden)
+}
+
+func TestObsTransitions(t *testing.T) {
+	before := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/transitions_a.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observations before",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.failed"]
+	["0", "2017-10-01T10:07:00Z", "2017-10-01T10:07:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T10:06:01Z", "2017-10-01T10:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]
+	["0", "2017-10-01T10:06:03Z", "2017-10-01T10:06:04Z", "10.0.0.1 * 10.0.0.4", "pto.test.failed"]
+	["0", "2017-10-01T10:06:05Z", "2017-10-01T10:06:06Z", "10.0.0.1 * 10.0.0.5", "pto.test.succeeded"]`)
+
+	after := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/transitions_b.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observations after",
+	}, `["0", "2017-11-01T10:06:00Z", "2017-11-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.failed"]
+	["0", "2017-11-01T10:06:01Z", "2017-11-01T10:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]
+	["0", "2017-11-01T10:06:03Z", "2017-11-01T10:06:04Z", "10.0.0.1 * 10.0.0.4", "pto.test.succeeded"]
+	["0", "2017-11-01T10:06:05Z", "2017-11-01T10:06:06Z", "10.0.0.1 * 10.0.0.6", "pto.test.failed"]`)
+
+	setIDs := make([]string, 2)
+	for i, link := range []string{before.Link, after.Link} {
+		setIDs[i] = link[strings.LastIndex(link, "/")+1:]
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/transitions",
+		map[string]interface{}{"before": setIDs[0], "after": setIDs[1]}, GoodAPIKey, http.StatusCreated)
+
+	derived := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &derived); err != nil {
+		t.Fatal(err)
+	}
+
+	// only paths observed in both sets have transitions
+	if derived.Count != 3 {
+		t.Fatalf("transition set has %d observations, expected 3", derived.Count)
+	}
+
+	if len(derived.Sources) != 2 {
+		t.Fatalf("transition set has unexpected sources %v", derived.Sources)
+	}
+
+	var stats struct {
+		Conditions map[string]int `json:"conditions"`
+	}
+
+	res = executeRequest(TestRouter, t, "GET", derived.Link+"/stats", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"pto.test.transition.succeeded.failed":    1,
+		"pto.test.transition.succeeded.succeeded": 1,
+		"pto.test.transition.failed.succeeded":    1,
+	}
+	if !reflect.DeepEqual(stats.Conditions, expected) {
+		t.Fatalf("unexpected transition counts %v", stats.Conditions)
+	}
+
+	// comparing a set to itself fails
+	executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/transitions",
+		map[string]interface{}{"before": setIDs[0], "after": setIDs[0]}, GoodAPIKey, http.StatusBadRequest)
+
+	// comparing to a nonexistent set fails
+	executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/transitions",
+		map[string]interface{}{"before": setIDs[0], "after": "ffffffff"}, GoodAPIKey, http.StatusNotFound)
+}
+
+func TestObsStats(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/stats.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observation set to summarize",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T11:06:01Z", "2017-10-01T11:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]
+	["0", "2017-10-02T10:07:00Z", "2017-10-02T10:07:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`)
+
+	var stats struct {
+		Conditions map[string]int `json:"conditions"`
+		Sources    int            `json:"distinct_sources"`
+		Targets    int            `json:"distinct_targets"`
+		Histogram  []struct {
+			Time  time.Time `json:"time"`
+			Count int       `json:"count"`
+		} `json:"histogram"`
+	}
+
+	res := executeRequest(TestRouter, t, "GET", set.Link+"/stats", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Conditions["pto.test.succeeded"] != 2 || stats.Conditions["pto.test.failed"] != 1 {
+		t.Fatalf("unexpected condition counts %v", stats.Conditions)
+	}
+
+	if stats.Sources != 1 || stats.Targets != 2 {
+		t.Fatalf("unexpected distinct source count %d or target count %d", stats.Sources, stats.Targets)
+	}
+
+	if len(stats.Histogram) != 2 || stats.Histogram[0].Count != 2 || stats.Histogram[1].Count != 1 {
+		t.Fatalf("unexpected daily histogram %v", stats.Histogram)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", set.Link+"/stats?granularity=hour", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.Histogram) != 3 {
+		t.Fatalf("unexpected hourly histogram %v", stats.Histogram)
+	}
+
+	executeRequest(TestRouter, t, "GET", set.Link+"/stats?granularity=fortnight", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsListByTimeRange(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/timerange.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set to find by time range",
+	}, `["0", "2016-03-01T10:00:00Z", "2016-03-01T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2016-03-03T10:00:00Z", "2016-03-03T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	setListed := func(url string) bool {
+		res := executeRequest(TestRouter, t, "GET", url, nil, "", GoodAPIKey, http.StatusOK)
+
+		var setlist ClientSetList
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range setlist.Sets {
+			if setlist.Sets[i] == set.Link {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !setListed("https://ptotest.mami-project.eu/obs?time_start=2016-03-02&time_end=2016-03-02") {
+		t.Fatal("set not listed in overlapping time range")
+	}
+
+	if setListed("https://ptotest.mami-project.eu/obs?time_end=2016-02-28") {
+		t.Fatal("set listed in earlier time range")
+	}
+
+	if setListed("https://ptotest.mami-project.eu/obs/by_metadata?time_start=2016-03-04") {
+		t.Fatal("set listed in later time range")
+	}
+
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?time_start=yesterday", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsTags(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/tags.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set to tag",
+	}, `["0", "2016-04-01T10:00:00Z", "2016-04-01T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	tagsOf := func(res *httptest.ResponseRecorder) []string {
+		var tagged struct {
+			Tags []string `json:"_tags"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &tagged); err != nil {
+			t.Fatal(err)
+		}
+		return tagged.Tags
+	}
+
+	setListed := func(url string) bool {
+		res := executeRequest(TestRouter, t, "GET", url, nil, "", GoodAPIKey, http.StatusOK)
+
+		var setlist ClientSetList
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range setlist.Sets {
+			if setlist.Sets[i] == set.Link {
+				return true
+			}
+		}
+		return false
+	}
+
+	executeRequest(TestRouter, t, "PUT", set.Link+"/tags/validated", nil, "", GoodAPIKey, http.StatusOK)
+	res := executeRequest(TestRouter, t, "PUT", set.Link+"/tags/paper-XYZ", nil, "", GoodAPIKey, http.StatusOK)
+	if tags := tagsOf(res); len(tags) != 2 || tags[0] != "paper-XYZ" || tags[1] != "validated" {
+		t.Fatalf("unexpected tags %v after tagging", tags)
+	}
+
+	if !setListed("https://ptotest.mami-project.eu/obs?tag=validated&tag=paper-XYZ") {
+		t.Fatal("set not listed by tags")
+	}
+
+	if !setListed("https://ptotest.mami-project.eu/obs/by_metadata?tag=validated") {
+		t.Fatal("set not listed by tag in metadata query")
+	}
+
+	res = executeRequest(TestRouter, t, "DELETE", set.Link+"/tags/validated", nil, "", GoodAPIKey, http.StatusOK)
+	if tags := tagsOf(res); len(tags) != 1 || tags[0] != "paper-XYZ" {
+		t.Fatalf("unexpected tags %v after untagging", tags)
+	}
+
+	if setListed("https://ptotest.mami-project.eu/obs?tag=validated") {
+		t.Fatal("set listed by removed tag")
+	}
+
+	// tags survive a metadata round trip
+	res = executeRequest(TestRouter, t, "GET", set.Link, nil, "", GoodAPIKey, http.StatusOK)
+	if tags := tagsOf(res); len(tags) != 1 || tags[0] != "paper-XYZ" {
+		t.Fatalf("unexpected tags %v in metadata", tags)
+	}
+
+	executeRequest(TestRouter, t, "PUT", set.Link+"/tags/bad,tag", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "PUT", "https://ptotest.mami-project.eu/obs/ffffffff/tags/validated", nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+// countQueryResults submits a selection query and waits for it to complete,
+// returning the number of observations in its result.
+func countQueryResults(t *testing.T, queryParams string) int {
+	q := new(testQueryMetadata)
+	for {
+		res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+
+		if q.State == "failed" {
+			t.Fatalf("Query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	count := 0
+	for resultLink := q.Result; resultLink != ""; {
+		res := executeRequest(TestRouter, t, "GET", resultLink, nil, "", GoodAPIKey, http.StatusOK)
+		qr := new(testResultSet)
+		if err := json.Unmarshal(res.Body.Bytes(), &qr); err != nil {
+			t.Fatal(err)
+		}
+		count += len(qr.Obs)
+		resultLink = qr.Next
+	}
+	return count
+}
+
+func TestObsDeprecation(t *testing.T) {
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/deprecation.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set to deprecate",
+	}
+	set := createObsSetWithData(t, setUp, `["0", "2015-06-01T10:00:00Z", "2015-06-01T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2015-06-01T11:00:00Z", "2015-06-01T11:01:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]`)
+
+	setID := set.Link[strings.LastIndex(set.Link, "/")+1:]
+	queryParams := "set=" + setID + "&time_start=2015-06-01T00%3A00%3A00Z&time_end=2015-06-02T00%3A00%3A00Z&condition=pto.test.succeeded"
+
+	if count := countQueryResults(t, queryParams); count != 2 {
+		t.Fatalf("active set query returned %d observations, expected 2", count)
+	}
+
+	// deprecate the set
+	md := map[string]interface{}{
+		"_analyzer":   setUp.Analyzer,
+		"_sources":    setUp.Sources,
+		"_conditions": setUp.Conditions,
+		"_state":      "deprecated",
+	}
+	res := executeWithJSON(TestRouter, t, "PUT", set.Link, md, GoodAPIKey, http.StatusCreated)
+
+	var stated struct {
+		State string `json:"_state"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &stated); err != nil {
+		t.Fatal(err)
+	}
+	if stated.State != "deprecated" {
+		t.Fatalf("unexpected state %s after deprecation", stated.State)
+	}
+
+	// listing shows the state
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?time_start=2015-06-01&time_end=2015-06-02", nil, "", GoodAPIKey, http.StatusOK)
+	var setlist struct {
+		States map[string]string `json:"states"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if setlist.States[set.Link] != "deprecated" {
+		t.Fatalf("listing has unexpected states %v", setlist.States)
+	}
+
+	// deprecated sets are excluded from queries unless requested
+	if count := countQueryResults(t, queryParams+"&on_path=10.0.0.1"); count != 0 {
+		t.Fatalf("deprecated set query returned %d observations, expected 0", count)
+	}
+	if count := countQueryResults(t, queryParams+"&on_path=10.0.0.1&option=include_deprecated"); count != 2 {
+		t.Fatalf("query including deprecated sets returned %d observations, expected 2", count)
+	}
+
+	// superseded sets must link to their replacement
+	md["_state"] = "superseded"
+	executeWithJSON(TestRouter, t, "PUT", set.Link, md, GoodAPIKey, http.StatusBadRequest)
+	md["_state"] = "retired"
+	executeWithJSON(TestRouter, t, "PUT", set.Link, md, GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsDownloadFiltered(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/filtered.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observation set to download slices of",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T11:06:01Z", "2017-10-01T11:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]
+	["0", "2017-10-02T10:07:00Z", "2017-10-02T10:07:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`)
+
+	testFilters := []struct {
+		params string
+		count  int
+	}{
+		{"", 3},
+		{"?time_start=2017-10-01T11:00:00Z", 2},
+		{"?time_end=2017-10-01T12:00:00Z", 2},
+		{"?time_start=2017-10-01T11:00:00Z&time_end=2017-10-01T12:00:00Z", 1},
+		{"?condition=pto.test.failed", 1},
+		{"?condition=pto.test.*", 3},
+		{"?condition=pto.test.succeeded&time_start=2017-10-01T11:00:00Z", 1},
+		{"?condition=pto.test.nonesuch", 0},
+	}
+
+	for _, tf := range testFilters {
+		res := executeRequest(TestRouter, t, "GET", set.Datalink+tf.params, nil, "", GoodAPIKey, http.StatusOK)
+
+		obsen, err := ReadObservations(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(obsen) != tf.count {
+			t.Fatalf("download with %s: expected %d observations, got %d", tf.params, tf.count, len(obsen))
+		}
+
+		// existence checks agree with downloads
+		headStatus := http.StatusOK
+		if tf.count == 0 {
+			headStatus = http.StatusNotFound
+		}
+		executeRequest(TestRouter, t, "HEAD", set.Datalink+tf.params, nil, "", GoodAPIKey, headStatus)
+
+		existsParams := "?exists_only=1"
+		if tf.params != "" {
+			existsParams = tf.params + "&exists_only=1"
+		}
+		res = executeRequest(TestRouter, t, "GET", set.Datalink+existsParams, nil, "", GoodAPIKey, http.StatusOK)
+
+		var existence struct {
+			Exists bool `json:"exists"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &existence); err != nil {
+			t.Fatal(err)
+		}
+		if existence.Exists != (tf.count > 0) {
+			t.Fatalf("existence check with %s: expected %v", tf.params, tf.count > 0)
+		}
+	}
+
+	executeRequest(TestRouter, t, "GET", set.Datalink+"?time_start=yesterday", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsDownloadDelta(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/delta.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observation set to append to",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T11:06:01Z", "2017-10-01T11:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]`)
+
+	download := func(params string, expectCount int) (string, string) {
+		res := executeRequest(TestRouter, t, "GET", set.Datalink+params, nil, "", GoodAPIKey, http.StatusOK)
+		obsen, err := ReadObservations(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(obsen) != expectCount {
+			t.Fatalf("download with %s: expected %d observations, got %d", params, expectCount, len(obsen))
+		}
+		seq := res.Header().Get("PTO-Sequence")
+		if seq == "" {
+			t.Fatalf("download with %s: missing sequence marker", params)
+		}
+		return seq, res.Header().Get("Last-Modified")
+	}
+
+	seq, modified := download("", 2)
+
+	// unmodified sets are not downloaded again
+	req, err := http.NewRequest("GET", set.Datalink, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+	req.Header.Set("If-Modified-Since", modified)
+	res := httptest.NewRecorder()
+	TestRouter.ServeHTTP(res, req)
+	if res.Code != http.StatusNotModified {
+		t.Fatalf("conditional download of unmodified set: expected 304, got %d", res.Code)
+	}
+
+	// nothing has been appended yet
+	download("?since="+seq, 0)
+
+	// append, and download only the new observations
+	res = executeRequest(TestRouter, t, "POST", set.Datalink,
+		bytes.NewBufferString(`["0", "2017-10-02T10:07:00Z", "2017-10-02T10:07:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusOK)
+
+	var appended ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &appended); err != nil {
+		t.Fatal(err)
+	}
+	if appended.Count != 3 {
+		t.Fatalf("expected 3 observations after append, got %d", appended.Count)
+	}
+
+	newSeq, _ := download("?since="+seq, 1)
+	download("?since="+seq+"&condition=pto.test.succeeded", 0)
+	download("?since="+newSeq, 0)
+	download("", 3)
+
+	executeRequest(TestRouter, t, "GET", set.Datalink+"?since=latest", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsDownloadPaged(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/paged.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observation set to page through",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T11:06:01Z", "2017-10-01T11:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]
+	["0", "2017-10-02T10:07:00Z", "2017-10-02T10:07:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`)
+
+	type obsPage struct {
+		Observations []pto3.Observation `json:"obs"`
+		Count        int                `json:"count"`
+		Next         string             `json:"next"`
+		Prev         string             `json:"prev"`
+	}
+
+	getPage := func(link string) *obsPage {
+		res := executeRequest(TestRouter, t, "GET", link, nil, "", GoodAPIKey, http.StatusOK)
+
+		var page obsPage
+		if err := json.Unmarshal(res.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Count != len(page.Observations) {
+			t.Fatalf("page count %d does not match %d observations", page.Count, len(page.Observations))
+		}
+		return &page
+	}
+
+	first := getPage(set.Datalink + "?count=2")
+	if first.Count != 2 || first.Next == "" || first.Prev != "" {
+		t.Fatalf("bad first page: count %d next %q prev %q", first.Count, first.Next, first.Prev)
+	}
+
+	second := getPage(first.Next)
+	if second.Count != 1 || second.Next != "" || second.Prev == "" {
+		t.Fatalf("bad second page: count %d next %q prev %q", second.Count, second.Next, second.Prev)
+	}
+	if second.Observations[0].Condition.Name != "pto.test.failed" {
+		t.Fatalf("expected last observation on second page, got %s", second.Observations[0].Condition.Name)
+	}
+
+	again := getPage(second.Prev)
+	if again.Count != 2 || again.Observations[0].TimeStart.Unix() != first.Observations[0].TimeStart.Unix() {
+		t.Fatalf("previous page does not match first page")
+	}
+
+	// filters apply to pages
+	filtered := getPage(set.Datalink + "?count=10&condition=pto.test.succeeded")
+	if filtered.Count != 2 || filtered.Next != "" {
+		t.Fatalf("bad filtered page: count %d next %q", filtered.Count, filtered.Next)
+	}
+
+	executeRequest(TestRouter, t, "GET", set.Datalink+"?count=0", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", set.Datalink+"?offset=beginning", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsStrictSources(t *testing.T) {
+	TestConfig.StrictSources = true
+	defer func() { TestConfig.StrictSources = false }()
+
+	source := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://example.com/raw/elsewhere.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set with remote provenance",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	// link to an existing set
+	executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		ClientObservationSet{
+			Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+			Sources:     []string{source.Link},
+			Conditions:  []string{"pto.test.succeeded"},
+			Description: "Observation set derived from an existing set",
+		}, GoodAPIKey, http.StatusCreated)
+
+	// links to a missing set and a missing raw file
+	for _, link := range []string{
+		"https://ptotest.mami-project.eu/obs/fffffff",
+		"https://ptotest.mami-project.eu/raw/nonesuch/nonesuch.json",
+	} {
+		executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+			ClientObservationSet{
+				Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+				Sources:     []string{link},
+				Conditions:  []string{"pto.test.succeeded"},
+				Description: "Observation set with dangling provenance",
+			}, GoodAPIKey, http.StatusBadRequest)
+	}
+}
+
+func TestObsBundle(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/bundled.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observation set to bundle",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2017-10-01T11:06:01Z", "2017-10-01T11:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]
+	["0", "2017-10-02T10:07:00Z", "2017-10-02T10:07:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`)
+
+	// download the bundle: metadata first, then observations
+	res := executeRequest(TestRouter, t, "GET", set.Link+"/bundle", nil, "", GoodAPIKey, http.StatusOK)
+	bundle := res.Body.String()
+
+	lines := strings.SplitN(bundle, "\n", 2)
+	var meta ClientObservationSet
+	if err := json.Unmarshal([]byte(lines[0]), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.Description != "Observation set to bundle" || len(meta.Conditions) != 2 {
+		t.Fatalf("unexpected bundle metadata %s", lines[0])
+	}
+
+	bundleObs, err := ReadObservations(strings.NewReader(lines[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// now load it as a new set in one shot
+	res = executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/bundle", strings.NewReader(bundle),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var loaded ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Link == set.Link || loaded.Description != meta.Description {
+		t.Fatalf("unexpected set loaded from bundle %+v", loaded)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", loaded.Datalink, nil, "", GoodAPIKey, http.StatusOK)
+	loadedObs, err := ReadObservations(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loadedObs) != 3 {
+		t.Fatalf("expected 3 observations loaded from bundle, got %d", len(loadedObs))
+	}
+	if err := compareObservationSlices(bundleObs, loadedObs); err != nil {
+		t.Fatal(err)
+	}
+
+	// bundles without metadata are rejected
+	executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/bundle", strings.NewReader(lines[1]),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsFormatV2(t *testing.T) {
+	set := createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/formatv2.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "Observation set in both observation file formats",
+	}, `["0", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	{"time_start": "2017-10-01T11:06:01Z", "time_end": "2017-10-01T11:06:02Z", "path": "10.0.0.1 * 10.0.0.3", "condition": "pto.test.failed", "value": 42, "metadata": {"probe": "p1"}}`)
+
+	// version 1 by default
+	res := executeRequest(TestRouter, t, "GET", set.Datalink, nil, "", GoodAPIKey, http.StatusOK)
+	if ct := res.Header().Get("Content-Type"); ct != "application/vnd.mami.ndjson" {
+		t.Fatalf("unexpected content type %s for version 1 download", ct)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(res.Body.String()), "\n") {
+		if !strings.HasPrefix(line, "[") {
+			t.Fatalf("unexpected line in version 1 download: %s", line)
+		}
+	}
+
+	// version 2 by form parameter or by Accept header
+	checkV2 := func(res *httptest.ResponseRecorder) {
+		if ct := res.Header().Get("Content-Type"); ct != "application/vnd.mami.ndjson; version=2" {
+			t.Fatalf("unexpected content type %s for version 2 download", ct)
+		}
+
+		found := false
+		for _, line := range strings.Split(strings.TrimSpace(res.Body.String()), "\n") {
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("bad line in version 2 download %s: %v", line, err)
+			}
+			if rec["condition"] == "pto.test.failed" {
+				found = true
+				md, _ := rec["metadata"].(map[string]interface{})
+				if rec["value"] != float64(42) || md["probe"] != "p1" {
+					t.Fatalf("unexpected version 2 observation %s", line)
+				}
+			}
+		}
+		if !found {
+			t.Fatal("missing observation in version 2 download")
+		}
+	}
+
+	checkV2(executeRequest(TestRouter, t, "GET", set.Datalink+"?format=2", nil, "", GoodAPIKey, http.StatusOK))
+
+	req := httptest.NewRequest("GET", set.Datalink, nil)
+	req.Header.Set("Accept", "application/vnd.mami.ndjson; version=2")
+	req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+	res = httptest.NewRecorder()
+	TestRouter.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("version 2 download by Accept failed with status %d", res.Code)
+	}
+	checkV2(res)
+
+	executeRequest(TestRouter, t, "GET", set.Datalink+"?format=3", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+// routerTransport serves HTTP client requests from the test router, so that
+// the test PTO can act as an upstream PTO.
+type routerTransport struct{}
+
+func (routerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := httptest.NewRecorder()
+	TestRouter.ServeHTTP(res, req)
+	return res.Result(), nil
+}
+
+func TestObsMirror(t *testing.T) {
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/mirror.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set to mirror",
+	}
+	set := createObsSetWithData(t, setUp, `["0", "2015-07-01T10:00:00Z", "2015-07-01T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["0", "2015-07-01T11:00:00Z", "2015-07-01T11:01:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]`)
+
+	// mirror from ourselves
+	config := *TestConfig
+	config.Upstreams = []pto3.UpstreamConfig{{
+		BaseURL: "https://ptotest.mami-project.eu/",
+		APIKey:  GoodAPIKey,
+		Filters: []string{"description=" + setUp.Description},
+	}}
+
+	mirror, err := pto3.NewMirror(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror.Client = &http.Client{Transport: routerTransport{}}
+
+	n, err := mirror.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("mirrored %d sets, expected 1", n)
+	}
+
+	// the mirror is a new set recording its upstream
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=_upstream&v="+url.QueryEscape(set.Link),
+		nil, "", GoodAPIKey, http.StatusOK)
+	var setlist ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 1 || setlist.Sets[0] == set.Link {
+		t.Fatalf("unexpected mirrored sets %v", setlist.Sets)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", setlist.Sets[0], nil, "", GoodAPIKey, http.StatusOK)
+	var mirrored struct {
+		ClientObservationSet
+		Upstream string `json:"_upstream"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &mirrored); err != nil {
+		t.Fatal(err)
+	}
+	if mirrored.Upstream != set.Link || mirrored.Count != set.Count || mirrored.Description != setUp.Description {
+		t.Fatalf("unexpected mirrored set metadata %s", res.Body.String())
+	}
+}
+
+func TestObsReplication(t *testing.T) {
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/replicate.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "Observation set to replicate",
+	}
+	set := createObsSetWithData(t, setUp, `["0", "2015-07-01T10:00:00Z", "2015-07-01T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	// replicate to ourselves
+	config := *TestConfig
+	config.Downstreams = []pto3.DownstreamConfig{{
+		BaseURL: "https://ptotest.mami-project.eu/",
+		APIKey:  GoodAPIKey,
+	}}
+
+	replicator, err := pto3.NewReplicator(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicator.Client = &http.Client{Transport: routerTransport{}}
+
+	setID, err := strconv.ParseInt(path.Base(set.Link), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pto3.EnqueueReplication(&config, pg.Connect(&config.ObsDatabase), int(setID)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := replicator.ProcessQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("processed %d replication tasks, expected 1", n)
+	}
+
+	// the replica is a new set recording where it was pushed from
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=_upstream&v="+url.QueryEscape(set.Link),
+		nil, "", GoodAPIKey, http.StatusOK)
+	var setlist ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 1 || setlist.Sets[0] == set.Link {
+		t.Fatalf("unexpected replicated sets %v", setlist.Sets)
+	}
+	replica := setlist.Sets[0]
+
+	// and the queue is empty
+	if n, err := replicator.ProcessQueue(); err != nil || n != 0 {
+		t.Fatalf("processed %d replication tasks after replication (%v), expected none", n, err)
+	}
+
+	// pushing the same set again, as when retrying after a lost response,
+	// does not create a second replica
+	if err := pto3.EnqueueReplication(&config, pg.Connect(&config.ObsDatabase), int(setID)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := replicator.ProcessQueue(); err != nil || n != 1 {
+		t.Fatalf("processed %d replication tasks on repeated push (%v), expected 1", n, err)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=_upstream&v="+url.QueryEscape(set.Link),
+		nil, "", GoodAPIKey, http.StatusOK)
+	setlist = ClientSetList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != replica {
+		t.Fatalf("unexpected replicated sets %v after repeated push, expected only %s", setlist.Sets, replica)
+	}
+}
@@ -0,0 +1,225 @@
+package papi
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// apiOperation documents a single API operation, identified by method and
+// path template, for the OpenAPI specification.
+type apiOperation struct {
+	summary    string
+	permission string
+}
+
+// apiOperations documents every route registered by the root, raw, obs, and
+// query APIs. Routes are taken from the router when the specification is
+// generated, so a route missing here will appear without a summary.
+var apiOperations = map[string]apiOperation{
+	"GET /":             {"Retrieve links to API resources", ""},
+	"GET /static/":      {"Retrieve static content", ""},
+	"GET /openapi.json": {"Retrieve this OpenAPI specification", ""},
+	"GET /healthz":      {"Check server health", ""},
+	"GET /stats":        {"Retrieve observatory-wide statistics", ""},
+
+	"GET /raw":                           {"List campaigns", "raw_metadata"},
+	"GET /raw/filetypes":                 {"List raw data filetypes", "raw_metadata"},
+	"GET /raw/vocabularies":              {"List controlled vocabularies for raw metadata", "raw_metadata"},
+	"GET /raw/{campaign}":                {"Retrieve campaign metadata and file list", "raw_metadata"},
+	"PUT /raw/{campaign}":                {"Create or update campaign metadata", "write_raw:<campaign>"},
+	"GET /raw/{campaign}/{file}":         {"Retrieve file metadata", "raw_metadata"},
+	"PUT /raw/{campaign}/{file}":         {"Create or update file metadata", "write_raw:<campaign>"},
+	"DELETE /raw/{campaign}/{file}":      {"Delete a file and its metadata", "write_raw:<campaign>"},
+	"GET /raw/{campaign}/{file}/data":    {"Download file data", "read_raw:<campaign>"},
+	"PUT /raw/{campaign}/{file}/data":    {"Upload file data", "write_raw:<campaign>"},
+	"GET /raw/{campaign}/{file}/preview": {"Preview the first lines of file data", "read_raw:<campaign>"},
+	"GET /raw/{campaign}/{file}/derived": {"List observation sets derived from a file", "read_obs"},
+	"GET /obs":                           {"List observation sets", "read_obs"},
+	"GET /obs/by_metadata":               {"List observation sets by metadata", "read_obs"},
+	"POST /obs/by_metadata":              {"List observation sets by metadata", "read_obs"},
+	"GET /obs/conditions":                {"List conditions in observation database", "read_obs"},
+	"POST /obs/conditions":               {"Create conditions in observation database", "write_obs"},
+	"POST /obs/create":                   {"Create new observation set", "write_obs"},
+	"POST /obs/merge":                    {"Create new observation set by merging existing sets", "write_obs"},
+	"POST /obs/transitions":              {"Create new observation set of condition transitions between two sets", "write_obs"},
+	"GET /obs/{set}":                     {"Retrieve observation set metadata", "read_obs"},
+	"PUT /obs/{set}":                     {"Update observation set metadata", "write_obs"},
+	"GET /obs/{set}/data":                {"Download observation set data", "read_obs_data"},
+	"HEAD /obs/{set}/data":               {"Check whether observation set data matching a filter exists", "read_obs_data"},
+	"PUT /obs/{set}/data":                {"Upload observation set data", "write_obs"},
+	"POST /obs/{set}/data":               {"Append observations to observation set data", "write_obs"},
+	"POST /obs/{set}/share":              {"Create a signed, expiring URL for observation set data", "read_obs_data"},
+	"GET /obs/{set}/stats":               {"Retrieve observation set statistics", "read_obs"},
+	"GET /obs/{set}/bundle":              {"Download observation set metadata and data as an observation file", "read_obs_data"},
+	"POST /obs/bundle":                   {"Create and load an observation set from an observation file", "write_obs"},
+	"PUT /obs/{set}/tags/{tag}":          {"Tag observation set", "write_obs"},
+	"DELETE /obs/{set}/tags/{tag}":       {"Remove tag from observation set", "write_obs"},
+	"GET /query":                         {"List cached queries", "read_query"},
+	"GET /query/submit":                  {"Submit a query for execution", "submit_query_<type>"},
+	"POST /query/submit":                 {"Submit a query for execution", "submit_query_<type>"},
+	"GET /query/retrieve":                {"Retrieve a query by parameters", "read_query"},
+	"POST /query/retrieve":               {"Retrieve a query by parameters", "read_query"},
+	"GET /query/sql":                     {"Render the SQL a query would execute", "explain_query"},
+	"POST /query/sql":                    {"Render the SQL a query would execute", "explain_query"},
+	"GET /query/queue":                   {"List queries executing or waiting to execute", "admin"},
+	"PUT /query/queue/{query}":           {"Set the execution priority of a queued query", "admin"},
+	"DELETE /query/queue/{query}":        {"Cancel a queued or executing query", "admin"},
+	"GET /query/{query}":                 {"Retrieve query metadata", "read_query"},
+	"PUT /query/{query}":                 {"Update query metadata", "update_query"},
+	"GET /query/{query}/result":          {"Retrieve query results", "read_query"},
+	"GET /admin/usage":                   {"Retrieve usage by API key", "admin"},
+	"GET /admin/metrics":                 {"Retrieve server metrics", "admin"},
+	"GET /admin/audit":                   {"Retrieve audit log of mutating operations", "admin"},
+
+	"GET /query/named":                 {"List named queries", "read_query"},
+	"GET /query/named/{name}":          {"Retrieve named query and execution history", "read_query"},
+	"PUT /query/named/{name}":          {"Save a query under a name", "update_query"},
+	"POST /query/named/{name}/execute": {"Execute a named query against current data", "submit_query_<type>"},
+
+	"GET /query/template":                {"List query templates", "read_query"},
+	"GET /query/template/{name}":         {"Retrieve query template and its parameters", "read_query"},
+	"PUT /query/template/{name}":         {"Save a parameterized query template under a name", "update_query"},
+	"POST /query/template/{name}/submit": {"Submit a query instantiated from a template", "submit_query_<type>"},
+
+	"GET /raw/{campaign}/{file}/upload-status": {"Retrieve progress of file data upload", "write_raw:<campaign>"},
+	"POST /raw/{campaign}/{file}/share":        {"Create a signed, expiring URL for file data", "read_raw:<campaign>"},
+}
+
+var pathVariableRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// walkOperations calls a function for each method on each route registered
+// on a router with a path template, with the path in OpenAPI form and any
+// path variables.
+func walkOperations(r *mux.Router, fn func(method string, path string, vars []string)) error {
+	return r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			// routes without paths are not documented
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// strip variable patterns, as OpenAPI doesn't support them
+		path := pathVariableRegexp.ReplaceAllString(tmpl, "{$1}")
+
+		var vars []string
+		for _, match := range pathVariableRegexp.FindAllStringSubmatch(tmpl, -1) {
+			vars = append(vars, match[1])
+		}
+
+		for _, method := range methods {
+			fn(method, path, vars)
+		}
+
+		return nil
+	})
+}
+
+// OpenAPISpec generates an OpenAPI 3 specification for the routes registered
+// on a given router.
+func OpenAPISpec(config *pto3.PTOConfiguration, r *mux.Router) (map[string]interface{}, error) {
+	paths := make(map[string]map[string]interface{})
+
+	err := walkOperations(r, func(method string, path string, vars []string) {
+		doc := apiOperations[method+" "+path]
+
+		op := map[string]interface{}{
+			"summary": doc.summary,
+			"responses": map[string]interface{}{
+				"default": map[string]string{"description": "see PTO API documentation"},
+			},
+		}
+
+		if len(vars) > 0 {
+			params := make([]interface{}, len(vars))
+			for i := range vars {
+				params[i] = map[string]interface{}{
+					"name":     vars[i],
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]string{"type": "string"},
+				}
+			}
+			op["parameters"] = params
+		}
+
+		if doc.permission != "" {
+			op["security"] = []map[string][]string{{"apikey": {}}}
+			op["x-pto-permission"] = doc.permission
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(method)] = op
+	})
+	if err != nil {
+		return nil, pto3.PTOWrapError(err)
+	}
+
+	server, _ := config.LinkTo("")
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]string{
+			"title":   "MAMI Path Transparency Observatory API",
+			"version": APIVersion,
+		},
+		"servers": []map[string]string{{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"apikey": map[string]string{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "Authorization",
+					"description": "API key, given as APIKEY <key>",
+				},
+			},
+		},
+	}, nil
+}
+
+// UndocumentedRoutes lists the routes registered on a given router which have
+// no summary in the OpenAPI specification, as "METHOD path".
+func UndocumentedRoutes(r *mux.Router) []string {
+	var out []string
+
+	walkOperations(r, func(method string, path string, vars []string) {
+		if _, ok := apiOperations[method+" "+path]; !ok {
+			out = append(out, method+" "+path)
+		}
+	})
+
+	sort.Strings(out)
+	return out
+}
+
+func (ra *RootAPI) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	spec, err := OpenAPISpec(ra.config, ra.router)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "generating OpenAPI specification", err)
+		return
+	}
+
+	specj, err := json.Marshal(spec)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling OpenAPI specification", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(specj)
+}
@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
@@ -34,20 +36,20 @@ var TestRC int
 var TestQueryCacheSetID int
 
 func setupRaw(config *pto3.PTOConfiguration, azr papi.Authorizer, r *mux.Router) *papi.RawAPI {
-	// create temporary RDS directory
+	// create temporary RDS directory, for tests of the filesystem store
 	var err error
 	config.RawRoot, err = ioutil.TempDir("", "papi-test-rawapi")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// create an RDS and an API around it
-	rawapi, err := papi.NewRawAPI(config, azr, r)
+	// create an in-memory store and an API around it
+	mrs, err := pto3.NewMemoryRawStore(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return rawapi
+	return papi.NewRawAPIForStore(config, azr, mrs, r)
 }
 
 func teardownRaw(config *pto3.PTOConfiguration) {
@@ -163,6 +165,9 @@ func teardownStatic(config *pto3.PTOConfiguration) {
 
 const GoodAPIKey = "07e57ab18e70"
 
+// OtherAPIKey may read and submit queries, as a second principal.
+const OtherAPIKey = "07e57ab18e71"
+
 func setupAZR() papi.Authorizer {
 	return &papi.APIKeyAuthorizer{
 		APIKeys: map[string]map[string]bool{
@@ -170,15 +175,21 @@ func setupAZR() papi.Authorizer {
 				"raw_metadata": true,
 			},
 			GoodAPIKey: map[string]bool{
-				"read_raw:test":      true,
-				"write_raw:test":     true,
-				"read_obs":           true,
-				"read_obs_data":      true,
-				"write_obs":          true,
+				"read_raw:test":       true,
+				"write_raw:test":      true,
+				"write_raw:limittest": true,
+				"read_obs":            true,
+				"read_obs_data":       true,
+				"write_obs":           true,
+				"submit_query_group":  true,
+				"submit_query_obs":    true,
+				"read_query":          true,
+				"update_query":        true,
+				"admin":               true,
+			},
+			OtherAPIKey: map[string]bool{
 				"submit_query_group": true,
-				"submit_query_obs":   true,
 				"read_query":         true,
-				"update_query":       true,
 			},
 		},
 	}
@@ -267,11 +278,19 @@ func TestMain(m *testing.M) {
 		"test" : "application/json",
 		"osf" :  "applicaton/vnd.mami.ndjson"
 	},
+	"Filetypes" : {
+		"test-bz2" : {
+			"ContentType" : "application/x-bzip2",
+			"MaxUploadSize" : 1048576,
+			"Validator" : "ptonorm-test"
+		}
+	},
 	"ObsDatabase" : {
 		"Addr":     "localhost:5432",
 		"User":     "ptotest",
 		"Database": "ptotest"
 	},
+	"ShareSecret": "not very secret",
 	"PageLength": 50
 }`)
 
@@ -299,19 +318,33 @@ func TestMain(m *testing.M) {
 		setupStatic(TestConfig)
 		defer teardownStatic(TestConfig)
 
-		papi.NewRootAPI(TestConfig, azr, TestRouter)
+		rootapi := papi.NewRootAPI(TestConfig, azr, TestRouter)
 
 		// build a raw data store  (and prepare to clean up after it)
-		setupRaw(TestConfig, azr, TestRouter)
+		rawapi := setupRaw(TestConfig, azr, TestRouter)
 		defer teardownRaw(TestConfig)
+		rootapi.AddHealthCheck("raw", rawapi.CheckHealth)
 
 		// build an observation store (and prepare to clean up after it)
 		obsapi := setupObs(TestConfig, azr, TestRouter)
 		defer teardownObs(obsapi)
+		rootapi.AddHealthCheck("obs", obsapi.CheckHealth)
+		obsapi.CheckSourcesIn(rawapi.DataStore())
 
 		// build an observation store (and prepare to clean up after it)
-		setupQuery(TestConfig, azr, TestRouter)
+		qapi := setupQuery(TestConfig, azr, TestRouter)
 		defer teardownQuery(TestConfig)
+		rootapi.AddHealthCheck("query", qapi.CheckHealth)
+
+		// serve observatory statistics
+		papi.NewStatsAPI(TestConfig, rawapi.DataStore(), TestRouter)
+
+		// account usage
+		usageapi, err := papi.NewUsageAPI(TestConfig, azr, TestRouter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		qapi.AccountQueriesTo(usageapi.Accountant())
 
 		TestRC = m.Run()
 		return TestRC
@@ -341,6 +374,222 @@ func TestStatic(t *testing.T) {
 
 }
 
+func TestRootCapabilities(t *testing.T) {
+	// serve root links rather than the static root file
+	config := *TestConfig
+	config.RootFile = ""
+	router := mux.NewRouter()
+	papi.NewRootAPI(&config, &papi.NullAuthorizer{}, router)
+
+	res := executeRequest(router, t, "GET", TestBaseURL+"/", nil, "", "", http.StatusOK)
+
+	var root struct {
+		Raw          string `json:"raw"`
+		Capabilities struct {
+			APIVersion string   `json:"api_version"`
+			PageLength int      `json:"page_length"`
+			Enabled    []string `json:"enabled"`
+			Raw        struct {
+				ContentTypes map[string]string `json:"content_types"`
+			} `json:"raw"`
+			Query struct {
+				Groups  []string `json:"groups"`
+				Options []string `json:"options"`
+			} `json:"query"`
+		} `json:"capabilities"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &root); err != nil {
+		t.Fatal(err)
+	}
+
+	caps := root.Capabilities
+	if root.Raw != TestBaseURL+"/raw" {
+		t.Fatalf("bad raw link %s", root.Raw)
+	}
+	if caps.APIVersion != papi.APIVersion || caps.PageLength != 50 {
+		t.Fatalf("bad version %s or page length %d", caps.APIVersion, caps.PageLength)
+	}
+	if strings.Join(caps.Enabled, " ") != "raw obs query" {
+		t.Fatalf("unexpected enabled subsystems %v", caps.Enabled)
+	}
+	if caps.Raw.ContentTypes["test"] != "application/json" {
+		t.Fatalf("missing test filetype in %v", caps.Raw.ContentTypes)
+	}
+	if len(caps.Query.Groups) == 0 || len(caps.Query.Options) == 0 {
+		t.Fatalf("missing query groups %v or options %v", caps.Query.Groups, caps.Query.Options)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	// every registered route must be documented
+	if undoc := papi.UndocumentedRoutes(TestRouter); len(undoc) > 0 {
+		t.Fatalf("routes missing from OpenAPI specification: %v", undoc)
+	}
+
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/openapi.json", nil, "", "", http.StatusOK)
+
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.OpenAPI != "3.0.0" {
+		t.Fatalf("unexpected OpenAPI version %s", spec.OpenAPI)
+	}
+
+	for _, path := range []string{"/raw/{campaign}/{file}/data", "/obs/{set}/data", "/query/{query}/result"} {
+		if _, ok := spec.Paths[path]["get"]; !ok {
+			t.Fatalf("OpenAPI specification missing GET %s", path)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/healthz", nil, "", "", http.StatusOK)
+
+	var report struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Status != "ok" {
+		t.Fatalf("unexpected health status %s", report.Status)
+	}
+
+	for _, check := range []string{"raw", "obs", "query"} {
+		if report.Checks[check] != "ok" {
+			t.Fatalf("health check %s not ok: %s", check, report.Checks[check])
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/stats", nil, "", "", http.StatusOK)
+
+	var stats pto3.ObservatoryStats
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	// the query test data is loaded before any test runs
+	if stats.Sets < 1 || stats.Observations < 1 || stats.Conditions < 1 {
+		t.Fatalf("missing observation statistics in %s", res.Body.String())
+	}
+	if stats.Earliest == nil || stats.Latest == nil || stats.Latest.Before(*stats.Earliest) {
+		t.Fatalf("bad observation time range in %s", res.Body.String())
+	}
+	if stats.Collected.IsZero() {
+		t.Fatalf("missing collection time in %s", res.Body.String())
+	}
+}
+
+func TestUsage(t *testing.T) {
+	// make an accounted request with an upload
+	executeRequest(TestRouter, t, "POST", TestBaseURL+"/obs/by_metadata", bytes.NewBufferString("source=nonesuch"),
+		"application/x-www-form-urlencoded", GoodAPIKey, http.StatusOK)
+
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/admin/usage?granularity=day", nil, "", GoodAPIKey, http.StatusOK)
+
+	var report struct {
+		Granularity string `json:"granularity"`
+		Usage       []struct {
+			Key      string `json:"key"`
+			Requests int    `json:"requests"`
+			BytesUp  int64  `json:"bytes_up"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Granularity != "day" {
+		t.Fatalf("unexpected granularity %s", report.Granularity)
+	}
+
+	found := false
+	for _, rec := range report.Usage {
+		if rec.Key == GoodAPIKey {
+			t.Fatal("API key disclosed in usage report")
+		}
+		if rec.Key == pto3.APIKeyPrincipal(GoodAPIKey) {
+			found = true
+			if rec.Requests < 1 || rec.BytesUp < 1 {
+				t.Fatalf("usage for test key not accounted: %+v", rec)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no usage for test key")
+	}
+
+	// usage is kept in the observation database, so another server sharing
+	// it reports the same usage
+	other, err := papi.NewUsageAPI(TestConfig, &papi.NullAuthorizer{}, mux.NewRouter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	usage, err := other.Accountant().Usage(now.Add(-24*time.Hour), now.Add(time.Hour), "day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found = false
+	for _, rec := range usage {
+		if rec.Key == pto3.APIKeyPrincipal(GoodAPIKey) && rec.Requests >= 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("usage for test key not kept in observation database")
+	}
+
+	// usage is only available to admins
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/admin/usage", nil, "", "", http.StatusForbidden)
+
+	// and only at supported granularities
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/admin/usage?granularity=fortnight", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestMetrics(t *testing.T) {
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/admin/metrics", nil, "", GoodAPIKey, http.StatusOK)
+
+	var metrics map[string]json.RawMessage
+	if err := json.Unmarshal(res.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := metrics["pto_db_statements"]; !ok {
+		t.Fatal("missing database statement metrics")
+	}
+
+	if _, ok := metrics["pto_query_queue"]; !ok {
+		t.Fatal("missing query queue metrics")
+	}
+
+	// metrics are only available to admins
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/admin/metrics", nil, "", "", http.StatusForbidden)
+}
+
 func TestBadAuth(t *testing.T) {
-	executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs", nil, "", "abadc0de", http.StatusForbidden)
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs", nil, "", "abadc0de", http.StatusForbidden)
+
+	// errors are returned as problem details
+	if res.Header().Get("Content-Type") != pto3.ProblemContentType {
+		t.Fatalf("error response should be %s, got %s", pto3.ProblemContentType, res.Header().Get("Content-Type"))
+	}
+
+	var problem pto3.Problem
+	if err := json.Unmarshal(res.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+
+	if problem.Status != http.StatusForbidden || problem.Code != pto3.ErrCodeForbidden {
+		t.Fatalf("unexpected problem %+v", problem)
+	}
 }
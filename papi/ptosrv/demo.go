@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/obsgen"
+)
+
+// demoPermissions are granted to requests without an API key in demo mode:
+// everything but writing data and administration.
+var demoPermissions = map[string]bool{
+	"raw_metadata":       true,
+	"read_obs":           true,
+	"read_obs_data":      true,
+	"submit_query_obs":   true,
+	"submit_query_group": true,
+	"read_query":         true,
+	"update_query":       true,
+}
+
+// demoServer is a temporary PostgreSQL server, raw data store, and query
+// cache, all kept in a single temporary directory, used by ptosrv -demo.
+type demoServer struct {
+	dir    string
+	pgdata string
+}
+
+// startDemo creates a temporary directory, starts a PostgreSQL server in it
+// using the initdb and pg_ctl binaries on the PATH, and loads sample
+// observation sets into it. It returns a configuration for serving the PTO
+// from the temporary directory on the given address.
+func startDemo(bindto string) (*pto3.PTOConfiguration, *demoServer, error) {
+	initdbPath, err := exec.LookPath("initdb")
+	if err != nil {
+		return nil, nil, fmt.Errorf("demo mode needs PostgreSQL binaries on the PATH: %v", err)
+	}
+	pgctlPath, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		return nil, nil, fmt.Errorf("demo mode needs PostgreSQL binaries on the PATH: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "ptosrv-demo")
+	if err != nil {
+		return nil, nil, err
+	}
+	ds := &demoServer{dir: dir, pgdata: filepath.Join(dir, "pgdata")}
+
+	for _, sub := range []string{"raw", "query"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+	}
+
+	// find a free port for the database
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	port := lis.Addr().(*net.TCPAddr).Port
+	lis.Close()
+
+	// create and start the database cluster
+	log.Printf("...initializing demo database in %s", ds.pgdata)
+	if out, err := exec.Command(initdbPath, "-D", ds.pgdata, "-U", "pto", "-A", "trust", "-E", "UTF8").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("initdb failed: %v\n%s", err, out)
+	}
+
+	pgopts := fmt.Sprintf("-p %d -k %s -c listen_addresses=localhost -c timezone=utc", port, dir)
+	if out, err := exec.Command(pgctlPath, "-D", ds.pgdata, "-l", filepath.Join(dir, "postgres.log"), "-o", pgopts, "-w", "start").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("pg_ctl start failed: %v\n%s", err, out)
+	}
+
+	// build a configuration pointing at the demo directory and database
+	b, err := json.Marshal(map[string]interface{}{
+		"BindTo":         bindto,
+		"BaseURL":        "http://" + bindto + "/",
+		"RawRoot":        filepath.Join(dir, "raw"),
+		"QueryCacheRoot": filepath.Join(dir, "query"),
+		"ObsDatabase": map[string]string{
+			"Addr":     fmt.Sprintf("localhost:%d", port),
+			"User":     "pto",
+			"Database": "postgres",
+		},
+	})
+	if err != nil {
+		ds.stop()
+		return nil, nil, err
+	}
+
+	config, err := pto3.NewConfigFromJSON(b)
+	if err != nil {
+		ds.stop()
+		return nil, nil, err
+	}
+
+	if err := ds.loadSampleData(config); err != nil {
+		ds.stop()
+		return nil, nil, err
+	}
+
+	return config, ds, nil
+}
+
+// loadSampleData creates the PTO's tables in the demo database, and loads an
+// observation set generated from each of obsgen's default specs.
+func (ds *demoServer) loadSampleData(config *pto3.PTOConfiguration) error {
+	db := pg.Connect(&config.ObsDatabase)
+	defer db.Close()
+
+	if err := pto3.CreateTables(db); err != nil {
+		return err
+	}
+
+	loader, err := pto3.NewLoader(db)
+	if err != nil {
+		return err
+	}
+
+	specs := obsgen.DefaultSpecs()
+	for i := range specs {
+		filename := filepath.Join(ds.dir, fmt.Sprintf("sample_%d.ndjson", i))
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		err = specs[i].Generate(file, true)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		set, err := loader.LoadSet(filename)
+		if err != nil {
+			return err
+		}
+		os.Remove(filename)
+
+		log.Printf("...loaded sample observation set %s with %d observations", pto3.SetID(set.ID), set.Count)
+	}
+
+	return nil
+}
+
+// stop stops the demo database and removes the demo directory.
+func (ds *demoServer) stop() {
+	if out, err := exec.Command("pg_ctl", "-D", ds.pgdata, "-m", "fast", "-w", "stop").CombinedOutput(); err != nil {
+		log.Printf("pg_ctl stop failed: %v\n%s", err, out)
+	}
+	if err := os.RemoveAll(ds.dir); err != nil {
+		log.Printf("cannot remove demo directory %s: %v", ds.dir, err)
+	}
+}
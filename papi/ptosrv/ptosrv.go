@@ -4,18 +4,28 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
 	"github.com/mami-project/pto3-go/papi"
+	"github.com/mami-project/pto3-go/pgrpc"
 	"github.com/rs/cors"
+	"google.golang.org/grpc"
 )
 
 var configPath = flag.String("config", "", "Path to PTO `config file`")
 var initdb = flag.Bool("initdb", false, "Create database tables on startup")
+var check = flag.Bool("check", false, "Check configuration and environment, then exit")
 var querylog = flag.Bool("querylog", false, "Log all database queries")
+var demo = flag.Bool("demo", false, "Serve sample data from a temporary database, without a config file")
+var demoBindTo = flag.String("demo-bind", "localhost:8383", "Interface and port to serve on in -demo mode")
 var help = flag.Bool("help", false, "show usage message")
 
 func main() {
@@ -26,12 +36,51 @@ func main() {
 		return
 	}
 
-	// load configuration file
-	config, err := pto3.NewConfigWithDefault(*configPath)
-	if err != nil {
-		log.Fatal(err)
+	// load configuration file, or set up a demo environment
+	var config *pto3.PTOConfiguration
+	var err error
+	if *demo && (*check || *initdb) {
+		log.Fatal("-demo cannot be combined with -check or -initdb")
+	}
+	if *demo {
+		log.Printf("ptosrv starting in demo mode...")
+		var ds *demoServer
+		config, ds, err = startDemo(*demoBindTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// stop the demo database on interrupt
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			log.Printf("stopping demo database...")
+			ds.stop()
+			os.Exit(0)
+		}()
+	} else {
+		config, err = pto3.NewConfigWithDefault(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("ptosrv starting with configuration at %s...", *configPath)
+	}
+
+	// check configuration and exit if -check given
+	if *check {
+		failed := false
+		for _, res := range pto3.SelfCheck(config) {
+			fmt.Println(res.String())
+			if res.Failed() {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
 	}
-	log.Printf("ptosrv starting with configuration at %s...", *configPath)
 
 	// initialize database and exit if -initdb given
 	if *initdb {
@@ -54,16 +103,35 @@ func main() {
 		return
 	}
 
-	// create an API key authorizer
-	azr, err := papi.LoadAPIKeys(config.APIKeyFile)
-	if err != nil {
-		log.Fatal(err)
+	// export trace spans if a collector is configured
+	if config.TraceEndpoint != "" {
+		if _, err := enableTracing(config); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("...will export traces to %s", config.TraceEndpoint)
+	}
+
+	// create an API key authorizer; in demo mode, everyone may read and query
+	var keyazr *papi.APIKeyAuthorizer
+	if *demo {
+		keyazr = &papi.APIKeyAuthorizer{APIKeys: map[string]map[string]bool{"default": demoPermissions}}
+	} else {
+		keyazr, err = papi.LoadAPIKeys(config.APIKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// open public sets and group queries to anonymous clients if configured
+	azr := papi.NewPublicAuthorizer(config, keyazr)
+	if config.PublicAccess {
+		log.Printf("...will serve sets tagged %s without an API key", papi.PublicTag)
 	}
 
 	// now hook up routes
 	r := mux.NewRouter()
 
-	papi.NewRootAPI(config, azr, r)
+	rootapi := papi.NewRootAPI(config, azr, r)
 
 	rawapi, err := papi.NewRawAPI(config, azr, r)
 	if err != nil {
@@ -71,6 +139,7 @@ func main() {
 	}
 	if rawapi != nil {
 		log.Printf("...will serve /raw from %s", config.RawRoot)
+		rootapi.AddHealthCheck("raw", rawapi.CheckHealth)
 	}
 
 	obsapi := papi.NewObsAPI(config, azr, r)
@@ -80,6 +149,35 @@ func main() {
 		if *querylog {
 			log.Printf("...with query logging enabled")
 			obsapi.EnableQueryLogging()
+		} else if config.SlowQueryThreshold > 0 {
+			log.Printf("...logging statements slower than %d ms", config.SlowQueryThreshold)
+			obsapi.EnableSlowQueryLogging()
+		}
+		rootapi.AddHealthCheck("obs", obsapi.CheckHealth)
+		if config.GeoIPDatabase != "" {
+			if err := pto3.EnableGeoIP(config); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("...annotating paths with countries from %s", config.GeoIPDatabase)
+		}
+		if rawapi != nil {
+			obsapi.CheckSourcesIn(rawapi.DataStore())
+		}
+		if len(config.Upstreams) > 0 {
+			mirror, err := pto3.NewMirror(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go mirror.RefreshEvery(nil)
+			log.Printf("...mirroring observation sets from %d upstream PTOs", len(config.Upstreams))
+		}
+		if len(config.Downstreams) > 0 {
+			replicator, err := pto3.NewReplicator(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go replicator.RunEvery(nil)
+			log.Printf("...pushing new observation sets to %d downstream PTOs", len(config.Downstreams))
 		}
 	}
 
@@ -89,6 +187,59 @@ func main() {
 	}
 	if qapi != nil {
 		log.Printf("...will serve /query from cache at %s", config.QueryCacheRoot)
+		if *querylog {
+			qapi.EnableQueryLogging()
+		} else if config.SlowQueryThreshold > 0 {
+			qapi.EnableSlowQueryLogging()
+		}
+		rootapi.AddHealthCheck("query", qapi.CheckHealth)
+		go qapi.EvictEvery(nil)
+	}
+
+	var rds pto3.RawStore
+	if rawapi != nil {
+		rds = rawapi.DataStore()
+	}
+	if statsapi := papi.NewStatsAPI(config, rds, r); statsapi != nil {
+		go statsapi.RefreshEvery(nil)
+	}
+
+	if auditapi, err := papi.NewAuditAPI(config, azr, r); err != nil {
+		log.Fatal(err)
+	} else if auditapi != nil {
+		log.Printf("...will record mutating operations in %s", config.AuditLogPath)
+	}
+
+	usageapi, err := papi.NewUsageAPI(config, azr, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go usageapi.Accountant().FlushEvery(nil)
+	if qapi != nil {
+		qapi.AccountQueriesTo(usageapi.Accountant())
+	}
+
+	// serve the gRPC API alongside the HTTP API if configured
+	if config.GRPCBindTo != "" {
+		grpcsrv, err := pgrpc.NewServer(config, azr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts, err := pgrpc.ServerOptions(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gs := grpc.NewServer(opts...)
+		grpcsrv.Register(gs)
+
+		lis, err := net.Listen("tcp", config.GRPCBindTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("...serving gRPC on %s", config.GRPCBindTo)
+		go func() {
+			log.Fatal(gs.Serve(lis))
+		}()
 	}
 
 	bindto := config.BindTo
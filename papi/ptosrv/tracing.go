@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	pto3 "github.com/mami-project/pto3-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// enableTracing configures export of trace spans to the OTLP/HTTP collector
+// given in the TraceEndpoint configuration option, and propagation of W3C
+// trace context and baggage through HTTP headers. It returns a function
+// which flushes pending spans and stops the exporter, to be called on
+// shutdown. The exporter is set up here rather than in the pto3 package, so
+// that library users do not depend on the OpenTelemetry SDK.
+func enableTracing(config *pto3.PTOConfiguration) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.TraceEndpoint)}
+	if config.TraceInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, pto3.PTOWrapError(err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.TraceServiceName))))
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,167 @@
+// Path Transparency Observatory public access mode
+
+package papi
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// PublicTag is the tag marking observation sets readable without an API key
+// in public access mode.
+const PublicTag = "public"
+
+// defaultPublicRequestsPerMinute limits public access if the configuration
+// does not.
+const defaultPublicRequestsPerMinute = 60
+
+// publicOperations are the operations, as method and route path template,
+// open to requests without an API key in public access mode, and the
+// permission each requires.
+var publicOperations = map[string]string{
+	"GET /obs":                  "read_obs",
+	"GET /obs/{set}":            "read_obs",
+	"GET /obs/{set}/data":       "read_obs_data",
+	"HEAD /obs/{set}/data":      "read_obs_data",
+	"GET /query/submit":         "submit_query_group",
+	"POST /query/submit":        "submit_query_group",
+	"GET /query/{query}":        "read_query",
+	"GET /query/{query}/result": "read_query",
+}
+
+// rateLimiter counts requests by client address in fixed one-minute
+// windows.
+type rateLimiter struct {
+	lock   sync.Mutex
+	limit  int
+	window time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{limit: limit, counts: make(map[string]int)}
+}
+
+// allow counts a request from a client at a given time, and returns false if
+// the client has exceeded its limit for the current window.
+func (rl *rateLimiter) allow(client string, at time.Time) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if window := at.Truncate(time.Minute); !window.Equal(rl.window) {
+		rl.window = window
+		rl.counts = make(map[string]int)
+	}
+
+	rl.counts[client]++
+	return rl.counts[client] <= rl.limit
+}
+
+// clientAddress returns the address of the client making a request, without
+// its port.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// discardResponseWriter swallows the problem responses of an authorizer
+// consulted only to learn whether it would authorize a request.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (dw *discardResponseWriter) Header() http.Header {
+	if dw.header == nil {
+		dw.header = make(http.Header)
+	}
+	return dw.header
+}
+
+func (dw *discardResponseWriter) WriteHeader(status int) {}
+
+func (dw *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// PublicAuthorizer wraps an Authorizer to implement public access mode.
+// Requests with an Authorization header, and requests the wrapped authorizer
+// allows on its own, are authorized by it. Other requests for the public
+// operations are allowed, up to a limit per client address per minute.
+// Handlers restrict requests allowed only by public access to public data;
+// see PublicOnly.
+type PublicAuthorizer struct {
+	azr     Authorizer
+	limiter *rateLimiter
+}
+
+// NewPublicAuthorizer wraps an authorizer in a PublicAuthorizer if public
+// access is enabled in the configuration, and returns it unchanged
+// otherwise.
+func NewPublicAuthorizer(config *pto3.PTOConfiguration, azr Authorizer) Authorizer {
+	if !config.PublicAccess {
+		return azr
+	}
+
+	limit := config.PublicRequestsPerMinute
+	if limit <= 0 {
+		limit = defaultPublicRequestsPerMinute
+	}
+
+	return &PublicAuthorizer{azr: azr, limiter: newRateLimiter(limit)}
+}
+
+// KnowsAPIKey returns true if the wrapped authorizer recognizes the given
+// API key.
+func (pa *PublicAuthorizer) KnowsAPIKey(key string) bool {
+	return knownAPIKey(pa.azr, key)
+}
+
+func (pa *PublicAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request, permission string) bool {
+	if !pa.PublicOnly(r, permission) {
+		return pa.azr.IsAuthorized(w, r, permission)
+	}
+
+	if !pa.limiter.allow(clientAddress(r), time.Now()) {
+		w.Header().Set("Retry-After", "60")
+		pto3.ProblemHTTP(w, http.StatusTooManyRequests, pto3.ErrCodeTooManyRequests,
+			"too many requests without an API key; try again later")
+		return false
+	}
+
+	return true
+}
+
+// PublicOnly returns true if a request would be authorized for a permission
+// only by public access, in which case the handler must restrict it to sets
+// tagged public and to group queries.
+func (pa *PublicAuthorizer) PublicOnly(r *http.Request, permission string) bool {
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	if publicOperations[r.Method+" "+routeName(r)] != permission {
+		return false
+	}
+
+	return !pa.azr.IsAuthorized(new(discardResponseWriter), r, permission)
+}
+
+// publicOnly returns true if an authorizer is in public access mode and
+// would authorize a request for a permission only by public access.
+func publicOnly(azr Authorizer, r *http.Request, permission string) bool {
+	pa, ok := azr.(*PublicAuthorizer)
+	return ok && pa.PublicOnly(r, permission)
+}
+
+// publicQuery returns true if a query may be read by requests allowed only by
+// public access: it is an aggregation query restricted to public sets.
+func publicQuery(q *pto3.Query) bool {
+	return q.IsGroupQuery() && q.VisibleTag() == PublicTag
+}
@@ -0,0 +1,84 @@
+package papi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/papi"
+)
+
+func TestPublicAccess(t *testing.T) {
+	config := &pto3.PTOConfiguration{PublicAccess: true, PublicRequestsPerMinute: 3}
+	azr := papi.NewPublicAuthorizer(config, setupAZR())
+
+	pa, ok := azr.(*papi.PublicAuthorizer)
+	if !ok {
+		t.Fatalf("public access enabled but got authorizer %T", azr)
+	}
+
+	// each route reports whether it was authorized, and whether it would be
+	// restricted to public data
+	r := mux.NewRouter()
+	route := func(path string, method string, permission string) {
+		r.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if !azr.IsAuthorized(w, r, permission) {
+				return
+			}
+			if pa.PublicOnly(r, permission) {
+				w.Header().Set("X-Public-Only", "1")
+			}
+			w.WriteHeader(http.StatusOK)
+		}).Methods(method)
+	}
+	route("/obs/{set}", "GET", "read_obs")
+	route("/obs/{set}", "PUT", "write_obs")
+	route("/obs/{set}/data", "GET", "read_obs_data")
+
+	request := func(method string, url string, apikey string, remote string, expectstatus int, expectPublic bool) {
+		req := httptest.NewRequest(method, url, nil)
+		req.RemoteAddr = remote
+		if apikey != "" {
+			req.Header.Set("Authorization", "APIKEY "+apikey)
+		}
+
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+
+		if res.Code != expectstatus {
+			t.Fatalf("%s %s from %s: expected status %d, got %d", method, url, remote, expectstatus, res.Code)
+		}
+		if public := res.Header().Get("X-Public-Only") != ""; public != expectPublic {
+			t.Fatalf("%s %s from %s: expected public only %v, got %v", method, url, remote, expectPublic, public)
+		}
+	}
+
+	// anonymous reads are allowed but restricted, writes are not
+	request("GET", "/obs/1", "", "192.0.2.1:1234", http.StatusOK, true)
+	request("GET", "/obs/1/data", "", "192.0.2.1:1234", http.StatusOK, true)
+	request("PUT", "/obs/1", "", "192.0.2.1:1234", http.StatusForbidden, false)
+
+	// API keys are unrestricted and not limited
+	for i := 0; i < 5; i++ {
+		request("GET", "/obs/1", GoodAPIKey, "192.0.2.1:1234", http.StatusOK, false)
+	}
+
+	// a bad API key is rejected outright, not served publicly
+	request("GET", "/obs/1", "abadkey", "192.0.2.1:1234", http.StatusForbidden, false)
+
+	// the third anonymous request in this minute uses up the limit
+	request("GET", "/obs/1", "", "192.0.2.1:5678", http.StatusOK, true)
+	request("GET", "/obs/1", "", "192.0.2.1:1234", http.StatusTooManyRequests, false)
+
+	// other clients have their own limits
+	request("GET", "/obs/1", "", "192.0.2.2:1234", http.StatusOK, true)
+
+	// without public access, the authorizer is not wrapped
+	if azr := papi.NewPublicAuthorizer(&pto3.PTOConfiguration{}, setupAZR()); azr == nil {
+		t.Fatal("no authorizer without public access")
+	} else if _, ok := azr.(*papi.PublicAuthorizer); ok {
+		t.Fatal("authorizer wrapped without public access")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
@@ -17,6 +18,7 @@ type QueryAPI struct {
 	config *pto3.PTOConfiguration
 	qc     *pto3.QueryCache
 	azr    Authorizer
+	acct   *UsageAccountant
 }
 
 func (qa *QueryAPI) queryResponse(w http.ResponseWriter, status int, q *pto3.Query) {
@@ -32,6 +34,21 @@ func (qa *QueryAPI) queryResponse(w http.ResponseWriter, status int, q *pto3.Que
 	w.Write(b)
 }
 
+// queryDebugResponse writes a query's metadata together with its execution
+// statistics.
+func (qa *QueryAPI) queryDebugResponse(w http.ResponseWriter, q *pto3.Query) {
+	b, err := q.DumpDebugJSONObject()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshalling query", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
 type queryList struct {
 	Queries []string `json:"queries"`
 }
@@ -48,7 +65,7 @@ func (qa *QueryAPI) handleList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// grab links and stuff them in JSON.
-	links, err := qa.qc.CachedQueryLinks()
+	links, err := qa.qc.CachedQueryLinksVisibleTo(pto3.APIKeyPrincipal(apiKeyForRequest(r)))
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "scanning cached queries", err)
 		return
@@ -79,26 +96,262 @@ func (qa *QueryAPI) authorizedToSubmit(w http.ResponseWriter, r *http.Request, f
 	return qa.azr.IsAuthorized(w, r, perm)
 }
 
+// SetQueryOwner makes the query specified by a form private to the principal
+// making a request if the form's private parameter is set, and shared
+// otherwise, overriding any owner given in the form. Private queries need an
+// API key; if the request has none, it returns an error.
+func SetQueryOwner(r *http.Request, form url.Values) error {
+	form.Del("owner")
+
+	if private := form.Get("private"); private == "" || private == "0" {
+		return nil
+	}
+
+	principal := pto3.APIKeyPrincipal(apiKeyForRequest(r))
+	if principal == pto3.AnonymousPrincipal {
+		return pto3.PTOErrorf("private queries require an API key").StatusIs(http.StatusBadRequest).CodeIs(pto3.ErrCodeBadRequest)
+	}
+
+	form.Set("owner", principal)
+	return nil
+}
+
+// RestrictPublicQuery restricts the query specified by a form to public sets
+// if the request submitting it is allowed only by public access, so that its
+// results, and the cache entries holding them, are distinct from those of
+// unrestricted queries.
+func RestrictPublicQuery(azr Authorizer, r *http.Request, form url.Values) {
+	if publicOnly(azr, r, "submit_query_group") {
+		form.Set("visible_tag", PublicTag)
+	}
+}
+
+// QueryReadable returns true if a request may read a query: the query is
+// visible to the request's principal, and, if the request is allowed only by
+// public access, it is a public query.
+func QueryReadable(azr Authorizer, r *http.Request, q *pto3.Query) bool {
+	if publicOnly(azr, r, "read_query") && !publicQuery(q) {
+		return false
+	}
+	return q.VisibleTo(pto3.APIKeyPrincipal(apiKeyForRequest(r)))
+}
+
+// setOwner sets the owner of the query specified by a form as with
+// SetQueryOwner. If the request may not own the query, it writes a problem
+// and returns false.
+func (qa *QueryAPI) setOwner(w http.ResponseWriter, r *http.Request, form url.Values) bool {
+	if err := SetQueryOwner(r, form); err != nil {
+		pto3.HandleErrorHTTP(w, "setting query owner", err)
+		return false
+	}
+	return true
+}
+
+// readable returns true if a request may read a query, as with
+// QueryReadable.
+func (qa *QueryAPI) readable(r *http.Request, q *pto3.Query) bool {
+	return QueryReadable(qa.azr, r, q)
+}
+
 func (qa *QueryAPI) handleSubmit(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the form (we need this to check authorization)
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
 	}
 
+	qa.submitForm(w, r, r.Form)
+}
+
+// submitForm submits the query specified by a form on behalf of a request,
+// if the request is authorized to submit it, and writes the query metadata.
+func (qa *QueryAPI) submitForm(w http.ResponseWriter, r *http.Request, form url.Values) {
 	// fail if not authorized
-	if !qa.authorizedToSubmit(w, r, r.Form) {
+	if !qa.authorizedToSubmit(w, r, form) {
 		return
 	}
 
+	if !qa.setOwner(w, r, form) {
+		return
+	}
+
+	// restrict requests allowed only by public access to public sets
+	RestrictPublicQuery(qa.azr, r, form)
+
 	// execute query, but don't wait for it beyond the immediate wait.
 	// This will give us an existing query if it's already in the cache.
-	q, _, err := qa.qc.ExecuteQueryFromForm(r.Form, make(chan struct{}))
+	done := make(chan struct{})
+	q, isNew, err := qa.qc.ExecuteQueryFromFormContext(r.Context(), form, done)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "parsing query", err)
 		return
 	}
 
+	// account execution time to the submitter of a new query
+	if isNew && qa.acct != nil {
+		key := usageKeyForRequest(qa.azr, r)
+		go func() {
+			<-done
+			if q.Executed != nil && q.Completed != nil {
+				qa.acct.RecordQuery(key, *q.Completed, q.Completed.Sub(*q.Executed))
+			}
+		}()
+	}
+
+	qa.queryResponse(w, http.StatusOK, q)
+}
+
+type querySQL struct {
+	Encoded string `json:"__encoded"`
+	SQL     string `json:"__sql"`
+}
+
+// handleExplain handles GET/POST /query/sql, returning the SQL a query
+// would execute to select its result, without submitting or executing it,
+// so that users can see how the shape of a query affects its execution. It
+// takes the same parameters as /query/submit, and writes a JSON object with
+// the normalized query in the __encoded key and its SQL in the __sql key.
+func (qa *QueryAPI) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
+		return
+	}
+
+	// fail if not authorized to see SQL, or to submit the query
+	if !qa.azr.IsAuthorized(w, r, "explain_query") || !qa.authorizedToSubmit(w, r, r.Form) {
+		return
+	}
+
+	q, err := qa.qc.ParseQueryFromForm(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing query", err)
+		return
+	}
+
+	sql, err := q.RenderSQL()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "rendering query SQL", err)
+		return
+	}
+
+	b, err := json.Marshal(querySQL{Encoded: q.URLEncoded(), SQL: sql})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshalling query SQL", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+type queuedQuery struct {
+	Link      string `json:"__link"`
+	State     string `json:"state"`
+	Priority  int    `json:"priority"`
+	Queued    string `json:"queued"`
+	Started   string `json:"started,omitempty"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+}
+
+type queryQueue struct {
+	Executing int           `json:"executing"`
+	Waiting   int           `json:"waiting"`
+	Queries   []queuedQuery `json:"queries"`
+}
+
+// handleQueue handles GET /query/queue, listing the queries executing or
+// waiting for an execution token on this server, with the time elapsed since
+// each was queued, so that operators can manage a congested executor.
+func (qa *QueryAPI) handleQueue(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "admin") {
+		return
+	}
+
+	queue := qa.qc.ExecutionQueue()
+	out := queryQueue{Queries: make([]queuedQuery, len(queue))}
+	for i := range queue {
+		qq := &queue[i]
+		link, err := qa.config.LinkTo("query/" + qq.Identifier)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "linking to query", err)
+			return
+		}
+
+		out.Queries[i] = queuedQuery{
+			Link:      link,
+			State:     "waiting",
+			Priority:  qq.Priority,
+			Queued:    qq.Queued.UTC().Format(time.RFC3339),
+			ElapsedMS: int64(qq.Elapsed() / time.Millisecond),
+		}
+		if qq.Executing() {
+			out.Queries[i].State = "executing"
+			out.Queries[i].Started = qq.Started.UTC().Format(time.RFC3339)
+			out.Executing++
+		} else {
+			out.Waiting++
+		}
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshalling query queue", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleQueuedQuery handles PUT and DELETE /query/queue/<query>. PUT sets the
+// priority of a query executing or waiting to execute on this server to its
+// priority parameter; DELETE cancels it. It writes the query's metadata in
+// the response.
+func (qa *QueryAPI) handleQueuedQuery(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "admin") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
+		return
+	}
+
+	qid := mux.Vars(r)["query"]
+
+	if r.Method == "DELETE" {
+		if err := qa.qc.CancelQuery(qid); err != nil {
+			pto3.HandleErrorHTTP(w, "cancelling query", err)
+			return
+		}
+	} else {
+		priority, err := strconv.Atoi(r.Form.Get("priority"))
+		if err != nil {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad priority %s", r.Form.Get("priority")))
+			return
+		}
+
+		if err := qa.qc.SetQueryPriority(qid, priority); err != nil {
+			pto3.HandleErrorHTTP(w, "setting query priority", err)
+			return
+		}
+	}
+
+	q, err := qa.qc.QueryByIdentifier(qid)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	} else if q == nil {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no such query %s", qid))
+		return
+	}
+
 	qa.queryResponse(w, http.StatusOK, q)
 }
 
@@ -106,7 +359,7 @@ func (qa *QueryAPI) handleRetrieve(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the form (we need this to check authorization)
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
 	}
 
 	// fail if not authorized
@@ -114,6 +367,10 @@ func (qa *QueryAPI) handleRetrieve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !qa.setOwner(w, r, r.Form) {
+		return
+	}
+
 	// parse the query and try to retrieve it by value
 	q, err := qa.qc.ParseQueryFromForm(r.Form)
 	if err != nil {
@@ -129,8 +386,8 @@ func (qa *QueryAPI) handleRetrieve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 404 if no query
-	if oq == nil {
-		http.Error(w, "query not found", http.StatusNotFound)
+	if oq == nil || !qa.readable(r, oq) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, "query not found")
 		return
 	}
 
@@ -142,7 +399,7 @@ func (qa *QueryAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 
 	qid, ok := vars["query"]
 	if !ok {
-		http.Error(w, "missing query", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing query")
 		return
 	}
 
@@ -151,11 +408,25 @@ func (qa *QueryAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// execution statistics are only available to administrators
+	debug := r.URL.Query().Get("debug") == "1"
+	if debug && !qa.azr.IsAuthorized(w, r, "admin") {
+		return
+	}
+
 	// get query metadata
 	q, err := qa.qc.QueryByIdentifier(qid)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "fetching query", err)
 		return
+	} else if q == nil || !qa.readable(r, q) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no such query %s", qid))
+		return
+	}
+
+	if debug {
+		qa.queryDebugResponse(w, q)
+		return
 	}
 
 	qa.queryResponse(w, http.StatusOK, q)
@@ -165,12 +436,12 @@ func (qa *QueryAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
 	}
 
 	qid, ok := vars["query"]
 	if !ok {
-		http.Error(w, "missing query", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing query")
 		return
 	}
 
@@ -183,19 +454,23 @@ func (qa *QueryAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	q, err := qa.qc.QueryByIdentifier(qid)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	} else if q == nil || !q.VisibleTo(pto3.APIKeyPrincipal(apiKeyForRequest(r))) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no such query %s", qid))
+		return
 	}
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for query metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for query metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
 		return
 	}
 
 	// update query with JSON
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
 	}
 
 	if err := q.UpdateFromJSON(b); err != nil {
@@ -217,12 +492,12 @@ func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
 
 	qid, ok := vars["query"]
 	if !ok {
-		http.Error(w, "missing query", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing query")
 		return
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
 	}
 
 	// fail if not authorized
@@ -235,33 +510,100 @@ func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "fetching query", err)
 		return
+	} else if q == nil || !qa.readable(r, q) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no such query %s", qid))
+		return
 	}
 
-	// verify that the query thinks that it's completed
+	// partial results of executing queries are available on request
+	partial := false
 	if q.Completed == nil {
-		http.Error(w, "results not available", http.StatusNotFound)
+		if r.Form.Get("allow_partial") == "" || q.Executed == nil {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, "results not available")
+			return
+		}
+		partial = true
+	}
+
+	// group results may be returned as objects, and pivoted
+	format := r.Form.Get("format")
+	pivot := r.Form.Get("pivot") != ""
+	switch format {
+	case "", "arrays":
+		if pivot {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, "pivot requires format=objects")
+			return
+		}
+	case "objects":
+		if !q.IsGroupQuery() {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, "format=objects is only supported for group queries")
+			return
+		}
+		if pivot && len(q.GroupDimensions()) != 2 {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, "pivot is only supported for queries grouped by two dimensions")
+			return
+		}
+	default:
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, fmt.Sprintf("unsupported result format %s", format))
+		return
 	}
 
 	// get page number from query, default to zero
 	page, _ := strconv.ParseInt(r.Form.Get("page"), 10, 64)
 
 	// retrieve and paginate result
-	robj, more, err := q.PaginateResultObject(int(page)*qa.config.PageLength, qa.config.PageLength)
+	var robj map[string]interface{}
+	var more bool
+	if partial {
+		robj, more, err = q.PaginatePartialResultObject(int(page)*qa.config.PageLength, qa.config.PageLength)
+	} else {
+		robj, more, err = q.PaginateResultObject(int(page)*qa.config.PageLength, qa.config.PageLength)
+	}
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "retrieving result", err)
 		return
 	}
 
+	// convert group rows to objects, keeping the format in links
+	linkSuffix := ""
+	if format == "objects" {
+		rows, _ := robj["groups"].([]interface{})
+		if pivot {
+			robj["pivot"], err = q.PivotGroupResults(rows)
+			linkSuffix = "&format=objects&pivot=1"
+		} else {
+			linkSuffix = "&format=objects"
+		}
+		if err == nil {
+			robj["groups"], err = q.GroupResultObjects(rows)
+		}
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "formatting result", err)
+			return
+		}
+	}
+
+	// partial results are counted so far, and links keep asking for them
+	totalCount := 0
+	if partial {
+		linkSuffix += "&allow_partial=1"
+		totalCount = q.RowsSoFar()
+		robj["partial"] = true
+		robj["rows_so_far"] = totalCount
+	} else if more || page > 0 {
+		totalCount = q.ResultRowCount()
+	}
+
 	if more {
-		nextLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d", q.Identifier, page+1))
+		nextLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d%s", q.Identifier, page+1, linkSuffix))
 		robj["next"] = nextLink
-		robj["total_count"] = q.ResultRowCount()
+		robj["total_count"] = totalCount
 	}
 
 	if page > 0 {
-		prevLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d", q.Identifier, page-1))
+		prevLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d%s", q.Identifier, page-1, linkSuffix))
 		robj["prev"] = prevLink
-		robj["total_count"] = q.ResultRowCount()
+		robj["total_count"] = totalCount
 	}
 
 	outb, err := json.Marshal(robj)
@@ -275,6 +617,327 @@ func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
 	w.Write(outb)
 }
 
+type namedQueryList struct {
+	NamedQueries []string `json:"named_queries"`
+}
+
+// handleListNamed handles GET /query/named, listing links to named queries.
+func (qa *QueryAPI) handleListNamed(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	links, err := qa.qc.NamedQueryLinks()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "listing named queries", err)
+		return
+	}
+
+	outb, err := json.Marshal(namedQueryList{NamedQueries: links})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling named query list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// namedQueryResponse writes a named query and its execution history.
+func (qa *QueryAPI) namedQueryResponse(w http.ResponseWriter, status int, nq *pto3.NamedQuery) {
+	b, err := json.Marshal(nq)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshalling named query", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// fetchNamedQuery retrieves the named query in a request's path, writing an
+// error and returning nil if it does not exist or is not visible to the
+// request's principal.
+func (qa *QueryAPI) fetchNamedQuery(w http.ResponseWriter, r *http.Request) *pto3.NamedQuery {
+	name := mux.Vars(r)["name"]
+
+	nq, err := qa.qc.NamedQueryByName(name)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching named query", err)
+		return nil
+	} else if nq == nil || !nq.VisibleTo(pto3.APIKeyPrincipal(apiKeyForRequest(r))) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no query named %s", name))
+		return nil
+	}
+
+	return nq
+}
+
+// handleGetNamed handles GET /query/named/{name}, returning a named query
+// and its execution history.
+func (qa *QueryAPI) handleGetNamed(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	nq := qa.fetchNamedQuery(w, r)
+	if nq == nil {
+		return
+	}
+
+	// fail if the query last executed under the name may not be read
+	q, err := qa.qc.QueryByIdentifier(nq.Identifier)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving named query", err)
+		return
+	} else if q != nil && !qa.readable(r, q) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no query named %s", nq.Name))
+		return
+	}
+
+	qa.namedQueryResponse(w, http.StatusOK, nq)
+}
+
+// handlePutNamed handles PUT /query/named/{name}, saving the query
+// referenced by identifier or link in the "query" key of a JSON object under
+// the given name.
+func (qa *QueryAPI) handlePutNamed(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "update_query") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for named query must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading named query", err)
+		return
+	}
+
+	var ref struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(b, &ref); err != nil || ref.Query == "" {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, "named query must be an object with a query identifier or link in the query key")
+		return
+	}
+
+	nq, err := qa.qc.NameQuery(mux.Vars(r)["name"], pto3.QueryIdentifierFromLink(ref.Query),
+		pto3.APIKeyPrincipal(apiKeyForRequest(r)))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "naming query", err)
+		return
+	}
+
+	qa.namedQueryResponse(w, http.StatusOK, nq)
+}
+
+// handleExecuteNamed handles POST /query/named/{name}/execute, executing a
+// named query against the current data and returning the executed query. If
+// the repin option is given, an already cached query is pinned to the
+// observation sets it covers now.
+func (qa *QueryAPI) handleExecuteNamed(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized to read named queries, before looking the name
+	// up, so that unauthorized requests cannot tell which names exist
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	nq := qa.fetchNamedQuery(w, r)
+	if nq == nil {
+		return
+	}
+
+	// fail if not authorized to submit the query
+	form, err := nq.Form()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing named query", err)
+		return
+	}
+	if !qa.authorizedToSubmit(w, r, form) {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	// refresh the observation sets the query covers if requested
+	repin := false
+	for _, option := range r.Form["option"] {
+		if option == "repin" {
+			repin = true
+		}
+	}
+
+	done := make(chan struct{})
+	q, err := nq.Execute(r.Context(), done, repin)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "executing named query", err)
+		return
+	}
+
+	if !qa.readable(r, q) {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no query named %s", nq.Name))
+		return
+	}
+
+	qa.queryResponse(w, http.StatusOK, q)
+}
+
+type queryTemplateList struct {
+	QueryTemplates []string `json:"templates"`
+}
+
+// handleListTemplates handles GET /query/template, listing links to query
+// templates.
+func (qa *QueryAPI) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	links, err := qa.qc.QueryTemplateLinks()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "listing query templates", err)
+		return
+	}
+
+	outb, err := json.Marshal(queryTemplateList{QueryTemplates: links})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling query template list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// queryTemplateResponse writes a query template.
+func (qa *QueryAPI) queryTemplateResponse(w http.ResponseWriter, status int, qt *pto3.QueryTemplate) {
+	b, err := json.Marshal(qt)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshalling query template", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// fetchQueryTemplate retrieves the query template in a request's path,
+// writing an error and returning nil if it does not exist.
+func (qa *QueryAPI) fetchQueryTemplate(w http.ResponseWriter, r *http.Request) *pto3.QueryTemplate {
+	name := mux.Vars(r)["name"]
+
+	qt, err := qa.qc.QueryTemplateByName(name)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching query template", err)
+		return nil
+	} else if qt == nil {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no such query template %s", name))
+		return nil
+	}
+
+	return qt
+}
+
+// handleGetTemplate handles GET /query/template/{name}, returning a query
+// template and its parameters.
+func (qa *QueryAPI) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	qt := qa.fetchQueryTemplate(w, r)
+	if qt == nil {
+		return
+	}
+
+	qa.queryTemplateResponse(w, http.StatusOK, qt)
+}
+
+// handlePutTemplate handles PUT /query/template/{name}, saving the
+// URL-encoded query specification in the "template" key of a JSON object,
+// with an optional "description", under the given name.
+func (qa *QueryAPI) handlePutTemplate(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "update_query") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for query template must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading query template", err)
+		return
+	}
+
+	var in struct {
+		Template    string `json:"template"`
+		Description string `json:"description"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil || in.Template == "" {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, "query template must be an object with a URL-encoded query specification in the template key")
+		return
+	}
+
+	qt, err := qa.qc.PutQueryTemplate(mux.Vars(r)["name"], in.Description, in.Template)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "saving query template", err)
+		return
+	}
+
+	qa.queryTemplateResponse(w, http.StatusOK, qt)
+}
+
+// handleSubmitTemplate handles POST /query/template/{name}/submit,
+// instantiating a query template with the parameter values given in the
+// form, and submitting the resulting query as for /query/submit.
+func (qa *QueryAPI) handleSubmitTemplate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	qt := qa.fetchQueryTemplate(w, r)
+	if qt == nil {
+		return
+	}
+
+	form, err := qt.Instantiate(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "instantiating query template", err)
+		return
+	}
+
+	qa.submitForm(w, r, form)
+}
+
 func (qa *QueryAPI) additionalHeaders(w http.ResponseWriter) {
 	if qa.config.AllowOrigin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", qa.config.AllowOrigin)
@@ -285,6 +948,17 @@ func (qa *QueryAPI) addRoutes(r *mux.Router, l *log.Logger) {
 	r.HandleFunc("/query", LogAccess(l, qa.handleList)).Methods("GET")
 	r.HandleFunc("/query/submit", LogAccess(l, qa.handleSubmit)).Methods("GET", "POST")
 	r.HandleFunc("/query/retrieve", LogAccess(l, qa.handleRetrieve)).Methods("GET", "POST")
+	r.HandleFunc("/query/sql", LogAccess(l, qa.handleExplain)).Methods("GET", "POST")
+	r.HandleFunc("/query/queue", LogAccess(l, qa.handleQueue)).Methods("GET")
+	r.HandleFunc("/query/queue/{query}", LogAccess(l, qa.handleQueuedQuery)).Methods("PUT", "DELETE")
+	r.HandleFunc("/query/named", LogAccess(l, qa.handleListNamed)).Methods("GET")
+	r.HandleFunc("/query/named/{name}", LogAccess(l, qa.handleGetNamed)).Methods("GET")
+	r.HandleFunc("/query/named/{name}", LogAccess(l, qa.handlePutNamed)).Methods("PUT")
+	r.HandleFunc("/query/named/{name}/execute", LogAccess(l, qa.handleExecuteNamed)).Methods("POST")
+	r.HandleFunc("/query/template", LogAccess(l, qa.handleListTemplates)).Methods("GET")
+	r.HandleFunc("/query/template/{name}", LogAccess(l, qa.handleGetTemplate)).Methods("GET")
+	r.HandleFunc("/query/template/{name}", LogAccess(l, qa.handlePutTemplate)).Methods("PUT")
+	r.HandleFunc("/query/template/{name}/submit", LogAccess(l, qa.handleSubmitTemplate)).Methods("POST")
 	r.HandleFunc("/query/{query}", LogAccess(l, qa.handleGetMetadata)).Methods("GET")
 	r.HandleFunc("/query/{query}", LogAccess(l, qa.handlePutMetadata)).Methods("PUT")
 	r.HandleFunc("/query/{query}/result", LogAccess(l, qa.handleGetResults)).Methods("GET")
@@ -298,6 +972,28 @@ func (qa *QueryAPI) EnableQueryLogging() {
 	qa.qc.EnableQueryLogging()
 }
 
+func (qa *QueryAPI) EnableSlowQueryLogging() {
+	qa.qc.EnableSlowQueryLogging()
+}
+
+// EvictEvery evicts expired query results from the cache behind this API at
+// the configured interval until the given channel is closed.
+func (qa *QueryAPI) EvictEvery(stop chan struct{}) {
+	qa.qc.EvictEvery(stop)
+}
+
+// AccountQueriesTo sets a usage accountant to which the execution time of
+// queries submitted through this API is reported.
+func (qa *QueryAPI) AccountQueriesTo(acct *UsageAccountant) {
+	qa.acct = acct
+}
+
+// CheckHealth checks that the query cache's database is reachable and its
+// result directory is writable.
+func (qa *QueryAPI) CheckHealth() error {
+	return qa.qc.CheckHealth()
+}
+
 func NewQueryAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*QueryAPI, error) {
 
 	if config.QueryCacheRoot == "" {
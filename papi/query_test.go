@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,6 +21,7 @@ type testQueryMetadata struct {
 	Completed   string `json:"__time_completed"`
 	ExtRef      string `json:"_ext_ref"`
 	Description string `json:"description"`
+	Owner       string `json:"__owner"`
 }
 
 type testResultSet struct {
@@ -93,10 +95,22 @@ func TestQueryLifecycle(t *testing.T) {
 		t.Fatalf("expected %d rows, got %d", expectedRowCount, rowCount)
 	}
 
+	// asking for partial results of a complete query returns complete results
+	res := executeRequest(TestRouter, t, "GET", q.Result+"?allow_partial=1", nil, "", GoodAPIKey, http.StatusOK)
+
+	var partial map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &partial); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := partial["partial"]; ok {
+		t.Fatal("complete query returned partial results")
+	}
+
 	// update the query metadata and verify we can retrieve it
 	q.Description = "this is a test query, yay!"
 
-	res := executeWithJSON(TestRouter, t, "PUT", q.Link, q, GoodAPIKey, http.StatusOK)
+	res = executeWithJSON(TestRouter, t, "PUT", q.Link, q, GoodAPIKey, http.StatusOK)
 
 	if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
 		t.Fatal(err)
@@ -136,3 +150,525 @@ func TestQueryLifecycle(t *testing.T) {
 	}
 
 }
+
+func TestQueryStatistics(t *testing.T) {
+	TestConfig.RecordQueryStatistics = true
+	defer func() { TestConfig.RecordQueryStatistics = false }()
+
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.orange",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+
+	q := new(testQueryMetadata)
+
+	for {
+		res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+
+		if q.State == "failed" {
+			t.Fatalf("Query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+
+	// statistics are only available to administrators
+	executeRequest(TestRouter, t, "GET", q.Link+"?debug=1", nil, "", "", http.StatusForbidden)
+
+	res := executeRequest(TestRouter, t, "GET", q.Link+"?debug=1", nil, "", GoodAPIKey, http.StatusOK)
+
+	var stats map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if sql, _ := stats["__sql"].(string); sql == "" {
+		t.Fatal("query statistics missing SQL")
+	}
+	if _, ok := stats["__exec_ms"]; !ok {
+		t.Fatal("query statistics missing execution time")
+	}
+	if statements, _ := stats["__statements"].(float64); statements < 1 {
+		t.Fatalf("query statistics recorded %v statements", stats["__statements"])
+	}
+
+	// and are not included without debug
+	res = executeRequest(TestRouter, t, "GET", q.Link, nil, "", GoodAPIKey, http.StatusOK)
+
+	stats = nil
+	if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stats["__sql"]; ok {
+		t.Fatal("query statistics returned without debug")
+	}
+}
+
+func TestNamedQueries(t *testing.T) {
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.green",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+
+	q := new(testQueryMetadata)
+
+	for {
+		res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+
+		if q.State == "failed" {
+			t.Fatalf("Query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+
+	type testNamedQuery struct {
+		Link    string              `json:"__link"`
+		Query   string              `json:"__query"`
+		Execute string              `json:"__execute"`
+		History []map[string]string `json:"__history"`
+	}
+
+	namedLink := "https://ptotest.mami-project.eu/query/named/green-test"
+
+	// name the query
+	ref := map[string]string{"query": q.Link}
+	res := executeWithJSON(TestRouter, t, "PUT", namedLink, ref, GoodAPIKey, http.StatusOK)
+
+	var nq testNamedQuery
+	if err := json.Unmarshal(res.Body.Bytes(), &nq); err != nil {
+		t.Fatal(err)
+	}
+
+	if nq.Link != namedLink || nq.Query != q.Link || len(nq.History) != 1 {
+		t.Fatalf("unexpected named query %+v", nq)
+	}
+
+	// it should be listed
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/named", nil, "", GoodAPIKey, http.StatusOK)
+
+	var list struct {
+		NamedQueries []string `json:"named_queries"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, link := range list.NamedQueries {
+		if link == namedLink {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("named query missing from list %v", list.NamedQueries)
+	}
+
+	// re-execute it, and check the execution is in its history
+	res = executeRequest(TestRouter, t, "POST", nq.Execute, nil, "", GoodAPIKey, http.StatusOK)
+
+	eq := new(testQueryMetadata)
+	if err := json.Unmarshal(res.Body.Bytes(), &eq); err != nil {
+		t.Fatal(err)
+	}
+	if eq.Link != q.Link {
+		t.Fatalf("named query executed as %s, expected %s", eq.Link, q.Link)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", namedLink, nil, "", GoodAPIKey, http.StatusOK)
+
+	nq = testNamedQuery{}
+	if err := json.Unmarshal(res.Body.Bytes(), &nq); err != nil {
+		t.Fatal(err)
+	}
+	if len(nq.History) != 2 {
+		t.Fatalf("expected 2 executions of named query, got %d", len(nq.History))
+	}
+
+	// names must refer to queries that exist
+	executeWithJSON(TestRouter, t, "PUT", namedLink, map[string]string{"query": "nonesuch"}, GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/named/nonesuch", nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+func TestQueryTemplates(t *testing.T) {
+	templateLink := "https://ptotest.mami-project.eu/query/template/color-test"
+
+	// save a template for all observations of a color in the test set
+	tmpl := map[string]string{
+		"template": fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.$color",
+			TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z")),
+		"description": "observations of a color in the test set",
+	}
+	res := executeWithJSON(TestRouter, t, "PUT", templateLink, tmpl, GoodAPIKey, http.StatusOK)
+
+	type testQueryTemplate struct {
+		Link       string   `json:"__link"`
+		Submit     string   `json:"__submit"`
+		Parameters []string `json:"parameters"`
+	}
+
+	var qt testQueryTemplate
+	if err := json.Unmarshal(res.Body.Bytes(), &qt); err != nil {
+		t.Fatal(err)
+	}
+
+	if qt.Link != templateLink || len(qt.Parameters) != 1 || qt.Parameters[0] != "color" {
+		t.Fatalf("unexpected query template %+v", qt)
+	}
+
+	// it should be listed
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/template", nil, "", GoodAPIKey, http.StatusOK)
+
+	var list struct {
+		QueryTemplates []string `json:"templates"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, link := range list.QueryTemplates {
+		if link == templateLink {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("query template missing from list %v", list.QueryTemplates)
+	}
+
+	// submitting the instantiated template submits the same query as
+	// submitting it directly
+	res = executeRequest(TestRouter, t, "POST", qt.Submit+"?color=green", nil, "", GoodAPIKey, http.StatusOK)
+
+	tq := new(testQueryMetadata)
+	if err := json.Unmarshal(res.Body.Bytes(), &tq); err != nil {
+		t.Fatal(err)
+	}
+
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.green",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+
+	q := new(testQueryMetadata)
+	if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+		t.Fatal(err)
+	}
+
+	if tq.Link != q.Link {
+		t.Fatalf("query template submitted as %s, expected %s", tq.Link, q.Link)
+	}
+
+	// parameters must be given, and only parameters
+	executeRequest(TestRouter, t, "POST", qt.Submit, nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "POST", qt.Submit+"?color=green&shape=round", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// templates must exist
+	executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/query/template/nonesuch/submit", nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+func TestQueryPinning(t *testing.T) {
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/pinning_a.json"},
+		Conditions:  []string{"pto.test.pinned"},
+		Description: "First observation set to pin",
+	}
+	setA := createObsSetWithData(t, setUp,
+		`["0", "2014-02-01T10:00:00Z", "2014-02-01T10:01:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.pinned"]`)
+
+	queryParams := "time_start=2014-02-01T00%3A00%3A00Z&time_end=2014-02-02T00%3A00%3A00Z&condition=pto.test.pinned"
+
+	// waitForQuery polls a query until it completes or fails
+	waitForQuery := func(link string) *testQueryMetadata {
+		for {
+			res := executeRequest(TestRouter, t, "GET", link, nil, "", GoodAPIKey, http.StatusOK)
+
+			q := new(testQueryMetadata)
+			if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+				t.Fatal(err)
+			}
+			if q.State == "failed" || q.State == "complete" {
+				return q
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	sourcesOf := func(link string) []string {
+		res := executeRequest(TestRouter, t, "GET", link, nil, "", GoodAPIKey, http.StatusOK)
+
+		var pinned struct {
+			Sources  []string          `json:"__sources"`
+			Modified map[string]string `json:"__sources_modified"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &pinned); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, link := range pinned.Sources {
+			if pinned.Modified[link] == "" {
+				t.Fatalf("pinned source %s missing modification time", link)
+			}
+		}
+		return pinned.Sources
+	}
+
+	if count := countQueryResults(t, queryParams); count != 1 {
+		t.Fatalf("query returned %d observations, expected 1", count)
+	}
+
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+	q := new(testQueryMetadata)
+	if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+		t.Fatal(err)
+	}
+	if sources := sourcesOf(q.Link); len(sources) != 1 || sources[0] != setA.Link {
+		t.Fatalf("query pinned to unexpected sources %v", sources)
+	}
+
+	// a new set in range does not change the cached query
+	createObsSetWithData(t, ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/pinning_b.json"},
+		Conditions:  []string{"pto.test.pinned"},
+		Description: "Second observation set to pin",
+	}, `["0", "2014-02-01T11:00:00Z", "2014-02-01T11:01:00Z", "10.0.0.1 * 10.0.0.3", "pto.test.pinned"]`)
+
+	// re-executing under a name covers the same sets
+	namedLink := "https://ptotest.mami-project.eu/query/named/pinning-test"
+	executeWithJSON(TestRouter, t, "PUT", namedLink, map[string]string{"query": q.Link}, GoodAPIKey, http.StatusOK)
+	executeRequest(TestRouter, t, "POST", namedLink+"/execute", nil, "", GoodAPIKey, http.StatusOK)
+	if q = waitForQuery(q.Link); q.State != "complete" {
+		t.Fatalf("pinned query failed with error %s", q.Error)
+	}
+	if sources := sourcesOf(q.Link); len(sources) != 1 {
+		t.Fatalf("re-executed query pinned to unexpected sources %v", sources)
+	}
+
+	// repinning covers the new set as well
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams+"&option=repin", nil, "", GoodAPIKey, http.StatusOK)
+	if q = waitForQuery(q.Link); q.State != "complete" {
+		t.Fatalf("repinned query failed with error %s", q.Error)
+	}
+	if sources := sourcesOf(q.Link); len(sources) != 2 {
+		t.Fatalf("repinned query pinned to unexpected sources %v", sources)
+	}
+	if count := countQueryResults(t, queryParams); count != 2 {
+		t.Fatalf("repinned query returned %d observations, expected 2", count)
+	}
+
+	// modifying a pinned set makes re-execution fail
+	executeWithJSON(TestRouter, t, "PUT", setA.Link, map[string]interface{}{
+		"_analyzer":   setUp.Analyzer,
+		"_sources":    setUp.Sources,
+		"_conditions": setUp.Conditions,
+		"description": "Modified observation set",
+	}, GoodAPIKey, http.StatusCreated)
+
+	executeRequest(TestRouter, t, "POST", namedLink+"/execute", nil, "", GoodAPIKey, http.StatusOK)
+	if q = waitForQuery(q.Link); q.State != "failed" {
+		t.Fatal("query pinned to modified set did not fail")
+	}
+
+	executeRequest(TestRouter, t, "POST", namedLink+"/execute?option=repin", nil, "", GoodAPIKey, http.StatusOK)
+	if q = waitForQuery(q.Link); q.State != "complete" {
+		t.Fatalf("repinned query failed with error %s", q.Error)
+	}
+}
+
+func TestQueryGroupObjects(t *testing.T) {
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.*&group=condition&group=day",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+
+	q := new(testQueryMetadata)
+
+	for {
+		res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+
+		if q.State == "failed" {
+			t.Fatalf("Query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+
+	res := executeRequest(TestRouter, t, "GET", q.Result, nil, "", GoodAPIKey, http.StatusOK)
+
+	arrays := new(testResultSet)
+	if err := json.Unmarshal(res.Body.Bytes(), &arrays); err != nil {
+		t.Fatal(err)
+	}
+	if len(arrays.Groups) == 0 {
+		t.Fatal("group query returned no groups")
+	}
+
+	res = executeRequest(TestRouter, t, "GET", q.Result+"?format=objects&pivot=1", nil, "", GoodAPIKey, http.StatusOK)
+
+	var objects struct {
+		Groups []struct {
+			Group map[string]interface{} `json:"group"`
+			Count float64                `json:"count"`
+		} `json:"groups"`
+		Pivot map[string]map[string]float64 `json:"pivot"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &objects); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects.Groups) != len(arrays.Groups) {
+		t.Fatalf("got %d group objects for %d group arrays", len(objects.Groups), len(arrays.Groups))
+	}
+	for i, row := range arrays.Groups {
+		obj := objects.Groups[i]
+		if obj.Group["condition"] != row[0] || obj.Group["day"] != row[1] || obj.Count != row[2] {
+			t.Fatalf("group object %v does not match group array %v", obj, row)
+		}
+		condition, _ := row[0].(string)
+		day, _ := row[1].(string)
+		if objects.Pivot[condition][day] != row[2] {
+			t.Fatalf("pivot %v does not match group array %v", objects.Pivot[condition], row)
+		}
+	}
+
+	// pivoting needs objects, and bad formats are rejected
+	executeRequest(TestRouter, t, "GET", q.Result+"?pivot=1", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", q.Result+"?format=pivoted", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestPrivateQueries(t *testing.T) {
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.red&group=condition",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:30:00Z"))
+
+	submit := func(params string, apikey string) *testQueryMetadata {
+		res := executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/query/submit",
+			strings.NewReader(params), "application/x-www-form-urlencoded", apikey, http.StatusOK)
+		q := new(testQueryMetadata)
+		if err := json.Unmarshal(res.Body.Bytes(), q); err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	// the same query, shared and private to each principal, has three
+	// identifiers
+	shared := submit(queryParams, GoodAPIKey)
+	private := submit(queryParams+"&private=1", GoodAPIKey)
+	otherPrivate := submit(queryParams+"&private=1", OtherAPIKey)
+	if shared.Link == private.Link || private.Link == otherPrivate.Link || shared.Link == otherPrivate.Link {
+		t.Fatalf("private queries share identifiers: %s, %s, %s", shared.Link, private.Link, otherPrivate.Link)
+	}
+	if private.Owner == "" || private.Owner == otherPrivate.Owner {
+		t.Fatalf("bad owners %q and %q on private queries", private.Owner, otherPrivate.Owner)
+	}
+
+	// owners may read their private queries; other principals may not
+	executeRequest(TestRouter, t, "GET", private.Link, nil, "", GoodAPIKey, http.StatusOK)
+	executeRequest(TestRouter, t, "GET", private.Link, nil, "", OtherAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", otherPrivate.Link, nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", shared.Link, nil, "", OtherAPIKey, http.StatusOK)
+
+	// nor list them
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query", nil, "", OtherAPIKey, http.StatusOK)
+	var list struct {
+		Queries []string `json:"queries"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range list.Queries {
+		if link == private.Link {
+			t.Fatalf("private query %s listed to another principal", link)
+		}
+	}
+
+	// an owner given in the form is ignored
+	forged := submit(queryParams+"&owner="+url.QueryEscape(private.Owner), OtherAPIKey)
+	if forged.Link != shared.Link {
+		t.Fatalf("query submitted with forged owner got identifier %s, expected shared %s", forged.Link, shared.Link)
+	}
+
+	// private queries may only be named by their owners
+	namedLink := "https://ptotest.mami-project.eu/query/named/private-test"
+	executeWithJSON(TestRouter, t, "PUT", namedLink, map[string]string{"query": otherPrivate.Link}, GoodAPIKey, http.StatusNotFound)
+	executeWithJSON(TestRouter, t, "PUT", namedLink, map[string]string{"query": private.Link}, GoodAPIKey, http.StatusOK)
+
+	// and named private queries may only be read and executed by their owners
+	executeRequest(TestRouter, t, "GET", namedLink, nil, "", GoodAPIKey, http.StatusOK)
+	executeRequest(TestRouter, t, "GET", namedLink, nil, "", OtherAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "POST", namedLink+"/execute", nil, "", OtherAPIKey, http.StatusNotFound)
+}
+
+func TestQueryQueue(t *testing.T) {
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.green",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+
+	q := new(testQueryMetadata)
+
+	// wait until the query completes or fails
+	for {
+		res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+
+		if q.State == "failed" {
+			t.Fatalf("Query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/queue", nil, "", GoodAPIKey, http.StatusOK)
+
+	var queue struct {
+		Executing int `json:"executing"`
+		Waiting   int `json:"waiting"`
+		Queries   []struct {
+			Link  string `json:"__link"`
+			State string `json:"state"`
+		} `json:"queries"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &queue); err != nil {
+		t.Fatal(err)
+	}
+
+	if queue.Executing+queue.Waiting != len(queue.Queries) {
+		t.Fatalf("queue counts %d executing and %d waiting for %d queries", queue.Executing, queue.Waiting, len(queue.Queries))
+	}
+
+	// completed queries are no longer queued
+	for _, qq := range queue.Queries {
+		if qq.Link == q.Link {
+			t.Fatalf("completed query %s still queued as %s", q.Link, qq.State)
+		}
+	}
+
+	qid := q.Link[strings.LastIndex(q.Link, "/")+1:]
+	executeRequest(TestRouter, t, "PUT", "https://ptotest.mami-project.eu/query/queue/"+qid+"?priority=10", nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "DELETE", "https://ptotest.mami-project.eu/query/queue/"+qid, nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// priorities must be integers
+	executeRequest(TestRouter, t, "PUT", "https://ptotest.mami-project.eu/query/queue/"+qid+"?priority=high", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// the queue is only available to admins
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/queue", nil, "", "", http.StatusForbidden)
+	executeRequest(TestRouter, t, "DELETE", "https://ptotest.mami-project.eu/query/queue/"+qid, nil, "", "", http.StatusForbidden)
+}
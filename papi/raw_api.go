@@ -2,11 +2,15 @@ package papi
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/mami-project/pto3-go"
 
@@ -15,17 +19,22 @@ import (
 
 type RawAPI struct {
 	config *pto3.PTOConfiguration
-	rds    *pto3.RawDataStore
+	rds    pto3.RawStore
 	azr    Authorizer
 }
 
-func (ra *RawAPI) rawMetadataResponse(w http.ResponseWriter, status int, cam *pto3.Campaign, filename string) {
+// DataStore returns the raw data store served by this API.
+func (ra *RawAPI) DataStore() pto3.RawStore {
+	return ra.rds
+}
+
+func (ra *RawAPI) rawMetadataResponse(w http.ResponseWriter, status int, camname string, filename string) {
 	var md *pto3.RawMetadata
 	var err error
 	if filename == "" {
-		md, err = cam.GetCampaignMetadata()
+		md, err = ra.rds.GetCampaignMetadata(camname)
 	} else {
-		md, err = cam.GetFileMetadata(filename)
+		md, err = ra.rds.GetFileMetadata(camname, filename)
 	}
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "retrieving metadata", err)
@@ -89,16 +98,49 @@ func (ra *RawAPI) handleListCampaigns(w http.ResponseWriter, r *http.Request) {
 type campaignFileList struct {
 	Metadata *pto3.RawMetadata
 	Files    []string
+	Details  map[string]map[string]interface{}
 	Next     string
 	Prev     string
 }
 
+// fileDetail summarizes file metadata for inclusion in a campaign file list:
+// its filetype, data size, record count, and time range.
+func fileDetail(md *pto3.RawMetadata) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	if ft := md.Filetype(true); ft != "" {
+		out["_file_type"] = ft
+	}
+
+	if size := md.DataSize(); size != 0 {
+		out["__data_size"] = size
+	}
+
+	if count := md.RecordCount(); count != nil {
+		out["__record_count"] = *count
+	}
+
+	if ts := md.TimeStart(true); ts != nil {
+		out["_time_start"] = ts.Format(time.RFC3339)
+	}
+
+	if te := md.TimeEnd(true); te != nil {
+		out["_time_end"] = te.Format(time.RFC3339)
+	}
+
+	return out
+}
+
 func (cfl *campaignFileList) MarshalJSON() ([]byte, error) {
 	out := make(map[string]interface{})
 
 	out["metadata"] = cfl.Metadata
 	out["files"] = cfl.Files
 
+	if cfl.Details != nil {
+		out["details"] = cfl.Details
+	}
+
 	if cfl.Next != "" {
 		out["next"] = cfl.Next
 	}
@@ -110,6 +152,67 @@ func (cfl *campaignFileList) MarshalJSON() ([]byte, error) {
 	return json.Marshal(out)
 }
 
+type filetypeList struct {
+	Filetypes []pto3.RawFiletype `json:"filetypes"`
+}
+
+// handleListFiletypes handles GET /raw/filetypes, returning the filetype
+// registry, so that upload clients can discover which filetypes they may
+// upload, as which MIME types, and up to which size. It writes a JSON object
+// to the response with a single key, "filetypes", whose content is an array
+// of filetype objects.
+func (ra *RawAPI) handleListFiletypes(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "raw_metadata") {
+		return
+	}
+
+	outb, err := json.Marshal(filetypeList{Filetypes: ra.config.RawFiletypes()})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling filetype list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+type vocabularyList struct {
+	Vocabularies map[string][]string `json:"vocabularies"`
+}
+
+// handleListVocabularies handles GET /raw/vocabularies, returning the
+// controlled vocabularies for raw metadata, so that clients can discover
+// which values they may give for which keys. It writes a JSON object to the
+// response with a single key, "vocabularies", whose content is an object
+// mapping metadata keys to arrays of allowed values.
+func (ra *RawAPI) handleListVocabularies(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "raw_metadata") {
+		return
+	}
+
+	vocabularies := ra.config.MetadataVocabularies
+	if vocabularies == nil {
+		vocabularies = make(map[string][]string)
+	}
+
+	outb, err := json.Marshal(vocabularyList{Vocabularies: vocabularies})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling vocabulary list", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
 // handleGetCampaignMetadata handles GET /raw/<campaign>, returning metadata for
 // a campaign. It writes a JSON object to the response containing campaign
 // metadata.
@@ -124,31 +227,26 @@ func (ra *RawAPI) handleGetCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	// get campaign name
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
 		return
 	}
 
 	// parse headers
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
 	}
 
 	// look up campaign
-	cam, err := ra.rds.CampaignForName(camname)
-	if err != nil {
-		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
-		return
-	}
-
 	var out campaignFileList
-	out.Metadata, err = cam.GetCampaignMetadata()
+	var err error
+	out.Metadata, err = ra.rds.GetCampaignMetadata(camname)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "getting campaign metadata", err)
 		return
 	}
 
 	// Get list of all files to determine whether we need to paginate
-	filenames, err := cam.FileNames()
+	filenames, err := ra.rds.FileNames(camname)
 
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "listing campaign files", err)
@@ -160,14 +258,21 @@ func (ra *RawAPI) handleGetCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	page := int(page64)
 	offset := page * ra.config.PageLength
 
+	// page links keep the detail parameter
+	detail, _ := strconv.ParseBool(r.Form.Get("detail"))
+	var detailParam string
+	if detail {
+		detailParam = "&detail=1"
+	}
+
 	if page > 0 || len(filenames) > (page+1)*ra.config.PageLength {
 
 		if len(filenames) > (page+1)*ra.config.PageLength {
-			out.Next, _ = ra.config.LinkTo(fmt.Sprintf("/raw/%s?page=%d", camname, page+1))
+			out.Next, _ = ra.config.LinkTo(fmt.Sprintf("/raw/%s?page=%d%s", camname, page+1, detailParam))
 		}
 
 		if page > 0 {
-			out.Prev, _ = ra.config.LinkTo(fmt.Sprintf("/raw/%s?page=%d", camname, page-1))
+			out.Prev, _ = ra.config.LinkTo(fmt.Sprintf("/raw/%s?page=%d%s", camname, page-1, detailParam))
 		}
 
 		endOffset := offset + ra.config.PageLength
@@ -184,6 +289,19 @@ func (ra *RawAPI) handleGetCampaignMetadata(w http.ResponseWriter, r *http.Reque
 		out.Files[i], _ = ra.config.LinkTo(fmt.Sprintf("/raw/%s/%s", camname, filenames[i]))
 	}
 
+	// inline file details if requested
+	if detail {
+		out.Details = make(map[string]map[string]interface{}, len(filenames))
+		for i := range filenames {
+			md, err := ra.rds.GetFileMetadata(camname, filenames[i])
+			if err != nil {
+				pto3.HandleErrorHTTP(w, "getting file metadata", err)
+				return
+			}
+			out.Details[out.Files[i]] = fileDetail(md)
+		}
+	}
+
 	// and write
 	outb, err := json.Marshal(&out)
 	if err != nil {
@@ -207,7 +325,7 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	// get campaign name
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
 		return
 	}
 
@@ -218,15 +336,15 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
 		return
 	}
 
 	// read metadata from request
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
 		return
 	}
 
@@ -234,44 +352,17 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	var in pto3.RawMetadata
 	err = json.Unmarshal(b, &in)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, err.Error())
 		return
 	}
 
-	// now look up the campaig and create if necessary.
-	cam, err := ra.rds.CampaignForName(camname)
-	didCreateCampaign := false
-	if err != nil {
-		switch ev := err.(type) {
-		case *pto3.PTOError:
-			if ev.Status() == http.StatusNotFound {
-				// Campaign doesn't exist. We have to create it.
-				cam, err = ra.rds.CreateCampaign(camname, &in)
-				if err != nil {
-					pto3.HandleErrorHTTP(w, "creating campaign", err)
-					return
-				}
-				didCreateCampaign = true
-			} else {
-				pto3.HandleErrorHTTP(w, "retrieving campaign", err)
-				return
-			}
-		default:
-			pto3.HandleErrorHTTP(w, "retrieving campaign", err)
-			return
-		}
-	}
-
-	// overwrite metadata unless we created the campaign
-	if !didCreateCampaign {
-		err = cam.PutCampaignMetadata(&in)
-		if err != nil {
-			pto3.HandleErrorHTTP(w, "writing metadata", err)
-			return
-		}
+	// now overwrite metadata, creating the campaign if necessary
+	if err := ra.rds.PutCampaignMetadata(camname, &in); err != nil {
+		pto3.HandleErrorHTTP(w, "writing metadata", err)
+		return
 	}
 
-	ra.rawMetadataResponse(w, http.StatusCreated, cam, "")
+	ra.rawMetadataResponse(w, http.StatusCreated, camname, "")
 }
 
 // handleGetFileMetadata handles GET /raw/<campaign>/<file>, returning
@@ -289,23 +380,17 @@ func (ra *RawAPI) handleGetFileMetadata(w http.ResponseWriter, r *http.Request)
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
-		return
-	}
-
-	cam, err := ra.rds.CampaignForName(camname)
-	if err != nil {
-		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
 		return
 	}
 
-	ra.rawMetadataResponse(w, http.StatusOK, cam, filename)
+	ra.rawMetadataResponse(w, http.StatusOK, camname, filename)
 }
 
 // handlePutFileMetadata handles PUT /raw/<campaign>/<file>, overwriting metadata for
@@ -317,13 +402,13 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
 		return
 	}
 
@@ -334,15 +419,15 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		pto3.ProblemHTTP(w, http.StatusUnsupportedMediaType, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")))
 		return
 	}
 
 	// read metadata from request
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadRequest, err.Error())
 		return
 	}
 
@@ -350,25 +435,18 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 	var in pto3.RawMetadata
 	err = json.Unmarshal(b, &in)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// now look up the campaign
-	cam, err := ra.rds.CampaignForName(camname)
-	if err != nil {
-		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadMetadata, err.Error())
 		return
 	}
 
 	// overwrite metadata for file
-	err = cam.PutFileMetadata(filename, &in)
+	err = ra.rds.PutFileMetadata(camname, filename, &in)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "writing file metadata", err)
 		return
 	}
 
-	ra.rawMetadataResponse(w, http.StatusCreated, cam, filename)
+	ra.rawMetadataResponse(w, http.StatusCreated, camname, filename)
 }
 
 // handleDeleteFile handles DELETE /raw/<campaign>/<file>, deleting a file's
@@ -376,57 +454,178 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 // Deletion is not yet fully specified or implemented, so this just returns a
 // StatusNotImplemented response for now.
 func (ra *RawAPI) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "delete not implemented, come back later", http.StatusNotImplemented)
+	pto3.ProblemHTTP(w, http.StatusNotImplemented, pto3.ErrCodeNotImplemented, "delete not implemented, come back later")
 }
 
 // handleFileDownload handles GET /raw/<campaign>/<file>/data, returning a file's
 // content. It writes a response of the appropriate MIME type for the file (as
-// determined by the filetypes map and the _file_type metadata key).
+// determined by the filetypes map and the _file_type metadata key). Range
+// requests are supported, so interrupted downloads can be resumed. Requests
+// with a valid signature (see handleShareFile) need no API key.
 func (ra *RawAPI) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
 		return
 	}
 
 	// fail if not authorized
-	if !ra.azr.IsAuthorized(w, r, "read_raw:"+camname) {
+	if ok, _ := authorizeSigned(ra.config, ra.azr, w, r, "read_raw:"+camname); !ok {
 		return
 	}
 
-	// now look up the campaign
-	cam, err := ra.rds.CampaignForName(camname)
+	// now look up the file
+	md, err := ra.rds.GetFileMetadata(camname, filename)
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		pto3.HandleErrorHTTP(w, "retrieving file metadata", err)
 		return
 	}
 
 	// determine MIME type
-	ft := cam.GetFiletype(filename)
+	ft := ra.filetypeOf(md)
 	if ft == nil {
 		pto3.HandleErrorHTTP(w, fmt.Sprintf("determining filetype for %s", filename), nil)
 		return
 	}
 
+	// open the file
+	in, err := ra.rds.OpenFileData(camname, filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no data for file %s", filename))
+		} else {
+			pto3.HandleErrorHTTP(w, "opening data file", err)
+		}
+		return
+	}
+	defer in.Close()
+
+	// data is immutable once uploaded, so it was last modified when created
+	var modtime time.Time
+	if md.CreationTime() != nil {
+		modtime = *md.CreationTime()
+	}
+
 	// write MIME type to header
 	w.Header().Set("Content-Type", ft.ContentType)
 	ra.additionalHeaders(w)
+
+	// and serve the file, handling range and conditional requests
+	http.ServeContent(w, r, filename, modtime, in)
+}
+
+// defaultPreviewLines and maxPreviewLines are the default and largest number
+// of lines returned by a raw file preview.
+const defaultPreviewLines = 10
+const maxPreviewLines = 1000
+
+type filePreview struct {
+	Lines []string `json:"lines"`
+	More  bool     `json:"more"`
+}
+
+// handleFilePreview handles GET /raw/<campaign>/<file>/preview, returning
+// the first lines of a text-based file's content, decompressed if necessary,
+// so that uploads can be checked without downloading them. The number of
+// lines is given by the lines parameter. It writes a JSON object to the
+// response with the lines as an array of strings in the "lines" key, and
+// whether the file has more lines in the "more" key; the JSON encoding
+// escapes markup, so the preview is safe to display in a browser whatever the
+// file contains.
+func (ra *RawAPI) handleFilePreview(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
+		return
+	}
+
+	filename, ok := vars["file"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
+		return
+	}
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "read_raw:"+camname) {
+		return
+	}
+
+	lines := defaultPreviewLines
+	if s := r.URL.Query().Get("lines"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPreviewLines {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad lines %s; must be between 1 and %d", s, maxPreviewLines))
+			return
+		}
+		lines = n
+	}
+
+	var preview filePreview
+	var err error
+	preview.Lines, preview.More, err = pto3.PreviewRawFileData(ra.rds, camname, filename, lines)
+	if err != nil {
+		if os.IsNotExist(err) {
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no data for file %s", filename))
+		} else {
+			pto3.HandleErrorHTTP(w, "previewing data file", err)
+		}
+		return
+	}
+
+	outb, err := json.Marshal(preview)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling preview", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	ra.additionalHeaders(w)
 	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
 
-	// and copy the file
-	if err := cam.ReadFileDataToStream(filename, w); err != nil {
-		pto3.HandleErrorHTTP(w, "downloading data file", err)
-		w.Write([]byte("\n\"error during download\"\n"))
+// handleShareFile handles POST /raw/<campaign>/<file>/share, returning a
+// signed URL for the file's content, granting access to it without an API
+// key for the lifetime given in the expires_in parameter.
+func (ra *RawAPI) handleShareFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
+		return
+	}
+
+	filename, ok := vars["file"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
+		return
+	}
+
+	// only those who may read a file may share it
+	if !ra.azr.IsAuthorized(w, r, "read_raw:"+camname) {
+		return
 	}
+
+	// make sure the file exists
+	if _, err := ra.rds.GetFileMetadata(camname, filename); err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving file metadata", err)
+		return
+	}
+
+	writeShareResponse(ra.config, w, r, fmt.Sprintf("raw/%s/%s/data", camname, filename))
 }
 
 // handleFileUpload handles PUT /raw/<campaign>/<file>/data. It requires a request of the appropriate MIME type for the file (as
@@ -436,13 +635,13 @@ func (ra *RawAPI) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
 		return
 	}
 
@@ -451,33 +650,144 @@ func (ra *RawAPI) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// now look up the campaign
-	cam, err := ra.rds.CampaignForName(camname)
+	// now look up the file
+	md, err := ra.rds.GetFileMetadata(camname, filename)
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		pto3.HandleErrorHTTP(w, "retrieving file metadata", err)
 		return
 	}
 
 	// determine and verify MIME type
-	ft := cam.GetFiletype(filename)
+	ft := ra.filetypeOf(md)
 	if ft == nil {
 		// fixme another way to do this?
 		pto3.HandleErrorHTTP(w, fmt.Sprintf("getting filetype for %s", filename), nil)
 		return
 	}
 	if ft.ContentType != r.Header.Get("Content-Type") {
-		http.Error(w, fmt.Sprintf("Content-Type for %s/%s must be %s", camname, filename, ft.ContentType), http.StatusBadRequest)
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeUnsupportedMediaType, fmt.Sprintf("Content-Type for %s/%s must be %s", camname, filename, ft.ContentType))
 		return
 	}
 
+	// enforce upload size limit for this filetype
+	var in io.Reader = r.Body
+	var limited *uploadLimitReader
+	limit := ra.config.UploadSizeLimit(ft.Filetype)
+	if limit > 0 {
+		if r.ContentLength > limit {
+			pto3.ProblemHTTP(w, http.StatusRequestEntityTooLarge, pto3.ErrCodeTooLarge, fmt.Sprintf("upload of %d bytes exceeds limit of %d bytes for %s", r.ContentLength, limit, ft.Filetype))
+			return
+		}
+		limited = &uploadLimitReader{r: r.Body, remaining: limit}
+		in = limited
+	}
+
 	// copy the stream to the file
-	if err := cam.WriteFileDataFromStream(filename, false, r.Body); err != nil {
-		pto3.HandleErrorHTTP(w, "writing uploaded data", err)
+	if err := ra.rds.WriteFileDataFromStreamContext(r.Context(), camname, filename, in, r.ContentLength); err != nil {
+		if err == errUploadTooLarge || (limited != nil && limited.exceeded()) {
+			pto3.ProblemHTTP(w, http.StatusRequestEntityTooLarge, pto3.ErrCodeTooLarge, fmt.Sprintf("upload exceeds limit of %d bytes for %s", limit, ft.Filetype))
+		} else {
+			pto3.HandleErrorHTTP(w, "writing uploaded data", err)
+		}
 		return
 	}
 
 	// and now a reply... return file metadata
-	ra.rawMetadataResponse(w, http.StatusCreated, cam, filename)
+	ra.rawMetadataResponse(w, http.StatusCreated, camname, filename)
+}
+
+// errUploadTooLarge is returned by an uploadLimitReader when the upload it
+// reads is longer than its limit.
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadLimitReader reads an upload, failing with errUploadTooLarge if the
+// upload is longer than a given number of bytes.
+type uploadLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (lr *uploadLimitReader) Read(p []byte) (int, error) {
+	if lr.remaining < 0 {
+		return 0, errUploadTooLarge
+	}
+
+	// read one byte past the limit, to detect overflow
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.remaining {
+		n = int(lr.remaining)
+		lr.remaining = -1
+		return n, errUploadTooLarge
+	}
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+// exceeded returns true if the upload was longer than the limit.
+func (lr *uploadLimitReader) exceeded() bool {
+	return lr.remaining < 0
+}
+
+// handleUploadStatus handles GET /raw/<campaign>/<file>/upload-status,
+// returning the progress of the current or most recent upload of the file's
+// data to this server as a JSON object.
+func (ra *RawAPI) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing campaign")
+		return
+	}
+
+	filename, ok := vars["file"]
+	if !ok {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeMissingParameter, "missing file")
+		return
+	}
+
+	// fail if not authorized to upload
+	if !ra.azr.IsAuthorized(w, r, "write_raw:"+camname) {
+		return
+	}
+
+	progress := ra.rds.UploadProgress(camname, filename)
+	if progress == nil {
+		pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, fmt.Sprintf("no upload of %s/%s in progress", camname, filename))
+		return
+	}
+
+	b, err := json.Marshal(progress)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling upload progress", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// CheckHealth checks that the raw data store is writable.
+func (ra *RawAPI) CheckHealth() error {
+	return ra.rds.CheckHealth()
+}
+
+// filetypeOf returns the filetype of a file, as determined by the filetypes
+// map and the _file_type key of its metadata, or nil if the filetype is not
+// configured.
+func (ra *RawAPI) filetypeOf(md *pto3.RawMetadata) *pto3.RawFiletype {
+	ftname := md.Filetype(true)
+	ctype, ok := ra.config.ContentTypes[ftname]
+	if !ok {
+		return nil
+	}
+	return &pto3.RawFiletype{Filetype: ftname, ContentType: ctype}
 }
 
 func (ra *RawAPI) additionalHeaders(w http.ResponseWriter) {
@@ -488,6 +798,8 @@ func (ra *RawAPI) additionalHeaders(w http.ResponseWriter) {
 
 func (ra *RawAPI) addRoutes(r *mux.Router, l *log.Logger) {
 	r.HandleFunc("/raw", LogAccess(l, ra.handleListCampaigns)).Methods("GET")
+	r.HandleFunc("/raw/filetypes", LogAccess(l, ra.handleListFiletypes)).Methods("GET")
+	r.HandleFunc("/raw/vocabularies", LogAccess(l, ra.handleListVocabularies)).Methods("GET")
 	r.HandleFunc("/raw/{campaign}", LogAccess(l, ra.handleGetCampaignMetadata)).Methods("GET")
 	r.HandleFunc("/raw/{campaign}", LogAccess(l, ra.handlePutCampaignMetadata)).Methods("PUT")
 	r.HandleFunc("/raw/{campaign}/{file}", LogAccess(l, ra.handleGetFileMetadata)).Methods("GET")
@@ -495,23 +807,35 @@ func (ra *RawAPI) addRoutes(r *mux.Router, l *log.Logger) {
 	r.HandleFunc("/raw/{campaign}/{file}", LogAccess(l, ra.handleDeleteFile)).Methods("DELETE")
 	r.HandleFunc("/raw/{campaign}/{file}/data", LogAccess(l, ra.handleFileDownload)).Methods("GET")
 	r.HandleFunc("/raw/{campaign}/{file}/data", LogAccess(l, ra.handleFileUpload)).Methods("PUT")
+	r.HandleFunc("/raw/{campaign}/{file}/preview", LogAccess(l, ra.handleFilePreview)).Methods("GET")
+	r.HandleFunc("/raw/{campaign}/{file}/share", LogAccess(l, ra.handleShareFile)).Methods("POST")
+	r.HandleFunc("/raw/{campaign}/{file}/upload-status", LogAccess(l, ra.handleUploadStatus)).Methods("GET")
 }
 
+// NewRawAPI creates a raw data API serving a raw data store on the local
+// filesystem at the configured raw root. It returns nil if no raw root is
+// configured.
 func NewRawAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*RawAPI, error) {
-	var err error
-
 	if config.RawRoot == "" {
 		return nil, nil
 	}
 
+	rds, err := pto3.NewRawDataStore(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRawAPIForStore(config, azr, rds, r), nil
+}
+
+// NewRawAPIForStore creates a raw data API serving a given raw data store.
+func NewRawAPIForStore(config *pto3.PTOConfiguration, azr Authorizer, rds pto3.RawStore, r *mux.Router) *RawAPI {
 	ra := new(RawAPI)
 	ra.config = config
 	ra.azr = azr
-	if ra.rds, err = pto3.NewRawDataStore(config); err != nil {
-		return nil, err
-	}
+	ra.rds = rds
 
 	ra.addRoutes(r, config.AccessLogger())
 
-	return ra, nil
+	return ra
 }
@@ -3,17 +3,23 @@ package papi_test
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/papi"
 )
 
-var rds *pto3.RawDataStore
-
 func checkContentType(t *testing.T, res *httptest.ResponseRecorder) {
 	if res.Header().Get("Content-Type") != "application/json" {
 		t.Fatalf("unexpected content type %s", res.Header().Get("Content-Type"))
@@ -27,10 +33,11 @@ type testCampaignMetadata struct {
 }
 
 type testFileMetadata struct {
-	TimeStart string `json:"_time_start"`
-	TimeEnd   string `json:"_time_end"`
-	DataSize  int    `json:"__data_size"`
-	DataURL   string `json:"__data"`
+	TimeStart string            `json:"_time_start"`
+	TimeEnd   string            `json:"_time_end"`
+	DataSize  int               `json:"__data_size"`
+	DataURL   string            `json:"__data"`
+	Links     map[string]string `json:"__links,omitempty"`
 }
 
 type testRawMetadata struct {
@@ -47,8 +54,24 @@ type testCampaignFileList struct {
 	Files    []string             `json:"files"`
 }
 
+// newFileRawRouter returns a router serving the raw data API over a raw data
+// store on the filesystem at the test raw root, for tests of behavior
+// specific to that store; TestRouter serves an in-memory store.
+func newFileRawRouter(t *testing.T) *mux.Router {
+	rds, err := pto3.NewRawDataStore(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	papi.NewRawAPIForStore(TestConfig, setupAZR(), rds, r)
+	return r
+}
+
 func TestScanCampaigns(t *testing.T) {
-	// create a test directory
+	router := newFileRawRouter(t)
+
+	// create a test directory behind the store's back
 	if err := os.Mkdir(filepath.Join(TestConfig.RawRoot, "scantest"), 0755); err != nil {
 		t.Fatal(err)
 	}
@@ -76,7 +99,7 @@ func TestScanCampaigns(t *testing.T) {
 	}
 
 	// list campaigns to force a rescan
-	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw", nil, "", GoodAPIKey, http.StatusOK)
+	res := executeRequest(router, t, "GET", TestBaseURL+"/raw", nil, "", GoodAPIKey, http.StatusOK)
 	checkContentType(t, res)
 
 	var camlist testCampaignList
@@ -85,8 +108,88 @@ func TestScanCampaigns(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(camlist.Campaigns) < 1 {
-		t.Fatal("missing campaign")
+	found := false
+	for _, link := range camlist.Campaigns {
+		if link == TestBaseURL+"/raw/scantest" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("rescanned campaign scantest missing from %v", camlist.Campaigns)
+	}
+}
+
+func TestConcurrentScanCampaigns(t *testing.T) {
+	router := newFileRawRouter(t)
+
+	cmd_up := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign read while campaigns are rescanned",
+	}
+
+	executeWithJSON(router, t, "PUT", TestBaseURL+"/raw/racetest", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	// list campaigns, forcing rescans, while reading campaign metadata; run
+	// with -race to detect unsynchronized access to the campaign cache
+	const requests = 20
+	codes := make(chan int, 2*requests)
+	var wg sync.WaitGroup
+
+	for i := 0; i < requests; i++ {
+		for _, url := range []string{TestBaseURL + "/raw", TestBaseURL + "/raw/racetest"} {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", url, nil)
+				req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+				res := httptest.NewRecorder()
+				router.ServeHTTP(res, req)
+				codes <- res.Code
+			}(url)
+		}
+	}
+
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("concurrent campaign request failed with status %d", code)
+		}
+	}
+}
+
+func TestListFiletypes(t *testing.T) {
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/filetypes", nil, "", GoodAPIKey, http.StatusOK)
+	checkContentType(t, res)
+
+	var ftlist struct {
+		Filetypes []pto3.RawFiletype `json:"filetypes"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &ftlist); err != nil {
+		t.Fatal(err)
+	}
+
+	fts := make(map[string]pto3.RawFiletype)
+	for _, ft := range ftlist.Filetypes {
+		fts[ft.Filetype] = ft
+	}
+
+	if ft := fts["test"]; ft.ContentType != "application/json" || ft.Compressed {
+		t.Fatalf("bad test filetype %+v", ft)
+	}
+
+	// structured filetype configuration is merged into the registry
+	expected := pto3.RawFiletype{
+		Filetype:      "test-bz2",
+		ContentType:   "application/x-bzip2",
+		Compressed:    true,
+		MaxUploadSize: 1048576,
+		Validator:     "ptonorm-test",
+	}
+	if fts["test-bz2"] != expected {
+		t.Fatalf("bad test-bz2 filetype %+v", fts["test-bz2"])
 	}
 }
 
@@ -145,6 +248,21 @@ func TestRawRoundtrip(t *testing.T) {
 		t.Fatalf("data URL mismatch, reflected %s, downloaded %s", fmd_refl.DataURL, fmd_down.DataURL)
 	}
 
+	expectLinks := map[string]string{
+		"self":     TestBaseURL + "/raw/test/file001.json",
+		"data":     fmd_down.DataURL,
+		"campaign": TestBaseURL + "/raw/test",
+		"history":  TestBaseURL + "/admin/audit?target=%2Fraw%2Ftest%2Ffile001.json",
+	}
+	for rel, link := range expectLinks {
+		if fmd_down.Links[rel] != link {
+			t.Fatalf("bad %s link in downloaded metadata: expected %s, got %s", rel, link, fmd_down.Links[rel])
+		}
+	}
+	if len(fmd_down.Links) != len(expectLinks) {
+		t.Fatalf("unexpected links in downloaded metadata: %v", fmd_down.Links)
+	}
+
 	if fmd_down.TimeStart != fmd_up.TimeStart {
 		t.Fatalf("bad start time in downloaded metadata, got %s", fmd_down.TimeStart)
 	}
@@ -178,4 +296,298 @@ func TestRawRoundtrip(t *testing.T) {
 	if !bytes.Equal(bytesup, bytesdown) {
 		t.Fatalf("file download content mismatch: sent %s got %s", bytesup, bytesdown)
 	}
+
+	if res.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("file download should accept byte ranges, got Accept-Ranges %s", res.Header().Get("Accept-Ranges"))
+	}
+
+	// and download part of the file
+	req, err := http.NewRequest("GET", fmd_refl.DataURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+	req.Header.Set("Range", "bytes=2-5")
+
+	res = httptest.NewRecorder()
+	TestRouter.ServeHTTP(res, req)
+
+	if res.Code != http.StatusPartialContent {
+		t.Fatalf("range request expected status %d but got %d", http.StatusPartialContent, res.Code)
+	}
+
+	if !bytes.Equal(bytesup[2:6], res.Body.Bytes()) {
+		t.Fatalf("range download content mismatch: expected %s got %s", bytesup[2:6], res.Body.Bytes())
+	}
+}
+
+func TestRawCampaignDetail(t *testing.T) {
+	// create a file with some data in the test campaign
+	fmd_up := testFileMetadata{
+		TimeStart: "2010-01-03T00:00:00Z",
+		TimeEnd:   "2010-01-04T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/detail001.json", fmd_up, GoodAPIKey, http.StatusCreated)
+
+	data := []string{"listed", "in", "detail"}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/detail001.json/data", data, GoodAPIKey, http.StatusCreated)
+	bytesup, _ := json.Marshal(data)
+
+	var cfl struct {
+		Files   []string                          `json:"files"`
+		Details map[string]map[string]interface{} `json:"details"`
+	}
+
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test?detail=1", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &cfl); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfl.Details) != len(cfl.Files) {
+		t.Fatalf("%d file details for %d files", len(cfl.Details), len(cfl.Files))
+	}
+
+	detail := cfl.Details[TestBaseURL+"/raw/test/detail001.json"]
+	if detail["_file_type"] != "test" || detail["__data_size"] != float64(len(bytesup)) ||
+		detail["_time_start"] != fmd_up.TimeStart || detail["_time_end"] != fmd_up.TimeEnd {
+		t.Fatalf("unexpected file detail %v", detail)
+	}
+
+	// details are only given on request
+	cfl.Details = nil
+	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &cfl); err != nil {
+		t.Fatal(err)
+	}
+	if cfl.Details != nil {
+		t.Fatal("file details given without detail parameter")
+	}
+}
+
+func TestRawPreview(t *testing.T) {
+	fmd_up := testFileMetadata{
+		TimeStart: "2010-01-03T00:00:00Z",
+		TimeEnd:   "2010-01-04T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/preview001.json", fmd_up, GoodAPIKey, http.StatusCreated)
+
+	data := "{\"n\": 1}\n{\"n\": 2, \"markup\": \"<script>\"}\n{\"n\": 3}\n"
+	executeRequest(TestRouter, t, "PUT", TestBaseURL+"/raw/test/preview001.json/data",
+		strings.NewReader(data), "application/json", GoodAPIKey, http.StatusCreated)
+
+	var preview struct {
+		Lines []string `json:"lines"`
+		More  bool     `json:"more"`
+	}
+
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test/preview001.json/preview?lines=2", nil, "", GoodAPIKey, http.StatusOK)
+	if strings.Contains(res.Body.String(), "<script>") {
+		t.Fatalf("preview %s contains unescaped markup", res.Body.String())
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Lines) != 2 || preview.Lines[1] != `{"n": 2, "markup": "<script>"}` || !preview.More {
+		t.Fatalf("unexpected preview %v", preview)
+	}
+
+	// asking for more lines than the file has returns them all
+	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test/preview001.json/preview?lines=10", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Lines) != 3 || preview.More {
+		t.Fatalf("unexpected preview %v", preview)
+	}
+
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test/preview001.json/preview?lines=0", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// binary data can't be previewed
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/preview002.json", fmd_up, GoodAPIKey, http.StatusCreated)
+	executeRequest(TestRouter, t, "PUT", TestBaseURL+"/raw/test/preview002.json/data",
+		bytes.NewReader([]byte{0x7b, 0x00, 0xff, 0x7d}), "application/json", GoodAPIKey, http.StatusCreated)
+	executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test/preview002.json/preview", nil, "", GoodAPIKey, http.StatusUnsupportedMediaType)
+}
+
+func TestRawShare(t *testing.T) {
+	// create a file with some data in the test campaign
+	fmd_up := testFileMetadata{
+		TimeStart: "2010-01-01T00:00:00Z",
+		TimeEnd:   "2010-01-02T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/share001.json", fmd_up, GoodAPIKey, http.StatusCreated)
+
+	data := []string{"shared", "with", "a", "reviewer"}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/share001.json/data", data, GoodAPIKey, http.StatusCreated)
+	bytesup, _ := json.Marshal(data)
+
+	// sharing requires permission to read the file
+	executeRequest(TestRouter, t, "POST", TestBaseURL+"/raw/test/share001.json/share", nil, "", "", http.StatusForbidden)
+
+	// lifetimes are limited
+	executeRequest(TestRouter, t, "POST", TestBaseURL+"/raw/test/share001.json/share?expires_in=10000h", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// files must exist to be shared
+	executeRequest(TestRouter, t, "POST", TestBaseURL+"/raw/test/share999.json/share", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	res := executeRequest(TestRouter, t, "POST", TestBaseURL+"/raw/test/share001.json/share?expires_in=1h", nil, "", GoodAPIKey, http.StatusCreated)
+
+	var share struct {
+		URL     string `json:"url"`
+		Expires string `json:"expires"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &share); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(share.URL, TestBaseURL+"/raw/test/share001.json/data?") {
+		t.Fatalf("bad signed URL %s", share.URL)
+	}
+
+	expires, err := time.Parse(time.RFC3339, share.Expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(61*time.Minute)) {
+		t.Fatalf("signed URL for one hour expires at %s", share.Expires)
+	}
+
+	// the signed URL grants access without an API key
+	res = executeRequest(TestRouter, t, "GET", share.URL, nil, "", "", http.StatusOK)
+	if !bytes.Equal(bytesup, res.Body.Bytes()) {
+		t.Fatalf("signed download content mismatch: sent %s got %s", bytesup, res.Body.Bytes())
+	}
+
+	// but not to other files
+	otherURL := strings.Replace(share.URL, "share001.json", "file001.json", 1)
+	executeRequest(TestRouter, t, "GET", otherURL, nil, "", "", http.StatusForbidden)
+
+	// nor for longer than signed
+	u, err := url.Parse(share.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("expires", strconv.FormatInt(expires.Add(24*time.Hour).Unix(), 10))
+	u.RawQuery = q.Encode()
+	executeRequest(TestRouter, t, "GET", u.String(), nil, "", "", http.StatusForbidden)
+}
+
+func TestRawUploadLimit(t *testing.T) {
+	TestConfig.MaxUploadSize = map[string]int64{"test": 16}
+	defer func() { TestConfig.MaxUploadSize = nil }()
+
+	cmd_up := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign with very small files",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/limittest", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	fmd_up := testFileMetadata{
+		TimeStart: "2010-01-01T00:00:00Z",
+		TimeEnd:   "2010-01-02T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/limittest/file001.json", fmd_up, GoodAPIKey, http.StatusCreated)
+
+	dataURL := TestBaseURL + "/raw/limittest/file001.json/data"
+	data := []string{"this", "is", "a", "list", "of", "too", "many", "words"}
+
+	// declared length over the limit is rejected up front
+	res := executeWithJSON(TestRouter, t, "PUT", dataURL, data, GoodAPIKey, http.StatusRequestEntityTooLarge)
+	if res.Header().Get("Content-Type") != pto3.ProblemContentType {
+		t.Fatalf("unexpected content type %s", res.Header().Get("Content-Type"))
+	}
+
+	// undeclared length over the limit is rejected while streaming
+	b, _ := json.Marshal(data)
+	executeRequest(TestRouter, t, "PUT", dataURL, struct{ io.Reader }{bytes.NewReader(b)}, "application/json", GoodAPIKey, http.StatusRequestEntityTooLarge)
+
+	// and leaves no partial file behind
+	executeWithJSON(TestRouter, t, "PUT", dataURL, []string{"short"}, GoodAPIKey, http.StatusCreated)
+}
+
+func TestRawUploadStatus(t *testing.T) {
+	cmd_up := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign with slowly uploaded files",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/progresstest", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	fmd_up := testFileMetadata{
+		TimeStart: "2010-01-01T00:00:00Z",
+		TimeEnd:   "2010-01-02T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/progresstest/file001.json", fmd_up, GoodAPIKey, http.StatusCreated)
+
+	statusURL := TestBaseURL + "/raw/progresstest/file001.json/upload-status"
+	executeRequest(TestRouter, t, "GET", statusURL, nil, "", GoodAPIKey, http.StatusNotFound)
+
+	type uploadStatus struct {
+		BytesReceived int64  `json:"bytes_received"`
+		BytesExpected *int64 `json:"bytes_expected"`
+		State         string `json:"state"`
+	}
+
+	// waitForBytes polls upload status until the given number of bytes has
+	// been received
+	waitForBytes := func(n int64) uploadStatus {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			res := executeRequest(TestRouter, t, "GET", statusURL, nil, "", GoodAPIKey, http.StatusOK)
+
+			var status uploadStatus
+			if err := json.Unmarshal(res.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if status.BytesReceived == n {
+				return status
+			} else if time.Now().After(deadline) {
+				t.Fatalf("upload status %+v never reached %d bytes", status, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// stream an upload of unknown length through a pipe
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", TestBaseURL+"/raw/progresstest/file001.json/data", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+
+	uploadStatusCode := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		TestRouter.ServeHTTP(res, req)
+		uploadStatusCode <- res.Code
+	}()
+
+	first := []byte(`["some", `)
+	if _, err := pw.Write(first); err != nil {
+		t.Fatal(err)
+	}
+
+	status := waitForBytes(int64(len(first)))
+	if status.State != "uploading" || status.BytesExpected != nil {
+		t.Fatalf("unexpected status %+v during upload", status)
+	}
+
+	rest := []byte(`"slowly", "uploaded", "words"]`)
+	if _, err := pw.Write(rest); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+
+	if code := <-uploadStatusCode; code != http.StatusCreated {
+		t.Fatalf("upload failed with status %d", code)
+	}
+
+	status = waitForBytes(int64(len(first) + len(rest)))
+	if status.State != "complete" {
+		t.Fatalf("unexpected status %+v after upload", status)
+	}
 }
@@ -3,7 +3,6 @@ package papi
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -14,8 +13,16 @@ import (
 	pto3 "github.com/mami-project/pto3-go"
 )
 
+// APIVersion is the version of the PTO API served by this package.
+const APIVersion = "3"
+
 type RootAPI struct {
 	config *pto3.PTOConfiguration
+	router *mux.Router
+
+	// health checks by name, run by /healthz
+	healthNames  []string
+	healthChecks map[string]func() error
 }
 
 var staticMimeTypeTable = map[string]string{
@@ -50,24 +57,47 @@ func (ra *RootAPI) additionalHeaders(w http.ResponseWriter) {
 	}
 }
 
+// handleRootLinks handles GET / when no root file is configured. It writes a
+// JSON object with links to each enabled subsystem, and a description of the
+// capabilities of this PTO in the capabilities key, so that generic clients
+// can adapt to it.
 func (ra *RootAPI) handleRootLinks(w http.ResponseWriter, r *http.Request) {
 
-	links := make(map[string]string)
+	links := make(map[string]interface{})
 
 	links["banner"] = "This is an instance of the MAMI Path Transparency Observatory. See https://github.com/mami-project/pto3-go for more information."
 
+	caps := map[string]interface{}{
+		"api_version": APIVersion,
+		"page_length": ra.config.PageLength,
+	}
+	enabled := make([]string, 0)
+
 	if ra.config.RawRoot != "" {
 		links["raw"], _ = ra.config.LinkTo("raw")
+		enabled = append(enabled, "raw")
+		caps["raw"] = map[string]interface{}{
+			"content_types": ra.config.ContentTypes,
+		}
 	}
 
 	if ra.config.ObsDatabase.Database != "" {
 		links["obs"], _ = ra.config.LinkTo("obs")
+		enabled = append(enabled, "obs")
 	}
 
 	if ra.config.QueryCacheRoot != "" {
 		links["query"], _ = ra.config.LinkTo("query")
+		enabled = append(enabled, "query")
+		caps["query"] = map[string]interface{}{
+			"groups":  pto3.QueryGroupNames(),
+			"options": pto3.QueryOptionNames,
+		}
 	}
 
+	caps["enabled"] = enabled
+	links["capabilities"] = caps
+
 	linksj, err := json.Marshal(links)
 
 	if err != nil {
@@ -92,10 +122,15 @@ func (ra *RootAPI) handleRootFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	fi, err := file.Stat()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "serving static root page", err)
+		return
+	}
+
 	w.Header().Set("Content-Type", mimeType)
 	ra.additionalHeaders(w)
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, file)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
 }
 
 func (ra *RootAPI) handleStaticFile(w http.ResponseWriter, r *http.Request) {
@@ -117,17 +152,68 @@ func (ra *RootAPI) handleStaticFile(w http.ResponseWriter, r *http.Request) {
 	file, err := os.Open(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			http.Error(w, "URL not found", http.StatusNotFound)
+			pto3.ProblemHTTP(w, http.StatusNotFound, pto3.ErrCodeNotFound, "URL not found")
 		} else {
 			pto3.HandleErrorHTTP(w, "serving static content", err)
 		}
+		return
 	}
 	defer file.Close()
 
+	fi, err := file.Stat()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "serving static content", err)
+		return
+	}
+
 	w.Header().Set("Content-Type", mimeType)
 	ra.additionalHeaders(w)
-	w.WriteHeader(http.StatusOK)
-	io.Copy(w, file)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
+}
+
+// AddHealthCheck adds a named check to be run when serving /healthz. The
+// check should return an error if the subsystem it checks is not healthy.
+func (ra *RootAPI) AddHealthCheck(name string, check func() error) {
+	if _, ok := ra.healthChecks[name]; !ok {
+		ra.healthNames = append(ra.healthNames, name)
+	}
+	ra.healthChecks[name] = check
+}
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleHealth handles GET /healthz. It runs each health check, returning 200
+// if all checks pass and 503 otherwise, with a report of each check's result.
+// It requires no authorization, for use by liveness and readiness probes.
+func (ra *RootAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+
+	for _, name := range ra.healthNames {
+		if err := ra.healthChecks[name](); err != nil {
+			log.Printf("health check %s failed: %v", name, err)
+			report.Checks[name] = err.Error()
+			report.Status = "fail"
+			status = http.StatusServiceUnavailable
+		} else {
+			report.Checks[name] = "ok"
+		}
+	}
+
+	reportj, err := json.Marshal(report)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling health report", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	ra.additionalHeaders(w)
+	w.WriteHeader(status)
+	w.Write(reportj)
 }
 
 func (ra *RootAPI) addRoutes(r *mux.Router, l *log.Logger) {
@@ -140,11 +226,18 @@ func (ra *RootAPI) addRoutes(r *mux.Router, l *log.Logger) {
 	if ra.config.StaticRoot != "" {
 		r.PathPrefix("/static/").Methods("GET").HandlerFunc(LogAccess(l, ra.handleStaticFile))
 	}
+
+	r.HandleFunc("/openapi.json", LogAccess(l, ra.handleOpenAPI)).Methods("GET")
+
+	// health checks are not access-logged, as probes request them frequently
+	r.HandleFunc("/healthz", ra.handleHealth).Methods("GET")
 }
 
 func NewRootAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *RootAPI {
 	ra := new(RootAPI)
 	ra.config = config
+	ra.router = r
+	ra.healthChecks = make(map[string]func() error)
 	ra.addRoutes(r, config.AccessLogger())
 	return ra
 }
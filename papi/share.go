@@ -0,0 +1,80 @@
+// Path Transparency Observatory signed URLs for time-limited sharing
+
+package papi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+type shareResponse struct {
+	URL     string `json:"url"`
+	Expires string `json:"expires"`
+}
+
+// authorizeSigned authorizes a request by the signature in its URL, if it has
+// one, and by an authorizer for a permission otherwise. It returns whether
+// the request is authorized, and whether it was authorized by signature; if
+// not authorized, it fills in an error response.
+func authorizeSigned(config *pto3.PTOConfiguration, azr Authorizer, w http.ResponseWriter, r *http.Request, permission string) (bool, bool) {
+	params := r.URL.Query()
+	if params.Get("signature") == "" {
+		return azr.IsAuthorized(w, r, permission), false
+	}
+
+	if err := config.VerifySignedPath(r.URL.Path, params, time.Now()); err != nil {
+		pto3.HandleErrorHTTP(w, "verifying signed URL", err)
+		return false, false
+	}
+
+	return true, true
+}
+
+// writeShareResponse writes a response containing a signed URL for a path
+// relative to the base URL. The lifetime of the URL is given by the
+// expires_in parameter, as a duration string, defaulting to
+// pto3.DefaultShareLifetime, and may not exceed the configured maximum.
+func writeShareResponse(config *pto3.PTOConfiguration, w http.ResponseWriter, r *http.Request, relative string) {
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("error parsing form: %s", err.Error()))
+		return
+	}
+
+	lifetime := pto3.DefaultShareLifetime
+	if s := r.Form.Get("expires_in"); s != "" {
+		var err error
+		if lifetime, err = time.ParseDuration(s); err != nil || lifetime <= 0 {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad expires_in %s", s))
+			return
+		}
+	}
+
+	if max := config.MaxShareLifetime(); lifetime > max {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("expires_in %s exceeds maximum %s", lifetime, max))
+		return
+	}
+
+	expires := time.Now().Add(lifetime).Truncate(time.Second).UTC()
+	link, err := config.SignedLink(relative, expires)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "signing URL", err)
+		return
+	}
+
+	b, err := json.Marshal(shareResponse{URL: link, Expires: expires.Format(time.RFC3339)})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling signed URL", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", config.AllowOrigin)
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
@@ -0,0 +1,131 @@
+package papi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// defaultStatsInterval is the interval between refreshes of observatory
+// statistics if not configured.
+const defaultStatsInterval = 15 * time.Minute
+
+// StatsAPI serves observatory-wide statistics. Statistics are collected when
+// first requested and refreshed periodically by RefreshEvery, so requests
+// never wait on the database.
+type StatsAPI struct {
+	config *pto3.PTOConfiguration
+	db     orm.DB
+	rds    pto3.RawStore
+
+	lock  sync.RWMutex
+	stats *pto3.ObservatoryStats
+}
+
+// Refresh recollects the statistics served by this API.
+func (sa *StatsAPI) Refresh() error {
+	stats, err := pto3.CollectObservatoryStats(sa.db, sa.rds)
+	if err != nil {
+		return err
+	}
+
+	sa.lock.Lock()
+	sa.stats = stats
+	sa.lock.Unlock()
+	return nil
+}
+
+// RefreshEvery refreshes statistics at the configured StatsInterval until the
+// stop channel is closed or receives a value; pass nil to refresh forever.
+func (sa *StatsAPI) RefreshEvery(stop chan struct{}) {
+	interval := defaultStatsInterval
+	if sa.config.StatsInterval != "" {
+		if d, err := time.ParseDuration(sa.config.StatsInterval); err == nil {
+			interval = d
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := sa.Refresh(); err != nil {
+			log.Printf("error refreshing observatory statistics: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleStats handles GET /stats. It writes a JSON object with the numbers of
+// observation sets, observations, conditions, campaigns, and raw data files,
+// the total size of raw data, the times of the earliest and latest
+// observations, and the time these statistics were collected. It requires no
+// authorization, so that public landing pages can show it.
+func (sa *StatsAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	sa.lock.RLock()
+	stats := sa.stats
+	sa.lock.RUnlock()
+
+	if stats == nil {
+		if err := sa.Refresh(); err != nil {
+			pto3.HandleErrorHTTP(w, "collecting observatory statistics", err)
+			return
+		}
+		sa.lock.RLock()
+		stats = sa.stats
+		sa.lock.RUnlock()
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling observatory statistics", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	sa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func (sa *StatsAPI) additionalHeaders(w http.ResponseWriter) {
+	if sa.config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", sa.config.AllowOrigin)
+	}
+}
+
+func (sa *StatsAPI) addRoutes(r *mux.Router, l *log.Logger) {
+	r.HandleFunc("/stats", LogAccess(l, sa.handleStats)).Methods("GET")
+}
+
+// NewStatsAPI creates an API serving statistics on the observation database
+// in the configuration and the given raw data store, which may be nil. It
+// returns nil if neither is available.
+func NewStatsAPI(config *pto3.PTOConfiguration, rds pto3.RawStore, r *mux.Router) *StatsAPI {
+	if config.ObsDatabase.Database == "" && rds == nil {
+		return nil
+	}
+
+	sa := new(StatsAPI)
+	sa.config = config
+	sa.rds = rds
+	if config.ObsDatabase.Database != "" {
+		sa.db = pg.Connect(&config.ObsDatabase)
+	}
+
+	sa.addRoutes(r, config.AccessLogger())
+
+	return sa
+}
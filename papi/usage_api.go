@@ -0,0 +1,449 @@
+package papi
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// usageRetention is how long usage records are kept.
+const usageRetention = 90 * 24 * time.Hour
+
+// usageFlushInterval is the interval at which usage is flushed to the usage
+// store, if any.
+const usageFlushInterval = time.Minute
+
+// UsageCounts accumulates usage of the PTO by a single API key.
+type UsageCounts struct {
+	Requests     int     `json:"requests"`
+	BytesUp      int64   `json:"bytes_up"`
+	BytesDown    int64   `json:"bytes_down"`
+	Queries      int     `json:"queries"`
+	QuerySeconds float64 `json:"query_seconds"`
+}
+
+func (uc *UsageCounts) add(other *UsageCounts) {
+	uc.Requests += other.Requests
+	uc.BytesUp += other.BytesUp
+	uc.BytesDown += other.BytesDown
+	uc.Queries += other.Queries
+	uc.QuerySeconds += other.QuerySeconds
+}
+
+// UsageAccountant aggregates usage of the PTO by API key into hourly buckets,
+// for fair-use reporting, kept for usageRetention. With a usage store, usage
+// is accumulated in memory and periodically flushed to the store, which is
+// shared by all servers using the same observation database; otherwise, it is
+// accounted per server, and kept only in memory.
+type UsageAccountant struct {
+	lock    sync.Mutex
+	buckets map[time.Time]map[string]*UsageCounts
+	store   *pto3.UsageStore
+}
+
+// NewUsageAccountant creates a new, empty usage accountant.
+func NewUsageAccountant() *UsageAccountant {
+	return &UsageAccountant{buckets: make(map[time.Time]map[string]*UsageCounts)}
+}
+
+// NewStoredUsageAccountant creates a usage accountant which keeps usage in a
+// usage store.
+func NewStoredUsageAccountant(store *pto3.UsageStore) *UsageAccountant {
+	ua := NewUsageAccountant()
+	ua.store = store
+	return ua
+}
+
+// counts returns the usage counts for a key in the bucket containing a given
+// time. Caller must hold the lock.
+func (ua *UsageAccountant) counts(key string, at time.Time) *UsageCounts {
+	hour := at.UTC().Truncate(time.Hour)
+
+	bucket := ua.buckets[hour]
+	if bucket == nil {
+		bucket = make(map[string]*UsageCounts)
+		ua.buckets[hour] = bucket
+		ua.expire(hour.Add(-usageRetention))
+	}
+
+	uc := bucket[key]
+	if uc == nil {
+		uc = new(UsageCounts)
+		bucket[key] = uc
+	}
+
+	return uc
+}
+
+// expire removes buckets before a given time. Caller must hold the lock.
+func (ua *UsageAccountant) expire(before time.Time) {
+	for hour := range ua.buckets {
+		if hour.Before(before) {
+			delete(ua.buckets, hour)
+		}
+	}
+}
+
+// RecordRequest accounts a request made with a given key at a given time.
+func (ua *UsageAccountant) RecordRequest(key string, at time.Time, bytesUp int64, bytesDown int64) {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+
+	uc := ua.counts(key, at)
+	uc.Requests++
+	uc.BytesUp += bytesUp
+	uc.BytesDown += bytesDown
+}
+
+// RecordQuery accounts the execution of a query submitted with a given key,
+// completed at a given time.
+func (ua *UsageAccountant) RecordQuery(key string, at time.Time, duration time.Duration) {
+	ua.lock.Lock()
+	defer ua.lock.Unlock()
+
+	uc := ua.counts(key, at)
+	uc.Queries++
+	uc.QuerySeconds += duration.Seconds()
+}
+
+// Flush adds the usage accumulated in memory to the usage store, if any, and
+// removes usage older than usageRetention from it. Usage which cannot be
+// added is kept in memory, to be flushed again later.
+func (ua *UsageAccountant) Flush() error {
+	if ua.store == nil {
+		return nil
+	}
+
+	ua.lock.Lock()
+	pending := ua.buckets
+	ua.buckets = make(map[time.Time]map[string]*UsageCounts)
+	ua.lock.Unlock()
+
+	var buckets []pto3.UsageBucket
+	for hour, bucket := range pending {
+		for key, uc := range bucket {
+			buckets = append(buckets, pto3.UsageBucket{
+				Hour:         hour,
+				Key:          key,
+				Requests:     uc.Requests,
+				BytesUp:      uc.BytesUp,
+				BytesDown:    uc.BytesDown,
+				Queries:      uc.Queries,
+				QuerySeconds: uc.QuerySeconds,
+			})
+		}
+	}
+
+	if err := ua.store.Add(buckets); err != nil {
+		ua.lock.Lock()
+		for hour, bucket := range pending {
+			for key, uc := range bucket {
+				ua.counts(key, hour).add(uc)
+			}
+		}
+		ua.lock.Unlock()
+		return err
+	}
+
+	return ua.store.Expire(time.Now().UTC().Add(-usageRetention))
+}
+
+// FlushEvery flushes usage to the usage store, if any, every
+// usageFlushInterval until the given channel is closed.
+func (ua *UsageAccountant) FlushEvery(stop chan struct{}) {
+	if ua.store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		if err := ua.Flush(); err != nil {
+			log.Printf("error flushing usage: %v", err)
+		}
+	}
+}
+
+// UsageRecord is the usage of the PTO by a single API key over a time bucket.
+type UsageRecord struct {
+	Time time.Time `json:"time"`
+	Key  string    `json:"key"`
+	UsageCounts
+}
+
+// Usage returns usage records between start (inclusive) and end (exclusive),
+// aggregated into buckets of the given granularity (hour, day, or month),
+// sorted by time and key.
+func (ua *UsageAccountant) Usage(start time.Time, end time.Time, granularity string) ([]UsageRecord, error) {
+	var truncate func(time.Time) time.Time
+	switch granularity {
+	case "hour":
+		truncate = func(t time.Time) time.Time { return t.Truncate(time.Hour) }
+	case "day":
+		truncate = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) }
+	case "month":
+		truncate = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) }
+	default:
+		return nil, pto3.PTOErrorf("unsupported granularity %s", granularity).StatusIs(http.StatusBadRequest).CodeIs(pto3.ErrCodeBadForm)
+	}
+
+	type bucketKey struct {
+		time time.Time
+		key  string
+	}
+	agg := make(map[bucketKey]*UsageCounts)
+	add := func(hour time.Time, key string, uc *UsageCounts) {
+		bk := bucketKey{truncate(hour.UTC()), key}
+		if agg[bk] == nil {
+			agg[bk] = new(UsageCounts)
+		}
+		agg[bk].add(uc)
+	}
+
+	// usage in the store, including that flushed from this accountant
+	if ua.store != nil {
+		if err := ua.Flush(); err != nil {
+			return nil, err
+		}
+
+		buckets, err := ua.store.Select(start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range buckets {
+			add(b.Hour, b.Key, &UsageCounts{
+				Requests:     b.Requests,
+				BytesUp:      b.BytesUp,
+				BytesDown:    b.BytesDown,
+				Queries:      b.Queries,
+				QuerySeconds: b.QuerySeconds,
+			})
+		}
+	}
+
+	// and usage accumulated in memory
+	ua.lock.Lock()
+	for hour, bucket := range ua.buckets {
+		if hour.Before(start) || !hour.Before(end) {
+			continue
+		}
+		for key, uc := range bucket {
+			add(hour, key, uc)
+		}
+	}
+	ua.lock.Unlock()
+
+	out := make([]UsageRecord, 0, len(agg))
+	for bk, uc := range agg {
+		out = append(out, UsageRecord{Time: bk.time, Key: bk.key, UsageCounts: *uc})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Time.Equal(out[j].Time) {
+			return out[i].Key < out[j].Key
+		}
+		return out[i].Time.Before(out[j].Time)
+	})
+
+	return out, nil
+}
+
+// apiKeyForRequest returns the API key presented with a request, or the
+// anonymous principal if none was presented.
+func apiKeyForRequest(r *http.Request) string {
+	authfield := strings.Fields(r.Header.Get("Authorization"))
+	if len(authfield) == 2 && authfield[0] == "APIKEY" {
+		return authfield[1]
+	}
+	return pto3.AnonymousPrincipal
+}
+
+// usageKeyForRequest returns the key under which a request's usage is
+// accounted: the principal of the API key presented with the request, if the
+// authorizer recognizes it, or the anonymous principal otherwise. Accounting only
+// recognized keys bounds the number of keys accounted, and principals keep
+// API keys out of usage reports.
+func usageKeyForRequest(azr Authorizer, r *http.Request) string {
+	key := apiKeyForRequest(r)
+	if !knownAPIKey(azr, key) {
+		return pto3.AnonymousPrincipal
+	}
+	return pto3.APIKeyPrincipal(key)
+}
+
+// countingReadCloser counts bytes read through it.
+type countingReadCloser struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// account is middleware which accounts each request routed by the router.
+func (ua *UsageAPI) account(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body *countingReadCloser
+		if r.Body != nil {
+			body = &countingReadCloser{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		lw := LoggingResponseWriter{w: w}
+		next.ServeHTTP(&lw, r)
+
+		var bytesUp int64
+		if body != nil {
+			bytesUp = body.n
+		}
+
+		ua.acct.RecordRequest(usageKeyForRequest(ua.azr, r), time.Now(), bytesUp, int64(lw.length))
+	})
+}
+
+// UsageAPI serves usage accounting reports to administrators.
+type UsageAPI struct {
+	config *pto3.PTOConfiguration
+	azr    Authorizer
+	acct   *UsageAccountant
+}
+
+// Accountant returns the usage accountant behind this API, to which other
+// APIs may report usage.
+func (ua *UsageAPI) Accountant() *UsageAccountant {
+	return ua.acct
+}
+
+type usageReport struct {
+	Granularity string        `json:"granularity"`
+	Start       string        `json:"time_start"`
+	End         string        `json:"time_end"`
+	Usage       []UsageRecord `json:"usage"`
+}
+
+// handleUsage handles GET /admin/usage. It takes optional time_start and
+// time_end parameters (RFC3339, default the last 24 hours), and an optional
+// granularity (hour, day, or month; default hour), and returns usage by API
+// key in each time bucket.
+func (ua *UsageAPI) handleUsage(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !ua.azr.IsAuthorized(w, r, "admin") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, "error parsing form")
+		return
+	}
+
+	end := time.Now().UTC()
+	start := end.Add(-24 * time.Hour)
+
+	var err error
+	if s := r.Form.Get("time_start"); s != "" {
+		if start, err = time.Parse(time.RFC3339, s); err != nil {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad time_start %s", s))
+			return
+		}
+	}
+	if s := r.Form.Get("time_end"); s != "" {
+		if end, err = time.Parse(time.RFC3339, s); err != nil {
+			pto3.ProblemHTTP(w, http.StatusBadRequest, pto3.ErrCodeBadForm, fmt.Sprintf("bad time_end %s", s))
+			return
+		}
+	}
+
+	granularity := r.Form.Get("granularity")
+	if granularity == "" {
+		granularity = "hour"
+	}
+
+	usage, err := ua.acct.Usage(start, end, granularity)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "aggregating usage", err)
+		return
+	}
+
+	b, err := json.Marshal(usageReport{
+		Granularity: granularity,
+		Start:       start.UTC().Format(time.RFC3339),
+		End:         end.UTC().Format(time.RFC3339),
+		Usage:       usage,
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling usage", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ua.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleMetrics handles GET /admin/metrics, returning the server's metrics,
+// including counts of database statements, as JSON.
+func (ua *UsageAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !ua.azr.IsAuthorized(w, r, "admin") {
+		return
+	}
+
+	ua.additionalHeaders(w)
+	expvar.Handler().ServeHTTP(w, r)
+}
+
+func (ua *UsageAPI) additionalHeaders(w http.ResponseWriter) {
+	if ua.config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", ua.config.AllowOrigin)
+	}
+}
+
+func (ua *UsageAPI) addRoutes(r *mux.Router, l *log.Logger) {
+	r.HandleFunc("/admin/usage", LogAccess(l, ua.handleUsage)).Methods("GET")
+	r.HandleFunc("/admin/metrics", LogAccess(l, ua.handleMetrics)).Methods("GET")
+}
+
+// NewUsageAPI creates a usage accounting API, accounting all requests routed
+// by the given router. If the configuration has an observation database,
+// usage is kept in it.
+func NewUsageAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*UsageAPI, error) {
+	ua := new(UsageAPI)
+	ua.config = config
+	ua.azr = azr
+
+	if config.ObsDatabase.Database != "" {
+		store, err := pto3.NewUsageStore(config)
+		if err != nil {
+			return nil, err
+		}
+		ua.acct = NewStoredUsageAccountant(store)
+	} else {
+		ua.acct = NewUsageAccountant()
+	}
+
+	r.Use(ua.account)
+	ua.addRoutes(r, config.AccessLogger())
+
+	return ua, nil
+}
@@ -16,6 +16,9 @@ type Path struct {
 	String string
 	Source string
 	Target string
+	// Country codes of source and target, if known; see SetCountryLookup
+	SourceCountry string
+	TargetCountry string
 }
 
 func extractSource(pathstring string) string {
@@ -79,7 +82,9 @@ func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) err
 		defer pathpipe.Close()
 
 		for pathstring := range pathSet {
-			p := []string{fmt.Sprintf("%d", pidseq), pathstring, extractSource(pathstring), extractTarget(pathstring)}
+			source, target := extractSource(pathstring), extractTarget(pathstring)
+			sourceCountry, targetCountry := countriesForPath(source, target)
+			p := []string{fmt.Sprintf("%d", pidseq), pathstring, source, target, sourceCountry, targetCountry}
 			cache[pathstring] = pidseq
 
 			if err := out.Write(p); err != nil {
@@ -94,7 +99,7 @@ func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) err
 	}()
 
 	// copy from the goroutine to the database
-	if _, err = db.CopyFrom(dbpipe, "COPY paths (id, string, source, target) FROM STDIN WITH CSV"); err != nil {
+	if _, err = db.CopyFrom(dbpipe, "COPY paths (id, string, source, target, source_country, target_country) FROM STDIN WITH CSV"); err != nil {
 		return PTOWrapError(err)
 	}
 
@@ -105,6 +110,7 @@ func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) err
 func (p *Path) Parse() {
 	p.Source = extractSource(p.String)
 	p.Target = extractTarget(p.String)
+	p.SourceCountry, p.TargetCountry = countriesForPath(p.Source, p.Target)
 }
 
 // InsertOnce retrieves a path's ID if it has already been inserted into the
@@ -0,0 +1,30 @@
+package pgrpc
+
+import "fmt"
+
+// Codec is a gRPC codec for the messages of the PTO gRPC API. It uses the
+// name of the standard protocol buffer codec, as its wire format is the same.
+type Codec struct{}
+
+// Marshal encodes a Message.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(Message)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T: not a PTO gRPC message", v)
+	}
+	return m.Marshal()
+}
+
+// Unmarshal decodes a Message.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(Message)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T: not a PTO gRPC message", v)
+	}
+	return m.Unmarshal(data)
+}
+
+// Name returns the name of the codec, proto.
+func (Codec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,132 @@
+package pgrpc
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+)
+
+// serviceName is the fully qualified name of the PTO service in pto3.proto.
+const serviceName = "pto3.PTO"
+
+// ptoServer is the set of methods the PTO service dispatches to, as
+// implemented by Server.
+type ptoServer interface {
+	ListObservationSets(context.Context, *ListObservationSetsRequest) (*ListObservationSetsResponse, error)
+	GetObservationSet(context.Context, *GetObservationSetRequest) (*ObservationSet, error)
+	DownloadObservations(*GetObservationSetRequest, grpc.ServerStream) error
+	UploadObservations(grpc.ServerStream) error
+	SubmitQuery(context.Context, *SubmitQueryRequest) (*Query, error)
+	GetQuery(context.Context, *GetQueryRequest) (*Query, error)
+	GetQueryResults(*GetQueryRequest, grpc.ServerStream) error
+}
+
+// unaryHandler returns a gRPC method handler which decodes a request into the
+// message returned by newIn, and passes it to call, through the server's
+// interceptor if it has one.
+func unaryHandler(method string, newIn func() Message,
+	call func(srv ptoServer, ctx context.Context, in Message) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		in := newIn()
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return call(srv.(ptoServer), ctx, in)
+		}
+
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + serviceName + "/" + method}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(ptoServer), ctx, req.(Message))
+		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+// serverStreamHandler returns a gRPC stream handler which receives a single
+// request into the message returned by newIn, and passes it to call together
+// with the stream for responses.
+func serverStreamHandler(newIn func() Message,
+	call func(srv ptoServer, in Message, stream grpc.ServerStream) error) grpc.StreamHandler {
+
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		in := newIn()
+		if err := stream.RecvMsg(in); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return call(srv.(ptoServer), in, stream)
+	}
+}
+
+// serviceDesc describes the PTO service in pto.proto to gRPC.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ptoServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListObservationSets",
+			Handler: unaryHandler("ListObservationSets",
+				func() Message { return new(ListObservationSetsRequest) },
+				func(srv ptoServer, ctx context.Context, in Message) (interface{}, error) {
+					return srv.ListObservationSets(ctx, in.(*ListObservationSetsRequest))
+				}),
+		},
+		{
+			MethodName: "GetObservationSet",
+			Handler: unaryHandler("GetObservationSet",
+				func() Message { return new(GetObservationSetRequest) },
+				func(srv ptoServer, ctx context.Context, in Message) (interface{}, error) {
+					return srv.GetObservationSet(ctx, in.(*GetObservationSetRequest))
+				}),
+		},
+		{
+			MethodName: "SubmitQuery",
+			Handler: unaryHandler("SubmitQuery",
+				func() Message { return new(SubmitQueryRequest) },
+				func(srv ptoServer, ctx context.Context, in Message) (interface{}, error) {
+					return srv.SubmitQuery(ctx, in.(*SubmitQueryRequest))
+				}),
+		},
+		{
+			MethodName: "GetQuery",
+			Handler: unaryHandler("GetQuery",
+				func() Message { return new(GetQueryRequest) },
+				func(srv ptoServer, ctx context.Context, in Message) (interface{}, error) {
+					return srv.GetQuery(ctx, in.(*GetQueryRequest))
+				}),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "DownloadObservations",
+			Handler: serverStreamHandler(
+				func() Message { return new(GetObservationSetRequest) },
+				func(srv ptoServer, in Message, stream grpc.ServerStream) error {
+					return srv.DownloadObservations(in.(*GetObservationSetRequest), stream)
+				}),
+			ServerStreams: true,
+		},
+		{
+			StreamName: "UploadObservations",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(ptoServer).UploadObservations(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "GetQueryResults",
+			Handler: serverStreamHandler(
+				func() Message { return new(GetQueryRequest) },
+				func(srv ptoServer, in Message, stream grpc.ServerStream) error {
+					return srv.GetQueryResults(in.(*GetQueryRequest), stream)
+				}),
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pto.proto",
+}
@@ -0,0 +1,547 @@
+package pgrpc
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Message is implemented by the messages of the PTO gRPC API, which encode
+// themselves in protocol buffer wire format as defined in pto.proto.
+type Message interface {
+	// Marshal encodes this message in protocol buffer wire format.
+	Marshal() ([]byte, error)
+	// Unmarshal replaces the contents of this message with the decoded
+	// contents of a protocol buffer encoded message. Unknown fields are
+	// ignored.
+	Unmarshal(b []byte) error
+
+	appendTo(b []byte) []byte
+}
+
+// Appending fields, leaving out default values as in proto3.
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendStrings(b []byte, num protowire.Number, v []string) []byte {
+	for _, s := range v {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	return b
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendPackedVarints appends a repeated scalar field in packed encoding, the
+// proto3 default.
+func appendPackedVarints(b []byte, num protowire.Number, v []uint64) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	var packed []byte
+	for _, x := range v {
+		packed = protowire.AppendVarint(packed, x)
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+func appendMessage(b []byte, num protowire.Number, m Message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.appendTo(nil))
+}
+
+// appendStringMap appends a map<string, string> field as its repeated entry
+// messages, in key order.
+func appendStringMap(b []byte, num protowire.Number, v map[string]string) []byte {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, v[k])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// consumeFields decodes the fields of a message, passing each to a function
+// which consumes its value and returns the number of bytes consumed, or zero
+// to skip an unknown field.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Consuming field values, checking wire types.
+
+func consumeString(typ protowire.Type, b []byte, v *string) int {
+	if typ != protowire.BytesType {
+		return -1
+	}
+	s, n := protowire.ConsumeString(b)
+	*v = s
+	return n
+}
+
+func consumeVarint(typ protowire.Type, b []byte, v *uint64) int {
+	if typ != protowire.VarintType {
+		return -1
+	}
+	x, n := protowire.ConsumeVarint(b)
+	*v = x
+	return n
+}
+
+func consumeInt64(typ protowire.Type, b []byte, v *int64) int {
+	var x uint64
+	n := consumeVarint(typ, b, &x)
+	*v = int64(x)
+	return n
+}
+
+// consumeRepeatedVarint consumes a repeated scalar field in either packed or
+// unpacked encoding.
+func consumeRepeatedVarint(typ protowire.Type, b []byte, v *[]uint64) int {
+	if typ == protowire.VarintType {
+		x, n := protowire.ConsumeVarint(b)
+		*v = append(*v, x)
+		return n
+	} else if typ != protowire.BytesType {
+		return -1
+	}
+
+	packed, n := protowire.ConsumeBytes(b)
+	for len(packed) > 0 {
+		x, m := protowire.ConsumeVarint(packed)
+		if m < 0 {
+			return m
+		}
+		*v = append(*v, x)
+		packed = packed[m:]
+	}
+	return n
+}
+
+func consumeMessage(typ protowire.Type, b []byte, m Message) (int, error) {
+	if typ != protowire.BytesType {
+		return -1, nil
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	return n, m.Unmarshal(v)
+}
+
+func consumeStringMapEntry(typ protowire.Type, b []byte, v map[string]string) (int, error) {
+	if typ != protowire.BytesType {
+		return -1, nil
+	}
+	entry, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	var k, s string
+	err := consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &k), nil
+		case 2:
+			return consumeString(typ, b, &s), nil
+		}
+		return 0, nil
+	})
+	v[k] = s
+	return n, err
+}
+
+// ListObservationSetsRequest requests a list of observation sets.
+type ListObservationSetsRequest struct {
+	// Metadata filter expressions, as for the meta parameter of
+	// /obs/by_metadata; all sets if empty
+	Meta []string
+}
+
+func (m *ListObservationSetsRequest) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *ListObservationSetsRequest) appendTo(b []byte) []byte {
+	return appendStrings(b, 1, m.Meta)
+}
+
+func (m *ListObservationSetsRequest) Unmarshal(b []byte) error {
+	*m = ListObservationSetsRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			var s string
+			n := consumeString(typ, b, &s)
+			m.Meta = append(m.Meta, s)
+			return n, nil
+		}
+		return 0, nil
+	})
+}
+
+// ListObservationSetsResponse lists observation sets by ID.
+type ListObservationSetsResponse struct {
+	SetIDs []uint64
+}
+
+func (m *ListObservationSetsResponse) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *ListObservationSetsResponse) appendTo(b []byte) []byte {
+	return appendPackedVarints(b, 1, m.SetIDs)
+}
+
+func (m *ListObservationSetsResponse) Unmarshal(b []byte) error {
+	*m = ListObservationSetsResponse{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			return consumeRepeatedVarint(typ, b, &m.SetIDs), nil
+		}
+		return 0, nil
+	})
+}
+
+// GetObservationSetRequest identifies an observation set.
+type GetObservationSetRequest struct {
+	SetID uint64
+}
+
+func (m *GetObservationSetRequest) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *GetObservationSetRequest) appendTo(b []byte) []byte {
+	return appendVarint(b, 1, m.SetID)
+}
+
+func (m *GetObservationSetRequest) Unmarshal(b []byte) error {
+	*m = GetObservationSetRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			return consumeVarint(typ, b, &m.SetID), nil
+		}
+		return 0, nil
+	})
+}
+
+// ObservationSet carries the metadata of an observation set. SetID, Link,
+// Count, Created, Modified, and State are output only.
+type ObservationSet struct {
+	SetID      uint64
+	Link       string
+	Analyzer   string
+	Sources    []string
+	Conditions []string
+	Metadata   map[string]string
+	Count      int64
+	Created    string
+	Modified   string
+	State      string
+}
+
+func (m *ObservationSet) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *ObservationSet) appendTo(b []byte) []byte {
+	b = appendVarint(b, 1, m.SetID)
+	b = appendString(b, 2, m.Link)
+	b = appendString(b, 3, m.Analyzer)
+	b = appendStrings(b, 4, m.Sources)
+	b = appendStrings(b, 5, m.Conditions)
+	b = appendStringMap(b, 6, m.Metadata)
+	b = appendVarint(b, 7, uint64(m.Count))
+	b = appendString(b, 8, m.Created)
+	b = appendString(b, 9, m.Modified)
+	b = appendString(b, 10, m.State)
+	return b
+}
+
+func (m *ObservationSet) Unmarshal(b []byte) error {
+	*m = ObservationSet{Metadata: make(map[string]string)}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var s string
+		switch num {
+		case 1:
+			return consumeVarint(typ, b, &m.SetID), nil
+		case 2:
+			return consumeString(typ, b, &m.Link), nil
+		case 3:
+			return consumeString(typ, b, &m.Analyzer), nil
+		case 4:
+			n := consumeString(typ, b, &s)
+			m.Sources = append(m.Sources, s)
+			return n, nil
+		case 5:
+			n := consumeString(typ, b, &s)
+			m.Conditions = append(m.Conditions, s)
+			return n, nil
+		case 6:
+			return consumeStringMapEntry(typ, b, m.Metadata)
+		case 7:
+			return consumeInt64(typ, b, &m.Count), nil
+		case 8:
+			return consumeString(typ, b, &m.Created), nil
+		case 9:
+			return consumeString(typ, b, &m.Modified), nil
+		case 10:
+			return consumeString(typ, b, &m.State), nil
+		}
+		return 0, nil
+	})
+}
+
+// Observation carries a single observation. Start and End are in seconds
+// since the Unix epoch; Metadata is a JSON object, or empty for none.
+type Observation struct {
+	Start     int64
+	End       int64
+	Path      string
+	Condition string
+	Value     string
+	Metadata  string
+}
+
+func (m *Observation) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *Observation) appendTo(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(m.Start))
+	b = appendVarint(b, 2, uint64(m.End))
+	b = appendString(b, 3, m.Path)
+	b = appendString(b, 4, m.Condition)
+	b = appendString(b, 5, m.Value)
+	b = appendString(b, 6, m.Metadata)
+	return b
+}
+
+func (m *Observation) Unmarshal(b []byte) error {
+	*m = Observation{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeInt64(typ, b, &m.Start), nil
+		case 2:
+			return consumeInt64(typ, b, &m.End), nil
+		case 3:
+			return consumeString(typ, b, &m.Path), nil
+		case 4:
+			return consumeString(typ, b, &m.Condition), nil
+		case 5:
+			return consumeString(typ, b, &m.Value), nil
+		case 6:
+			return consumeString(typ, b, &m.Metadata), nil
+		}
+		return 0, nil
+	})
+}
+
+// consumeObservation consumes an observation in a repeated field, appending
+// it to a slice.
+func consumeObservation(typ protowire.Type, b []byte, v *[]*Observation) (int, error) {
+	obs := new(Observation)
+	n, err := consumeMessage(typ, b, obs)
+	*v = append(*v, obs)
+	return n, err
+}
+
+// ObservationBatch carries a batch of downloaded observations.
+type ObservationBatch struct {
+	Observations []*Observation
+}
+
+func (m *ObservationBatch) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *ObservationBatch) appendTo(b []byte) []byte {
+	for _, obs := range m.Observations {
+		b = appendMessage(b, 1, obs)
+	}
+	return b
+}
+
+func (m *ObservationBatch) Unmarshal(b []byte) error {
+	*m = ObservationBatch{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			return consumeObservation(typ, b, &m.Observations)
+		}
+		return 0, nil
+	})
+}
+
+// UploadObservationsRequest carries a part of an uploaded observation set: its
+// metadata, in the first message only, and a batch of observations.
+type UploadObservationsRequest struct {
+	Set          *ObservationSet
+	Observations []*Observation
+}
+
+func (m *UploadObservationsRequest) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *UploadObservationsRequest) appendTo(b []byte) []byte {
+	if m.Set != nil {
+		b = appendMessage(b, 1, m.Set)
+	}
+	for _, obs := range m.Observations {
+		b = appendMessage(b, 2, obs)
+	}
+	return b
+}
+
+func (m *UploadObservationsRequest) Unmarshal(b []byte) error {
+	*m = UploadObservationsRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			m.Set = new(ObservationSet)
+			return consumeMessage(typ, b, m.Set)
+		case 2:
+			return consumeObservation(typ, b, &m.Observations)
+		}
+		return 0, nil
+	})
+}
+
+// SubmitQueryRequest carries a URL-encoded query, as for /query/submit.
+type SubmitQueryRequest struct {
+	Encoded string
+}
+
+func (m *SubmitQueryRequest) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *SubmitQueryRequest) appendTo(b []byte) []byte {
+	return appendString(b, 1, m.Encoded)
+}
+
+func (m *SubmitQueryRequest) Unmarshal(b []byte) error {
+	*m = SubmitQueryRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			return consumeString(typ, b, &m.Encoded), nil
+		}
+		return 0, nil
+	})
+}
+
+// GetQueryRequest identifies a query.
+type GetQueryRequest struct {
+	Identifier string
+}
+
+func (m *GetQueryRequest) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *GetQueryRequest) appendTo(b []byte) []byte {
+	return appendString(b, 1, m.Identifier)
+}
+
+func (m *GetQueryRequest) Unmarshal(b []byte) error {
+	*m = GetQueryRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			return consumeString(typ, b, &m.Identifier), nil
+		}
+		return 0, nil
+	})
+}
+
+// Query carries the state of a query.
+type Query struct {
+	Identifier string
+	Link       string
+	State      string
+	Encoded    string
+	Error      string
+	RowCount   int64
+}
+
+func (m *Query) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *Query) appendTo(b []byte) []byte {
+	b = appendString(b, 1, m.Identifier)
+	b = appendString(b, 2, m.Link)
+	b = appendString(b, 3, m.State)
+	b = appendString(b, 4, m.Encoded)
+	b = appendString(b, 5, m.Error)
+	b = appendVarint(b, 6, uint64(m.RowCount))
+	return b
+}
+
+func (m *Query) Unmarshal(b []byte) error {
+	*m = Query{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &m.Identifier), nil
+		case 2:
+			return consumeString(typ, b, &m.Link), nil
+		case 3:
+			return consumeString(typ, b, &m.State), nil
+		case 4:
+			return consumeString(typ, b, &m.Encoded), nil
+		case 5:
+			return consumeString(typ, b, &m.Error), nil
+		case 6:
+			return consumeInt64(typ, b, &m.RowCount), nil
+		}
+		return 0, nil
+	})
+}
+
+// QueryResultBatch carries a batch of query result rows, each a JSON array as
+// in /query/{query}/result.
+type QueryResultBatch struct {
+	Rows []string
+}
+
+func (m *QueryResultBatch) Marshal() ([]byte, error) { return m.appendTo(nil), nil }
+
+func (m *QueryResultBatch) appendTo(b []byte) []byte {
+	return appendStrings(b, 1, m.Rows)
+}
+
+func (m *QueryResultBatch) Unmarshal(b []byte) error {
+	*m = QueryResultBatch{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 {
+			var s string
+			n := consumeString(typ, b, &s)
+			m.Rows = append(m.Rows, s)
+			return n, nil
+		}
+		return 0, nil
+	})
+}
@@ -0,0 +1,64 @@
+package pgrpc_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mami-project/pto3-go/pgrpc"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	up := &pgrpc.UploadObservationsRequest{
+		Set: &pgrpc.ObservationSet{
+			Analyzer:   "https://ptotest.mami-project.eu/analysis/passthrough",
+			Sources:    []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+			Conditions: []string{"pto.test.succeeded", "pto.test.failed"},
+			Metadata:   map[string]string{"description": "gRPC test set", "empty": ""},
+		},
+		Observations: []*pgrpc.Observation{
+			{Start: 1435744800, End: 1435744860, Path: "10.0.0.1 * 10.0.0.2", Condition: "pto.test.succeeded"},
+			{Start: -1, End: 0, Path: "10.0.0.1 * 10.0.0.3", Condition: "pto.test.failed", Value: "1", Metadata: `{"k":"v"}`},
+		},
+	}
+
+	b, err := up.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var down pgrpc.UploadObservationsRequest
+	if err := down.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(up, &down) {
+		t.Fatalf("round trip changed message: %+v became %+v", up, &down)
+	}
+}
+
+func TestMessageDecoding(t *testing.T) {
+	// set IDs 1 and 300, packed and unpacked, with an unknown field 15
+	for _, b := range [][]byte{
+		{0x0a, 0x03, 0x01, 0xac, 0x02, 0x78, 0x05},
+		{0x08, 0x01, 0x78, 0x05, 0x08, 0xac, 0x02},
+	} {
+		var res pgrpc.ListObservationSetsResponse
+		if err := res.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.SetIDs, []uint64{1, 300}) {
+			t.Fatalf("decoded set IDs %v from %x, expected [1 300]", res.SetIDs, b)
+		}
+	}
+
+	// wrong wire type for a known field
+	var req pgrpc.GetQueryRequest
+	if err := req.Unmarshal([]byte{0x08, 0x01}); err == nil {
+		t.Fatal("decoded varint as string")
+	}
+
+	// truncated message
+	if err := req.Unmarshal([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Fatal("decoded truncated string")
+	}
+}
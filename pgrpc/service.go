@@ -0,0 +1,585 @@
+// Package pgrpc implements the PTO gRPC API, an optional alternative to the
+// HTTP API in package papi for bulk transfer of observations and query
+// results. The service is defined in pto.proto.
+package pgrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/papi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// batchSize is the number of observations or result rows sent in each
+// message of a download stream.
+const batchSize = 1000
+
+// Server implements the PTO gRPC service over the observation database and
+// query cache of a PTO configuration. Either may be missing, in which case
+// the corresponding RPCs fail as unimplemented.
+type Server struct {
+	config *pto3.PTOConfiguration
+	azr    papi.Authorizer
+	db     *pg.DB
+	qc     *pto3.QueryCache
+	log    *pto3.AuditLog
+}
+
+// NewServer creates a Server for the observation database and query cache in
+// the given configuration, authorizing requests with the given Authorizer,
+// and recording mutating calls in the configured audit log, if any.
+func NewServer(config *pto3.PTOConfiguration, azr papi.Authorizer) (*Server, error) {
+	s := &Server{config: config, azr: azr}
+
+	var err error
+	if s.log, err = pto3.NewAuditLog(config); err != nil {
+		return nil, err
+	}
+
+	if config.ObsDatabase.Database != "" {
+		s.db = pg.Connect(&config.ObsDatabase)
+	}
+
+	if config.QueryCacheRoot != "" && config.ObsDatabase.Database != "" {
+		if s.qc, err = pto3.NewQueryCache(config); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Register registers the PTO service with a gRPC server. The server must be
+// created with the ServerOptions returned by ServerOptions.
+func (s *Server) Register(gs *grpc.Server) {
+	gs.RegisterService(&serviceDesc, s)
+}
+
+// ServerOptions returns the options with which a gRPC server serving the PTO
+// service must be created: the PTO message codec, and TLS credentials if the
+// configuration has a certificate and private key.
+func ServerOptions(config *pto3.PTOConfiguration) ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(Codec{})}
+
+	if config.CertificateFile != "" && config.PrivateKeyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(config.CertificateFile, config.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	return opts, nil
+}
+
+// request returns an HTTP request carrying the authorization metadata of an
+// incoming call, for use with the Authorizer and helpers of the HTTP API.
+func request(ctx context.Context) *http.Request {
+	r := &http.Request{Method: "POST", URL: &url.URL{Path: "/pto3.PTO"}, Header: make(http.Header)}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("authorization") {
+			r.Header.Add("Authorization", v)
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// authorize checks the authorization metadata of an incoming call for a
+// given permission, using the same Authorizer as the HTTP API.
+func (s *Server) authorize(ctx context.Context, permission string) error {
+	w := new(statusRecorder)
+	if s.azr.IsAuthorized(w, request(ctx), permission) {
+		return nil
+	}
+
+	if w.status == http.StatusForbidden {
+		return status.Errorf(codes.PermissionDenied, "not authorized for %s", permission)
+	}
+	return status.Error(codes.Unauthenticated, "bad authorization metadata")
+}
+
+// audit records a successful mutating call in the audit log, if one is
+// configured, as the HTTP API does for mutating requests. The operation is
+// the full name of the called method.
+func (s *Server) audit(ctx context.Context, method string, target string) {
+	if s.log == nil {
+		return
+	}
+
+	rec := pto3.AuditRecord{
+		Principal: papi.RequestPrincipal(request(ctx)),
+		Operation: "/" + serviceName + "/" + method,
+		Target:    target,
+		RequestID: pto3.NewRequestID(),
+	}
+	if err := s.log.Record(&rec); err != nil {
+		log.Printf("failed to record call %s in audit log: %v", rec.RequestID, err)
+	}
+}
+
+// statusRecorder is a ResponseWriter recording the status of the problem
+// response an Authorizer writes when refusing authorization.
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (w *statusRecorder) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+}
+
+// grpcError converts an error from the PTO into a gRPC status error, logging
+// internal errors as HandleErrorHTTP does.
+func grpcError(during string, err error) error {
+	if err == pg.ErrNoRows {
+		return status.Error(codes.NotFound, "not found")
+	}
+
+	code := codes.Internal
+	if perr, ok := err.(*pto3.PTOError); ok {
+		switch perr.Status() {
+		case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusRequestEntityTooLarge:
+			code = codes.InvalidArgument
+		case http.StatusForbidden:
+			code = codes.PermissionDenied
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusNotImplemented:
+			code = codes.Unimplemented
+		}
+	}
+
+	if code == codes.Internal {
+		log.Printf("internal error %s: %v", during, err)
+		return status.Errorf(codes.Internal, "internal error %s", during)
+	}
+	return status.Error(code, err.Error())
+}
+
+// requireObs fails if this server has no observation database.
+func (s *Server) requireObs() error {
+	if s.db == nil {
+		return status.Error(codes.Unimplemented, "no observation database")
+	}
+	return nil
+}
+
+// requireQuery fails if this server has no query cache.
+func (s *Server) requireQuery() error {
+	if s.qc == nil {
+		return status.Error(codes.Unimplemented, "no query cache")
+	}
+	return nil
+}
+
+// setMessage converts an observation set's metadata to a message.
+func (s *Server) setMessage(set *pto3.ObservationSet) *ObservationSet {
+	set.LinkVia(s.config)
+
+	out := &ObservationSet{
+		SetID:    uint64(set.ID),
+		Link:     set.Link(),
+		Analyzer: set.Analyzer,
+		Sources:  set.Sources,
+		Metadata: set.Metadata,
+		Count:    int64(set.Count),
+		State:    set.LifecycleState(),
+	}
+
+	for _, c := range set.Conditions {
+		out.Conditions = append(out.Conditions, c.Name)
+	}
+	if set.Created != nil {
+		out.Created = set.Created.Format(time.RFC3339)
+	}
+	if set.Modified != nil {
+		out.Modified = set.Modified.Format(time.RFC3339)
+	}
+
+	return out
+}
+
+// ListObservationSets lists observation sets, optionally filtered by metadata.
+func (s *Server) ListObservationSets(ctx context.Context, in *ListObservationSetsRequest) (*ListObservationSetsResponse, error) {
+	if err := s.requireObs(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, "read_obs"); err != nil {
+		return nil, err
+	}
+
+	var setIDs []int
+	var err error
+	if len(in.Meta) == 0 {
+		setIDs, err = pto3.AllObservationSetIDs(s.db)
+	} else {
+		filters := make([]pto3.MetadataFilter, len(in.Meta))
+		for i, expr := range in.Meta {
+			mf, err := pto3.ParseMetadataFilter(expr)
+			if err != nil {
+				return nil, grpcError("parsing metadata filter", err)
+			}
+			filters[i] = *mf
+		}
+		setIDs, err = pto3.ObservationSetIDsWithMetadataFilters(s.db, filters)
+	}
+	if err != nil {
+		return nil, grpcError("listing observation sets", err)
+	}
+
+	out := &ListObservationSetsResponse{SetIDs: make([]uint64, len(setIDs))}
+	for i, setID := range setIDs {
+		out.SetIDs[i] = uint64(setID)
+	}
+	return out, nil
+}
+
+// GetObservationSet returns an observation set's metadata.
+func (s *Server) GetObservationSet(ctx context.Context, in *GetObservationSetRequest) (*ObservationSet, error) {
+	if err := s.requireObs(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, "read_obs"); err != nil {
+		return nil, err
+	}
+
+	set := pto3.ObservationSet{ID: int(in.SetID)}
+	if err := set.SelectByID(s.db); err != nil {
+		return nil, grpcError("retrieving observation set", err)
+	}
+
+	return s.setMessage(&set), nil
+}
+
+// DownloadObservations streams the observations in a set in batches.
+func (s *Server) DownloadObservations(in *GetObservationSetRequest, stream grpc.ServerStream) error {
+	if err := s.requireObs(); err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), "read_obs_data"); err != nil {
+		return err
+	}
+
+	set := pto3.ObservationSet{ID: int(in.SetID)}
+	if err := set.SelectByID(s.db); err != nil {
+		return grpcError("retrieving observation set", err)
+	}
+
+	cursor := 0
+	for {
+		page, err := set.SelectObservationPage(s.db, nil, cursor, batchSize)
+		if err != nil {
+			return grpcError("retrieving observations", err)
+		}
+
+		batch := &ObservationBatch{Observations: make([]*Observation, len(page.Observations))}
+		for i, obs := range page.Observations {
+			batch.Observations[i] = &Observation{
+				Start:     obs.TimeStart.Unix(),
+				End:       obs.TimeEnd.Unix(),
+				Path:      obs.Path.String,
+				Condition: obs.Condition.Name,
+				Value:     obs.Value,
+			}
+		}
+
+		if len(batch.Observations) > 0 {
+			if err := stream.SendMsg(batch); err != nil {
+				return err
+			}
+		}
+
+		if !page.HasNext {
+			return nil
+		}
+		cursor = page.Next
+	}
+}
+
+// writeObsFileMetadata writes uploaded observation set metadata as the
+// metadata line of an observation file.
+func writeObsFileMetadata(out io.Writer, in *ObservationSet) error {
+	md := make(map[string]interface{}, len(in.Metadata)+3)
+	for k, v := range in.Metadata {
+		md[k] = v
+	}
+	md["_analyzer"] = in.Analyzer
+	md["_sources"] = in.Sources
+	md["_conditions"] = in.Conditions
+
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(b, '\n'))
+	return err
+}
+
+// writeObsFileObservation writes an uploaded observation as a line of an
+// observation file.
+func writeObsFileObservation(out io.Writer, in *Observation) error {
+	start := time.Unix(in.Start, 0)
+	end := time.Unix(in.End, 0)
+	obs := pto3.Observation{
+		TimeStart: &start,
+		TimeEnd:   &end,
+		Path:      &pto3.Path{String: in.Path},
+		Condition: &pto3.Condition{Name: in.Condition},
+		Value:     in.Value,
+	}
+
+	if in.Metadata != "" {
+		if err := json.Unmarshal([]byte(in.Metadata), &obs.Metadata); err != nil {
+			return pto3.PTOErrorf("bad observation metadata: %v", err).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	b, err := json.Marshal(&obs)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(b, '\n'))
+	return err
+}
+
+// UploadObservations creates a new observation set from a stream of metadata
+// and observations. The stream is spooled to a temporary observation file,
+// which is loaded as with POST /obs/bundle once the client closes the
+// stream.
+func (s *Server) UploadObservations(stream grpc.ServerStream) error {
+	if err := s.requireObs(); err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), "write_obs"); err != nil {
+		return err
+	}
+
+	tf, err := ioutil.TempFile("", "pto3_grpc")
+	if err != nil {
+		return grpcError("creating temporary observation file", err)
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+
+	out := bufio.NewWriter(tf)
+	var meta *ObservationSet
+	for {
+		in := new(UploadObservationsRequest)
+		if err := stream.RecvMsg(in); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if meta == nil {
+			if in.Set == nil {
+				return status.Error(codes.InvalidArgument, "first message must contain observation set metadata")
+			}
+			meta = in.Set
+			if err := writeObsFileMetadata(out, meta); err != nil {
+				return grpcError("writing metadata", err)
+			}
+		}
+
+		for _, obs := range in.Observations {
+			if err := writeObsFileObservation(out, obs); err != nil {
+				return grpcError("writing observations", err)
+			}
+		}
+	}
+
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "no observation set metadata")
+	}
+	if err := out.Flush(); err != nil {
+		return grpcError("writing observations", err)
+	}
+
+	// check local provenance links before loading
+	setmd, err := pto3.ReadObsFileMetadata(tf.Name())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	dangling, err := setmd.DanglingSources(s.config, s.db, nil)
+	if err != nil {
+		return grpcError("checking sources", err)
+	}
+	if len(dangling) > 0 {
+		if s.config.StrictSources {
+			return status.Errorf(codes.InvalidArgument, "_sources links to missing resources %v", dangling)
+		}
+		log.Printf("creating observation set with dangling _sources %v", dangling)
+	}
+
+	loader, err := pto3.NewLoader(s.db)
+	if err != nil {
+		return grpcError("loading condition cache", err)
+	}
+	set, err := loader.LoadSet(tf.Name())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "error loading observations: %v", err)
+	}
+
+	s.audit(stream.Context(), "UploadObservations", "/obs/"+pto3.SetID(set.ID).String())
+
+	if len(s.config.Downstreams) > 0 {
+		if err := pto3.EnqueueReplication(s.config, s.db, set.ID); err != nil {
+			log.Printf("error queueing replication of set %x: %v", set.ID, err)
+		}
+	}
+
+	return stream.SendMsg(s.setMessage(set))
+}
+
+// queryMessage converts a query's state to a message.
+func (s *Server) queryMessage(q *pto3.Query) *Query {
+	out := &Query{
+		Identifier: q.Identifier,
+		State:      q.State(),
+		Encoded:    q.URLEncoded(),
+	}
+
+	out.Link, _ = s.config.LinkTo("query/" + q.Identifier)
+	if q.ExecutionError != nil {
+		out.Error = q.ExecutionError.Error()
+	} else if q.Completed != nil {
+		out.RowCount = int64(q.ResultRowCount())
+	}
+
+	return out
+}
+
+// SubmitQuery submits a query for execution, returning its state at once,
+// without waiting for results. As with the HTTP API, the query is private to
+// the caller if its private parameter is set, and restricted to public sets
+// if the caller is allowed only by public access.
+func (s *Server) SubmitQuery(ctx context.Context, in *SubmitQueryRequest) (*Query, error) {
+	if err := s.requireQuery(); err != nil {
+		return nil, err
+	}
+
+	form, err := url.ParseQuery(in.Encoded)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad query: %v", err)
+	}
+
+	perm := "submit_query_obs"
+	if _, ok := form["group"]; ok {
+		perm = "submit_query_group"
+	}
+	if err := s.authorize(ctx, perm); err != nil {
+		return nil, err
+	}
+
+	r := request(ctx)
+	if err := papi.SetQueryOwner(r, form); err != nil {
+		return nil, grpcError("setting query owner", err)
+	}
+	papi.RestrictPublicQuery(s.azr, r, form)
+
+	q, _, err := s.qc.ExecuteQueryFromFormContext(ctx, form, make(chan struct{}))
+	if err != nil {
+		return nil, grpcError("parsing query", err)
+	}
+
+	return s.queryMessage(q), nil
+}
+
+// fetchQuery retrieves a query by identifier, if the caller may read it.
+// Queries the caller may not read are not found, as with the HTTP API.
+func (s *Server) fetchQuery(ctx context.Context, identifier string) (*pto3.Query, error) {
+	q, err := s.qc.QueryByIdentifier(identifier)
+	if err != nil {
+		return nil, grpcError("fetching query", err)
+	} else if q == nil || !papi.QueryReadable(s.azr, request(ctx), q) {
+		return nil, status.Errorf(codes.NotFound, "no such query %s", identifier)
+	}
+	return q, nil
+}
+
+// GetQuery returns a query's state.
+func (s *Server) GetQuery(ctx context.Context, in *GetQueryRequest) (*Query, error) {
+	if err := s.requireQuery(); err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, "read_query"); err != nil {
+		return nil, err
+	}
+
+	q, err := s.fetchQuery(ctx, in.Identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.queryMessage(q), nil
+}
+
+// GetQueryResults streams the results of a completed query in batches.
+func (s *Server) GetQueryResults(in *GetQueryRequest, stream grpc.ServerStream) error {
+	if err := s.requireQuery(); err != nil {
+		return err
+	}
+	if err := s.authorize(stream.Context(), "read_query"); err != nil {
+		return err
+	}
+
+	q, err := s.fetchQuery(stream.Context(), in.Identifier)
+	if err != nil {
+		return err
+	}
+	if q.Completed == nil || q.ExecutionError != nil {
+		return status.Error(codes.FailedPrecondition, "results not available")
+	}
+
+	resultFile, err := q.ReadResultFile()
+	if err != nil {
+		return grpcError("retrieving result", err)
+	}
+	defer resultFile.Close()
+
+	batch := new(QueryResultBatch)
+	scanner := bufio.NewScanner(resultFile)
+	for scanner.Scan() {
+		batch.Rows = append(batch.Rows, scanner.Text())
+		if len(batch.Rows) == batchSize {
+			if err := stream.SendMsg(batch); err != nil {
+				return err
+			}
+			batch.Rows = batch.Rows[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return grpcError("reading result", err)
+	}
+
+	if len(batch.Rows) > 0 {
+		return stream.SendMsg(batch)
+	}
+	return nil
+}
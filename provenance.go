@@ -0,0 +1,132 @@
+package pto3
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// localPath returns the path of a link relative to this configuration's base
+// URL, and true if the link is local to this PTO. Non-local links return
+// false.
+func (config *PTOConfiguration) localPath(link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || config.baseURL == nil {
+		return "", false
+	}
+
+	if u.Scheme != config.baseURL.Scheme || u.Host != config.baseURL.Host {
+		return "", false
+	}
+
+	if !strings.HasPrefix(u.Path, config.baseURL.Path) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(u.Path, config.baseURL.Path), true
+}
+
+// SourceLinkExists checks whether a link in an observation set's _sources
+// refers to something that exists. Links to observation sets local to this
+// PTO are checked against the observation database, and links to local raw
+// data files are checked against the raw data store if rds is not nil. Other
+// links, to other observatories or to local resources that cannot be
+// checked, are assumed to exist.
+func SourceLinkExists(config *PTOConfiguration, db orm.DB, rds RawStore, link string) (bool, error) {
+	path, ok := config.localPath(link)
+	if !ok {
+		return true, nil
+	}
+
+	elements := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch elements[0] {
+	case "obs":
+		// obs/<set>
+		if len(elements) != 2 {
+			return false, nil
+		}
+
+		setid, err := ParseSetID(elements[1])
+		if err != nil {
+			return false, nil
+		}
+
+		count, err := db.Model(&ObservationSet{}).Where("id = ?", int(setid)).Count()
+		if err != nil {
+			return false, PTOWrapError(err)
+		}
+		return count > 0, nil
+
+	case "raw":
+		if rds == nil {
+			return true, nil
+		}
+
+		// raw/<campaign>/<file>, or raw/<campaign>/<file>/data
+		if len(elements) < 3 || len(elements) > 4 || (len(elements) == 4 && elements[3] != "data") {
+			return false, nil
+		}
+
+		if _, err := rds.GetFileMetadata(elements[1], elements[2]); err != nil {
+			if perr, ok := err.(*PTOError); ok && perr.Status() == http.StatusNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	return true, nil
+}
+
+// DanglingSources returns the links in this observation set's _sources which
+// refer to local raw data files or observation sets which do not exist, as
+// determined by SourceLinkExists.
+func (set *ObservationSet) DanglingSources(config *PTOConfiguration, db orm.DB, rds RawStore) ([]string, error) {
+	var out []string
+
+	for _, link := range set.Sources {
+		ok, err := SourceLinkExists(config, db, rds, link)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			out = append(out, link)
+		}
+	}
+
+	return out, nil
+}
+
+// ObservationSetIDsDerivedFromRawFile lists the IDs of observation sets
+// derived from a local raw data file, i.e. those whose _sources contain a link
+// to the file's metadata or data. Lookup uses the index on observation set
+// sources, which is kept up to date as sets are loaded and their metadata
+// changed.
+func ObservationSetIDsDerivedFromRawFile(config *PTOConfiguration, db orm.DB, camname string, filename string) ([]int, error) {
+	filelink, err := config.LinkTo("raw/" + camname + "/" + filename)
+	if err != nil {
+		return nil, err
+	}
+	links := []string{filelink, filelink + "/data"}
+
+	var setIds []int
+	err = db.Model(&ObservationSet{}).
+		ColumnExpr("array_agg(id)").
+		Where("sources && ?::text[]", pg.Array(links)).
+		Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
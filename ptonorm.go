@@ -14,23 +14,9 @@ import (
 
 func normalizerMetadataCopy(from io.Reader, to io.WriteCloser, errchan chan error) {
 	defer to.Close()
-	buf := make([]byte, 65536)
-	for {
-		n, err := from.Read(buf)
-		if err == nil {
-			_, err2 := to.Write(buf[0:n])
-			if err2 != nil {
-				errchan <- err2
-				log.Fatal(err)
-				return
-			}
-		} else if err == io.EOF {
-			break
-		} else {
-			log.Fatal(err)
-			errchan <- err
-			return
-		}
+	if _, err := io.Copy(to, from); err != nil {
+		errchan <- err
+		return
 	}
 	errchan <- nil
 }
@@ -44,18 +30,21 @@ func normalizerMetadataFilter(from io.ReadCloser, to io.Writer, sourceurl string
 	for scanner.Scan() {
 		lineno++
 		line := strings.TrimSpace(scanner.Text())
-		switch line[0] {
-		case '{':
+		if line == "" {
+			continue
+		}
+		switch {
+		case isObservationLine([]byte(line)):
+			// data. pass.
+			fmt.Fprintln(to, line)
+
+		case line[0] == '{':
 			// metadata. coalesce
 			err := json.Unmarshal([]byte(line), &md)
 			if err != nil {
 				errchan <- err
 				return
 			}
-
-		case '[':
-			// data. pass.
-			fmt.Fprintln(to, line)
 		}
 	}
 
@@ -2,16 +2,19 @@ package pto3
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,6 +23,9 @@ import (
 
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type QueryCache struct {
@@ -35,27 +41,22 @@ type QueryCache struct {
 	// Path to result cache directory
 	path string
 
-	// Cached queries we know about
-	query map[string]*Query
-
-	// channel for execution tokens
-	exectokens chan struct{}
-
-	// Lock for submitted and cached maps
-	lock sync.RWMutex
+	// Queries executing or waiting to execute on this server
+	queue *executionQueue
 }
 
-// NewQueryCache creates a query cache given a configuration and an
-// authorizer. The query cache contains metadata and results (when available),
-// backed by permanent storage on disk, and an in-memory cache of recently executed
+// NewQueryCache creates a query cache given a configuration. The query cache
+// stores query metadata and state in the observation database, and results
+// (when available) on disk, so it may be shared among multiple API servers
+// with access to the same database and result storage. Query metadata left on
+// disk by previous versions is imported into the database.
 func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 
 	qc := QueryCache{
-		config:     config,
-		db:         pg.Connect(&config.ObsDatabase),
-		path:       config.QueryCacheRoot,
-		query:      make(map[string]*Query),
-		exectokens: make(chan struct{}, config.ConcurrentQueries),
+		config: config,
+		db:     pg.Connect(&config.ObsDatabase),
+		path:   config.QueryCacheRoot,
+		queue:  newExecutionQueue(),
 	}
 
 	var err error
@@ -64,6 +65,26 @@ func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 		return nil, err
 	}
 
+	if err := createQueryTable(qc.db); err != nil {
+		return nil, err
+	}
+
+	if err := createNamedQueryTables(qc.db); err != nil {
+		return nil, err
+	}
+
+	if err := createQueryTemplateTables(qc.db); err != nil {
+		return nil, err
+	}
+
+	if err := createConditionAliasTables(qc.db); err != nil {
+		return nil, err
+	}
+
+	if err := qc.importMetadataFiles(); err != nil {
+		return nil, err
+	}
+
 	return &qc, nil
 }
 
@@ -71,8 +92,12 @@ func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 // of the setup for testing the query cache, and should not be called in the
 // normal case.
 func (qc *QueryCache) LoadTestData(obsFilename string) (int, error) {
-	pidCache := make(PathCache)
-	set, err := CopySetFromObsFile(obsFilename, qc.db, qc.cidCache, pidCache)
+	loader, err := NewLoader(qc.db)
+	if err != nil {
+		return 0, err
+	}
+
+	set, err := loader.LoadSet(obsFilename)
 	if err != nil {
 		return 0, err
 	} else {
@@ -84,125 +109,77 @@ func (qc *QueryCache) EnableQueryLogging() {
 	EnableQueryLogging(qc.db)
 }
 
-func (qc *QueryCache) metadataPath(identifier string) string {
-	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.json", identifier))
-}
-
-func (qc *QueryCache) writeMetadataFile(identifier string) (*os.File, error) {
-	return os.Create(qc.metadataPath(identifier))
-}
-
-func (qc *QueryCache) readMetadataFile(identifier string) (*os.File, error) {
-	return os.Open(qc.metadataPath(identifier))
-}
-
-func (qc *QueryCache) statMetadataFile(identifier string) (os.FileInfo, error) {
-	return os.Stat(qc.metadataPath(identifier))
+// EnableSlowQueryLogging logs statements executed by this cache taking longer
+// than the configured SlowQueryThreshold.
+func (qc *QueryCache) EnableSlowQueryLogging() {
+	EnableSlowQueryLogging(qc.db, time.Duration(qc.config.SlowQueryThreshold)*time.Millisecond)
 }
 
+// fetchQuery retrieves a query from the database by identifier, returning
+// nil if no such query exists.
 func (qc *QueryCache) fetchQuery(identifier string) (*Query, error) {
-	// we're modifying the cache
-	qc.lock.Lock()
-	defer qc.lock.Unlock()
-
-	in, err := qc.readMetadataFile(identifier)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// nothing on disk, but that's not an error.
+	rec := QueryRecord{Identifier: identifier}
+	if err := qc.db.Select(&rec); err != nil {
+		if err == pg.ErrNoRows {
+			// not in the cache, but that's not an error.
 			return nil, nil
-		} else {
-			return nil, PTOWrapError(err)
 		}
-	}
-	defer in.Close()
-
-	b, err := ioutil.ReadAll(in)
-	if err != nil {
-		return nil, PTOWrapError(err)
-	}
-
-	q := Query{qc: qc}
-	if err := json.Unmarshal(b, &q); err != nil {
 		return nil, PTOWrapError(err)
 	}
 
-	if q.Identifier != identifier {
-		return nil, PTOErrorf("Identifier mismatch on query fetch: fetched %s got %s", identifier, q.Identifier)
-	}
-
-	// Stick query in the cache
-	qc.query[identifier] = &q
-
-	// FIXME any query we fetch in executing state necessarily crashed.
-	// we need to restart these. see #59.
+	// FIXME any query we fetch in executing state whose server has died
+	// necessarily crashed. we need to restart these. see #59.
 
-	return &q, nil
+	return qc.queryFromRecord(&rec)
 }
 
+// QueryByIdentifier retrieves a query by identifier, returning nil if no such
+// query exists. Query state is always read from the database, since it may
+// have been changed by another server sharing the cache.
 func (qc *QueryCache) QueryByIdentifier(identifier string) (*Query, error) {
-
-	q := func() *Query {
-		qc.lock.RLock()
-		defer qc.lock.RUnlock()
-
-		// in in-memory cache?
-		q := qc.query[identifier]
-		if q != nil {
-			return q
-		}
-
-		return nil
-
-	}()
-
-	if q != nil {
-		return q, nil
-	}
-
-	// nope, check on disk
 	return qc.fetchQuery(identifier)
 }
 
 func (qc *QueryCache) CachedQueryLinks() ([]string, error) {
-	out := make([]string, 0)
+	return qc.CachedQueryLinksVisibleTo("")
+}
 
-	// FIXME: cache this somewhere, allow invalidation
-	direntries, err := ioutil.ReadDir(qc.config.QueryCacheRoot)
+// CachedQueryLinksVisibleTo lists links to the cached queries a principal may
+// retrieve: shared queries, and those private to the principal. Private
+// queries are not listed for the empty principal.
+func (qc *QueryCache) CachedQueryLinksVisibleTo(principal string) ([]string, error) {
+	var identifiers []string
 
-	if err != nil {
+	// FIXME: paginate this
+	if err := qc.db.Model((*QueryRecord)(nil)).Column("identifier").
+		Where("owner = '' OR owner = ?", principal).
+		Order("identifier").Select(&identifiers); err != nil {
 		return nil, PTOWrapError(err)
 	}
 
-	for _, direntry := range direntries {
-		metafilename := direntry.Name()
-		if strings.HasSuffix(metafilename, ".json") {
-			linkname := metafilename[0 : len(metafilename)-len(".json")]
-			link, _ := qc.config.LinkTo(fmt.Sprintf("query/%s", linkname))
-			out = append(out, link)
-		}
+	out := make([]string, len(identifiers))
+	for i := range identifiers {
+		out[i], _ = qc.config.LinkTo(fmt.Sprintf("query/%s", identifiers[i]))
 	}
 
 	return out, nil
 }
 
 func (qc *QueryCache) Purge(identifier string) error {
-	qc.lock.RLock()
-	defer qc.lock.RUnlock()
-
-	if err := os.Remove(qc.dataPath(identifier)); err != nil {
-		if !os.IsNotExist(err) {
-			return PTOWrapError(err)
-		}
+	if _, err := qc.db.Model((*QueryRecord)(nil)).Where("identifier = ?", identifier).Delete(); err != nil {
+		return PTOWrapError(err)
 	}
 
-	if err := os.Remove(qc.metadataPath(identifier)); err != nil {
-		if !os.IsNotExist(err) {
-			return PTOWrapError(err)
+	// remove results and their index, and partial results left by
+	// interrupted execution
+	for _, path := range []string{qc.dataPath(identifier), qc.partialDataPath(identifier), qc.indexPath(identifier)} {
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				return PTOWrapError(err)
+			}
 		}
 	}
 
-	delete(qc.query, identifier)
-
 	return nil
 }
 
@@ -212,6 +189,17 @@ type GroupSpec interface {
 	ColumnSpec() string
 }
 
+// JoiningGroupSpec is a GroupSpec whose column specification refers to tables
+// other than observations. ExtTables returns the names of the tables related
+// to observations to join: "conditions" (aliased to condition) and "paths"
+// (aliased to path). Joins returns any further JOIN clauses, e.g. to a local
+// mapping table, which are applied after these.
+type JoiningGroupSpec interface {
+	GroupSpec
+	ExtTables() []string
+	Joins() []string
+}
+
 // SimpleGroupSpec groups a pg-go query by a single column
 type SimpleGroupSpec struct {
 	Name     string
@@ -227,10 +215,24 @@ func (gs *SimpleGroupSpec) ColumnSpec() string {
 	return gs.Column
 }
 
-// DateTruncGroupSpec groups a pg-go query by applying PostgreSQL's date_trunc function to a column
+func (gs *SimpleGroupSpec) ExtTables() []string {
+	if gs.ExtTable == "" {
+		return nil
+	}
+	return []string{gs.ExtTable}
+}
+
+func (gs *SimpleGroupSpec) Joins() []string {
+	return nil
+}
+
+// DateTruncGroupSpec groups a pg-go query by applying PostgreSQL's date_trunc function to a column.
+// If Labels is set, groups by week are labeled with ISO week numbers (e.g.
+// 2017-W49) instead of the timestamp at the start of the week.
 type DateTruncGroupSpec struct {
 	Truncation string
 	Column     string
+	Labels     bool
 }
 
 func (gs *DateTruncGroupSpec) URLEncoded() string {
@@ -238,13 +240,19 @@ func (gs *DateTruncGroupSpec) URLEncoded() string {
 }
 
 func (gs *DateTruncGroupSpec) ColumnSpec() string {
+	if gs.Labels && gs.Truncation == "week" {
+		return fmt.Sprintf(`to_char(%s, 'IYYY-"W"IW')`, gs.Column)
+	}
 	return fmt.Sprintf("date_trunc('%s', %s)", gs.Truncation, gs.Column)
 }
 
-// DatePartGroupSpec groups a pg-go query by applying PostgreSQL's date_part function to a column
+// DatePartGroupSpec groups a pg-go query by applying PostgreSQL's date_part function to a column.
+// If Labels is set, groups are labeled with abbreviated day names (Mon to Sun)
+// or hours (00:00 to 23:00) instead of numbers.
 type DatePartGroupSpec struct {
 	Part   string
 	Column string
+	Labels bool
 }
 
 func (gs *DatePartGroupSpec) URLEncoded() string {
@@ -259,9 +267,59 @@ func (gs *DatePartGroupSpec) URLEncoded() string {
 }
 
 func (gs *DatePartGroupSpec) ColumnSpec() string {
+	if gs.Labels {
+		switch gs.Part {
+		case "dow":
+			return fmt.Sprintf("to_char(%s, 'Dy')", gs.Column)
+		case "hour":
+			return fmt.Sprintf("to_char(%s, 'HH24:00')", gs.Column)
+		}
+	}
 	return fmt.Sprintf("date_part('%s', %s)", gs.Part, gs.Column)
 }
 
+// PathElementGroupSpec groups a pg-go query by the element at a given
+// position in each observation's path. Positions count from 1 at the start of
+// the path, or from -1 at its end. If Pattern is given, only elements
+// matching it (as a PostgreSQL regular expression matching the whole element)
+// are counted, e.g. AS[0-9]+ to group by AS hops. Observations whose paths
+// have no element at the position fall into an empty group.
+type PathElementGroupSpec struct {
+	Name     string
+	Position int
+	Pattern  string
+}
+
+func (gs *PathElementGroupSpec) URLEncoded() string {
+	return gs.Name
+}
+
+func (gs *PathElementGroupSpec) ColumnSpec() string {
+	where := ""
+	if gs.Pattern != "" {
+		where = fmt.Sprintf(" WHERE pe.element ~ '^(%s)$'", strings.Replace(gs.Pattern, "'", "''", -1))
+	}
+
+	order, index := "pe.n", gs.Position
+	if gs.Position < 0 {
+		order, index = "pe.n DESC", -gs.Position
+	}
+
+	return fmt.Sprintf("(ARRAY(SELECT pe.element FROM unnest(string_to_array(path.string, ' ')) WITH ORDINALITY AS pe(element, n)%s ORDER BY %s))[%d]",
+		where, order, index)
+}
+
+func (gs *PathElementGroupSpec) ExtTables() []string {
+	return []string{"paths"}
+}
+
+func (gs *PathElementGroupSpec) Joins() []string {
+	return nil
+}
+
+// asPathElementPattern matches AS numbers in paths
+const asPathElementPattern = "AS[0-9]+"
+
 type Query struct {
 	// Reference to cache containing query
 	qc *QueryCache
@@ -274,44 +332,218 @@ type Query struct {
 	Executed  *time.Time
 	Completed *time.Time
 
-	// Result Row Count (cached)
-	resultRowCount int
+	// Modification timestamp, as stored in the database
+	modified *time.Time
+
+	// Result row count, recorded at execution time or cached after scanning
+	// the result file; valid only if resultRowCountKnown
+	resultRowCount      int
+	resultRowCountKnown bool
+
+	// Number of result rows written to the partial result file so far
+	rowsSoFar int
+
+	// Database handle used while executing, and statistics recorded by the
+	// last execution, if enabled
+	execDB *pg.DB
+	stats  *QueryStatistics
+
+	// Trace context of the request which caused this query to be executed
+	traceCtx context.Context
 
 	// Errors, references, and sources
 	ExecutionError error
 	ExtRef         string
 	Sources        []int
 
+	// Observation sets this query was pinned to when first executed; nil if
+	// not yet pinned
+	pins []QuerySource
+	// Refresh pins on resubmission; not part of the query specification
+	repin bool
+	// Retention of results requested on submission; zero for the configured
+	// default. Not part of the query specification
+	retainHint time.Duration
+
 	// Arbitrary metadata
 	Metadata map[string]string
 
 	// Parsed query parameters
-	timeStart        *time.Time
-	timeEnd          *time.Time
-	selectSets       []int
-	selectOnPath     []string
-	selectSources    []string
-	selectTargets    []string
-	selectConditions []Condition
-	selectFeatures   []string
-	selectAspects    []string
-	selectValues     []string
-	groups           []GroupSpec
+	timeStart             *time.Time
+	timeEnd               *time.Time
+	selectSets            []int
+	selectOnPath          []string
+	selectSources         []string
+	selectTargets         []string
+	selectSourceCountries []string
+	selectTargetCountries []string
+	selectConditions      []Condition
+	selectFeatures        []string
+	selectAspects         []string
+	selectValues          []string
+	selectValuesGT        []string
+	selectValuesLT        []string
+	selectValuesNE        []string
+	selectMetadata        []MetadataFilter
+	groups                []GroupSpec
 
 	// Query options
-	optionSetsOnly             bool
-	optionCountDistinctTargets bool
+	optionSetsOnly          bool
+	optionCountDistinct     string
+	optionIncludeDeprecated bool
+	optionSample            int
+	optionDateLabels        bool
+
+	// Time zone to group dates in; UTC if empty
+	timeZone string
+
+	// Tag restricting the query to the observation sets carrying it; all
+	// sets are visible if empty
+	visibleTag string
+
+	// Principal owning this query, which only it may list or retrieve;
+	// shared with all principals if empty
+	owner string
+}
+
+// queryGroupSpecs maps the group names supported in queries to functions
+// creating the group specification for each.
+var queryGroupSpecs = map[string]GroupSpecFunc{
+	"year": func() GroupSpec {
+		return &DateTruncGroupSpec{Truncation: "year", Column: "time_start"}
+	},
+	"month": func() GroupSpec {
+		return &DateTruncGroupSpec{Truncation: "month", Column: "time_start"}
+	},
+	"week": func() GroupSpec {
+		return &DateTruncGroupSpec{Truncation: "week", Column: "time_start"}
+	},
+	"day": func() GroupSpec {
+		return &DateTruncGroupSpec{Truncation: "day", Column: "time_start"}
+	},
+	"hour": func() GroupSpec {
+		return &DateTruncGroupSpec{Truncation: "hour", Column: "time_start"}
+	},
+	"week_day": func() GroupSpec {
+		return &DatePartGroupSpec{Part: "dow", Column: "time_start"}
+	},
+	"day_hour": func() GroupSpec {
+		return &DatePartGroupSpec{Part: "hour", Column: "time_start"}
+	},
+	"condition": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "condition", Column: "condition.name", ExtTable: "conditions"}
+	},
+	"feature": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "feature", Column: "condition.feature", ExtTable: "conditions"}
+	},
+	"aspect": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "aspect", Column: "condition.aspect", ExtTable: "conditions"}
+	},
+	"source": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "source", Column: "path.source", ExtTable: "paths"}
+	},
+	"target": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "target", Column: "path.target", ExtTable: "paths"}
+	},
+	"source_country": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "source_country", Column: "path.source_country", ExtTable: "paths"}
+	},
+	"target_country": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "target_country", Column: "path.target_country", ExtTable: "paths"}
+	},
+	"value": func() GroupSpec {
+		return &SimpleGroupSpec{Name: "value", Column: "value", ExtTable: ""}
+	},
+	"first_as": func() GroupSpec {
+		return &PathElementGroupSpec{Name: "first_as", Position: 1, Pattern: asPathElementPattern}
+	},
+	"last_as": func() GroupSpec {
+		return &PathElementGroupSpec{Name: "last_as", Position: -1, Pattern: asPathElementPattern}
+	},
+}
+
+var queryGroupSpecLock sync.RWMutex
+
+// GroupSpecFunc creates a new group specification.
+type GroupSpecFunc func() GroupSpec
+
+// RegisterGroupSpec registers a group specification for use in queries under
+// the given name, so that deployments can add site-specific groupings at
+// startup. The specification's URLEncoded method must return the name under
+// which it is registered. Names of existing groups cannot be reused.
+func RegisterGroupSpec(name string, fn GroupSpecFunc) error {
+	gs := fn()
+	if gs.URLEncoded() != name {
+		return PTOErrorf("group specification for %s encodes as %s", name, gs.URLEncoded())
+	}
+
+	if jgs, ok := gs.(JoiningGroupSpec); ok {
+		for _, extTable := range jgs.ExtTables() {
+			if extTable != "conditions" && extTable != "paths" {
+				return PTOErrorf("group specification for %s joins unjoinable table %s", name, extTable)
+			}
+		}
+	}
+
+	queryGroupSpecLock.Lock()
+	defer queryGroupSpecLock.Unlock()
+
+	if _, ok := queryGroupSpecs[name]; ok {
+		return PTOErrorf("group %s already registered", name)
+	}
+	queryGroupSpecs[name] = fn
+
+	return nil
+}
+
+// QueryGroupNames returns the names of the groups supported in queries, in
+// sorted order.
+func QueryGroupNames() []string {
+	queryGroupSpecLock.RLock()
+	defer queryGroupSpecLock.RUnlock()
+
+	out := make([]string, 0, len(queryGroupSpecs))
+	for name := range queryGroupSpecs {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// QueryOptionNames lists the options supported in queries.
+var QueryOptionNames = []string{"sets_only", "count_targets", "count_sources", "count_paths", "count_sets", "include_deprecated", "repin", "sample:<n>"}
+
+// queryCountOptions maps the options making group queries count distinct
+// values instead of observations to the column counted.
+var queryCountOptions = map[string]string{
+	"count_targets": "path.target",
+	"count_sources": "path.source",
+	"count_paths":   "observation.path_id",
+	"count_sets":    "observation.set_id",
+}
+
+// maxQuerySampleSize limits the number of observations a query may sample.
+const maxQuerySampleSize = 100000
+
+// QuerySource records an observation set a query covers, and the set's
+// modification time when the query was pinned to it.
+type QuerySource struct {
+	SetID    int        `json:"set_id"`
+	Modified *time.Time `json:"modified"`
 }
 
 func (q *Query) populateFromForm(form url.Values) error {
 	var ok bool
 
-	// Parse start and end times
+	// Parse start and end times, resolving relative times against the same
+	// instant
+	now := time.Now()
+
 	timeStartStrs, ok := form["time_start"]
 	if !ok || len(timeStartStrs) < 1 || timeStartStrs[0] == "" {
 		return PTOErrorf("Query missing mandatory time_start parameter").StatusIs(http.StatusBadRequest)
 	}
-	timeStart, err := ParseTime(timeStartStrs[0])
+	timeStart, err := q.parseQueryTime(timeStartStrs[0], now, "__time_start_expr")
 	if err != nil {
 		return PTOErrorf("Error parsing time_start: %s", err.Error()).StatusIs(http.StatusBadRequest)
 	}
@@ -321,7 +553,7 @@ func (q *Query) populateFromForm(form url.Values) error {
 	if !ok || len(timeEndStrs) < 1 || timeEndStrs[0] == "" {
 		return PTOErrorf("Query missing mandatory time_start parameter").StatusIs(http.StatusBadRequest)
 	}
-	timeEnd, err := ParseTime(timeEndStrs[0])
+	timeEnd, err := q.parseQueryTime(timeEndStrs[0], now, "__time_end_expr")
 	if err != nil {
 		return PTOErrorf("Error parsing time_end: %s", err.Error()).StatusIs(http.StatusBadRequest)
 	}
@@ -336,11 +568,11 @@ func (q *Query) populateFromForm(form url.Values) error {
 	if ok {
 		q.selectSets = make([]int, len(setStrs))
 		for i := range setStrs {
-			seti64, err := strconv.ParseInt(setStrs[i], 16, 32)
+			setid, err := ParseSetID(setStrs[i])
 			if err != nil {
-				return PTOErrorf("Error parsing set ID: %s", err.Error()).StatusIs(http.StatusBadRequest)
+				return err
 			}
-			q.selectSets[i] = int(seti64)
+			q.selectSets[i] = int(setid)
 		}
 	}
 
@@ -348,10 +580,24 @@ func (q *Query) populateFromForm(form url.Values) error {
 	q.selectOnPath = form["on_path"]
 	q.selectSources = form["source"]
 	q.selectTargets = form["target"]
+	q.selectSourceCountries = form["source_country"]
+	q.selectTargetCountries = form["target_country"]
 	q.selectValues = form["value"]
+	q.selectValuesGT = form["value_gt"]
+	q.selectValuesLT = form["value_lt"]
+	q.selectValuesNE = form["value_ne"]
 	q.selectFeatures = form["feature"]
 	q.selectAspects = form["aspect"]
 
+	// Parse per-observation metadata filters
+	for _, metaExpr := range form["meta"] {
+		mf, err := ParseMetadataFilter(metaExpr)
+		if err != nil {
+			return err
+		}
+		q.selectMetadata = append(q.selectMetadata, *mf)
+	}
+
 	// Validate and expand conditions
 	conditionStrs, ok := form["condition"]
 	if ok {
@@ -382,36 +628,13 @@ func (q *Query) populateFromForm(form url.Values) error {
 		}
 		q.groups = make([]GroupSpec, len(groupStrs))
 		for i, groupStr := range groupStrs {
-			switch groupStr {
-			case "year":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "year", Column: "time_start"}
-			case "month":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "month", Column: "time_start"}
-			case "week":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "week", Column: "time_start"}
-			case "day":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "day", Column: "time_start"}
-			case "hour":
-				q.groups[i] = &DateTruncGroupSpec{Truncation: "hour", Column: "time_start"}
-			case "week_day":
-				q.groups[i] = &DatePartGroupSpec{Part: "dow", Column: "time_start"}
-			case "day_hour":
-				q.groups[i] = &DatePartGroupSpec{Part: "hour", Column: "time_start"}
-			case "condition":
-				q.groups[i] = &SimpleGroupSpec{Name: "condition", Column: "condition.name", ExtTable: "conditions"}
-			case "feature":
-				q.groups[i] = &SimpleGroupSpec{Name: "feature", Column: "condition.feature", ExtTable: "conditions"}
-			case "aspect":
-				q.groups[i] = &SimpleGroupSpec{Name: "aspect", Column: "condition.aspect", ExtTable: "conditions"}
-			case "source":
-				q.groups[i] = &SimpleGroupSpec{Name: "source", Column: "path.source", ExtTable: "paths"}
-			case "target":
-				q.groups[i] = &SimpleGroupSpec{Name: "target", Column: "path.target", ExtTable: "paths"}
-			case "value":
-				q.groups[i] = &SimpleGroupSpec{Name: "value", Column: "value", ExtTable: ""}
-			default:
+			queryGroupSpecLock.RLock()
+			newGroupSpec, ok := queryGroupSpecs[groupStr]
+			queryGroupSpecLock.RUnlock()
+			if !ok {
 				return PTOErrorf("unsupported group name %s", groupStr).StatusIs(http.StatusBadRequest)
 			}
+			q.groups[i] = newGroupSpec()
 		}
 	}
 
@@ -422,18 +645,140 @@ func (q *Query) populateFromForm(form url.Values) error {
 			switch optionStr {
 			case "sets_only":
 				q.optionSetsOnly = true
-			case "count_targets":
-				q.optionCountDistinctTargets = true
+			case "count_targets", "count_sources", "count_paths", "count_sets":
+				if q.optionCountDistinct != "" && q.optionCountDistinct != optionStr {
+					return PTOErrorf("conflicting options %s and %s", q.optionCountDistinct, optionStr).StatusIs(http.StatusBadRequest)
+				}
+				q.optionCountDistinct = optionStr
+			case "include_deprecated":
+				q.optionIncludeDeprecated = true
+			case "repin":
+				q.repin = true
+			case "date_labels":
+				q.optionDateLabels = true
+			default:
+				if strings.HasPrefix(optionStr, "sample:") {
+					n, err := strconv.Atoi(strings.TrimPrefix(optionStr, "sample:"))
+					if err != nil || n <= 0 || n > maxQuerySampleSize {
+						return PTOErrorf("bad sample size in option %s: must be between 1 and %d", optionStr, maxQuerySampleSize).StatusIs(http.StatusBadRequest)
+					}
+					q.optionSample = n
+				}
 			}
 		}
 	}
 
-	// hash everything into an identifier
+	// group dates in a time zone if requested; there must be some to group
+	if tz := form.Get("tz"); tz != "" && tz != "UTC" {
+		if !timeZoneRegexp.MatchString(tz) {
+			return PTOErrorf("bad time zone %s", tz).StatusIs(http.StatusBadRequest)
+		}
+		if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+			return PTOErrorf("unknown time zone %s", tz).StatusIs(http.StatusBadRequest)
+		}
+		q.timeZone = tz
+		if !q.zoneDateGroups() {
+			return PTOErrorf("tz parameter requires a date group").StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	// restrict to sets with a tag if requested
+	q.visibleTag = form.Get("visible_tag")
+
+	// retain results for a given period if requested
+	if retain := form.Get("retain"); retain != "" {
+		if err := q.parseRetentionHint(retain); err != nil {
+			return err
+		}
+	}
+
+	// make private to a principal if requested; the owner is part of the
+	// query specification, so a private query has its own identifier
+	q.owner = form.Get("owner")
+
+	// label date groups if requested; there must be some to label
+	if q.optionDateLabels && !q.labelDateGroups() {
+		return PTOErrorf("date_labels option requires a week, week_day, or day_hour group").StatusIs(http.StatusBadRequest)
+	}
+
+	// sampling only applies to observation selection
+	if q.optionSample > 0 && (len(q.groups) > 0 || q.optionSetsOnly) {
+		return PTOErrorf("sample option not supported for group or sets_only queries").StatusIs(http.StatusBadRequest)
+	}
+
+	// canonicalize and hash everything into an identifier
+	q.canonicalize()
 	q.generateIdentifier()
 
 	return nil
 }
 
+// timeZoneRegexp matches the characters allowed in IANA time zone names, so
+// that time zones can be safely interpolated into SQL.
+var timeZoneRegexp = regexp.MustCompile(`^[A-Za-z0-9_+\-]+(/[A-Za-z0-9_+\-]+)*$`)
+
+// zoneDateGroups makes this query's groups by date and time group in its
+// time zone rather than in UTC, returning false if it has no such groups.
+func (q *Query) zoneDateGroups() bool {
+	column := fmt.Sprintf("(time_start AT TIME ZONE '%s')", q.timeZone)
+	zoned := false
+	for _, gs := range q.groups {
+		switch tgs := gs.(type) {
+		case *DatePartGroupSpec:
+			tgs.Column = column
+			zoned = true
+		case *DateTruncGroupSpec:
+			tgs.Column = column
+			zoned = true
+		}
+	}
+	return zoned
+}
+
+// labelDateGroups makes this query's groups by week, day of week, and hour
+// of day emit human-readable labels, returning false if it has no such
+// groups.
+func (q *Query) labelDateGroups() bool {
+	labeled := false
+	for _, gs := range q.groups {
+		switch tgs := gs.(type) {
+		case *DatePartGroupSpec:
+			tgs.Labels = true
+			labeled = true
+		case *DateTruncGroupSpec:
+			if tgs.Truncation == "week" {
+				tgs.Labels = true
+				labeled = true
+			}
+		}
+	}
+	return labeled
+}
+
+// relativeTimeKeys are the metadata keys under which the relative time
+// expressions a query was submitted with are recorded.
+var relativeTimeKeys = []string{"__time_start_expr", "__time_end_expr"}
+
+// parseQueryTime parses an absolute or relative time for this query. Relative
+// times are resolved against now, and the expression is recorded in this
+// query's metadata under the given key; the query itself, and therefore its
+// identifier, uses only the resolved absolute time.
+func (q *Query) parseQueryTime(s string, now time.Time, key string) (time.Time, error) {
+	t, relative, err := ParseRelativeTime(s, now)
+	if err != nil {
+		return time.Time{}, err
+	} else if !relative {
+		return ParseTime(s)
+	}
+
+	if q.Metadata == nil {
+		q.Metadata = make(map[string]string)
+	}
+	q.Metadata[key] = s
+
+	return t, nil
+}
+
 func (q *Query) populateFromEncoded(urlencoded string) error {
 	v, err := url.ParseQuery(urlencoded)
 	if err != nil {
@@ -467,35 +812,49 @@ func (qc *QueryCache) SubmitQueryFromForm(form url.Values) (*Query, bool, error)
 		return nil, false, err
 	}
 
-	// check to see if it's been cached
-	oq, err := qc.QueryByIdentifier(q.Identifier)
-	if err != nil {
-		return nil, false, err
-	}
-	if oq != nil {
-		return oq, false, nil
-	}
-
-	// nope, new query. set submitted timestamp.
+	// set submitted timestamp, in case it's new
 	t := time.Now()
 	q.Submitted = &t
+	q.modified = &t
+
+	// try to add it to the cache. if another server has already done so, the
+	// query is not new, and will be executed there.
+	res, err := qc.db.Model(q.record()).OnConflict("DO NOTHING").Insert()
+	if err != nil {
+		return nil, false, PTOWrapError(err)
+	}
 
-	// we're modifying the cache
-	qc.lock.Lock()
-	defer qc.lock.Unlock()
+	if res.RowsAffected() > 0 {
+		return q, true, nil
+	}
 
-	// write to disk
-	if err := q.FlushMetadata(); err != nil {
+	oq, err := qc.QueryByIdentifier(q.Identifier)
+	if err != nil {
 		return nil, false, err
 	}
+	if oq == nil {
+		return nil, false, PTOErrorf("query %s disappeared during submission", q.Identifier)
+	}
+	oq.repin = q.repin
 
-	// add to cache
-	qc.query[q.Identifier] = q
+	// keep results as long as any submission asked for
+	if q.retainsLongerThan(oq) {
+		oq.retainHint = q.retainHint
+		if err := oq.flushColumns("retain_seconds"); err != nil {
+			return nil, false, err
+		}
+	}
 
-	return q, true, nil
+	return oq, false, nil
 }
 
 func (qc *QueryCache) ExecuteQueryFromForm(form url.Values, done chan struct{}) (*Query, bool, error) {
+	return qc.ExecuteQueryFromFormContext(context.Background(), form, done)
+}
+
+// ExecuteQueryFromFormContext works like ExecuteQueryFromForm, but traces
+// execution of the query as part of the trace in the given context.
+func (qc *QueryCache) ExecuteQueryFromFormContext(ctx context.Context, form url.Values, done chan struct{}) (*Query, bool, error) {
 
 	// submit the query
 	q, new, err := qc.SubmitQueryFromForm(form)
@@ -503,12 +862,8 @@ func (qc *QueryCache) ExecuteQueryFromForm(form url.Values, done chan struct{})
 		return nil, false, err
 	}
 
-	// execute and do an immediate wait for it if it's new
-	if new {
-		q.ExecuteWaitImmediate(done)
-	} else {
-		close(done)
-	}
+	q.traceCtx = ctx
+	q.executeIfNewOrRepinned(new, done)
 
 	return q, new, nil
 }
@@ -542,105 +897,202 @@ func (qc *QueryCache) ExecuteQueryFromURLEncoded(encoded string, done chan struc
 		return nil, false, err
 	}
 
-	// execute and do an immediate wait for it if it's new
-	if new {
-		q.ExecuteWaitImmediate(done)
-	} else {
-		close(done)
-	}
+	q.executeIfNewOrRepinned(new, done)
 
 	return q, new, nil
 }
 
+// canonicalize puts this query into canonical form, so that semantically
+// equal queries have the same URL-encoded form and identifier: times are
+// converted to UTC at second precision, country codes are upper-cased, and
+// all selections (including conditions expanded from wildcards), groups, and
+// set IDs are sorted with duplicates removed.
+func (q *Query) canonicalize() {
+	// times
+	timeStart := q.timeStart.UTC().Truncate(time.Second)
+	q.timeStart = &timeStart
+	timeEnd := q.timeEnd.UTC().Truncate(time.Second)
+	q.timeEnd = &timeEnd
+
+	// observation sets
+	sort.Ints(q.selectSets)
+	if len(q.selectSets) > 0 {
+		sets := q.selectSets[:1]
+		for _, setid := range q.selectSets[1:] {
+			if setid != sets[len(sets)-1] {
+				sets = append(sets, setid)
+			}
+		}
+		q.selectSets = sets
+	}
+
+	// string selections
+	for i := range q.selectSourceCountries {
+		q.selectSourceCountries[i] = strings.ToUpper(q.selectSourceCountries[i])
+	}
+	for i := range q.selectTargetCountries {
+		q.selectTargetCountries[i] = strings.ToUpper(q.selectTargetCountries[i])
+	}
+	q.selectOnPath = sortedUniqueStrings(q.selectOnPath)
+	q.selectSources = sortedUniqueStrings(q.selectSources)
+	q.selectTargets = sortedUniqueStrings(q.selectTargets)
+	q.selectSourceCountries = sortedUniqueStrings(q.selectSourceCountries)
+	q.selectTargetCountries = sortedUniqueStrings(q.selectTargetCountries)
+	q.selectFeatures = sortedUniqueStrings(q.selectFeatures)
+	q.selectAspects = sortedUniqueStrings(q.selectAspects)
+	q.selectValues = sortedUniqueStrings(q.selectValues)
+	q.selectValuesGT = sortedUniqueStrings(q.selectValuesGT)
+	q.selectValuesLT = sortedUniqueStrings(q.selectValuesLT)
+	q.selectValuesNE = sortedUniqueStrings(q.selectValuesNE)
+
+	// metadata filters
+	sort.SliceStable(q.selectMetadata, func(i, j int) bool {
+		return q.selectMetadata[i].String() < q.selectMetadata[j].String()
+	})
+	if len(q.selectMetadata) > 0 {
+		filters := q.selectMetadata[:1]
+		for _, mf := range q.selectMetadata[1:] {
+			if mf != filters[len(filters)-1] {
+				filters = append(filters, mf)
+			}
+		}
+		q.selectMetadata = filters
+	}
+
+	// conditions
+	sort.SliceStable(q.selectConditions, func(i, j int) bool {
+		return q.selectConditions[i].Name < q.selectConditions[j].Name
+	})
+	if len(q.selectConditions) > 0 {
+		conditions := q.selectConditions[:1]
+		for _, c := range q.selectConditions[1:] {
+			if c.Name != conditions[len(conditions)-1].Name {
+				conditions = append(conditions, c)
+			}
+		}
+		q.selectConditions = conditions
+	}
+
+	// groups
+	sort.SliceStable(q.groups, func(i, j int) bool {
+		return q.groups[i].URLEncoded() < q.groups[j].URLEncoded()
+	})
+	if len(q.groups) > 0 {
+		groups := q.groups[:1]
+		for _, g := range q.groups[1:] {
+			if g.URLEncoded() != groups[len(groups)-1].URLEncoded() {
+				groups = append(groups, g)
+			}
+		}
+		q.groups = groups
+	}
+}
+
+// sortedUniqueStrings sorts a slice of strings in place and returns it with
+// duplicates removed.
+func sortedUniqueStrings(in []string) []string {
+	if len(in) == 0 {
+		return in
+	}
+
+	sort.Strings(in)
+	out := in[:1]
+	for _, s := range in[1:] {
+		if s != out[len(out)-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 // URLEncoded returns the normalized query string representing this query.
 // This is used to generate query identifiers, and to serialize queries to
-// disk.
+// disk. The query must be in canonical form.
 func (q *Query) URLEncoded() string {
-	// generate query specification as normalized, urlencoded
-
 	// start with start and end time
 	out := fmt.Sprintf("time_start=%s&time_end=%s",
 		url.QueryEscape(q.timeStart.Format(time.RFC3339)),
 		url.QueryEscape(q.timeEnd.Format(time.RFC3339)))
 
-	// add sorted observation sets
-	sort.SliceStable(q.selectSets, func(i, j int) bool {
-		return q.selectSets[i] < q.selectSets[j]
-	})
+	// add observation sets, in hex as in set links
 	for i := range q.selectSets {
-		out += fmt.Sprintf("&set=%d", q.selectSets[i])
+		out += fmt.Sprintf("&set=%s", SetID(q.selectSets[i]))
 	}
 
-	// add sorted path elements
-	sort.SliceStable(q.selectOnPath, func(i, j int) bool {
-		return q.selectOnPath[i] < q.selectOnPath[j]
-	})
+	// add selections
 	for i := range q.selectOnPath {
 		out += fmt.Sprintf("&on_path=%s", q.selectOnPath[i])
 	}
-
-	// add sorted sources
-	sort.SliceStable(q.selectSources, func(i, j int) bool {
-		return q.selectSources[i] < q.selectSources[j]
-	})
 	for i := range q.selectSources {
 		out += fmt.Sprintf("&source=%s", q.selectSources[i])
 	}
-
-	// add sorted targets
-	sort.SliceStable(q.selectTargets, func(i, j int) bool {
-		return q.selectTargets[i] < q.selectTargets[j]
-	})
 	for i := range q.selectTargets {
 		out += fmt.Sprintf("&target=%s", q.selectTargets[i])
 	}
-
-	// add sorted conditions
-	sort.SliceStable(q.selectConditions, func(i, j int) bool {
-		return q.selectConditions[i].Name < q.selectConditions[j].Name
-	})
+	for i := range q.selectSourceCountries {
+		out += fmt.Sprintf("&source_country=%s", q.selectSourceCountries[i])
+	}
+	for i := range q.selectTargetCountries {
+		out += fmt.Sprintf("&target_country=%s", q.selectTargetCountries[i])
+	}
 	for i := range q.selectConditions {
 		out += fmt.Sprintf("&condition=%s", q.selectConditions[i].Name)
 	}
-
-	// add sorted features
-	sort.SliceStable(q.selectFeatures, func(i, j int) bool {
-		return q.selectFeatures[i] < q.selectFeatures[j]
-	})
 	for i := range q.selectFeatures {
 		out += fmt.Sprintf("&feature=%s", q.selectFeatures[i])
 	}
-
-	// add sorted aspects
-	sort.SliceStable(q.selectAspects, func(i, j int) bool {
-		return q.selectAspects[i] < q.selectAspects[j]
-	})
 	for i := range q.selectAspects {
 		out += fmt.Sprintf("&aspect=%s", q.selectAspects[i])
 	}
-
-	// add sorted values
-	sort.SliceStable(q.selectValues, func(i, j int) bool {
-		return q.selectValues[i] < q.selectValues[j]
-	})
 	for i := range q.selectValues {
 		out += fmt.Sprintf("&value=%s", q.selectValues[i])
 	}
+	for i := range q.selectValuesGT {
+		out += fmt.Sprintf("&value_gt=%s", q.selectValuesGT[i])
+	}
+	for i := range q.selectValuesLT {
+		out += fmt.Sprintf("&value_lt=%s", q.selectValuesLT[i])
+	}
+	for i := range q.selectValuesNE {
+		out += fmt.Sprintf("&value_ne=%s", q.selectValuesNE[i])
+	}
+	for i := range q.selectMetadata {
+		out += fmt.Sprintf("&meta=%s", url.QueryEscape(q.selectMetadata[i].String()))
+	}
 
-	// add sorted groups
-	sort.SliceStable(q.groups, func(i, j int) bool {
-		return q.groups[i].URLEncoded() < q.groups[j].URLEncoded()
-	})
+	// add groups
 	for i := range q.groups {
 		out += fmt.Sprintf("&group=%s", q.groups[i].URLEncoded())
 	}
 
+	// add time zone
+	if q.timeZone != "" {
+		out += fmt.Sprintf("&tz=%s", url.QueryEscape(q.timeZone))
+	}
+
+	// add visibility restriction and owner
+	if q.visibleTag != "" {
+		out += fmt.Sprintf("&visible_tag=%s", url.QueryEscape(q.visibleTag))
+	}
+	if q.owner != "" {
+		out += fmt.Sprintf("&owner=%s", url.QueryEscape(q.owner))
+	}
+
 	// add options
 	if q.optionSetsOnly {
 		out += "&option=sets_only"
 	}
-	if q.optionCountDistinctTargets {
-		out += "&option=count_targets"
+	if q.optionCountDistinct != "" {
+		out += "&option=" + q.optionCountDistinct
+	}
+	if q.optionIncludeDeprecated {
+		out += "&option=include_deprecated"
+	}
+	if q.optionSample > 0 {
+		out += fmt.Sprintf("&option=sample:%d", q.optionSample)
+	}
+	if q.optionDateLabels {
+		out += "&option=date_labels"
 	}
 
 	return out
@@ -652,8 +1104,30 @@ func (q *Query) generateIdentifier() {
 	q.Identifier = hex.EncodeToString(hashbytes[:])
 }
 
+// executeIfNewOrRepinned executes a submitted query and does an immediate wait
+// for it if it is new, or if it was resubmitted with the repin option and can
+// be executed again; in the latter case, it is pinned to the observation sets
+// it covers now.
+func (q *Query) executeIfNewOrRepinned(new bool, done chan struct{}) {
+	if new {
+		q.ExecuteWaitImmediate(done)
+	} else if q.repin && q.reexecutable() {
+		q.pins = nil
+		q.ExecuteWaitImmediate(done)
+	} else {
+		close(done)
+	}
+}
+
+// reexecutable returns true if this query may be executed again: it is
+// neither executing nor permanent.
+func (q *Query) reexecutable() bool {
+	executing := q.Executed != nil && q.Completed == nil
+	return !executing && q.ExtRef == ""
+}
+
 func (q *Query) generateSources() error {
-	if len(q.selectSets) > 0 {
+	if len(q.selectSets) > 0 && q.visibleTag == "" {
 		// Sets specified in query. Let's just use them.
 		q.Sources = q.selectSets
 	} else {
@@ -666,8 +1140,12 @@ func (q *Query) generateSources() error {
 	return nil
 }
 
+// ResultRowCount returns the number of rows in this query's result. The count
+// is recorded when the query executes; for queries executed by previous
+// versions, it is counted by scanning the result file once, and then
+// recorded.
 func (q *Query) ResultRowCount() int {
-	if q.resultRowCount > 0 {
+	if q.resultRowCountKnown {
 		return q.resultRowCount
 	}
 
@@ -682,21 +1160,107 @@ func (q *Query) ResultRowCount() int {
 	}
 	defer resultFile.Close()
 
-	q.resultRowCount = 0
+	rows := 0
 	resultScanner := bufio.NewScanner(resultFile)
 	for resultScanner.Scan() {
-		q.resultRowCount++
+		rows++
+	}
+
+	q.setResultRowCount(rows)
+	if err := q.flushColumns("result_rows"); err != nil {
+		log.Printf("cannot record row count for query %s: %v", q.Identifier, err)
 	}
 
 	return q.resultRowCount
 }
 
+// setResultRowCount records the number of rows in this query's result.
+func (q *Query) setResultRowCount(rows int) {
+	q.resultRowCount = rows
+	q.resultRowCountKnown = true
+}
+
 // ResultLink generates a link to the file containing query results.
 func (q *Query) ResultLink() string {
 	link, _ := q.qc.config.LinkTo(fmt.Sprintf("query/%s/result", q.Identifier))
 	return link
 }
 
+// pinSources pins this query to the observation sets it covers, at their
+// current modification times, if it is not yet pinned. Otherwise, it checks
+// that none of the pinned sets has been modified or removed since, so that
+// executing the query again reproduces its results.
+func (q *Query) pinSources() error {
+	if q.pins == nil {
+		if err := q.generateSources(); err != nil {
+			return err
+		}
+
+		sets, err := q.selectSourceSets(q.Sources)
+		if err != nil {
+			return err
+		}
+
+		q.pins = make([]QuerySource, len(sets))
+		q.Sources = make([]int, len(sets))
+		for i := range sets {
+			q.pins[i] = QuerySource{SetID: sets[i].ID, Modified: sets[i].Modified}
+			q.Sources[i] = sets[i].ID
+		}
+		return nil
+	}
+
+	setIds := q.pinnedSetIDs()
+	sets, err := q.selectSourceSets(setIds)
+	if err != nil {
+		return err
+	}
+
+	modified := make(map[int]*time.Time)
+	for i := range sets {
+		modified[sets[i].ID] = sets[i].Modified
+	}
+
+	for _, pin := range q.pins {
+		mtime, ok := modified[pin.SetID]
+		if !ok || (mtime == nil) != (pin.Modified == nil) || (mtime != nil && !mtime.Equal(*pin.Modified)) {
+			return PTOErrorf("observation set %x has changed since query %s was pinned to it; resubmit with option=repin to refresh", pin.SetID, q.Identifier)
+		}
+	}
+
+	q.Sources = setIds
+	return nil
+}
+
+// pinnedSetIDs returns the IDs of the observation sets this query is pinned to.
+func (q *Query) pinnedSetIDs() []int {
+	out := make([]int, len(q.pins))
+	for i := range q.pins {
+		out[i] = q.pins[i].SetID
+	}
+	return out
+}
+
+// selectSourceSets selects the IDs and modification times of the observation
+// sets with the given IDs, sorted by ID.
+func (q *Query) selectSourceSets(setIds []int) ([]ObservationSet, error) {
+	var sets []ObservationSet
+	if len(setIds) == 0 {
+		return sets, nil
+	}
+
+	err := q.execDB.Model(&sets).
+		Column("id", "modified").
+		Where("id IN (?)", pg.In(setIds)).
+		Order("id").
+		Select()
+	if err != nil && err != pg.ErrNoRows {
+		return nil, PTOWrapError(err)
+	}
+
+	return sets, nil
+}
+
 // SourceLinks generates links to the observation sets contributing to this query
 func (q *Query) SourceLinks() []string {
 	out := make([]string, len(q.Sources))
@@ -707,16 +1271,24 @@ func (q *Query) SourceLinks() []string {
 }
 
 func (q *Query) modificationTime() *time.Time {
-	fi, err := q.qc.statMetadataFile(q.Identifier)
-	if err != nil {
+	if q.modified == nil {
 		return q.Submitted
-	} else {
-		mt := fi.ModTime()
-		return &mt
 	}
+	return q.modified
 }
 
 func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
+	jobj, err := q.jsonObject(toDisk)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jobj)
+}
+
+// jsonObject returns this query's metadata as a map to be marshaled to JSON,
+// as with DumpJSONObject.
+func (q *Query) jsonObject(toDisk bool) (map[string]interface{}, error) {
 
 	jobj := make(map[string]interface{})
 
@@ -734,6 +1306,11 @@ func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 		jobj["__created"] = q.Submitted.Format(time.RFC3339)
 	}
 
+	// Emit owner of private queries
+	if !toDisk && q.owner != "" {
+		jobj["__owner"] = q.owner
+	}
+
 	// Store/emit error
 	if q.ExecutionError != nil {
 		jobj["__error"] = q.ExecutionError.Error()
@@ -746,11 +1323,40 @@ func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 		}
 	}
 
+	// Store/emit relative time expressions used at submission
+	for _, k := range relativeTimeKeys {
+		if v, ok := q.Metadata[k]; ok {
+			jobj[k] = v
+		}
+	}
+
 	// Store/emit external reference
 	if q.ExtRef != "" {
 		jobj["_ext_ref"] = q.ExtRef
 	}
 
+	// Emit retention, and when results will be evicted
+	if !toDisk {
+		if d, ok := q.Retention(); ok {
+			jobj["__retention"] = formatRetention(d)
+		}
+		if expires, ok := q.Expires(); ok {
+			jobj["__expires"] = expires.UTC().Format(time.RFC3339)
+		}
+	}
+
+	// Emit sources this query is pinned to, and their modification times
+	if !toDisk && q.pins != nil {
+		sources := make([]string, len(q.pins))
+		modified := make(map[string]interface{}, len(q.pins))
+		for i, pin := range q.pins {
+			sources[i] = LinkForSetID(q.qc.config, pin.SetID)
+			modified[sources[i]] = pin.Modified
+		}
+		jobj["__sources"] = sources
+		jobj["__sources_modified"] = modified
+	}
+
 	// Now emit ancillary data if we're not storing to disk
 	if !toDisk {
 
@@ -767,24 +1373,142 @@ func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 		}
 
 		// state, result, and row count
+		jobj["__state"] = q.State()
 		if q.Completed != nil {
-			if q.ExecutionError != nil {
-				jobj["__state"] = "failed"
-			} else if q.ExtRef != "" {
-				jobj["__state"] = "permanent"
-				jobj["__result"] = jobj["__link"].(string) + "/result"
-				jobj["__row_count"] = q.ResultRowCount()
-			} else {
-				jobj["__state"] = "complete"
+			if q.ExecutionError == nil {
 				jobj["__result"] = jobj["__link"].(string) + "/result"
 				jobj["__row_count"] = q.ResultRowCount()
 			}
-		} else {
-			jobj["__state"] = "pending"
+		} else if q.Executed != nil {
+			jobj["__rows_so_far"] = q.rowsSoFar
 		}
 	}
 
-	return json.Marshal(jobj)
+	return jobj, nil
+}
+
+// State returns the state of this query as reported in its __state metadata:
+// pending, failed, permanent, or complete.
+func (q *Query) State() string {
+	if q.Completed == nil {
+		return "pending"
+	} else if q.ExecutionError != nil {
+		return "failed"
+	} else if q.ExtRef != "" {
+		return "permanent"
+	}
+	return "complete"
+}
+
+// IsGroupQuery returns true if this query groups observations, i.e. its
+// results are counts rather than observations or observation sets.
+func (q *Query) IsGroupQuery() bool {
+	return len(q.groups) > 0
+}
+
+// Owner returns the principal owning this query, or the empty string if it
+// is shared with all principals.
+func (q *Query) Owner() string {
+	return q.owner
+}
+
+// VisibleTo returns true if a principal may list and retrieve this query: it
+// is shared, or owned by the principal.
+func (q *Query) VisibleTo(principal string) bool {
+	return q.owner == "" || q.owner == principal
+}
+
+// VisibleTag returns the tag this query is restricted to observation sets
+// carrying, or the empty string if it covers all sets.
+func (q *Query) VisibleTag() string {
+	return q.visibleTag
+}
+
+// GroupDimensions returns the names of the dimensions this query groups
+// observations by, as given in its group parameters, in order; nil if it is
+// not a group query.
+func (q *Query) GroupDimensions() []string {
+	if len(q.groups) == 0 {
+		return nil
+	}
+	out := make([]string, len(q.groups))
+	for i := range q.groups {
+		out[i] = q.groups[i].URLEncoded()
+	}
+	return out
+}
+
+// groupResultRow splits a row of group query results, as returned in the
+// groups key by PaginateResultObject, into its group values and count.
+func (q *Query) groupResultRow(row interface{}) ([]interface{}, interface{}, error) {
+	cols, ok := row.([]interface{})
+	if !ok || len(cols) != len(q.groups)+1 {
+		return nil, nil, PTOErrorf("malformed group result row %v for query %s", row, q.Identifier)
+	}
+	return cols[:len(q.groups)], cols[len(q.groups)], nil
+}
+
+// GroupResultObjects converts rows of group query results, as returned in the
+// groups key by PaginateResultObject, to objects with the row's value in each
+// dimension in a group object keyed by dimension name, and its count in
+// count.
+func (q *Query) GroupResultObjects(rows []interface{}) ([]interface{}, error) {
+	dims := q.GroupDimensions()
+	if dims == nil {
+		return nil, PTOErrorf("query %s is not a group query", q.Identifier).StatusIs(http.StatusBadRequest)
+	}
+
+	out := make([]interface{}, len(rows))
+	for i := range rows {
+		vals, count, err := q.groupResultRow(rows[i])
+		if err != nil {
+			return nil, err
+		}
+		group := make(map[string]interface{})
+		for j := range dims {
+			group[dims[j]] = vals[j]
+		}
+		out[i] = map[string]interface{}{"group": group, "count": count}
+	}
+	return out, nil
+}
+
+// pivotKey returns a group value as a JSON object key.
+func pivotKey(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return tv
+	default:
+		return fmt.Sprint(tv)
+	}
+}
+
+// PivotGroupResults converts rows of two-dimensional group query results, as
+// returned in the groups key by PaginateResultObject, to an object keyed by
+// the value in the first dimension, each mapping the value in the second
+// dimension to the count.
+func (q *Query) PivotGroupResults(rows []interface{}) (map[string]interface{}, error) {
+	if len(q.groups) != 2 {
+		return nil, PTOErrorf("only queries grouped by two dimensions can be pivoted").StatusIs(http.StatusBadRequest)
+	}
+
+	out := make(map[string]interface{})
+	for i := range rows {
+		vals, count, err := q.groupResultRow(rows[i])
+		if err != nil {
+			return nil, err
+		}
+		k0 := pivotKey(vals[0])
+		inner, ok := out[k0].(map[string]interface{})
+		if !ok {
+			inner = make(map[string]interface{})
+			out[k0] = inner
+		}
+		inner[pivotKey(vals[1])] = count
+	}
+	return out, nil
 }
 
 func (q *Query) MarshalJSON() ([]byte, error) {
@@ -795,8 +1519,14 @@ func (q *Query) setMetadata(jmap map[string]string) {
 	// store external reference
 	q.ExtRef = jmap["_ext_ref"]
 
-	// copy and replace arbitrary metadata
+	// copy and replace arbitrary metadata, keeping relative time expressions
+	oldMetadata := q.Metadata
 	q.Metadata = make(map[string]string)
+	for _, k := range relativeTimeKeys {
+		if v, ok := oldMetadata[k]; ok {
+			q.Metadata[k] = v
+		}
+	}
 	for k := range jmap {
 		if !strings.HasPrefix(k, "__") && k != "_ext_ref" {
 			q.Metadata[k] = jmap[k]
@@ -867,18 +1597,32 @@ func (q *Query) Purge() error {
 	return q.qc.Purge(q.Identifier)
 }
 
+// FlushMetadata writes this query's external reference and arbitrary
+// metadata to the query cache.
 func (q *Query) FlushMetadata() error {
-	out, err := q.qc.writeMetadataFile(q.Identifier)
-	if err != nil {
-		return PTOWrapError(err)
-	}
+	t := time.Now()
+	q.modified = &t
 
-	b, err := q.DumpJSONObject(true)
-	if err != nil {
-		return PTOWrapError(err)
-	}
+	return q.flushColumns("ext_ref", "metadata", "modified")
+}
+
+// flushState writes this query's execution state to the query cache.
+func (q *Query) flushState() error {
+	t := time.Now()
+	q.modified = &t
+
+	return q.flushColumns("executed", "completed", "error", "rows_so_far", "result_rows", "stats", "sources", "modified")
+}
 
-	if _, err = out.Write(b); err != nil {
+// flushColumns writes the given columns of this query's record to the
+// database, leaving other columns, which may be concurrently updated by
+// another server, alone.
+func (q *Query) flushColumns(columns ...string) error {
+	_, err := q.qc.db.Model(q.record()).
+		Column(columns...).
+		Where("identifier = ?", q.Identifier).
+		Update()
+	if err != nil {
 		return PTOWrapError(err)
 	}
 
@@ -889,19 +1633,62 @@ func (qc *QueryCache) dataPath(identifier string) string {
 	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.ndjson", identifier))
 }
 
-func (q *Query) writeResultFile() (*os.File, error) {
-	return os.Create(q.qc.dataPath(q.Identifier))
+func (qc *QueryCache) partialDataPath(identifier string) string {
+	return qc.dataPath(identifier) + ".partial"
+}
+
+// writeResultFile creates this query's result file. The result is only
+// visible in the cache once the file has been committed.
+func (q *Query) writeResultFile() (*AtomicFile, error) {
+	return CreateAtomic(q.qc.dataPath(q.Identifier), 0644)
+}
+
+// writePartialResultFile creates this query's result file, written via a
+// partial result file which can be read while the query executes.
+func (q *Query) writePartialResultFile() (*AtomicFile, error) {
+	return CreateAtomicVia(q.qc.dataPath(q.Identifier), q.qc.partialDataPath(q.Identifier), 0644)
+}
+
+// commitResultFile commits this query's result file, records its row count,
+// and indexes it for pagination. Failure to index is not fatal, as
+// pagination will attempt to index the result again when it is read.
+func (q *Query) commitResultFile(outfile *AtomicFile, rows int) error {
+	// an index for a previous result would be wrong for this one
+	if err := os.Remove(q.qc.indexPath(q.Identifier)); err != nil && !os.IsNotExist(err) {
+		return PTOWrapError(err)
+	}
+
+	if err := outfile.Commit(); err != nil {
+		return err
+	}
+
+	q.setResultRowCount(rows)
+
+	if err := q.qc.indexResultFile(q.Identifier); err != nil {
+		log.Printf("cannot index result file for query %s: %v", q.Identifier, err)
+	}
+
+	return nil
 }
 
 func (q *Query) ReadResultFile() (*os.File, error) {
 	return os.Open(q.qc.dataPath(q.Identifier))
 }
 
-func (q *Query) PaginateResultObject(offset int, count int) (map[string]interface{}, bool, error) {
+// RowsSoFar returns the number of result rows available to
+// PaginatePartialResultObject while this query executes.
+func (q *Query) RowsSoFar() int {
+	return q.rowsSoFar
+}
 
-	// create output object
-	outData := make([]interface{}, 0)
+// recordProgress notes that a number of result rows have been written to the
+// partial result file, making them available to readers of this query.
+func (q *Query) recordProgress(rows int) error {
+	q.rowsSoFar += rows
+	return q.flushColumns("rows_so_far")
+}
 
+func (q *Query) PaginateResultObject(offset int, count int) (map[string]interface{}, bool, error) {
 	// open result file
 	resultFile, err := q.ReadResultFile()
 	if err != nil {
@@ -909,10 +1696,58 @@ func (q *Query) PaginateResultObject(offset int, count int) (map[string]interfac
 	}
 	defer resultFile.Close()
 
+	// use the index to seek directly to the requested page, falling back to
+	// scanning the result file from the top if it cannot be indexed
+	idx, err := q.qc.openResultIndex(q.Identifier)
+	if err != nil {
+		log.Printf("cannot read result index for query %s, scanning: %v", q.Identifier, err)
+		return q.paginateResultStream(resultFile, offset, count, -1)
+	}
+	defer idx.Close()
+
+	ok, err := seekResultLine(resultFile, idx, offset)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		out := make(map[string]interface{})
+		out[q.resultObjectLabel()] = make([]interface{}, 0)
+		return out, false, nil
+	}
+
+	return q.paginateResultStream(resultFile, 0, count, -1)
+}
+
+// PaginatePartialResultObject paginates the results written so far by an
+// executing query, as with PaginateResultObject. Only the first RowsSoFar
+// rows are read.
+func (q *Query) PaginatePartialResultObject(offset int, count int) (map[string]interface{}, bool, error) {
+	resultFile, err := os.Open(q.qc.partialDataPath(q.Identifier))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, PTOErrorf("no partial results available for query %s", q.Identifier).StatusIs(http.StatusNotFound)
+		}
+		return nil, false, PTOWrapError(err)
+	}
+	defer resultFile.Close()
+
+	return q.paginateResultStream(resultFile, offset, count, q.rowsSoFar)
+}
+
+// paginateResultStream reads a page of results from a stream, reading at
+// most limit lines if limit is not negative.
+func (q *Query) paginateResultStream(in io.Reader, offset int, count int, limit int) (map[string]interface{}, bool, error) {
+
+	// create output object
+	outData := make([]interface{}, 0)
+
 	// attempt to seek to offset
 	lineno := 0
-	resultScanner := bufio.NewScanner(resultFile)
+	resultScanner := bufio.NewScanner(in)
 	for resultScanner.Scan() {
+		if limit >= 0 && lineno >= limit {
+			break
+		}
 		lineno++
 
 		if offset >= lineno {
@@ -950,6 +1785,27 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 		})
 	}
 
+	// sets this query is pinned to
+	if q.pins != nil {
+		if len(q.pins) == 0 {
+			pq = pq.Where("FALSE")
+		} else {
+			pq = pq.Where("set_id IN (?)", pg.In(q.pinnedSetIDs()))
+		}
+	}
+
+	// sets visible to the submitter
+	if q.visibleTag != "" {
+		pq = pq.Where("set_id IN (SELECT id FROM observation_sets WHERE tags @> ?::text[])",
+			pg.Array([]string{q.visibleTag}))
+	}
+
+	// deprecated and superseded sets, unless requested
+	if !q.optionIncludeDeprecated {
+		pq = pq.Where("set_id NOT IN (SELECT id FROM observation_sets WHERE state IN (?, ?))",
+			ObsSetStateDeprecated, ObsSetStateSuperseded)
+	}
+
 	// conditions
 	if len(q.selectConditions) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
@@ -990,6 +1846,22 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 		})
 	}
 
+	// value ranges and exclusions; all must match
+	for _, val := range q.selectValuesGT {
+		pq = valueComparisonClause(pq, ">", val)
+	}
+	for _, val := range q.selectValuesLT {
+		pq = valueComparisonClause(pq, "<", val)
+	}
+	for _, val := range q.selectValuesNE {
+		pq = valueComparisonClause(pq, "IS DISTINCT FROM", val)
+	}
+
+	// per-observation metadata; all filters must match
+	for i := range q.selectMetadata {
+		pq = q.selectMetadata[i].whereClause(pq)
+	}
+
 	// source
 	if len(q.selectSources) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
@@ -1010,6 +1882,16 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 		})
 	}
 
+	// source country
+	if len(q.selectSourceCountries) > 0 {
+		pq = pq.Where("path.source_country IN (?)", pg.In(q.selectSourceCountries))
+	}
+
+	// target country
+	if len(q.selectTargetCountries) > 0 {
+		pq = pq.Where("path.target_country IN (?)", pg.In(q.selectTargetCountries))
+	}
+
 	// on path
 	if len(q.selectOnPath) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
@@ -1023,28 +1905,119 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 	return pq
 }
 
+// queryResultBatchSize is the number of observations selected at a time by
+// an observation query.
+const queryResultBatchSize = 10000
+
 // selectAndStoreObservations selects observations from this query and dumps
 // them to the data file for this query as an NDJSON observation file.
+// Observations are selected in batches sorted by start time, and each batch
+// is made available in the partial result file as soon as it is written.
 func (q *Query) selectAndStoreObservations() error {
-	var obsdat []Observation
-
-	pq := q.qc.db.Model(&obsdat).Column("observation.*", "Condition", "Path")
-	pq = q.whereClauses(pq)
-	if err := pq.Select(); err != nil {
-		return PTOWrapError(err)
+	outfile, err := q.writePartialResultFile()
+	if err != nil {
+		return err
 	}
+	defer outfile.Abort()
 
-	outfile, err := q.writeResultFile()
+	rows, err := q.selectAndWriteObservations(outfile, q.recordProgress)
 	if err != nil {
 		return err
 	}
-	defer outfile.Close()
 
-	if err := WriteObservations(obsdat, outfile); err != nil {
-		return err
+	return q.commitResultFile(outfile, rows)
+}
+
+// selectAndWriteObservations selects observations from this query and
+// writes them to a writer as an NDJSON observation file, in batches sorted by
+// start time, calling progress with the number of rows in each batch after
+// it is written and flushed. It returns the number of rows written.
+func (q *Query) selectAndWriteObservations(out io.Writer, progress func(rows int) error) (int, error) {
+	ow := NewObservationWriter(out)
+
+	// fix the sample, if any, before selecting in batches
+	var sampleIDs []int
+	if q.optionSample > 0 {
+		var err error
+		if sampleIDs, err = q.selectSampleIDs(); err != nil {
+			return 0, err
+		}
+		if len(sampleIDs) == 0 {
+			return 0, nil
+		}
+	}
+
+	rows := 0
+	var last *Observation
+	for {
+		var obsdat []Observation
+
+		pq := q.observationBatchQuery(q.execDB, &obsdat, last)
+		if sampleIDs != nil {
+			pq = pq.Where("observation.id IN (?)", pg.In(sampleIDs))
+		}
+		if err := pq.Select(); err != nil {
+			return 0, PTOWrapError(err)
+		}
+
+		if err := ow.WriteObservations(obsdat); err != nil {
+			return 0, err
+		}
+		if err := ow.Flush(); err != nil {
+			return 0, err
+		}
+		rows += len(obsdat)
+		if progress != nil {
+			if err := progress(len(obsdat)); err != nil {
+				return 0, err
+			}
+		}
+
+		if len(obsdat) < queryResultBatchSize {
+			break
+		}
+		last = &obsdat[len(obsdat)-1]
+	}
+
+	return rows, nil
+}
+
+// observationBatchQuery builds the statement selecting the batch of
+// observations responding to this query following the given observation, or
+// the first batch if last is nil, into a model.
+func (q *Query) observationBatchQuery(db orm.DB, model interface{}, last *Observation) *orm.Query {
+	pq := db.Model(model).Column("observation.*", "Condition", "Path")
+	pq = q.whereClauses(pq)
+	if last != nil {
+		pq = pq.Where("(observation.time_start, observation.id) > (?, ?)", last.TimeStart, last.ID)
+	}
+	return pq.Order("observation.time_start", "observation.id").Limit(queryResultBatchSize)
+}
+
+// selectSampleIDs selects the IDs of a uniform random sample of the
+// observations responding to this query, of the size given by the sample
+// option, or of all of them if there are fewer.
+func (q *Query) selectSampleIDs() ([]int, error) {
+	var ids []int
+
+	if err := q.sampleIDsQuery(q.execDB).Select(&ids); err != nil {
+		return nil, PTOWrapError(err)
 	}
 
-	return outfile.Sync()
+	return ids, nil
+}
+
+// sampleIDsQuery builds the statement selecting the IDs of a random sample
+// of observations responding to this query.
+func (q *Query) sampleIDsQuery(db orm.DB) *orm.Query {
+	pq := db.Model((*Observation)(nil)).ColumnExpr("observation.id")
+	if len(q.selectFeatures) > 0 || len(q.selectAspects) > 0 {
+		pq = joinGroupExtTable(pq, "conditions")
+	}
+	if q.selectsOnPath() {
+		pq = joinGroupExtTable(pq, "paths")
+	}
+	return q.whereClauses(pq).OrderExpr("random()").Limit(q.optionSample)
 }
 
 // selectObservationSetIDs selects observation set IDs responding to
@@ -1052,36 +2025,66 @@ func (q *Query) selectAndStoreObservations() error {
 func (q *Query) selectObservationSetIDs() ([]int, error) {
 	var setids []int
 
-	pq := q.qc.db.Model(&setids).ColumnExpr("DISTINCT set_id")
-	pq = q.whereClauses(pq)
-	if err := pq.Select(); err != nil {
+	if err := q.observationSetIDsQuery(q.execDB).Select(&setids); err != nil {
 		return nil, PTOWrapError(err)
 	}
 
+	sort.Ints(setids)
 	return setids, nil
 }
 
+// observationSetIDsQuery builds the statement selecting the IDs of
+// observation sets responding to this query.
+func (q *Query) observationSetIDsQuery(db orm.DB) *orm.Query {
+	pq := db.Model((*Observation)(nil)).ColumnExpr("DISTINCT set_id")
+	if len(q.selectFeatures) > 0 || len(q.selectAspects) > 0 {
+		pq = joinGroupExtTable(pq, "conditions")
+	}
+	if q.selectsOnPath() {
+		pq = joinGroupExtTable(pq, "paths")
+	}
+	return q.whereClauses(pq)
+}
+
 // selectAndStoreObservationSetIDs selects observation set IDs responding to
 // this query and dumps them to the data file as NDJSON: one URL per line.
 func (q *Query) selectAndStoreObservationSetLinks() error {
+	return q.selectAndStore(q.selectAndWriteObservationSetLinks)
+}
+
+// selectAndWriteObservationSetLinks selects observation set IDs responding
+// to this query and writes links to them to a writer as NDJSON, returning the
+// number of rows written.
+func (q *Query) selectAndWriteObservationSetLinks(out io.Writer) (int, error) {
 	setids, err := q.selectObservationSetIDs()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	for _, setid := range setids {
+		if _, err := fmt.Fprintf(out, "\"%s\"\n", LinkForSetID(q.qc.config, setid)); err != nil {
+			return 0, PTOWrapError(err)
+		}
+	}
+
+	return len(setids), nil
+}
+
+// selectAndStore writes this query's result file using a function writing
+// the result to a writer, and commits it.
+func (q *Query) selectAndStore(write func(out io.Writer) (int, error)) error {
 	outfile, err := q.writeResultFile()
 	if err != nil {
 		return err
 	}
-	defer outfile.Close()
+	defer outfile.Abort()
 
-	for _, setid := range setids {
-		if _, err := fmt.Fprintf(outfile, "\"%s\"\n", LinkForSetID(q.qc.config, setid)); err != nil {
-			return err
-		}
+	rows, err := write(outfile)
+	if err != nil {
+		return err
 	}
 
-	return outfile.Sync()
+	return q.commitResultFile(outfile, rows)
 }
 
 func joinGroupExtTable(q *orm.Query, extTable string) *orm.Query {
@@ -1097,134 +2100,179 @@ func joinGroupExtTable(q *orm.Query, extTable string) *orm.Query {
 	}
 }
 
-func (q *Query) selectAndStoreOneGroup() error {
+// valueNumericRegexp matches observation values and query parameters which
+// can be compared numerically.
+var valueNumericRegexp = regexp.MustCompile(metadataNumericPattern)
 
-	var results []struct {
-		tableName struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
-		Group0    string
-		Count     int
+// valueComparisonClause adds a WHERE clause comparing observation values to a
+// given value with an operator. If the given value is numeric, the comparison
+// is numeric, and observations with non-numeric values are never greater or
+// less than it; otherwise values are compared as strings.
+func valueComparisonClause(pq *orm.Query, op string, val string) *orm.Query {
+	if valueNumericRegexp.MatchString(val) {
+		return pq.Where("(CASE WHEN value ~ '"+metadataNumericPattern+"' THEN value::numeric END) "+op+" ?::numeric", val)
 	}
+	return pq.Where("value "+op+" ?", val)
+}
 
-	var countClause string
-	if q.optionCountDistinctTargets {
-		countClause = "count(distinct path.target)"
-	} else {
-		countClause = "count(*)"
+// selectsOnPath returns true if this query selects observations by properties
+// of their paths, and therefore needs paths joined.
+func (q *Query) selectsOnPath() bool {
+	return len(q.selectSources) > 0 || len(q.selectTargets) > 0 || len(q.selectOnPath) > 0 ||
+		len(q.selectSourceCountries) > 0 || len(q.selectTargetCountries) > 0
+}
+
+// countClause returns the expression counting the members of each group in
+// this query: distinct values of a column if a count option is given, and
+// observations otherwise.
+func (q *Query) countClause() string {
+	if column, ok := queryCountOptions[q.optionCountDistinct]; ok {
+		return "count(distinct " + column + ")"
 	}
+	return "count(*)"
+}
 
-	pq := q.qc.db.Model(&results).ColumnExpr(q.groups[0].ColumnSpec() + " as group0, " + countClause)
+// countsOnPath returns true if this query counts distinct properties of
+// paths, and therefore needs paths joined.
+func (q *Query) countsOnPath() bool {
+	return strings.HasPrefix(queryCountOptions[q.optionCountDistinct], "path.")
+}
 
-	// add join clause if necessary
-	joinedPaths := false
-	if q.optionCountDistinctTargets {
-		pq = joinGroupExtTable(pq, "paths")
-		joinedPaths = true
+// joinGroupTables joins the tables needed by this query's groups, and by the
+// count_targets and count_sources options, to a query.
+func (q *Query) joinGroupTables(pq *orm.Query) *orm.Query {
+	extTableSet := make(map[string]struct{})
+	if q.countsOnPath() || q.selectsOnPath() {
+		extTableSet["paths"] = struct{}{}
 	}
 
-	sgs, ok := q.groups[0].(*SimpleGroupSpec)
-	if ok && sgs.ExtTable != "" {
-		if sgs.ExtTable != "paths" || !joinedPaths {
-			pq = joinGroupExtTable(pq, sgs.ExtTable)
+	var joins []string
+	joinSet := make(map[string]struct{})
+	for _, gs := range q.groups {
+		jgs, ok := gs.(JoiningGroupSpec)
+		if !ok {
+			continue
+		}
+		for _, extTable := range jgs.ExtTables() {
+			extTableSet[extTable] = struct{}{}
+		}
+		for _, join := range jgs.Joins() {
+			if _, ok := joinSet[join]; !ok {
+				joinSet[join] = struct{}{}
+				joins = append(joins, join)
+			}
 		}
 	}
 
-	// now group
-	pq = q.whereClauses(pq).Group("group0")
-	if err := pq.Select(); err != nil {
-		return PTOWrapError(err)
+	for _, extTable := range []string{"conditions", "paths"} {
+		if _, ok := extTableSet[extTable]; ok {
+			pq = joinGroupExtTable(pq, extTable)
+		}
 	}
 
-	outfile, err := q.writeResultFile()
-	if err != nil {
-		return err
+	for _, join := range joins {
+		pq = pq.Join(join)
 	}
-	defer outfile.Close()
 
-	for _, result := range results {
-		out := make([]interface{}, 2)
-		out[0] = result.Group0
-		out[1] = result.Count
-
-		b, err := json.Marshal(out)
-		if err != nil {
-			return PTOWrapError(err)
-		}
+	return pq
+}
 
-		if _, err := fmt.Fprintf(outfile, "%s\n", b); err != nil {
-			return PTOWrapError(err)
-		}
-	}
+// oneGroupResult is a row of the result of a group query with one
+// dimension.
+type oneGroupResult struct {
+	tableName struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
+	Group0    string
+	Count     int
+}
 
-	return outfile.Sync()
+// twoGroupResult is a row of the result of a group query with two
+// dimensions.
+type twoGroupResult struct {
+	tableName struct{} `sql:"observations,alias:observation"`
+	Group0    string
+	Group1    string
+	Count     int
 }
 
-func (q *Query) selectAndStoreTwoGroups() error {
+// groupQuery builds the statement selecting the groups responding to this
+// query into a model, a pointer to a slice of oneGroupResult or
+// twoGroupResult according to the number of groups.
+func (q *Query) groupQuery(db orm.DB, model interface{}) *orm.Query {
+	countClause := q.countClause()
 
-	var results []struct {
-		tableName struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
-		Group0    string
-		Group1    string
-		Count     int
+	var pq *orm.Query
+	if len(q.groups) == 1 {
+		pq = db.Model(model).ColumnExpr(q.groups[0].ColumnSpec() + " as group0, " + countClause)
+	} else {
+		pq = db.Model(model).ColumnExpr(
+			q.groups[0].ColumnSpec() + " as group0, " +
+				q.groups[1].ColumnSpec() + "as group1, " + countClause)
 	}
 
-	var countClause string
-	if q.optionCountDistinctTargets {
-		countClause = "count(distinct path.target)"
-	} else {
-		countClause = "count(*)"
+	// add join clauses if necessary
+	pq = q.joinGroupTables(pq)
+
+	// now group
+	pq = q.whereClauses(pq).Group("group0")
+	if len(q.groups) > 1 {
+		pq = pq.Group("group1")
 	}
+	return pq
+}
 
-	pq := q.qc.db.Model(&results).ColumnExpr(
-		q.groups[0].ColumnSpec() + " as group0, " +
-			q.groups[1].ColumnSpec() + "as group1, " + countClause)
+func (q *Query) selectAndWriteOneGroup(out io.Writer) (int, error) {
 
-	// now join as necessary
-	extTableSet := make(map[string]struct{})
+	var results []oneGroupResult
 
-	if q.optionCountDistinctTargets {
-		extTableSet["paths"] = struct{}{}
+	pq := q.groupQuery(q.execDB, &results)
+	if err := pq.Select(); err != nil {
+		return 0, PTOWrapError(err)
 	}
 
-	for i := 0; i < 2; i++ {
-		sgs, ok := q.groups[i].(*SimpleGroupSpec)
-		if ok && sgs.ExtTable != "" {
-			extTableSet[sgs.ExtTable] = struct{}{}
+	for _, result := range results {
+		row := make([]interface{}, 2)
+		row[0] = result.Group0
+		row[1] = result.Count
+
+		b, err := json.Marshal(row)
+		if err != nil {
+			return 0, PTOWrapError(err)
+		}
+
+		if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+			return 0, PTOWrapError(err)
 		}
 	}
 
-	for k := range extTableSet {
-		pq = joinGroupExtTable(pq, k)
-	}
+	return len(results), nil
+}
 
-	// and group
-	pq = q.whereClauses(pq).Group("group0").Group("group1")
-	if err := pq.Select(); err != nil {
-		return PTOWrapError(err)
-	}
+func (q *Query) selectAndWriteTwoGroups(out io.Writer) (int, error) {
 
-	outfile, err := q.writeResultFile()
-	if err != nil {
-		return err
+	var results []twoGroupResult
+
+	pq := q.groupQuery(q.execDB, &results)
+	if err := pq.Select(); err != nil {
+		return 0, PTOWrapError(err)
 	}
-	defer outfile.Close()
 
 	for _, result := range results {
-		out := make([]interface{}, 3)
-		out[0] = result.Group0
-		out[1] = result.Group1
-		out[2] = result.Count
+		row := make([]interface{}, 3)
+		row[0] = result.Group0
+		row[1] = result.Group1
+		row[2] = result.Count
 
-		b, err := json.Marshal(out)
+		b, err := json.Marshal(row)
 		if err != nil {
-			return PTOWrapError(err)
+			return 0, PTOWrapError(err)
 		}
 
-		if _, err := fmt.Fprintf(outfile, "%s\n", b); err != nil {
-			return PTOWrapError(err)
+		if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+			return 0, PTOWrapError(err)
 		}
 	}
 
-	return outfile.Sync()
+	return len(results), nil
 }
 
 // selectAndStoreGroups selects groups responding to this query and dumps them
@@ -1232,15 +2280,22 @@ func (q *Query) selectAndStoreTwoGroups() error {
 // with elements 0 to n-1 being group names, and element n being the count of
 // observations in the group.
 func (q *Query) selectAndStoreGroups() error {
+	return q.selectAndStore(q.selectAndWriteGroups)
+}
+
+// selectAndWriteGroups selects groups responding to this query and writes
+// them to a writer in the same format as selectAndStoreGroups, returning the
+// number of rows written.
+func (q *Query) selectAndWriteGroups(out io.Writer) (int, error) {
 	switch len(q.groups) {
 	case 0:
-		panic("Programmer error: Query.selectAndStoreGroups() called on a non-group query")
+		panic("Programmer error: Query.selectAndWriteGroups() called on a non-group query")
 	case 1:
-		return q.selectAndStoreOneGroup()
+		return q.selectAndWriteOneGroup(out)
 	case 2:
-		return q.selectAndStoreTwoGroups()
+		return q.selectAndWriteTwoGroups(out)
 	default:
-		return PTOErrorf("Group by more than two dimensions not presently supported").StatusIs(http.StatusBadRequest)
+		return 0, PTOErrorf("Group by more than two dimensions not presently supported").StatusIs(http.StatusBadRequest)
 	}
 }
 
@@ -1265,11 +2320,17 @@ func (q *Query) resultObjectLabel() string {
 }
 
 func (q *Query) ExecuteWaitImmediate(done chan struct{}) {
+	q.ExecuteWaitImmediateContext(context.Background(), done)
+}
+
+// ExecuteWaitImmediateContext works like ExecuteWaitImmediate, but executes
+// the query as with ExecuteContext.
+func (q *Query) ExecuteWaitImmediateContext(ctx context.Context, done chan struct{}) {
 	// start the immediate delay timer
 	itimer := time.NewTimer(time.Duration(q.qc.config.ImmediateQueryDelay) * time.Millisecond)
 
 	// start the query
-	q.Execute(done)
+	q.ExecuteContext(ctx, done)
 
 	// wait for either the done timer or the immediate timer
 	select {
@@ -1279,32 +2340,169 @@ func (q *Query) ExecuteWaitImmediate(done chan struct{}) {
 }
 
 func (q *Query) Execute(done chan struct{}) {
+	q.ExecuteContext(context.Background(), done)
+}
+
+// ExecuteContext executes this query in the background, closing done when
+// execution completes. Statements executed for the query are cancelled when
+// the given context is done, in which case the query fails with the
+// context's error. Since execution outlives the request which submitted the
+// query, callers should not pass a request's context here; the trace context
+// of the submitting request is followed regardless.
+func (q *Query) ExecuteContext(ctx context.Context, done chan struct{}) {
+	parent := ctx
+	if q.traceCtx != nil && !trace.SpanContextFromContext(ctx).IsValid() {
+		parent = trace.ContextWithSpan(ctx, trace.SpanFromContext(q.traceCtx))
+	}
+
 	// fire off a goroutine to actually run the query
 	go func() {
+		// and notify that we're done
+		defer close(done)
+
+		// trace execution, including the wait for a token
+		ctx, span := Tracer().Start(parent, "query.execute",
+			trace.WithAttributes(attribute.String("pto.query", q.Identifier)))
+		defer span.End()
+
+		// queue for a token, so that operators can see and cancel the query
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		qe := q.qc.queue.enqueue(q.Identifier, cancel)
+		defer q.qc.queue.remove(qe)
+
 		// grab a token
-		q.qc.exectokens <- struct{}{}
+		tok, err := q.qc.acquireExecutionToken(ctx, qe)
+		if err != nil {
+			log.Printf("cannot acquire execution token for query %s: %v", q.Identifier, err)
+			span.SetStatus(codes.Error, err.Error())
+			if q.qc.queue.wasCancelled(qe) {
+				q.failCancelled()
+			}
+			return
+		}
+		defer tok.release()
+		q.qc.queue.start(qe)
 
 		// mark query as executing
 		startTime := time.Now()
 		q.Executed = &startTime
+		q.Completed = nil
+		q.ExecutionError = nil
+		q.rowsSoFar = 0
+		q.resultRowCountKnown = false
+		q.stats = nil
+
+		// flush to database
+		if err := q.flushState(); err != nil {
+			log.Printf("cannot flush state for query %s: %v", q.Identifier, err)
+		}
 
-		// flush to disk
-		q.FlushMetadata()
-
-		// switch and run query
-		q.ExecutionError = q.executionFunc()()
+		// switch, pin, and run query, recording statistics if enabled
+		var qsh *queryStatsHook
+		q.execDB, qsh = q.executionDB(ctx)
+		q.ExecutionError = q.pinSources()
+		if q.ExecutionError == nil {
+			q.ExecutionError = q.executionFunc()()
+		}
+		if q.ExecutionError != nil {
+			span.RecordError(q.ExecutionError)
+			span.SetStatus(codes.Error, q.ExecutionError.Error())
+		}
+		if q.ExecutionError != nil && q.qc.queue.wasCancelled(qe) {
+			q.ExecutionError = errQueryCancelled
+		}
+		if qsh != nil {
+			q.stats = qsh.statistics()
+		}
 
 		// mark query as done
 		endTime := time.Now()
 		q.Completed = &endTime
 
-		// flush to disk
-		q.FlushMetadata()
+		// flush to database
+		if err := q.flushState(); err != nil {
+			log.Printf("cannot flush state for query %s: %v", q.Identifier, err)
+		}
+	}()
+}
 
-		// return the waitgroup token
-		<-q.qc.exectokens
+// errQueryCancelled is the execution error of queries cancelled with
+// CancelQuery.
+var errQueryCancelled = errors.New("query cancelled by operator")
 
-		// and notify that we're done
-		close(done)
-	}()
+// failCancelled marks a query cancelled before it acquired an execution
+// token as failed.
+func (q *Query) failCancelled() {
+	now := time.Now()
+	q.Executed = &now
+	q.Completed = &now
+	q.ExecutionError = errQueryCancelled
+	if err := q.flushState(); err != nil {
+		log.Printf("cannot flush state for query %s: %v", q.Identifier, err)
+	}
+}
+
+// RenderSQL returns the SQL statement this query executes to select its
+// result, with parameters bound, without executing it. Observation queries
+// are selected in batches; the statement for the first batch is returned.
+// Sampling queries select the IDs of their sample before selecting
+// observations, which is rendered as a subquery. Statements executed to pin
+// the query to the observation sets it covers are not included.
+func (q *Query) RenderSQL() (string, error) {
+	db := q.qc.db
+
+	var pq *orm.Query
+	if len(q.groups) == 1 {
+		pq = q.groupQuery(db, &[]oneGroupResult{})
+	} else if len(q.groups) > 1 {
+		pq = q.groupQuery(db, &[]twoGroupResult{})
+	} else if q.optionSetsOnly {
+		pq = q.observationSetIDsQuery(db)
+	} else {
+		pq = q.observationBatchQuery(db, &[]Observation{}, nil)
+		if q.optionSample > 0 {
+			pq = pq.Where("observation.id IN (?)", q.sampleIDsQuery(db))
+		}
+	}
+
+	b, err := pq.AppendFormat(nil, db)
+	if err != nil {
+		return "", PTOWrapError(err)
+	}
+	return string(b), nil
+}
+
+// ParseQuery creates a new query from a form, using the given observation
+// database to expand conditions but no query cache. Such a query is meant to
+// be executed with WriteResults by batch analysis tools; it cannot be
+// submitted, and has no result file. The configuration is used only to link
+// to observation sets in the results of sets_only queries.
+func ParseQuery(config *PTOConfiguration, db *pg.DB, form url.Values) (*Query, error) {
+	cidCache, err := LoadConditionCache(db)
+	if err != nil {
+		return nil, err
+	}
+
+	qc := QueryCache{config: config, db: db, cidCache: cidCache}
+	return qc.ParseQueryFromForm(form)
+}
+
+// WriteResults executes this query synchronously against the given
+// observation database, and streams its result to a writer in the format of
+// the result file written by Execute: an observation file, NDJSON arrays of
+// groups and counts for group queries, or NDJSON links for sets_only queries.
+// It returns the number of rows written. The query cache, if any, is neither
+// consulted nor updated, and the query is not pinned to the observation sets
+// it covers. Statements are cancelled when the given context is done.
+func (q *Query) WriteResults(ctx context.Context, db *pg.DB, out io.Writer) (int, error) {
+	q.execDB = db.WithContext(ctx)
+
+	if len(q.groups) > 0 {
+		return q.selectAndWriteGroups(out)
+	} else if q.optionSetsOnly {
+		return q.selectAndWriteObservationSetLinks(out)
+	} else {
+		return q.selectAndWriteObservations(out, nil)
+	}
 }
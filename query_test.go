@@ -2,10 +2,18 @@ package pto3_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
 )
@@ -68,6 +76,13 @@ func TestQueryParsing(t *testing.T) {
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&group=condition&group=week",
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&option=sets_only",
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&value=0",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&value_gt=10&value_lt=20.5&value_ne=15",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&option=sample:100",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&option=count_sources",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&group=week_day&option=date_labels",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=day_hour&tz=Asia%2FKolkata",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&visible_tag=public",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&owner=key%3A0123456789abcdef",
 	}
 
 	for i := range encodedTestQueries {
@@ -90,6 +105,40 @@ func TestQueryParsing(t *testing.T) {
 			t.Fatalf("parsed query %s, got first round %s and second round %s", encodedTestQueries[i], q0e, q1e)
 		}
 	}
+
+	// queries restricted to tagged sets are distinct from unrestricted ones
+	qAll, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qPublic, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&visible_tag=public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qAll.Identifier == qPublic.Identifier {
+		t.Fatalf("query restricted to public sets has unrestricted identifier %s", qAll.Identifier)
+	}
+	if qPublic.VisibleTag() != "public" {
+		t.Fatalf("expected query restricted to public sets, got visible tag %q", qPublic.VisibleTag())
+	}
+
+	badTestQueries := []string{
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&option=sample:0",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&option=sample:many",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&option=sample:10&group=condition",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&option=sample:10&option=sets_only",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&option=count_targets&option=count_paths",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&group=day&option=date_labels",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=day_hour&tz=Mars%2FOlympus_Mons",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=day_hour&tz=UTC%27%29",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&tz=Europe%2FZurich",
+	}
+
+	for i := range badTestQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(badTestQueries[i]); err == nil {
+			t.Fatalf("parsed bad query %s without error", badTestQueries[i])
+		}
+	}
 }
 
 func TestSelectQueries(t *testing.T) {
@@ -103,6 +152,14 @@ func TestSelectQueries(t *testing.T) {
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&aspect=pto.test.color", 601},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&target=10.13.14.253", 0},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value=nonesuch", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&meta=rtt", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value_gt=-1&value_lt=1", 601},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value_gt=0", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value_ne=0.0", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value_ne=nonesuch", 601},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&visible_tag=public", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&option=sample:50", 50},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&feature=pto&option=sample:1000", 601},
 	}
 
 	for i, qspec := range testSelectQueries {
@@ -143,6 +200,43 @@ func TestSelectQueries(t *testing.T) {
 		if j != qspec.count {
 			t.Fatalf("Query %d failed: expected %d rows got %d", i, qspec.count, j)
 		}
+
+		// all rows should have been made available as partial results
+		if q.RowsSoFar() != qspec.count {
+			t.Fatalf("Query %d made %d rows available so far, expected %d", i, q.RowsSoFar(), qspec.count)
+		}
+
+		// and the row count should have been recorded without rescanning
+		var rec pto3.QueryRecord
+		if err := TestDB.Model(&rec).Where("identifier = ?", q.Identifier).Select(); err != nil {
+			t.Fatal(err)
+		}
+		if rec.ResultRows == nil || *rec.ResultRows != qspec.count {
+			t.Fatalf("Query %d did not record %d result rows", i, qspec.count)
+		}
+
+		rq, err := TestQueryCache.QueryByIdentifier(q.Identifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rq.ResultRowCount() != qspec.count {
+			t.Fatalf("Query %d reloaded with %d result rows, expected %d", i, rq.ResultRowCount(), qspec.count)
+		}
+
+		// pagination should seek straight to the last page using the index
+		for _, offset := range []int{qspec.count - qspec.count%100, qspec.count + 100} {
+			page, more, err := q.PaginateResultObject(offset, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := qspec.count - offset
+			if expected < 0 {
+				expected = 0
+			}
+			if more || len(page["obs"].([]interface{})) != expected {
+				t.Fatalf("Query %d page at %d had %d rows (more %v), expected %d", i, offset, len(page["obs"].([]interface{})), more, expected)
+			}
+		}
 	}
 }
 
@@ -157,10 +251,20 @@ func TestOneGroupQueries(t *testing.T) {
 		{"time_start=2017-12-05&time_end=2017-12-06&group=source", "2001:db8:e55:5::33", 3273},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=target", "10.15.16.17", 7},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=day_hour", "14", 3412},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&option=date_labels", "14:00", 3412},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=week_day&option=date_labels", "Tue", 14400},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=week&option=date_labels", "2017-W49", 14400},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&tz=Europe/Zurich", "15", 3412},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&tz=America/New_York&option=date_labels", "09:00", 3412},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=count_targets", "pto.test.color.red", 1832},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=count_sources", "pto.test.color.red", 2},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=count_paths", "pto.test.color.red", 1832},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=count_sets", "pto.test.color.red", 1},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=value", "0", 14400},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=feature", "pto", 14400},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=aspect", "pto.test.color", 14400},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=first_as", "", 14400},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=last_as", "", 14400},
 	}
 
 	for i, qspec := range testQueries {
@@ -215,6 +319,100 @@ func TestOneGroupQueries(t *testing.T) {
 	}
 }
 
+func TestWriteResultsWithoutCache(t *testing.T) {
+	for _, encoded := range []string{
+		"time_start=2017-12-05&time_end=2017-12-06&condition=pto.test.color.red",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&group=day_hour",
+		"time_start=2017-12-05&time_end=2017-12-06&option=sets_only",
+	} {
+		encoded += fmt.Sprintf("&set=%x", TestQueryCacheSetID)
+
+		// execute through the cache
+		done := make(chan struct{})
+		cq, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if cq.ExecutionError != nil {
+			t.Fatalf("query %s failed: %v", encoded, cq.ExecutionError)
+		}
+		cached, err := ioutil.ReadFile(TestConfig.QueryCacheRoot + "/" + cq.Identifier + ".ndjson")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// and directly, which must give the same result
+		form, err := url.ParseQuery(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := pto3.ParseQuery(TestConfig, TestDB, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Identifier != cq.Identifier {
+			t.Fatalf("query %s parsed without cache has identifier %s, expected %s", encoded, q.Identifier, cq.Identifier)
+		}
+
+		var out bytes.Buffer
+		rows, err := q.WriteResults(context.Background(), TestDB, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != cq.ResultRowCount() {
+			t.Fatalf("query %s wrote %d rows without cache, expected %d", encoded, rows, cq.ResultRowCount())
+		}
+
+		// groups are unordered, so compare sorted lines
+		sortedLines := func(b []byte) string {
+			lines := strings.Split(string(b), "\n")
+			sort.Strings(lines)
+			return strings.Join(lines, "\n")
+		}
+		if sortedLines(out.Bytes()) != sortedLines(cached) {
+			t.Fatalf("query %s result without cache differs from cached result", encoded)
+		}
+	}
+}
+
+func TestRenderSQL(t *testing.T) {
+	testQueries := []struct {
+		encoded  string
+		contains []string
+	}{
+		{"time_start=2017-12-05&time_end=2017-12-06&condition=pto.test.color.red", []string{"observation.time_start", "LIMIT 10000"}},
+		{"time_start=2017-12-05&time_end=2017-12-06&option=sample:10", []string{"random()", "LIMIT 10"}},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=condition", []string{"group0", "GROUP BY"}},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=condition&group=week", []string{"group0", "group1", "date_trunc('week'"}},
+		{"time_start=2017-12-05&time_end=2017-12-06&option=sets_only", []string{"DISTINCT set_id"}},
+	}
+
+	for _, qspec := range testQueries {
+		q, err := TestQueryCache.ParseQueryFromURLEncoded(qspec.encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sql, err := q.RenderSQL()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// parameters are bound
+		if strings.Contains(sql, "?") {
+			t.Fatalf("SQL for query %s has unbound parameters: %s", qspec.encoded, sql)
+		}
+
+		for _, s := range qspec.contains {
+			if !strings.Contains(sql, s) {
+				t.Fatalf("SQL for query %s missing %s: %s", qspec.encoded, s, sql)
+			}
+		}
+	}
+}
+
 func TestTwoGroupQueries(t *testing.T) {
 
 	testQueries := []struct {
@@ -278,3 +476,566 @@ func TestTwoGroupQueries(t *testing.T) {
 		}
 	}
 }
+
+// targetFamilyGroupSpec groups observations by the address family of their
+// targets, to test group specification registration.
+type targetFamilyGroupSpec struct{}
+
+func (gs *targetFamilyGroupSpec) URLEncoded() string {
+	return "target_family"
+}
+
+func (gs *targetFamilyGroupSpec) ColumnSpec() string {
+	return "CASE WHEN strpos(path.target, ':') > 0 THEN 'ipv6' ELSE 'ipv4' END"
+}
+
+func (gs *targetFamilyGroupSpec) ExtTables() []string {
+	return []string{"paths"}
+}
+
+func (gs *targetFamilyGroupSpec) Joins() []string {
+	return nil
+}
+
+func TestRegisterGroupSpec(t *testing.T) {
+	newTargetFamily := func() pto3.GroupSpec { return &targetFamilyGroupSpec{} }
+
+	if err := pto3.RegisterGroupSpec("target_family", newTargetFamily); err != nil {
+		t.Fatal(err)
+	}
+
+	// names must be unique and match the encoding
+	if err := pto3.RegisterGroupSpec("target_family", newTargetFamily); err == nil {
+		t.Fatal("registered group target_family twice")
+	}
+	if err := pto3.RegisterGroupSpec("family", newTargetFamily); err == nil {
+		t.Fatal("registered group under a name not matching its encoding")
+	}
+
+	found := false
+	for _, name := range pto3.QueryGroupNames() {
+		if name == "target_family" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("target_family missing from query group names")
+	}
+
+	// the custom group should partition the observations of each condition
+	encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&group=condition&group=target_family&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatalf("query failed: %v", q.ExecutionError)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	groupResults, err := parseGroupQueryResults(resfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redCount := 0
+	for _, res := range groupResults {
+		if res.groups[0] == "pto.test.color.red" {
+			redCount += res.count
+		}
+	}
+	if redCount != 3195 {
+		t.Fatalf("expected 3195 pto.test.color.red observations across target families, got %d", redCount)
+	}
+}
+
+func TestPathElementGroupSpec(t *testing.T) {
+	// grouping by the last element of each path is grouping by target, and
+	// by the second, skipping the source, by the first hop seen
+	for _, gs := range []*pto3.PathElementGroupSpec{
+		{Name: "last_element", Position: -1},
+		{Name: "first_hop", Position: 2},
+	} {
+		gs := gs
+		if err := pto3.RegisterGroupSpec(gs.Name, func() pto3.GroupSpec { return gs }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testQueries := []struct {
+		group string
+		value string
+		count int
+	}{
+		{"last_element", "10.15.16.17", 7},
+		{"first_hop", "*", 14400},
+	}
+
+	for i, qspec := range testQueries {
+		encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&group=%s&set=%x", qspec.group, TestQueryCacheSetID)
+
+		done := make(chan struct{})
+		q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+
+		if q.ExecutionError != nil {
+			t.Fatalf("Query %d failed: %v", i, q.ExecutionError)
+		}
+
+		resfile, err := q.ReadResultFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resfile.Close()
+
+		groupResults, err := parseGroupQueryResults(resfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, res := range groupResults {
+			if res.groups[0] == qspec.value {
+				found = true
+				if res.count != qspec.count {
+					t.Fatalf("Query %d expected count %d for group %s, got %d", i, qspec.count, qspec.value, res.count)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("Query %d results missing group %s", i, qspec.value)
+		}
+	}
+}
+
+// prefixCountryLookup assigns countries to addresses by prefix, to test
+// country annotation without a GeoIP database.
+type prefixCountryLookup map[string]string
+
+func (pcl prefixCountryLookup) CountryForElement(element string) string {
+	for prefix, country := range pcl {
+		if strings.HasPrefix(element, prefix) {
+			return country
+		}
+	}
+	return ""
+}
+
+func TestCountryQueries(t *testing.T) {
+	pto3.SetCountryLookup(prefixCountryLookup{
+		"192.0.2.":    "AA",
+		"198.51.100.": "BB",
+		"203.0.113.":  "CC",
+	})
+	defer pto3.SetCountryLookup(nil)
+
+	// load a set whose paths are annotated with countries
+	tf, err := ioutil.TempFile("", "pto3-test-country")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tf.Name())
+
+	fmt.Fprintln(tf, `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":["https://localhost:8383/raw/test1/country.ndjson"],"_conditions":["pto.test.color.red"]}`)
+	fmt.Fprintln(tf, `["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "192.0.2.1 * 198.51.100.1", "pto.test.color.red"]`)
+	fmt.Fprintln(tf, `["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "192.0.2.1 * 198.51.100.2", "pto.test.color.red"]`)
+	fmt.Fprintln(tf, `["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:28Z", "192.0.2.1 * 203.0.113.1", "pto.test.color.red"]`)
+	tf.Close()
+
+	setID, err := TestQueryCache.LoadTestData(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testQueries := []struct {
+		encoded string
+		counts  map[string]int
+	}{
+		{"group=target_country", map[string]int{"BB": 2, "CC": 1}},
+		{"group=source_country", map[string]int{"AA": 3}},
+		{"group=target_country&target_country=CC", map[string]int{"CC": 1}},
+		{"group=target_country&source_country=BB", map[string]int{}},
+	}
+
+	for i, qspec := range testQueries {
+		encoded := fmt.Sprintf("time_start=2017-12-05&time_end=2017-12-06&set=%x&%s", setID, qspec.encoded)
+
+		done := make(chan struct{})
+		q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+
+		if q.ExecutionError != nil {
+			t.Fatalf("Query %d failed: %v", i, q.ExecutionError)
+		}
+
+		resfile, err := q.ReadResultFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resfile.Close()
+
+		groupResults, err := parseGroupQueryResults(resfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(groupResults) != len(qspec.counts) {
+			t.Fatalf("Query %d expected %d groups, got %d", i, len(qspec.counts), len(groupResults))
+		}
+		for _, res := range groupResults {
+			if qspec.counts[res.groups[0]] != res.count {
+				t.Fatalf("Query %d expected count %d for country %s, got %d", i, qspec.counts[res.groups[0]], res.groups[0], res.count)
+			}
+		}
+	}
+}
+
+func TestSharedQueryCache(t *testing.T) {
+	// a second query cache on the same database and storage, as on another
+	// API server
+	otherCache, err := pto3.NewQueryCache(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := "time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A01%3A00Z" +
+		fmt.Sprintf("&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, isNew, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isNew {
+		t.Fatal("expected query to be new")
+	}
+	<-done
+
+	// the other server sees the query as already submitted
+	otherDone := make(chan struct{})
+	oq, isNew, err := otherCache.ExecuteQueryFromURLEncoded(encoded, otherDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-otherDone
+	if isNew {
+		t.Fatal("query submitted to one server should not be new on another")
+	}
+	if oq.Identifier != q.Identifier || oq.Completed == nil {
+		t.Fatalf("other server has wrong state for query %s", q.Identifier)
+	}
+
+	// and sees metadata updates
+	if err := q.UpdateFromJSON([]byte(`{"_ext_ref": "shared", "note": "hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.FlushMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	oq, err = otherCache.QueryByIdentifier(q.Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oq.ExtRef != "shared" || oq.Metadata["note"] != "hello" {
+		t.Fatalf("metadata update not visible on other server: %v", oq.Metadata)
+	}
+
+	// purging on one server purges on both
+	if err := oq.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if q, err = TestQueryCache.QueryByIdentifier(q.Identifier); err != nil {
+		t.Fatal(err)
+	} else if q != nil {
+		t.Fatal("purged query still present")
+	}
+}
+
+func TestQueryCanonicalization(t *testing.T) {
+	equivalentQueries := [][]string{
+		{
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z",
+			"time_start=2017-12-05T15%3A31%3A26%2B01%3A00&time_end=2017-12-05T16%3A31%3A53Z",
+			"time_end=2017-12-05T14%3A31%3A26Z&time_start=2017-12-05T16%3A31%3A53Z",
+		},
+		{
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*",
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.red&condition=pto.test.color.*",
+		},
+		{
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&set=10&set=a",
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&set=a&set=10&set=a",
+		},
+		{
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&target_country=CH&value=0",
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&value=0&target_country=ch&value=0",
+		},
+		{
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&meta=probe%3Dp*&meta=rtt%3E%3D10",
+			"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&meta=rtt%3E%3D10&meta=probe%3Dp*&meta=rtt%3E%3D10",
+		},
+	}
+
+	for i, queries := range equivalentQueries {
+		var identifier string
+		for j, encoded := range queries {
+			q, err := TestQueryCache.ParseQueryFromURLEncoded(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// canonical form must survive a round trip
+			rq, err := TestQueryCache.ParseQueryFromURLEncoded(q.URLEncoded())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rq.Identifier != q.Identifier {
+				t.Fatalf("query %d.%d changed identifier on round trip: %s then %s", i, j, q.URLEncoded(), rq.URLEncoded())
+			}
+
+			if j == 0 {
+				identifier = q.Identifier
+			} else if q.Identifier != identifier {
+				t.Fatalf("query %d.%d (%s) not deduplicated with %s", i, j, q.URLEncoded(), queries[0])
+			}
+		}
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	start := time.Date(2017, 12, 5, 14, 31, 26, 0, time.UTC)
+	end := time.Date(2017, 12, 5, 16, 31, 53, 0, time.UTC)
+
+	built, err := pto3.NewQueryBuilder(end, start.In(time.FixedZone("CET", 3600))).
+		WithSets(0x10, 0xa, 0x10).
+		WithConditions("pto.test.color.*").
+		WithTargetCountries("ch").
+		WithGroup("condition").
+		WithOption("count_targets").
+		Parse(TestQueryCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z" +
+		"&set=a&set=10&condition=pto.test.color.*&target_country=CH&group=condition&option=count_targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if built.Identifier != parsed.Identifier || built.URLEncoded() != parsed.URLEncoded() {
+		t.Fatalf("built query %s differs from parsed query %s", built.URLEncoded(), parsed.URLEncoded())
+	}
+
+	// builders are validated on parsing
+	if _, err := pto3.NewQueryBuilder(start, end).WithGroup("no_such_group").Parse(TestQueryCache); err == nil {
+		t.Fatal("query with bad group built")
+	}
+
+	// forms are copies
+	qb := pto3.NewQueryBuilder(start, end)
+	qb.Form().Set("group", "no_such_group")
+	if _, err := qb.Parse(TestQueryCache); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelativeTimeQueries(t *testing.T) {
+	before := time.Now().Truncate(time.Second)
+
+	q, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=-7d&time_end=now&condition=pto.test.color.red")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the canonical form uses resolved absolute times
+	v, err := url.ParseQuery(q.URLEncoded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeStart, err := time.Parse(time.RFC3339, v.Get("time_start"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeEnd, err := time.Parse(time.RFC3339, v.Get("time_end"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timeEnd.Before(before) || timeEnd.After(time.Now()) {
+		t.Fatalf("time_end=now resolved to %v", timeEnd)
+	}
+	if timeEnd.Sub(timeStart) != 7*24*time.Hour {
+		t.Fatalf("time_start=-7d resolved to %v, %v before time_end", timeStart, timeEnd.Sub(timeStart))
+	}
+
+	// and the expressions are recorded in metadata
+	if q.Metadata["__time_start_expr"] != "-7d" || q.Metadata["__time_end_expr"] != "now" {
+		t.Fatalf("relative time expressions not recorded: %v", q.Metadata)
+	}
+
+	// bad relative times are rejected
+	if _, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=now-7y&time_end=now"); err == nil {
+		t.Fatal("parsed query with bad relative time unit")
+	}
+}
+
+func TestQueryTemplateInstantiation(t *testing.T) {
+	qt := pto3.QueryTemplate{
+		Name:     "color-by-week",
+		Template: "time_start=-52w&time_end=now&condition=pto.test.color.%24color&target=%24%7Bnet%7D&group=week",
+	}
+
+	params := qt.Parameters()
+	if len(params) != 2 || params[0] != "color" || params[1] != "net" {
+		t.Fatalf("expected parameters [color net], got %v", params)
+	}
+
+	form, err := qt.Instantiate(url.Values{"color": {"green"}, "net": {"10.0.0.0/8&set=1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if form.Get("condition") != "pto.test.color.green" {
+		t.Fatalf("bad instantiated condition %s", form.Get("condition"))
+	}
+
+	// values are substituted whole, and cannot add keys
+	if form.Get("target") != "10.0.0.0/8&set=1" || len(form["set"]) != 0 {
+		t.Fatalf("bad instantiated target %s", form.Encode())
+	}
+
+	if form.Get("group") != "week" || form.Get("time_start") != "-52w" {
+		t.Fatalf("instantiation changed unparameterized values: %s", form.Encode())
+	}
+
+	// every parameter needs exactly one value, and no others are allowed
+	badValues := []url.Values{
+		{"color": {"green"}},
+		{"color": {"green", "red"}, "net": {"10.0.0.0/8"}},
+		{"color": {"green"}, "net": {"10.0.0.0/8"}, "source": {"10.0.0.1"}},
+	}
+	for i, values := range badValues {
+		if _, err := qt.Instantiate(values); err == nil {
+			t.Fatalf("bad values %d instantiated template", i)
+		}
+	}
+}
+
+func TestQueryRetention(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"72h": 72 * time.Hour,
+		"90m": 90 * time.Minute,
+		"0d":  0,
+		"-1d": 0,
+		"1ms": 0,
+		"d":   0,
+		"bad": 0,
+	} {
+		d, err := pto3.ParseRetention(s)
+		if expected == 0 {
+			if err == nil {
+				t.Fatalf("retention %s should not parse", s)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if d != expected {
+			t.Fatalf("retention %s parsed as %v, expected %v", s, d, expected)
+		}
+	}
+
+	encoded := fmt.Sprintf("set=%x&time_start=2017-12-05T14:00:00Z&time_end=2017-12-05T14:10:00Z&condition=pto.test.color.red", TestQueryCacheSetID)
+
+	// retention is bounded by the configured maximum
+	if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded + "&retain=91d"); err == nil {
+		t.Fatal("retention beyond maximum accepted")
+	}
+
+	// retention is not part of the query's identity
+	q, err := TestQueryCache.ParseQueryFromURLEncoded(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq, err := TestQueryCache.ParseQueryFromURLEncoded(encoded + "&retain=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rq.Identifier != q.Identifier {
+		t.Fatalf("retention changed query identifier from %s to %s", q.Identifier, rq.Identifier)
+	}
+
+	// execute a query retained for an hour
+	done := make(chan struct{})
+	q, _, err = TestQueryCache.ExecuteQueryFromURLEncoded(encoded+"&retain=1h", done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	if d, ok := q.Retention(); !ok || d != time.Hour {
+		t.Fatalf("query retention %v (limited %v), expected 1h", d, ok)
+	}
+	expires, ok := q.Expires()
+	if !ok || !expires.Equal(q.Completed.Add(time.Hour)) {
+		t.Fatalf("query expires at %v, expected an hour after %v", expires, *q.Completed)
+	}
+
+	// resubmission extends retention, but does not shorten it
+	for _, retain := range []string{"2d", "1h"} {
+		if _, _, err := TestQueryCache.SubmitQueryFromURLEncoded(encoded + "&retain=" + retain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q, err = TestQueryCache.QueryByIdentifier(q.Identifier); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := q.Retention(); !ok || d != 48*time.Hour {
+		t.Fatalf("query retention %v (limited %v) after resubmission, expected 48h", d, ok)
+	}
+
+	// queries are not evicted before they expire
+	if _, err := TestQueryCache.EvictExpired(q.Completed.Add(47 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if oq, err := TestQueryCache.QueryByIdentifier(q.Identifier); err != nil {
+		t.Fatal(err)
+	} else if oq == nil {
+		t.Fatal("query evicted before it expired")
+	}
+
+	// but are afterward, with their results
+	if n, err := TestQueryCache.EvictExpired(q.Completed.Add(49 * time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if n < 1 {
+		t.Fatal("expired query not evicted")
+	}
+	if oq, err := TestQueryCache.QueryByIdentifier(q.Identifier); err != nil {
+		t.Fatal(err)
+	} else if oq != nil {
+		t.Fatal("expired query still present")
+	}
+	if _, err := os.Stat(TestConfig.QueryCacheRoot + "/" + q.Identifier + ".ndjson"); !os.IsNotExist(err) {
+		t.Fatalf("results of expired query still present: %v", err)
+	}
+}
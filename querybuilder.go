@@ -0,0 +1,185 @@
+package pto3
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// QueryBuilder constructs a query specification programmatically, for tools
+// and analyzers which would otherwise assemble query forms by hand. Each
+// With method adds to the specification and returns the builder, so that
+// calls can be chained:
+//
+//	q, err := NewQueryBuilder(start, end).
+//		WithConditions("ecn.connectivity.*").
+//		WithGroup("condition", "week").
+//		WithOption("count_targets").
+//		Parse(qc)
+//
+// The specification is validated when it is parsed or submitted to a query
+// cache, exactly as a submitted form would be, and the resulting query has
+// the same normalized encoding and identifier as an equivalent form.
+type QueryBuilder struct {
+	form url.Values
+}
+
+// NewQueryBuilder returns a builder for a query over observations in the
+// given time range.
+func NewQueryBuilder(timeStart time.Time, timeEnd time.Time) *QueryBuilder {
+	qb := &QueryBuilder{form: make(url.Values)}
+	return qb.WithTimeRange(timeStart, timeEnd)
+}
+
+// WithTimeRange replaces the time range of the query.
+func (qb *QueryBuilder) WithTimeRange(timeStart time.Time, timeEnd time.Time) *QueryBuilder {
+	qb.form.Set("time_start", timeStart.UTC().Format(time.RFC3339))
+	qb.form.Set("time_end", timeEnd.UTC().Format(time.RFC3339))
+	return qb
+}
+
+// WithRelativeTimeRange replaces the time range of the query with relative
+// time expressions (see ParseRelativeTime), resolved when the query is
+// parsed.
+func (qb *QueryBuilder) WithRelativeTimeRange(timeStart string, timeEnd string) *QueryBuilder {
+	qb.form.Set("time_start", timeStart)
+	qb.form.Set("time_end", timeEnd)
+	return qb
+}
+
+// WithSets restricts the query to observation sets with the given IDs.
+func (qb *QueryBuilder) WithSets(setIds ...int) *QueryBuilder {
+	for _, setid := range setIds {
+		qb.form.Add("set", SetID(setid).String())
+	}
+	return qb
+}
+
+// WithConditions restricts the query to observations of the given
+// conditions. Names may end in a wildcard (e.g. "ecn.*").
+func (qb *QueryBuilder) WithConditions(conditions ...string) *QueryBuilder {
+	return qb.add("condition", conditions)
+}
+
+// WithOnPath restricts the query to paths containing the given elements.
+func (qb *QueryBuilder) WithOnPath(elements ...string) *QueryBuilder {
+	return qb.add("on_path", elements)
+}
+
+// WithSources restricts the query to paths from the given sources.
+func (qb *QueryBuilder) WithSources(sources ...string) *QueryBuilder {
+	return qb.add("source", sources)
+}
+
+// WithTargets restricts the query to paths to the given targets.
+func (qb *QueryBuilder) WithTargets(targets ...string) *QueryBuilder {
+	return qb.add("target", targets)
+}
+
+// WithSourceCountries restricts the query to paths from sources in the
+// given countries.
+func (qb *QueryBuilder) WithSourceCountries(countries ...string) *QueryBuilder {
+	return qb.add("source_country", countries)
+}
+
+// WithTargetCountries restricts the query to paths to targets in the given
+// countries.
+func (qb *QueryBuilder) WithTargetCountries(countries ...string) *QueryBuilder {
+	return qb.add("target_country", countries)
+}
+
+// WithFeatures restricts the query to conditions with the given features.
+func (qb *QueryBuilder) WithFeatures(features ...string) *QueryBuilder {
+	return qb.add("feature", features)
+}
+
+// WithAspects restricts the query to conditions with the given aspects.
+func (qb *QueryBuilder) WithAspects(aspects ...string) *QueryBuilder {
+	return qb.add("aspect", aspects)
+}
+
+// WithValues restricts the query to observations with the given values.
+func (qb *QueryBuilder) WithValues(values ...string) *QueryBuilder {
+	return qb.add("value", values)
+}
+
+// WithMetadata restricts the query to observations matching the given
+// metadata filter expressions (see ParseMetadataFilter).
+func (qb *QueryBuilder) WithMetadata(filters ...string) *QueryBuilder {
+	return qb.add("meta", filters)
+}
+
+// WithGroup makes the query a group query over the given dimensions, by
+// name as listed by QueryGroupNames.
+func (qb *QueryBuilder) WithGroup(groups ...string) *QueryBuilder {
+	return qb.add("group", groups)
+}
+
+// WithOption sets the given options, as listed in QueryOptionNames.
+func (qb *QueryBuilder) WithOption(options ...string) *QueryBuilder {
+	return qb.add("option", options)
+}
+
+// WithSample makes the query select a random sample of n observations.
+func (qb *QueryBuilder) WithSample(n int) *QueryBuilder {
+	qb.form.Add("option", "sample:"+strconv.Itoa(n))
+	return qb
+}
+
+// WithTimeZone groups dates in the query in the given IANA time zone.
+func (qb *QueryBuilder) WithTimeZone(tz string) *QueryBuilder {
+	qb.form.Set("tz", tz)
+	return qb
+}
+
+// WithOwner makes the query private to the given principal.
+func (qb *QueryBuilder) WithOwner(principal string) *QueryBuilder {
+	qb.form.Set("owner", principal)
+	return qb
+}
+
+// WithRetention asks for the query's results to be kept for the given
+// retention period (see ParseRetention) after it completes.
+func (qb *QueryBuilder) WithRetention(period string) *QueryBuilder {
+	qb.form.Set("retain", period)
+	return qb
+}
+
+func (qb *QueryBuilder) add(key string, values []string) *QueryBuilder {
+	for _, v := range values {
+		qb.form.Add(key, v)
+	}
+	return qb
+}
+
+// Form returns a copy of the query specification as a form, as would be
+// submitted to the query API.
+func (qb *QueryBuilder) Form() url.Values {
+	out := make(url.Values, len(qb.form))
+	for k, vv := range qb.form {
+		out[k] = append([]string(nil), vv...)
+	}
+	return out
+}
+
+// Parse creates a query bound to a cache from this specification, but does
+// not submit it. Use the query's URLEncoded method and Identifier field for
+// its normalized encoding and identifier.
+func (qb *QueryBuilder) Parse(qc *QueryCache) (*Query, error) {
+	return qc.ParseQueryFromForm(qb.Form())
+}
+
+// ParseWithoutCache creates a query from this specification using an
+// observation database without a query cache, as ParseQuery does, for
+// execution with WriteResults.
+func (qb *QueryBuilder) ParseWithoutCache(config *PTOConfiguration, db *pg.DB) (*Query, error) {
+	return ParseQuery(config, db, qb.Form())
+}
+
+// Submit submits a query built from this specification to a cache, as
+// SubmitQueryFromForm does.
+func (qb *QueryBuilder) Submit(qc *QueryCache) (*Query, bool, error) {
+	return qc.SubmitQueryFromForm(qb.Form())
+}
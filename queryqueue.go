@@ -0,0 +1,240 @@
+package pto3
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queryQueueMetrics counts queries waiting for and holding execution tokens
+// on this server, and queries cancelled by operators, in the pto_query_queue
+// metrics.
+var queryQueueMetrics = expvar.NewMap("pto_query_queue")
+
+// QueuedQuery describes a query waiting for or holding an execution token on
+// this server.
+type QueuedQuery struct {
+	// Identifier of the query
+	Identifier string
+	// Time the query was queued for execution
+	Queued time.Time
+	// Time the query acquired an execution token; nil if still waiting
+	Started *time.Time
+	// Priority of the query; waiting queries with higher priority acquire
+	// execution tokens first
+	Priority int
+}
+
+// Executing returns true if this query holds an execution token.
+func (qq *QueuedQuery) Executing() bool {
+	return qq.Started != nil
+}
+
+// Elapsed returns the time since this query was queued.
+func (qq *QueuedQuery) Elapsed() time.Duration {
+	return time.Since(qq.Queued)
+}
+
+// queueEntry is a query in an execution queue.
+type queueEntry struct {
+	QueuedQuery
+	seq       uint64
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// executionQueue tracks the queries executing or waiting to execute on a
+// server, so that operators can see and manage a congested executor. Tokens
+// are shared among all servers using a database, but the queue, and
+// therefore priority ordering, is local to each server.
+type executionQueue struct {
+	lock    sync.Mutex
+	entries []*queueEntry
+	seq     uint64
+	changed chan struct{}
+}
+
+func newExecutionQueue() *executionQueue {
+	return &executionQueue{changed: make(chan struct{})}
+}
+
+// notify wakes queries waiting for the queue to change. Caller must hold the
+// lock.
+func (eq *executionQueue) notify() {
+	close(eq.changed)
+	eq.changed = make(chan struct{})
+}
+
+// enqueue adds a query to the queue, with a function cancelling its
+// execution.
+func (eq *executionQueue) enqueue(identifier string, cancel context.CancelFunc) *queueEntry {
+	eq.lock.Lock()
+	defer eq.lock.Unlock()
+
+	eq.seq++
+	e := &queueEntry{
+		QueuedQuery: QueuedQuery{Identifier: identifier, Queued: time.Now()},
+		seq:         eq.seq,
+		cancel:      cancel,
+	}
+	eq.entries = append(eq.entries, e)
+	queryQueueMetrics.Add("waiting", 1)
+	eq.notify()
+
+	return e
+}
+
+// ahead returns true if entry a should acquire an execution token before
+// entry b.
+func ahead(a *queueEntry, b *queueEntry) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+
+// next returns true if no waiting entry in the queue is ahead of the given
+// entry, and a channel closed when the queue next changes. Entries for which
+// next returns false wait for the channel without holding a database
+// connection.
+func (eq *executionQueue) next(e *queueEntry) (bool, <-chan struct{}) {
+	eq.lock.Lock()
+	defer eq.lock.Unlock()
+
+	for _, other := range eq.entries {
+		if other != e && other.Started == nil && ahead(other, e) {
+			return false, eq.changed
+		}
+	}
+	return true, eq.changed
+}
+
+// start marks an entry as holding an execution token.
+func (eq *executionQueue) start(e *queueEntry) {
+	eq.lock.Lock()
+	defer eq.lock.Unlock()
+
+	now := time.Now()
+	e.Started = &now
+	queryQueueMetrics.Add("waiting", -1)
+	queryQueueMetrics.Add("executing", 1)
+	queryQueueMetrics.AddFloat("wait_seconds", now.Sub(e.Queued).Seconds())
+	eq.notify()
+}
+
+// remove removes an entry from the queue, when its query has finished
+// executing or given up waiting.
+func (eq *executionQueue) remove(e *queueEntry) {
+	eq.lock.Lock()
+	defer eq.lock.Unlock()
+
+	for i, other := range eq.entries {
+		if other == e {
+			eq.entries = append(eq.entries[:i], eq.entries[i+1:]...)
+			if e.Started == nil {
+				queryQueueMetrics.Add("waiting", -1)
+			} else {
+				queryQueueMetrics.Add("executing", -1)
+				queryQueueMetrics.Add("executed", 1)
+			}
+			eq.notify()
+			return
+		}
+	}
+}
+
+// wasCancelled returns true if an entry's query was cancelled with
+// CancelQuery.
+func (eq *executionQueue) wasCancelled(e *queueEntry) bool {
+	eq.lock.Lock()
+	defer eq.lock.Unlock()
+
+	return e.cancelled
+}
+
+// ExecutionQueue returns the queries executing on this server, ordered by
+// start time, followed by the queries waiting for an execution token, in
+// the order in which they will acquire one.
+func (qc *QueryCache) ExecutionQueue() []QueuedQuery {
+	if qc.queue == nil {
+		return nil
+	}
+
+	qc.queue.lock.Lock()
+	entries := make([]*queueEntry, len(qc.queue.entries))
+	copy(entries, qc.queue.entries)
+	out := make([]QueuedQuery, len(entries))
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Started != nil && b.Started != nil {
+			return a.Started.Before(*b.Started)
+		} else if a.Started != nil || b.Started != nil {
+			return a.Started != nil
+		}
+		return ahead(a, b)
+	})
+	for i := range entries {
+		out[i] = entries[i].QueuedQuery
+	}
+	qc.queue.lock.Unlock()
+
+	return out
+}
+
+// SetQueryPriority sets the priority of a query executing or waiting to
+// execute on this server. Waiting queries with higher priority acquire
+// execution tokens first; queries with the same priority acquire them in the
+// order in which they were queued. The priority of queries which are not
+// queued on this server cannot be set.
+func (qc *QueryCache) SetQueryPriority(identifier string, priority int) error {
+	if qc.queue == nil {
+		return PTONotFoundError("queued query", identifier)
+	}
+
+	qc.queue.lock.Lock()
+	defer qc.queue.lock.Unlock()
+
+	found := false
+	for _, e := range qc.queue.entries {
+		if e.Identifier == identifier {
+			e.Priority = priority
+			found = true
+		}
+	}
+	if !found {
+		return PTONotFoundError("queued query", identifier)
+	}
+
+	qc.queue.notify()
+	return nil
+}
+
+// CancelQuery cancels a query executing or waiting to execute on this
+// server. The query fails with an error noting its cancellation; it may be
+// executed again by resubmitting it with the repin option. Queries which are
+// not queued on this server cannot be cancelled.
+func (qc *QueryCache) CancelQuery(identifier string) error {
+	if qc.queue == nil {
+		return PTONotFoundError("queued query", identifier)
+	}
+
+	qc.queue.lock.Lock()
+	defer qc.queue.lock.Unlock()
+
+	found := false
+	for _, e := range qc.queue.entries {
+		if e.Identifier == identifier {
+			e.cancelled = true
+			e.cancel()
+			found = true
+		}
+	}
+	if !found {
+		return PTONotFoundError("queued query", identifier)
+	}
+
+	queryQueueMetrics.Add("cancelled", 1)
+	return nil
+}
@@ -0,0 +1,184 @@
+package pto3
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultQueryMaxRetention is the longest retention hint accepted with a
+// query if QueryMaxRetention is not configured.
+const defaultQueryMaxRetention = 90 * 24 * time.Hour
+
+// defaultQueryEvictionInterval is the interval between evictions of expired
+// query results if QueryEvictionInterval is not configured.
+const defaultQueryEvictionInterval = time.Hour
+
+// ParseRetention parses a query retention period, either as a duration string
+// (e.g. "72h") or as a number of seconds (s), minutes (m), hours (h), days
+// (d), or weeks (w), as in relative time expressions (e.g. "7d"). The period
+// must be at least one second.
+func ParseRetention(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil && len(s) > 1 {
+		if unit, ok := relativeTimeUnits[s[len(s)-1]]; ok {
+			var n int
+			if n, err = strconv.Atoi(s[:len(s)-1]); err == nil {
+				d = time.Duration(n) * unit
+			}
+		}
+	}
+
+	if err != nil || d < time.Second {
+		return 0, PTOErrorf("bad retention period %s", s).StatusIs(http.StatusBadRequest)
+	}
+	return d, nil
+}
+
+// formatRetention formats a retention period in the largest unit of
+// ParseRetention in which it is whole.
+func formatRetention(d time.Duration) string {
+	for _, suffix := range []byte("wdhm") {
+		unit := relativeTimeUnits[suffix]
+		if d%unit == 0 {
+			return strconv.FormatInt(int64(d/unit), 10) + string(suffix)
+		}
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+// queryRetention returns the configured retention of query results
+// submitted without a retention hint, or zero if they are kept indefinitely.
+func (config *PTOConfiguration) queryRetention() time.Duration {
+	if config.QueryRetention == "" {
+		return 0
+	}
+	d, _ := ParseRetention(config.QueryRetention)
+	return d
+}
+
+// queryMaxRetention returns the longest retention hint accepted with a query.
+func (config *PTOConfiguration) queryMaxRetention() time.Duration {
+	if config.QueryMaxRetention == "" {
+		return defaultQueryMaxRetention
+	}
+	d, _ := ParseRetention(config.QueryMaxRetention)
+	return d
+}
+
+// parseRetentionHint parses the retention hint a query was submitted with,
+// which may not exceed the configured maximum.
+func (q *Query) parseRetentionHint(s string) error {
+	d, err := ParseRetention(s)
+	if err != nil {
+		return err
+	}
+
+	if max := q.qc.config.queryMaxRetention(); d > max {
+		return PTOErrorf("retention %s exceeds maximum %s", s, formatRetention(max)).StatusIs(http.StatusBadRequest)
+	}
+
+	q.retainHint = d.Truncate(time.Second)
+	return nil
+}
+
+// Retention returns how long this query's results are kept after it
+// completes, and false if they are kept indefinitely. This is the retention
+// hint the query was submitted with, if any, or the configured default.
+// Permanent queries are never evicted, regardless of their retention.
+func (q *Query) Retention() (time.Duration, bool) {
+	if q.retainHint > 0 {
+		return q.retainHint, true
+	}
+	d := q.qc.config.queryRetention()
+	return d, d > 0
+}
+
+// Expires returns the time after which this query's results may be evicted
+// from the cache, and false if they will not be: if it has not completed, is
+// permanent, or is retained indefinitely.
+func (q *Query) Expires() (time.Time, bool) {
+	if q.Completed == nil || q.ExtRef != "" {
+		return time.Time{}, false
+	}
+
+	d, ok := q.Retention()
+	if !ok {
+		return time.Time{}, false
+	}
+	return q.Completed.Add(d), true
+}
+
+// retainsLongerThan returns true if this query's results would be kept
+// longer than another's.
+func (q *Query) retainsLongerThan(other *Query) bool {
+	d, limited := q.Retention()
+	od, olimited := other.Retention()
+	if !limited {
+		return olimited
+	}
+	return olimited && d > od
+}
+
+// EvictExpired purges queries whose results have been kept longer than their
+// retention, as of the given time, returning the number of queries purged.
+// Permanent queries, and queries most recently executed under a name, are
+// never evicted.
+func (qc *QueryCache) EvictExpired(now time.Time) (int, error) {
+	pq := qc.db.Model((*QueryRecord)(nil)).Column("identifier").
+		Where("completed IS NOT NULL").
+		Where("(ext_ref IS NULL OR ext_ref = '')").
+		Where("identifier NOT IN (SELECT identifier FROM named_queries)")
+
+	if d := qc.config.queryRetention(); d > 0 {
+		pq = pq.Where("completed + (CASE WHEN retain_seconds > 0 THEN retain_seconds ELSE ? END) * interval '1 second' < ?",
+			int64(d/time.Second), now)
+	} else {
+		pq = pq.Where("retain_seconds > 0").
+			Where("completed + retain_seconds * interval '1 second' < ?", now)
+	}
+
+	var identifiers []string
+	if err := pq.Select(&identifiers); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	for i, identifier := range identifiers {
+		if err := qc.Purge(identifier); err != nil {
+			return i, err
+		}
+	}
+
+	return len(identifiers), nil
+}
+
+// EvictEvery evicts expired query results at the configured
+// QueryEvictionInterval until the given channel is closed, logging the
+// result of each eviction.
+func (qc *QueryCache) EvictEvery(stop chan struct{}) {
+	interval := defaultQueryEvictionInterval
+	if qc.config.QueryEvictionInterval != "" {
+		if d, err := time.ParseDuration(qc.config.QueryEvictionInterval); err == nil {
+			interval = d
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := qc.EvictExpired(time.Now())
+		if err != nil {
+			log.Printf("error evicting expired query results: %v", err)
+		} else if n > 0 {
+			log.Printf("evicted %d expired queries from the query cache", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
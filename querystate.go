@@ -0,0 +1,272 @@
+package pto3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// QueryRecord stores the state and metadata of a query in the database, so
+// that a query cache can be shared among multiple API servers. Only query
+// results are stored on disk.
+type QueryRecord struct {
+	// Hash-based identifier
+	Identifier string `sql:",pk"`
+	// Normalized, urlencoded query specification
+	Encoded string `sql:",notnull"`
+	// Timestamps for state management
+	Submitted *time.Time
+	Executed  *time.Time
+	Completed *time.Time
+	// Modification timestamp
+	Modified *time.Time
+	// Execution error, empty if none
+	Error string
+	// Number of result rows available in the partial result file so far
+	RowsSoFar int `sql:",notnull"`
+	// Number of rows in the complete result, if recorded
+	ResultRows *int
+	// Execution statistics, if recorded
+	Stats *QueryStatistics
+	// Observation sets the query is pinned to, if executed
+	Sources []QuerySource
+	// External reference
+	ExtRef string
+	// Arbitrary metadata, stored as a JSONB object
+	Metadata map[string]string
+	// Principal owning a private query; empty if shared
+	Owner string `sql:",notnull"`
+	// Retention of results in seconds after completion; zero for the
+	// configured default
+	RetainSeconds int64 `sql:",notnull"`
+}
+
+// queryExecutionLockClass is the first key of the PostgreSQL advisory locks
+// used as query execution tokens; the second key is the token number.
+const queryExecutionLockClass = 0x50544f33
+
+// queryExecutionPollInterval is how long to wait before trying again to
+// acquire an execution token when all are held.
+const queryExecutionPollInterval = 500 * time.Millisecond
+
+// record returns a database record for this query's state and metadata.
+func (q *Query) record() *QueryRecord {
+	var resultRows *int
+	if q.resultRowCountKnown {
+		rows := q.resultRowCount
+		resultRows = &rows
+	}
+
+	return &QueryRecord{
+		Identifier:    q.Identifier,
+		Encoded:       q.URLEncoded(),
+		Submitted:     q.Submitted,
+		Executed:      q.Executed,
+		Completed:     q.Completed,
+		Modified:      q.modified,
+		Error:         errorString(q.ExecutionError),
+		RowsSoFar:     q.rowsSoFar,
+		ResultRows:    resultRows,
+		Stats:         q.stats,
+		Sources:       q.pins,
+		ExtRef:        q.ExtRef,
+		Metadata:      q.Metadata,
+		Owner:         q.owner,
+		RetainSeconds: int64(q.retainHint / time.Second),
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// queryFromRecord creates a query bound to this cache from a database record.
+func (qc *QueryCache) queryFromRecord(rec *QueryRecord) (*Query, error) {
+	q := Query{qc: qc}
+	if err := q.populateFromEncoded(rec.Encoded); err != nil {
+		return nil, err
+	}
+
+	// queries submitted before canonicalization was introduced may have a
+	// different canonical form now; keep the identifier they were stored
+	// under, so their results remain available.
+	q.Identifier = rec.Identifier
+
+	q.Submitted = rec.Submitted
+	q.Executed = rec.Executed
+	q.Completed = rec.Completed
+	q.modified = rec.Modified
+	q.rowsSoFar = rec.RowsSoFar
+	if rec.ResultRows != nil {
+		q.setResultRowCount(*rec.ResultRows)
+	}
+	q.stats = rec.Stats
+	q.pins = rec.Sources
+	q.Sources = q.pinnedSetIDs()
+	if rec.Error != "" {
+		q.ExecutionError = errors.New(rec.Error)
+	}
+	q.ExtRef = rec.ExtRef
+	q.Metadata = rec.Metadata
+	q.retainHint = time.Duration(rec.RetainSeconds) * time.Second
+
+	return &q, nil
+}
+
+// createQueryTable ensures the table holding query state exists.
+func createQueryTable(db *pg.DB) error {
+	opts := orm.CreateTableOptions{IfNotExists: true}
+	if err := db.CreateTable(&QueryRecord{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// add columns to query tables created by previous versions
+	if _, err := db.Exec("ALTER TABLE query_records ADD COLUMN IF NOT EXISTS rows_so_far bigint NOT NULL DEFAULT 0, ADD COLUMN IF NOT EXISTS result_rows bigint, ADD COLUMN IF NOT EXISTS stats jsonb, ADD COLUMN IF NOT EXISTS sources jsonb, ADD COLUMN IF NOT EXISTS owner text NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS retain_seconds bigint NOT NULL DEFAULT 0"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// importMetadataFiles moves query metadata stored on disk by previous
+// versions of the query cache into the database. Queries already in the
+// database are left alone, so this is safe to run from multiple servers.
+func (qc *QueryCache) importMetadataFiles() error {
+	direntries, err := ioutil.ReadDir(qc.path)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, direntry := range direntries {
+		metafilename := direntry.Name()
+		if !strings.HasSuffix(metafilename, ".json") {
+			continue
+		}
+
+		metapath := filepath.Join(qc.path, metafilename)
+		b, err := ioutil.ReadFile(metapath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// another server got here first
+				continue
+			}
+			return PTOWrapError(err)
+		}
+
+		var q Query
+		q.qc = qc
+		if err := json.Unmarshal(b, &q); err != nil {
+			log.Printf("skipping unreadable query metadata file %s: %v", metapath, err)
+			continue
+		}
+
+		mt := direntry.ModTime()
+		q.modified = &mt
+
+		if _, err := qc.db.Model(q.record()).OnConflict("DO NOTHING").Insert(); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := os.Remove(metapath); err != nil && !os.IsNotExist(err) {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// executionToken is held by a query while it executes, limiting the number
+// of queries executing concurrently across all servers sharing a database.
+type executionToken struct {
+	tx *pg.Tx
+}
+
+// acquireExecutionToken blocks until one of the configured number of
+// execution tokens is available, and returns it. Tokens are PostgreSQL
+// advisory locks, held by a transaction for the duration of execution, so
+// they are released if the server holding them dies. Tokens are only tried
+// for the given queue entry when no entry ahead of it in this server's
+// execution queue is waiting. A waiting query holds no database connection;
+// one is taken only for each attempt to acquire a token. It gives up with the
+// context's error if the given context is done while waiting.
+func (qc *QueryCache) acquireExecutionToken(ctx context.Context, qe *queueEntry) (*executionToken, error) {
+	tokens := qc.config.ConcurrentQueries
+	if tokens < 1 {
+		tokens = 1
+	}
+
+	for {
+		next, changed := qc.queue.next(qe)
+		if !next {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-changed:
+			}
+			continue
+		}
+
+		tok, err := qc.tryExecutionToken(ctx, tokens)
+		if err != nil {
+			return nil, err
+		}
+		if tok != nil {
+			return tok, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(queryExecutionPollInterval):
+		case <-changed:
+		}
+	}
+}
+
+// tryExecutionToken tries once to acquire one of the given number of
+// execution tokens, returning nil if all are held. The transaction used to
+// try is kept as the token on success, and rolled back otherwise, returning
+// its connection to the pool.
+func (qc *QueryCache) tryExecutionToken(ctx context.Context, tokens int) (*executionToken, error) {
+	tx, err := qc.db.WithContext(ctx).Begin()
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	for i := 0; i < tokens; i++ {
+		var ok bool
+		if _, err := tx.QueryOne(pg.Scan(&ok),
+			"SELECT pg_try_advisory_xact_lock(?, ?)", queryExecutionLockClass, i); err != nil {
+			tx.Rollback()
+			return nil, PTOWrapError(err)
+		}
+		if ok {
+			return &executionToken{tx: tx}, nil
+		}
+	}
+
+	if err := tx.Rollback(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return nil, nil
+}
+
+// release returns an execution token.
+func (tok *executionToken) release() error {
+	if err := tok.tx.Rollback(); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
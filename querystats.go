@@ -0,0 +1,123 @@
+package pto3
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryStatistics describes the execution of a query, for troubleshooting
+// slow query shapes. Statistics are only recorded if enabled by the
+// RecordQueryStatistics configuration option.
+type QueryStatistics struct {
+	// SQL of the first statement executed for the query; observation queries
+	// execute the same statement repeatedly, once per batch of results.
+	SQL string `json:"sql"`
+	// Number of statements executed
+	Statements int `json:"statements"`
+	// Wall-clock execution time in milliseconds
+	ExecMillis int64 `json:"exec_ms"`
+	// Total time spent waiting on the database in milliseconds
+	DBMillis int64 `json:"db_ms"`
+	// Number of rows returned by the database
+	RowsScanned int `json:"rows_scanned"`
+}
+
+// queryStatsHook is a query hook which accumulates statistics for the
+// statements executed by a single query.
+type queryStatsHook struct {
+	lock    sync.Mutex
+	stats   QueryStatistics
+	dbTime  time.Duration
+	started time.Time
+}
+
+func (qsh *queryStatsHook) BeforeQuery(qe *pg.QueryEvent) {}
+
+func (qsh *queryStatsHook) AfterQuery(qe *pg.QueryEvent) {
+	elapsed := time.Since(qe.StartTime)
+
+	qsh.lock.Lock()
+	defer qsh.lock.Unlock()
+
+	if qsh.stats.Statements == 0 {
+		if sql, err := qe.FormattedQuery(); err == nil {
+			qsh.stats.SQL = sql
+		}
+	}
+	qsh.stats.Statements++
+	qsh.dbTime += elapsed
+	if qe.Result != nil {
+		qsh.stats.RowsScanned += qe.Result.RowsReturned()
+	}
+}
+
+// statistics returns the statistics accumulated by this hook since it was
+// created.
+func (qsh *queryStatsHook) statistics() *QueryStatistics {
+	qsh.lock.Lock()
+	defer qsh.lock.Unlock()
+
+	out := qsh.stats
+	out.ExecMillis = int64(time.Since(qsh.started) / time.Millisecond)
+	out.DBMillis = int64(qsh.dbTime / time.Millisecond)
+	return &out
+}
+
+// executionDB returns a handle to the observation database for executing
+// this query. If statistics recording is enabled, the handle records
+// statistics for the statements executed through it in the returned hook;
+// otherwise, the hook is nil. If the span in the given context is being
+// recorded, the handle also records a child span for each statement.
+// Statements through the handle are cancelled when the context is done.
+func (q *Query) executionDB(ctx context.Context) (*pg.DB, *queryStatsHook) {
+	db := q.qc.db.WithContext(ctx)
+	tracing := trace.SpanFromContext(ctx).IsRecording()
+	if !q.qc.config.RecordQueryStatistics && !tracing {
+		return db, nil
+	}
+
+	// WithParam returns a copy of the handle sharing the connection pool,
+	// so that the hooks see only this query's statements.
+	db = db.WithParam("pto_query", q.Identifier)
+
+	var qsh *queryStatsHook
+	if q.qc.config.RecordQueryStatistics {
+		qsh = &queryStatsHook{started: time.Now()}
+		db.AddQueryHook(qsh)
+	}
+	if tracing {
+		db.AddQueryHook(&traceQueryHook{ctx: ctx})
+	}
+	return db, qsh
+}
+
+// Statistics returns the statistics recorded when this query was last
+// executed, or nil if none were recorded.
+func (q *Query) Statistics() *QueryStatistics {
+	return q.stats
+}
+
+// DumpDebugJSONObject returns this query's metadata as with MarshalJSON,
+// together with its execution statistics, if any, in __sql, __exec_ms,
+// __db_ms, __statements, and __rows_scanned.
+func (q *Query) DumpDebugJSONObject() ([]byte, error) {
+	jobj, err := q.jsonObject(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.stats != nil {
+		jobj["__sql"] = q.stats.SQL
+		jobj["__exec_ms"] = q.stats.ExecMillis
+		jobj["__db_ms"] = q.stats.DBMillis
+		jobj["__statements"] = q.stats.Statements
+		jobj["__rows_scanned"] = q.stats.RowsScanned
+	}
+
+	return json.Marshal(jobj)
+}
@@ -0,0 +1,214 @@
+package pto3
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// QueryTemplate is a parameterized query specification, stored under a
+// human-readable name, from which queries are instantiated by substituting
+// values for its parameters.
+type QueryTemplate struct {
+	// Reference to cache containing template
+	qc *QueryCache
+
+	// Human-readable name
+	Name string `sql:",pk"`
+	// Description of the analysis the template performs
+	Description string
+	// URL-encoded query specification, whose values may contain parameters
+	// as $name or ${name}
+	Template string `sql:",notnull"`
+	// Timestamps
+	Created  *time.Time
+	Modified *time.Time
+}
+
+// templateParameterRegexp matches parameters in query template values.
+var templateParameterRegexp = regexp.MustCompile(`\$(?:([A-Za-z_][A-Za-z0-9_]*)|\{([A-Za-z_][A-Za-z0-9_]*)\})`)
+
+// createQueryTemplateTables ensures the table holding query templates exists.
+func createQueryTemplateTables(db *pg.DB) error {
+	opts := orm.CreateTableOptions{IfNotExists: true}
+
+	if err := db.CreateTable(&QueryTemplate{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// parameterName returns the name of a parameter matched by
+// templateParameterRegexp.
+func parameterName(match []string) string {
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
+
+// form returns the specification of this template as a form, with
+// parameters in its values.
+func (qt *QueryTemplate) form() (url.Values, error) {
+	v, err := url.ParseQuery(qt.Template)
+	if err != nil {
+		return nil, PTOErrorf("bad query template: %v", err).StatusIs(http.StatusBadRequest)
+	}
+	return v, nil
+}
+
+// Parameters returns the names of the parameters of this template, sorted.
+func (qt *QueryTemplate) Parameters() []string {
+	form, err := qt.form()
+	if err != nil {
+		return nil
+	}
+
+	params := make(map[string]struct{})
+	for _, values := range form {
+		for _, value := range values {
+			for _, match := range templateParameterRegexp.FindAllStringSubmatch(value, -1) {
+				params[parameterName(match)] = struct{}{}
+			}
+		}
+	}
+
+	out := make([]string, 0, len(params))
+	for param := range params {
+		out = append(out, param)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Instantiate returns the query specification of this template as a form,
+// with the given values substituted for its parameters. Values are
+// substituted after the template is decoded, so they cannot add keys to the
+// specification. Every parameter must be given exactly one value, and only
+// parameters of the template may be given.
+func (qt *QueryTemplate) Instantiate(values url.Values) (url.Values, error) {
+	form, err := qt.form()
+	if err != nil {
+		return nil, err
+	}
+
+	params := qt.Parameters()
+	for _, param := range params {
+		if len(values[param]) != 1 {
+			return nil, PTOErrorf("query template %s requires exactly one value for parameter %s", qt.Name, param).StatusIs(http.StatusBadRequest)
+		}
+	}
+	for param := range values {
+		i := sort.SearchStrings(params, param)
+		if i == len(params) || params[i] != param {
+			return nil, PTOErrorf("query template %s has no parameter %s", qt.Name, param).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	out := make(url.Values)
+	for key, vs := range form {
+		for _, v := range vs {
+			out.Add(key, templateParameterRegexp.ReplaceAllStringFunc(v, func(s string) string {
+				return values.Get(parameterName(templateParameterRegexp.FindStringSubmatch(s)))
+			}))
+		}
+	}
+
+	return out, nil
+}
+
+// PutQueryTemplate saves a query template under a name, replacing any
+// template previously saved under that name.
+func (qc *QueryCache) PutQueryTemplate(name string, description string, template string) (*QueryTemplate, error) {
+	if !namedQueryNameRegexp.MatchString(name) {
+		return nil, PTOErrorf("invalid query template name %s", name).StatusIs(http.StatusBadRequest)
+	}
+
+	now := time.Now()
+	qt := QueryTemplate{
+		qc:          qc,
+		Name:        name,
+		Description: description,
+		Template:    strings.TrimPrefix(template, "?"),
+		Created:     &now,
+		Modified:    &now,
+	}
+
+	if _, err := qt.form(); err != nil {
+		return nil, err
+	}
+
+	if _, err := qc.db.Model(&qt).
+		OnConflict("(name) DO UPDATE").
+		Set("description = EXCLUDED.description, template = EXCLUDED.template, modified = EXCLUDED.modified").
+		Insert(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return qc.QueryTemplateByName(name)
+}
+
+// QueryTemplateByName retrieves a query template, returning nil if no
+// template is saved under the given name.
+func (qc *QueryCache) QueryTemplateByName(name string) (*QueryTemplate, error) {
+	qt := QueryTemplate{Name: name}
+	if err := qc.db.Select(&qt); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, PTOWrapError(err)
+	}
+	qt.qc = qc
+
+	return &qt, nil
+}
+
+// QueryTemplateLinks returns links to all query templates in the cache,
+// sorted by name.
+func (qc *QueryCache) QueryTemplateLinks() ([]string, error) {
+	var names []string
+
+	if err := qc.db.Model((*QueryTemplate)(nil)).Column("name").Order("name").Select(&names); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make([]string, len(names))
+	for i := range names {
+		out[i], _ = qc.config.LinkTo("query/template/" + names[i])
+	}
+
+	return out, nil
+}
+
+func (qt *QueryTemplate) MarshalJSON() ([]byte, error) {
+	jobj := make(map[string]interface{})
+
+	jobj["name"] = qt.Name
+	jobj["description"] = qt.Description
+	jobj["template"] = qt.Template
+	jobj["parameters"] = qt.Parameters()
+
+	link, err := qt.qc.config.LinkTo("query/template/" + qt.Name)
+	if err != nil {
+		return nil, err
+	}
+	jobj["__link"] = link
+	jobj["__submit"] = link + "/submit"
+
+	if qt.Created != nil {
+		jobj["__created"] = qt.Created.Format(time.RFC3339)
+	}
+	if qt.Modified != nil {
+		jobj["__modified"] = qt.Modified.Format(time.RFC3339)
+	}
+
+	return json.Marshal(jobj)
+}
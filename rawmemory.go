@@ -0,0 +1,357 @@
+package pto3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryRawFile is a file in a MemoryRawStore campaign.
+type memoryRawFile struct {
+	md      *RawMetadata
+	data    []byte
+	hasData bool
+}
+
+// memoryRawCampaign is a campaign in a MemoryRawStore.
+type memoryRawCampaign struct {
+	md    *RawMetadata
+	files map[string]*memoryRawFile
+}
+
+// MemoryRawStore is a raw data store kept entirely in memory, implementing
+// RawStore. It applies the same metadata validation as RawDataStore, and
+// fills in the same virtual metadata, but nothing is persisted. It is meant
+// for tests and embedded or demo use.
+type MemoryRawStore struct {
+	config    *PTOConfiguration
+	schemas   map[string]*MetadataSchema
+	lock      sync.RWMutex
+	campaigns map[string]*memoryRawCampaign
+	uploads   uploadTable
+}
+
+// NewMemoryRawStore creates an empty in-memory raw data store, given a
+// configuration providing filetypes, vocabularies, and the base URL for
+// links.
+func NewMemoryRawStore(config *PTOConfiguration) (*MemoryRawStore, error) {
+	schemas, err := loadMetadataSchemas(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryRawStore{
+		config:    config,
+		schemas:   schemas,
+		campaigns: make(map[string]*memoryRawCampaign),
+	}, nil
+}
+
+// copyRawMetadata returns a copy of metadata, so that the store never shares
+// metadata it later updates with its callers.
+func copyRawMetadata(md *RawMetadata) *RawMetadata {
+	out := *md
+
+	out.Metadata = make(map[string]string, len(md.Metadata))
+	for k, v := range md.Metadata {
+		out.Metadata[k] = v
+	}
+
+	if md.links != nil {
+		out.links = make(map[string]string, len(md.links))
+		for k, v := range md.links {
+			out.links[k] = v
+		}
+	}
+
+	return &out
+}
+
+// campaign returns the named campaign. Caller must hold the lock.
+func (mrs *MemoryRawStore) campaign(camname string) (*memoryRawCampaign, error) {
+	cam, ok := mrs.campaigns[camname]
+	if !ok {
+		return nil, PTONotFoundError("campaign", camname)
+	}
+	return cam, nil
+}
+
+// file returns the named file in the named campaign. Caller must hold the
+// lock.
+func (mrs *MemoryRawStore) file(camname string, filename string) (*memoryRawFile, error) {
+	cam, err := mrs.campaign(camname)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := cam.files[filename]
+	if !ok || f.md == nil {
+		return nil, PTONotFoundError("file", filename)
+	}
+	return f, nil
+}
+
+// ScanCampaigns does nothing, as an in-memory store has no underlying
+// storage to scan.
+func (mrs *MemoryRawStore) ScanCampaigns() error {
+	return nil
+}
+
+// CampaignNames returns the names of all campaigns in the store.
+func (mrs *MemoryRawStore) CampaignNames() []string {
+	mrs.lock.RLock()
+	defer mrs.lock.RUnlock()
+
+	out := make([]string, 0, len(mrs.campaigns))
+	for camname := range mrs.campaigns {
+		out = append(out, camname)
+	}
+	return out
+}
+
+// GetCampaignMetadata returns the metadata of the named campaign.
+func (mrs *MemoryRawStore) GetCampaignMetadata(camname string) (*RawMetadata, error) {
+	mrs.lock.RLock()
+	defer mrs.lock.RUnlock()
+
+	cam, err := mrs.campaign(camname)
+	if err != nil {
+		return nil, err
+	}
+	return copyRawMetadata(cam.md), nil
+}
+
+// PutCampaignMetadata overwrites the metadata of the named campaign, creating
+// the campaign if it does not exist.
+func (mrs *MemoryRawStore) PutCampaignMetadata(camname string, md *RawMetadata) error {
+	if err := md.validate(true); err != nil {
+		return err
+	}
+	if err := md.checkVocabularies(mrs.config); err != nil {
+		return err
+	}
+
+	mrs.lock.Lock()
+	defer mrs.lock.Unlock()
+
+	cam, ok := mrs.campaigns[camname]
+	if !ok {
+		cam = &memoryRawCampaign{files: make(map[string]*memoryRawFile)}
+		mrs.campaigns[camname] = cam
+	}
+	cam.md = copyRawMetadata(md)
+
+	// files inherit from the new campaign metadata
+	for _, f := range cam.files {
+		if f.md != nil {
+			f.md.Parent = cam.md
+		}
+	}
+
+	return nil
+}
+
+// FileNames returns the sorted names of the files in the named campaign.
+func (mrs *MemoryRawStore) FileNames(camname string) ([]string, error) {
+	mrs.lock.RLock()
+	defer mrs.lock.RUnlock()
+
+	cam, err := mrs.campaign(camname)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(cam.files))
+	for filename, f := range cam.files {
+		if f.md != nil {
+			out = append(out, filename)
+		}
+	}
+	sort.Strings(out)
+
+	return out, nil
+}
+
+// GetFileMetadata returns the metadata of a file in the named campaign.
+func (mrs *MemoryRawStore) GetFileMetadata(camname string, filename string) (*RawMetadata, error) {
+	mrs.lock.RLock()
+	defer mrs.lock.RUnlock()
+
+	f, err := mrs.file(camname, filename)
+	if err != nil {
+		return nil, err
+	}
+	return copyRawMetadata(f.md), nil
+}
+
+// PutFileMetadata overwrites the metadata of a file in the named campaign.
+func (mrs *MemoryRawStore) PutFileMetadata(camname string, filename string, md *RawMetadata) error {
+	mrs.lock.Lock()
+	defer mrs.lock.Unlock()
+
+	cam, err := mrs.campaign(camname)
+	if err != nil {
+		return err
+	}
+
+	// inherit from campaign
+	md.Parent = cam.md
+
+	// ensure we have a filetype, and that the metadata uses configured
+	// vocabularies and conforms to the filetype's schema, if any
+	if md.Filetype(true) == "" {
+		return PTOMissingMetadataError("_file_type")
+	}
+	if err := md.checkVocabularies(mrs.config); err != nil {
+		return err
+	}
+	if schema := mrs.schemas[md.Filetype(true)]; schema != nil {
+		if err := schema.Validate(md); err != nil {
+			return err
+		}
+	}
+
+	f, ok := cam.files[filename]
+	if !ok {
+		f = new(memoryRawFile)
+		cam.files[filename] = f
+	}
+
+	// carry over virtual metadata describing the data
+	now := time.Now()
+	if f.md != nil {
+		md.datasize = f.md.datasize
+		md.recordcount = f.md.recordcount
+		md.creatime = f.md.creatime
+	} else {
+		md.creatime = &now
+	}
+	md.modtime = &now
+	if err := mrs.updateLinks(camname, filename, md); err != nil {
+		return err
+	}
+	f.md = copyRawMetadata(md)
+
+	return nil
+}
+
+// updateLinks fills in the links in the virtual metadata of a file.
+func (mrs *MemoryRawStore) updateLinks(camname string, filename string, md *RawMetadata) error {
+	var err error
+	md.datalink, md.links, err = rawFileLinks(mrs.config, camname, filename)
+	return err
+}
+
+// OpenFileData opens the data of a file in the named campaign for reading.
+func (mrs *MemoryRawStore) OpenFileData(camname string, filename string) (io.ReadSeekCloser, error) {
+	mrs.lock.RLock()
+	defer mrs.lock.RUnlock()
+
+	f, err := mrs.file(camname, filename)
+	if err != nil {
+		return nil, err
+	}
+	if !f.hasData {
+		return nil, PTONotFoundError("data for file", filename)
+	}
+
+	// data is never modified in place, so it can be read without the lock
+	return readSeekNopCloser{bytes.NewReader(f.data)}, nil
+}
+
+// ReadFileDataToStream copies the data of a file in the named campaign to a
+// writer.
+func (mrs *MemoryRawStore) ReadFileDataToStream(camname string, filename string, out io.Writer) error {
+	in, err := mrs.OpenFileData(camname, filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// WriteFileDataFromStream copies data from a reader to a file in the named
+// campaign, failing if the file already has data. Records in NDJSON files are
+// counted as they are copied.
+func (mrs *MemoryRawStore) WriteFileDataFromStream(camname string, filename string, in io.Reader) error {
+	return mrs.WriteFileDataFromStreamContext(context.Background(), camname, filename, in, -1)
+}
+
+// WriteFileDataFromStreamContext works like WriteFileDataFromStream, but
+// stops copying with the context's error when the given context is done, and
+// tracks upload progress against the expected size, negative if unknown.
+func (mrs *MemoryRawStore) WriteFileDataFromStreamContext(ctx context.Context, camname string, filename string, in io.Reader, size int64) (err error) {
+	// read outside the lock, since the reader may be slow
+	var buf bytes.Buffer
+	var rc *recordCounter
+	var dst io.Writer = &buf
+
+	mrs.lock.RLock()
+	f, err := mrs.file(camname, filename)
+	if err == nil && f.hasData {
+		err = PTOExistsError("file", filename)
+	}
+	if err == nil {
+		if ctype, ok := mrs.config.ContentTypes[f.md.Filetype(true)]; ok && isNDJSON(ctype) {
+			rc = new(recordCounter)
+			dst = io.MultiWriter(&buf, rc)
+		}
+	}
+	mrs.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	pr, ut := mrs.uploads.begin(camname, filename, &contextReader{ctx: ctx, r: in}, size)
+	defer func() { ut.finish(err) }()
+
+	if _, err := io.Copy(dst, pr); err != nil {
+		return err
+	}
+
+	mrs.lock.Lock()
+	defer mrs.lock.Unlock()
+
+	// make sure the file didn't go away or get data in the meantime
+	if f, err = mrs.file(camname, filename); err != nil {
+		return err
+	} else if f.hasData {
+		return PTOExistsError("file", filename)
+	}
+
+	f.data = buf.Bytes()
+	f.hasData = true
+
+	now := time.Now()
+	f.md.datasize = len(f.data)
+	f.md.creatime = &now
+	if f.md.modtime == nil || f.md.modtime.Before(now) {
+		f.md.modtime = &now
+	}
+	if rc != nil {
+		count := rc.count()
+		f.md.recordcount = &count
+	} else {
+		f.md.recordcount = nil
+	}
+
+	return nil
+}
+
+// UploadProgress returns the progress of the current or most recent upload to
+// a file in a campaign in this store, or nil if none is known.
+func (mrs *MemoryRawStore) UploadProgress(camname string, filename string) *UploadProgress {
+	return mrs.uploads.progress(camname, filename)
+}
+
+// CheckHealth always succeeds, as an in-memory store can always be written.
+func (mrs *MemoryRawStore) CheckHealth() error {
+	return nil
+}
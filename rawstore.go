@@ -1,7 +1,11 @@
 package pto3
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -12,7 +16,9 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // CampaignMetadataFilename is the name of each campaign metadata file in each campaign directory
@@ -21,9 +27,22 @@ const CampaignMetadataFilename = "__pto_campaign_metadata.json"
 // FileMetadataSuffix is the suffix on each metadata file on disk
 const FileMetadataSuffix = ".pto_file_metadata.json"
 
+// CampaignLockFilename is the name of the lock file in each campaign
+// directory, used to serialize metadata changes among processes
+const CampaignLockFilename = ".pto_campaign_lock"
+
 // DeletionTagSuffix is the suffix on a deletion tag on disk
 const DeletionTagSuffix = ".pto_file_delete_me"
 
+// campaignTempPrefix is the prefix on temporary directories in which new
+// campaigns are built before being renamed into place
+const campaignTempPrefix = ".pto_campaign_tmp."
+
+// staleCampaignTempAge is the age after which a temporary campaign directory
+// is assumed to have been left behind by a failed creation, and removed when
+// a raw data store is opened
+const staleCampaignTempAge = time.Hour
+
 // DataRelativeURL is the path relative to each file metadata path for content access
 var DataRelativeURL *url.URL
 
@@ -47,8 +66,12 @@ type RawMetadata struct {
 	Metadata map[string]string
 	// Link to data object
 	datalink string
+	// Links to related resources, by relation
+	links map[string]string
 	// Size of data object
 	datasize int
+	// Number of records in data object, if counted
+	recordcount *int
 	// File creation time
 	creatime *time.Time
 	// Metadata modification time
@@ -138,6 +161,19 @@ func (md *RawMetadata) ModificationTime() *time.Time {
 	return md.modtime
 }
 
+// DataSize returns the size of the data object this metadata describes, or 0
+// if it has no data.
+func (md *RawMetadata) DataSize() int {
+	return md.datasize
+}
+
+// RecordCount returns the number of records in the data object this metadata
+// describes, or nil if they were not counted: records are counted for
+// NDJSON files as they are uploaded.
+func (md *RawMetadata) RecordCount() *int {
+	return md.recordcount
+}
+
 // DumpJSONObject serializes a RawMetadata object to JSON. If inherit is true,
 // this inherits data and metadata items from the parent; if false, it only
 // dumps information in this object itself.
@@ -170,10 +206,18 @@ func (md *RawMetadata) DumpJSONObject(inherit bool) ([]byte, error) {
 		jmap["__data"] = md.datalink
 	}
 
+	if len(md.links) > 0 {
+		jmap["__links"] = md.links
+	}
+
 	if md.datasize != 0 {
 		jmap["__data_size"] = md.datasize
 	}
 
+	if md.recordcount != nil {
+		jmap["__record_count"] = *md.recordcount
+	}
+
 	if md.creatime != nil {
 		jmap["__created"] = md.creatime.Format(time.RFC3339)
 	}
@@ -236,14 +280,14 @@ func (md *RawMetadata) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// writeToFile writes this RawMetadata object as JSON to a file.
+// writeToFile atomically writes this RawMetadata object as JSON to a file.
 func (md *RawMetadata) writeToFile(pathname string) error {
 	b, err := md.DumpJSONObject(false)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(pathname, b, 0644)
+	return WriteFileAtomic(pathname, b, 0644)
 }
 
 // validate returns nil if the metadata is valid (i.e., it or its parent has all required keys), or an error if not
@@ -273,6 +317,46 @@ func (md *RawMetadata) validate(isCampaign bool) error {
 	return nil
 }
 
+// checkVocabularies returns an error listing the keys of this metadata object
+// itself, not inherited from its parent, whose values are not in the
+// vocabularies configured for them, with the values allowed for each, or nil
+// if there are none.
+func (md *RawMetadata) checkVocabularies(config *PTOConfiguration) error {
+	if len(config.MetadataVocabularies) == 0 {
+		return nil
+	}
+
+	keys := md.Keys(false)
+	sort.Strings(keys)
+
+	violations := make([]string, 0)
+	for _, k := range keys {
+		vocabulary, ok := config.MetadataVocabularies[k]
+		if !ok {
+			continue
+		}
+
+		v := md.Get(k, false)
+		allowed := false
+		for _, term := range vocabulary {
+			if v == term {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("%s %q not one of %s", k, v, strings.Join(vocabulary, ", ")))
+		}
+	}
+
+	if len(violations) > 0 {
+		return PTOErrorf("metadata values not in vocabulary: %s", strings.Join(violations, "; ")).
+			StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadMetadata)
+	}
+
+	return nil
+}
+
 // RawMetadataFromReader reads metadata for a raw data file from a stream. It
 // creates a new RawMetadata object bound to an optional parent.
 func RawMetadataFromReader(r io.Reader, parent *RawMetadata) (*RawMetadata, error) {
@@ -309,6 +393,13 @@ type RawFiletype struct {
 	Filetype string `json:"file_type"`
 	// Associated MIME type
 	ContentType string `json:"mime_type"`
+	// True if files of this type are compressed with a registered
+	// decompressor
+	Compressed bool `json:"compressed"`
+	// Maximum upload size in bytes, zero for no limit
+	MaxUploadSize int64 `json:"max_upload_size,omitempty"`
+	// Validator for files of this type, if configured
+	Validator string `json:"validator,omitempty"`
 }
 
 // FIXME reconsider design of RawFiletype
@@ -316,9 +407,17 @@ type RawFiletype struct {
 // Campaign encapsulates a single campaign in a raw data store,
 // and caches metadata for the campaign and files within it.
 type Campaign struct {
+	// time of last metadata access in nanoseconds since the epoch, for
+	// unloading least recently used campaigns; accessed atomically, so first
+	// for alignment
+	lastUsed int64
+
 	// application configuration
 	config *PTOConfiguration
 
+	// store containing this campaign
+	rds *RawDataStore
+
 	// path to campaign directory
 	path string
 
@@ -339,13 +438,14 @@ type Campaign struct {
 // disk containing the campaign's files. If a pointer to metadata is given, it
 // creates a new campaign directory on disk with the given metadata. Error can
 // be ignored if metadata is nil.
-func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campaign, error) {
+func newCampaign(rds *RawDataStore, name string, md *RawMetadata) (*Campaign, error) {
 
+	config := rds.config
 	cam := &Campaign{
-		config:       config,
-		path:         filepath.Join(config.RawRoot, name),
-		stale:        true,
-		fileMetadata: make(map[string]*RawMetadata),
+		config: config,
+		rds:    rds,
+		path:   filepath.Join(config.RawRoot, name),
+		stale:  true,
 	}
 
 	// metadata means try to create new campaign
@@ -355,6 +455,9 @@ func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campa
 		if err := md.validate(true); err != nil {
 			return nil, err
 		}
+		if err := md.checkVocabularies(config); err != nil {
+			return nil, err
+		}
 
 		// then check to see if the campaign directory exists
 		_, err := os.Stat(cam.path)
@@ -362,16 +465,32 @@ func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campa
 			return nil, PTOExistsError("campaign", name)
 		}
 
-		// create directory
-		if err := os.Mkdir(cam.path, 0755); err != nil {
+		// build the campaign in a temporary directory and rename it into place
+		// once complete, so that a failed creation leaves no half-created
+		// campaign behind
+		tmppath, err := ioutil.TempDir(config.RawRoot, campaignTempPrefix+name+".")
+		if err != nil {
+			return nil, PTOWrapError(err)
+		}
+		defer os.RemoveAll(tmppath)
+
+		if err := os.Chmod(tmppath, 0755); err != nil {
 			return nil, PTOWrapError(err)
 		}
 
 		// write metadata to campaign metadata file
-		if err := md.writeToFile(filepath.Join(cam.path, CampaignMetadataFilename)); err != nil {
+		if err := md.writeToFile(filepath.Join(tmppath, CampaignMetadataFilename)); err != nil {
 			return nil, err
 		}
 
+		if err := os.Rename(tmppath, cam.path); err != nil {
+			if os.IsExist(err) {
+				// lost a race with another creation of the same campaign
+				return nil, PTOExistsError("campaign", name)
+			}
+			return nil, PTOWrapError(err)
+		}
+
 		// and force a rescan
 		if err := cam.reloadMetadata(true); err != nil {
 			return nil, err
@@ -383,18 +502,50 @@ func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campa
 
 }
 
-// reloadMetadata reloads the metadata for this campaign and its files from disk
+// lockDirectory acquires an advisory lock on this campaign's directory,
+// excluding other processes from changing its metadata while held. Shared
+// locks are taken for reading, exclusive locks for writing.
+func (cam *Campaign) lockDirectory(exclusive bool) (*fileLock, error) {
+	return lockFile(filepath.Join(cam.path, CampaignLockFilename), exclusive)
+}
+
+// reloadMetadata reloads the metadata for this campaign and its files from
+// disk if it is stale or if forced, and marks the campaign as used. If
+// metadata was loaded, metadata for least recently used campaigns may be
+// unloaded to keep within the configured limit.
 func (cam *Campaign) reloadMetadata(force bool) error {
-	var err error
+	atomic.StoreInt64(&cam.lastUsed, time.Now().UnixNano())
 
 	cam.lock.Lock()
-	defer cam.lock.Unlock()
+	loaded := false
+	if force || cam.stale {
+		if err := cam.loadMetadata(); err != nil {
+			cam.lock.Unlock()
+			return err
+		}
+		loaded = true
+	}
+	cam.lock.Unlock()
 
-	// skip if not stale
-	if !force && !cam.stale {
-		return nil
+	if loaded {
+		cam.rds.trimMetadataCache(cam)
 	}
 
+	return nil
+}
+
+// loadMetadata loads the metadata for this campaign and its files from disk.
+// Caller must hold the campaign lock.
+func (cam *Campaign) loadMetadata() error {
+	var err error
+
+	// don't read while another process is writing
+	fl, err := cam.lockDirectory(false)
+	if err != nil {
+		return err
+	}
+	defer fl.unlock()
+
 	// load the campaign metadata file
 	cam.campaignMetadata, err = RawMetadataFromFile(filepath.Join(cam.path, CampaignMetadataFilename), nil)
 	if err != nil {
@@ -402,6 +553,7 @@ func (cam *Campaign) reloadMetadata(force bool) error {
 	}
 
 	// now scan directory and load each metadata file
+	cam.fileMetadata = make(map[string]*RawMetadata)
 	direntries, err := ioutil.ReadDir(cam.path)
 	for _, direntry := range direntries {
 		metafilename := direntry.Name()
@@ -424,6 +576,30 @@ func (cam *Campaign) reloadMetadata(force bool) error {
 	return nil
 }
 
+// rlockMetadata loads this campaign's metadata if necessary, and returns
+// holding a read lock on it. Metadata may be unloaded between loading and
+// locking, in which case it is loaded again.
+func (cam *Campaign) rlockMetadata() error {
+	for {
+		if err := cam.reloadMetadata(false); err != nil {
+			return err
+		}
+
+		cam.lock.RLock()
+		if !cam.stale {
+			return nil
+		}
+		cam.lock.RUnlock()
+	}
+}
+
+// isLoaded returns true if this campaign's metadata is loaded.
+func (cam *Campaign) isLoaded() bool {
+	cam.lock.RLock()
+	defer cam.lock.RUnlock()
+	return !cam.stale
+}
+
 // unloadMetadata allows a campaign's metadata to be garbage-collected, requiring reload on access.
 func (cam *Campaign) unloadMetadata() {
 	cam.lock.Lock()
@@ -437,10 +613,10 @@ func (cam *Campaign) unloadMetadata() {
 // GetCampaignMetadata returns the metadata for this campaign.
 func (cam *Campaign) GetCampaignMetadata() (*RawMetadata, error) {
 	// reload if stale
-	err := cam.reloadMetadata(false)
-	if err != nil {
+	if err := cam.rlockMetadata(); err != nil {
 		return nil, err
 	}
+	defer cam.lock.RUnlock()
 
 	return cam.campaignMetadata, nil
 }
@@ -454,6 +630,15 @@ func (cam *Campaign) PutCampaignMetadata(md *RawMetadata) error {
 	if err := md.validate(true); err != nil {
 		return err
 	}
+	if err := md.checkVocabularies(cam.config); err != nil {
+		return err
+	}
+
+	fl, err := cam.lockDirectory(true)
+	if err != nil {
+		return err
+	}
+	defer fl.unlock()
 
 	// write to campaign metadata file
 	if err := md.writeToFile(filepath.Join(cam.path, CampaignMetadataFilename)); err != nil {
@@ -468,13 +653,11 @@ func (cam *Campaign) PutCampaignMetadata(md *RawMetadata) error {
 // FileNames returns a sorted  list of filenames currently in the campaign.
 func (cam *Campaign) FileNames() ([]string, error) {
 	// reload if stale
-	err := cam.reloadMetadata(false)
-	if err != nil {
+	if err := cam.rlockMetadata(); err != nil {
 		return nil, err
 	}
-
-	cam.lock.RLock()
 	defer cam.lock.RUnlock()
+
 	out := make([]string, len(cam.fileMetadata))
 	i := 0
 	for filename := range cam.fileMetadata {
@@ -490,10 +673,10 @@ func (cam *Campaign) FileNames() ([]string, error) {
 // GetFileMetadata retrieves metadata for a file in this campaign given a file name.
 func (cam *Campaign) GetFileMetadata(filename string) (*RawMetadata, error) {
 	// reload if stale
-	err := cam.reloadMetadata(false)
-	if err != nil {
+	if err := cam.rlockMetadata(); err != nil {
 		return nil, err
 	}
+	defer cam.lock.RUnlock()
 
 	// check for file metadata
 	filemd, ok := cam.fileMetadata[filename]
@@ -528,6 +711,12 @@ func (cam *Campaign) updateFileVirtualMetadata(filename string) error {
 		return err
 	}
 
+	// get record count, if counted on upload
+	md.recordcount, err = readRecordCount(filepath.Join(cam.path, filename))
+	if err != nil {
+		return err
+	}
+
 	// get modification time (from metadata file modification time)
 	metafi, err := os.Stat(filepath.Join(cam.path, filename+FileMetadataSuffix))
 	if err == nil {
@@ -545,26 +734,59 @@ func (cam *Campaign) updateFileVirtualMetadata(filename string) error {
 		return err
 	}
 
-	// generate data path
-	md.datalink, err = cam.config.LinkTo("raw/" + filepath.Base(cam.path) + "/" + filename + "/data")
+	// generate data path and links to related resources
+	md.datalink, md.links, err = rawFileLinks(cam.config, filepath.Base(cam.path), filename)
+	return err
+}
+
+// rawFileLinks returns the data link of a file in a campaign, and the links
+// to related resources for its virtual metadata: the file itself, its data,
+// its campaign, and its history, the audit log of operations on it.
+func rawFileLinks(config *PTOConfiguration, camname string, filename string) (string, map[string]string, error) {
+	path := "raw/" + camname + "/" + filename
+
+	datalink, err := config.LinkTo(path + "/data")
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	return nil
+	camlink, err := config.LinkTo("raw/" + camname)
+	if err != nil {
+		return "", nil, err
+	}
+
+	selflink, err := config.LinkTo(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	historylink, err := config.LinkTo("admin/audit?" + url.Values{"target": {"/" + path}}.Encode())
+	if err != nil {
+		return "", nil, err
+	}
+
+	return datalink, map[string]string{
+		"self":     selflink,
+		"data":     datalink,
+		"campaign": camlink,
+		"history":  historylink,
+	}, nil
 }
 
 // PutFileMetadata overwrites the metadata in this campaign with the given metadata.
 func (cam *Campaign) PutFileMetadata(filename string, md *RawMetadata) error {
-	// reload if stale
-	err := cam.reloadMetadata(false)
-	if err != nil {
-		return err
-	}
+	atomic.StoreInt64(&cam.lastUsed, time.Now().UnixNano())
 
 	cam.lock.Lock()
 	defer cam.lock.Unlock()
 
+	// reload if stale
+	if cam.stale {
+		if err := cam.loadMetadata(); err != nil {
+			return err
+		}
+	}
+
 	// inherit from campaign
 	md.Parent = cam.campaignMetadata
 
@@ -573,6 +795,23 @@ func (cam *Campaign) PutFileMetadata(filename string, md *RawMetadata) error {
 		return PTOMissingMetadataError("_file_type")
 	}
 
+	// and that the metadata uses configured vocabularies, and conforms to
+	// the filetype's schema, if any
+	if err := md.checkVocabularies(cam.config); err != nil {
+		return err
+	}
+	if schema := cam.rds.schemas[md.Filetype(true)]; schema != nil {
+		if err := schema.Validate(md); err != nil {
+			return err
+		}
+	}
+
+	fl, err := cam.lockDirectory(true)
+	if err != nil {
+		return err
+	}
+	defer fl.unlock()
+
 	// write to file metadata file
 	err = md.writeToFile(filepath.Join(cam.path, filename+FileMetadataSuffix))
 	if err != nil {
@@ -589,10 +828,10 @@ func (cam *Campaign) PutFileMetadata(filename string, md *RawMetadata) error {
 // GetFiletype returns the filetype associated with a given file in this campaign.
 func (cam *Campaign) GetFiletype(filename string) *RawFiletype {
 	// reload if stale
-	err := cam.reloadMetadata(false)
-	if err != nil {
+	if err := cam.rlockMetadata(); err != nil {
 		return nil
 	}
+	defer cam.lock.RUnlock()
 
 	md, ok := cam.fileMetadata[filename]
 	if !ok {
@@ -605,7 +844,7 @@ func (cam *Campaign) GetFiletype(filename string) *RawFiletype {
 		return nil
 	}
 
-	return &RawFiletype{ftname, ctype}
+	return &RawFiletype{Filetype: ftname, ContentType: ctype}
 }
 
 // ReadFileData opens and returns the data file associated with a filename on this campaign for reading.
@@ -623,6 +862,12 @@ func (cam *Campaign) ReadFileData(filename string) (*os.File, error) {
 // ReadFileDataToStream copies data from the data file associated with a
 // filename on this campaign to a given writer.
 func (cam *Campaign) ReadFileDataToStream(filename string, out io.Writer) error {
+	return cam.ReadFileDataToStreamContext(context.Background(), filename, out)
+}
+
+// ReadFileDataToStreamContext works like ReadFileDataToStream, but stops
+// copying with the context's error when the given context is done.
+func (cam *Campaign) ReadFileDataToStreamContext(ctx context.Context, filename string, out io.Writer) error {
 	in, err := cam.ReadFileData(filename)
 	if err != nil {
 		return err
@@ -630,13 +875,115 @@ func (cam *Campaign) ReadFileDataToStream(filename string, out io.Writer) error
 	defer in.Close()
 
 	// now copy to the writer until EOF
-	if _, err := io.Copy(out, in); err != nil {
+	if _, err := io.Copy(out, &contextReader{ctx: ctx, r: in}); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// MaxPreviewLineLength is the number of bytes of each line returned by
+// PreviewFileData; longer lines are truncated.
+const MaxPreviewLineLength = 4096
+
+// PreviewFileData returns up to n lines from the start of the data file
+// associated with a filename on this campaign, decompressing it if its
+// filetype is compressed, and whether the file has more lines. Lines longer
+// than MaxPreviewLineLength bytes are truncated. Returns an error with status
+// 415 if the data is not text, i.e. not UTF-8 or containing NUL bytes.
+func (cam *Campaign) PreviewFileData(filename string, n int) ([]string, bool, error) {
+	md, err := cam.GetFileMetadata(filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	in, err := cam.ReadFileData(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer in.Close()
+
+	return previewFileData(md.Filetype(true), filename, in, n)
+}
+
+// PreviewRawFileData works like Campaign.PreviewFileData, for a file in a
+// campaign in any raw data store.
+func PreviewRawFileData(store RawStore, camname string, filename string, n int) ([]string, bool, error) {
+	md, err := store.GetFileMetadata(camname, filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	in, err := store.OpenFileData(camname, filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer in.Close()
+
+	return previewFileData(md.Filetype(true), filename, in, n)
+}
+
+// previewFileData returns up to n lines from the start of a file's data of a
+// given filetype, as PreviewFileData does.
+func previewFileData(filetype string, filename string, in io.Reader, n int) ([]string, bool, error) {
+	rawin, _, err := NewDecompressingReader(filetype, in)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rawin.Close()
+
+	br := bufio.NewReader(rawin)
+	out := make([]string, 0, n)
+	for {
+		line, err := readPreviewLine(br)
+		if err == io.EOF {
+			return out, false, nil
+		} else if err != nil {
+			return nil, false, PTOWrapError(err)
+		}
+
+		if len(out) == n {
+			return out, true, nil
+		}
+
+		if !utf8.Valid(line) || bytes.IndexByte(line, 0) >= 0 {
+			return nil, false, PTOErrorf("data for file %s is not text", filename).
+				StatusIs(http.StatusUnsupportedMediaType).CodeIs(ErrCodeUnsupportedMediaType)
+		}
+
+		out = append(out, string(line))
+	}
+}
+
+// readPreviewLine reads a line without its line ending, truncated to
+// MaxPreviewLineLength bytes, discarding the remainder of the line. It returns
+// io.EOF only if no bytes remain.
+func readPreviewLine(br *bufio.Reader) ([]byte, error) {
+	line := make([]byte, 0)
+	for {
+		frag, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = nil
+			}
+			return line, err
+		}
+		if room := MaxPreviewLineLength - len(line); room > 0 {
+			if len(frag) > room {
+				// don't cut a UTF-8 sequence in half
+				for room > 0 && !utf8.RuneStart(frag[room]) {
+					room--
+				}
+				frag = frag[:room]
+			}
+			line = append(line, frag...)
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
 // WriteDataFile creates, open and returns the data file associated with a
 // filename on this campaign for writing.If force is true, replaces the data
 // file if it exists; otherwise, returns an error if the data file exists.
@@ -647,7 +994,14 @@ func (cam *Campaign) WriteFileData(filename string, force bool) (*os.File, error
 		return nil, PTOErrorf("path %s is not ok", rawpath).StatusIs(http.StatusInternalServerError)
 	}
 
-	// ensure file isn't there unless we're forcing overwrite
+	// ensure file isn't there unless we're forcing overwrite; hold the
+	// campaign lock so another process can't create it in the meantime
+	fl, err := cam.lockDirectory(true)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.unlock()
+
 	if !force {
 		_, err := os.Stat(rawpath)
 		if (err == nil) || !os.IsNotExist(err) {
@@ -662,15 +1016,37 @@ func (cam *Campaign) WriteFileData(filename string, force bool) (*os.File, error
 // WriteFileDataFromStream copies data from a given reader to the data file
 // associated with a filename on this campaign. If force is true, replaces the
 // data file if it exists; otherwise, returns an error if the data file exists.
-func (cam *Campaign) WriteFileDataFromStream(filename string, force bool, in io.Reader) error {
+// Progress of the copy is available from the raw data store's UploadProgress
+// while it runs; size is the number of bytes expected, or negative if
+// unknown.
+func (cam *Campaign) WriteFileDataFromStream(filename string, force bool, in io.Reader, size int64) error {
+	return cam.WriteFileDataFromStreamContext(context.Background(), filename, force, in, size)
+}
+
+// WriteFileDataFromStreamContext works like WriteFileDataFromStream, but
+// stops copying with the context's error when the given context is done,
+// removing the partial data file.
+func (cam *Campaign) WriteFileDataFromStreamContext(ctx context.Context, filename string, force bool, in io.Reader, size int64) (err error) {
 	out, err := cam.WriteFileData(filename, force)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	// now copy from the reader until EOF
-	if _, err := io.Copy(out, in); err != nil {
+	pr, ut := cam.rds.uploads.begin(filepath.Base(cam.path), filename, &contextReader{ctx: ctx, r: in}, size)
+	defer func() { ut.finish(err) }()
+
+	// count records in NDJSON files as they are copied
+	var rc *recordCounter
+	var dst io.Writer = out
+	if ft := cam.GetFiletype(filename); ft != nil && isNDJSON(ft.ContentType) {
+		rc = new(recordCounter)
+		dst = io.MultiWriter(out, rc)
+	}
+
+	// now copy from the reader until EOF, removing partial data on failure
+	if _, err := io.Copy(dst, pr); err != nil {
+		os.Remove(out.Name())
 		return err
 	}
 
@@ -679,9 +1055,22 @@ func (cam *Campaign) WriteFileDataFromStream(filename string, force bool, in io.
 		return PTOWrapError(err)
 	}
 
-	// update virtual metadata, as the underlying file size will have changed
+	// store the record count, or remove one left by a replaced file
+	if rc != nil {
+		if err := writeRecordCount(out.Name(), rc.count()); err != nil {
+			return err
+		}
+	} else if err := os.Remove(out.Name() + RecordCountSuffix); err != nil && !os.IsNotExist(err) {
+		return PTOWrapError(err)
+	}
+
+	// update virtual metadata, as the underlying file size will have changed;
+	// if metadata is not loaded, this will happen when it is
 	cam.lock.Lock()
 	defer cam.lock.Unlock()
+	if cam.stale {
+		return nil
+	}
 	return cam.updateFileVirtualMetadata(filename)
 }
 
@@ -699,6 +1088,12 @@ type RawDataStore struct {
 
 	// campaign cache
 	campaigns map[string]*Campaign
+
+	// progress of uploads through this store
+	uploads uploadTable
+
+	// metadata schemas by filetype
+	schemas map[string]*MetadataSchema
 }
 
 // ScanCampaigns updates the campaign cache in RawDataStore to reflect the
@@ -716,7 +1111,7 @@ func (rds *RawDataStore) ScanCampaigns() error {
 	}
 
 	for _, direntry := range direntries {
-		if direntry.IsDir() {
+		if direntry.IsDir() && !strings.HasPrefix(direntry.Name(), campaignTempPrefix) {
 
 			// look for a metadata file
 			mdpath := filepath.Join(rds.path, direntry.Name(), CampaignMetadataFilename)
@@ -731,7 +1126,7 @@ func (rds *RawDataStore) ScanCampaigns() error {
 			}
 
 			// create a new (stale) campaign
-			cam, _ := newCampaign(rds.config, direntry.Name(), nil)
+			cam, _ := newCampaign(rds, direntry.Name(), nil)
 			rds.campaigns[direntry.Name()] = cam
 		}
 	}
@@ -741,7 +1136,7 @@ func (rds *RawDataStore) ScanCampaigns() error {
 
 // CreateCampaign creates a new campaign given a campaign name and initial metadata for the new campaign.
 func (rds *RawDataStore) CreateCampaign(camname string, md *RawMetadata) (*Campaign, error) {
-	cam, err := newCampaign(rds.config, camname, md)
+	cam, err := newCampaign(rds, camname, md)
 	if err != nil {
 		return nil, err
 	}
@@ -758,8 +1153,45 @@ func (rds *RawDataStore) CreateCampaign(camname string, md *RawMetadata) (*Campa
 	return cam, nil
 }
 
-// CampaignForName returns a campaign object for a given name.
+// trimMetadataCache unloads metadata for the least recently used campaigns
+// past the number configured by RawMetadataCacheCampaigns, if any, sparing a
+// given campaign which has just been loaded.
+func (rds *RawDataStore) trimMetadataCache(spare *Campaign) {
+	limit := rds.config.RawMetadataCacheCampaigns
+	if limit <= 0 {
+		return
+	}
+
+	rds.lock.RLock()
+	loaded := make([]*Campaign, 0)
+	for _, cam := range rds.campaigns {
+		if cam != spare && cam.isLoaded() {
+			loaded = append(loaded, cam)
+		}
+	}
+	rds.lock.RUnlock()
+
+	// the spared campaign counts against the limit
+	excess := len(loaded) + 1 - limit
+	if excess <= 0 {
+		return
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return atomic.LoadInt64(&loaded[i].lastUsed) < atomic.LoadInt64(&loaded[j].lastUsed)
+	})
+
+	for _, cam := range loaded[:excess] {
+		cam.unloadMetadata()
+	}
+}
+
+// CampaignForName returns a campaign object for a given name. It is safe to
+// call concurrently with ScanCampaigns.
 func (rds *RawDataStore) CampaignForName(camname string) (*Campaign, error) {
+	rds.lock.RLock()
+	defer rds.lock.RUnlock()
+
 	// die if campaign not found
 	cam, ok := rds.campaigns[camname]
 	if !ok {
@@ -769,6 +1201,8 @@ func (rds *RawDataStore) CampaignForName(camname string) (*Campaign, error) {
 	return cam, nil
 }
 
+// CampaignNames returns the names of all campaigns in the store. It is safe to
+// call concurrently with ScanCampaigns.
 func (rds *RawDataStore) CampaignNames() []string {
 	// return list of names
 	rds.lock.RLock()
@@ -782,11 +1216,64 @@ func (rds *RawDataStore) CampaignNames() []string {
 	return out
 }
 
+// removeStaleCampaignTemps removes temporary campaign directories left
+// behind by failed campaign creations. Only directories older than
+// staleCampaignTempAge are removed, so as not to disturb creations in
+// progress in other processes.
+func (rds *RawDataStore) removeStaleCampaignTemps() error {
+	direntries, err := ioutil.ReadDir(rds.path)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, direntry := range direntries {
+		if direntry.IsDir() &&
+			strings.HasPrefix(direntry.Name(), campaignTempPrefix) &&
+			time.Since(direntry.ModTime()) > staleCampaignTempAge {
+
+			log.Printf("removing stale temporary campaign directory %s", direntry.Name())
+			if err := os.RemoveAll(filepath.Join(rds.path, direntry.Name())); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadMetadataSchemas loads the metadata schemas configured for filetypes,
+// by filetype.
+func loadMetadataSchemas(config *PTOConfiguration) (map[string]*MetadataSchema, error) {
+	schemas := make(map[string]*MetadataSchema)
+	for name, ftc := range config.Filetypes {
+		if ftc.MetadataSchema != "" {
+			schema, err := LoadMetadataSchema(ftc.MetadataSchema)
+			if err != nil {
+				return nil, err
+			}
+			schemas[name] = schema
+		}
+	}
+	return schemas, nil
+}
+
 // NewRawDataStore encapsulates a raw data store, given a configuration object
 // pointing to a directory containing data and metadata organized into campaigns.
+// Temporary directories left behind by failed campaign creations are removed.
 func NewRawDataStore(config *PTOConfiguration) (*RawDataStore, error) {
 	rds := RawDataStore{config: config, path: config.RawRoot}
 
+	// load metadata schemas for filetypes which have them
+	var err error
+	if rds.schemas, err = loadMetadataSchemas(config); err != nil {
+		return nil, err
+	}
+
+	// clean up after failed campaign creations
+	if err := rds.removeStaleCampaignTemps(); err != nil {
+		return nil, err
+	}
+
 	// scan the directory for campaigns
 	if err := rds.ScanCampaigns(); err != nil {
 		return nil, err
@@ -794,3 +1281,136 @@ func NewRawDataStore(config *PTOConfiguration) (*RawDataStore, error) {
 
 	return &rds, nil
 }
+
+// RawStore is the interface to a raw data store: named campaigns of files,
+// each with metadata and data. RawDataStore implements it on the local
+// filesystem, and MemoryRawStore in memory, for tests and embedded use. The
+// raw data API serves any RawStore.
+type RawStore interface {
+	// ScanCampaigns updates the store's list of campaigns from its
+	// underlying storage.
+	ScanCampaigns() error
+	// CampaignNames returns the names of all campaigns in the store.
+	CampaignNames() []string
+	// GetCampaignMetadata returns the metadata of a campaign.
+	GetCampaignMetadata(camname string) (*RawMetadata, error)
+	// PutCampaignMetadata overwrites the metadata of a campaign, creating
+	// the campaign if it does not exist.
+	PutCampaignMetadata(camname string, md *RawMetadata) error
+	// FileNames returns the sorted names of the files in a campaign.
+	FileNames(camname string) ([]string, error)
+	// GetFileMetadata returns the metadata of a file in a campaign.
+	GetFileMetadata(camname string, filename string) (*RawMetadata, error)
+	// PutFileMetadata overwrites the metadata of a file in a campaign.
+	PutFileMetadata(camname string, filename string, md *RawMetadata) error
+	// OpenFileData opens the data of a file in a campaign for reading. The
+	// error if the file has no data satisfies os.IsNotExist or has status
+	// 404.
+	OpenFileData(camname string, filename string) (io.ReadSeekCloser, error)
+	// ReadFileDataToStream copies the data of a file in a campaign to a
+	// writer.
+	ReadFileDataToStream(camname string, filename string, out io.Writer) error
+	// WriteFileDataFromStream copies data from a reader to a file in a
+	// campaign, failing if the file already has data.
+	WriteFileDataFromStream(camname string, filename string, in io.Reader) error
+	// WriteFileDataFromStreamContext works like WriteFileDataFromStream,
+	// but stops copying with the context's error when the given context is
+	// done, and tracks upload progress against the expected size, negative
+	// if unknown.
+	WriteFileDataFromStreamContext(ctx context.Context, camname string, filename string, in io.Reader, size int64) error
+	// UploadProgress returns the progress of the current or most recent
+	// upload to a file in a campaign, or nil if none is known.
+	UploadProgress(camname string, filename string) *UploadProgress
+	// CheckHealth returns an error if the store cannot be written.
+	CheckHealth() error
+}
+
+// GetCampaignMetadata returns the metadata of the named campaign.
+func (rds *RawDataStore) GetCampaignMetadata(camname string) (*RawMetadata, error) {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return nil, err
+	}
+	return cam.GetCampaignMetadata()
+}
+
+// PutCampaignMetadata overwrites the metadata of the named campaign, creating
+// the campaign if it does not exist.
+func (rds *RawDataStore) PutCampaignMetadata(camname string, md *RawMetadata) error {
+	cam, err := rds.CampaignForName(camname)
+	if perr, ok := err.(*PTOError); ok && perr.Status() == http.StatusNotFound {
+		_, err = rds.CreateCampaign(camname, md)
+		return err
+	} else if err != nil {
+		return err
+	}
+	return cam.PutCampaignMetadata(md)
+}
+
+// FileNames returns the sorted names of the files in the named campaign.
+func (rds *RawDataStore) FileNames(camname string) ([]string, error) {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return nil, err
+	}
+	return cam.FileNames()
+}
+
+// GetFileMetadata returns the metadata of a file in the named campaign.
+func (rds *RawDataStore) GetFileMetadata(camname string, filename string) (*RawMetadata, error) {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return nil, err
+	}
+	return cam.GetFileMetadata(filename)
+}
+
+// PutFileMetadata overwrites the metadata of a file in the named campaign.
+func (rds *RawDataStore) PutFileMetadata(camname string, filename string, md *RawMetadata) error {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return err
+	}
+	return cam.PutFileMetadata(filename, md)
+}
+
+// ReadFileDataToStream copies the data of a file in the named campaign to a
+// writer.
+func (rds *RawDataStore) ReadFileDataToStream(camname string, filename string, out io.Writer) error {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return err
+	}
+	return cam.ReadFileDataToStream(filename, out)
+}
+
+// OpenFileData opens the data of a file in the named campaign for reading.
+func (rds *RawDataStore) OpenFileData(camname string, filename string) (io.ReadSeekCloser, error) {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := cam.ReadFileData(filename)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFileDataFromStream copies data from a reader to a file in the named
+// campaign, failing if the file already has data.
+func (rds *RawDataStore) WriteFileDataFromStream(camname string, filename string, in io.Reader) error {
+	return rds.WriteFileDataFromStreamContext(context.Background(), camname, filename, in, -1)
+}
+
+// WriteFileDataFromStreamContext works like WriteFileDataFromStream, but
+// stops copying with the context's error when the given context is done, and
+// tracks upload progress against the expected size, negative if unknown.
+func (rds *RawDataStore) WriteFileDataFromStreamContext(ctx context.Context, camname string, filename string, in io.Reader, size int64) error {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return err
+	}
+	return cam.WriteFileDataFromStreamContext(ctx, filename, false, in, size)
+}
@@ -1,10 +1,15 @@
 package pto3_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +17,36 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// testRawTimes are the start and end times for raw file metadata in tests.
+const testRawTimes = `"_time_start": "2018-01-01T00:00:00Z", "_time_end": "2018-01-02T00:00:00Z"`
+
+// createTestCampaign creates a campaign with the test campaign metadata in a
+// raw data store rooted at TestConfig.RawRoot, removing it when the test ends.
+func createTestCampaign(t *testing.T, rds *pto3.RawDataStore, camname string) *pto3.Campaign {
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := rds.CreateCampaign(camname, cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Join(TestConfig.RawRoot, camname)) })
+
+	return cam
+}
+
+// putTestFileMetadata parses file metadata from JSON and puts it for a file
+// in a campaign, returning any error from the campaign.
+func putTestFileMetadata(t *testing.T, cam *pto3.Campaign, filename string, js string) error {
+	md, err := pto3.RawMetadataFromReader(strings.NewReader(js), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cam.PutFileMetadata(filename, md)
+}
+
 func TestRawExisting(t *testing.T) {
 
 	// get campaign
@@ -211,3 +246,592 @@ func TestRawRoundtrip(t *testing.T) {
 	}
 
 }
+
+func TestStaleCampaignTemps(t *testing.T) {
+	// simulate campaign creations which failed long ago and just now
+	stale := TestConfig.RawRoot + "/.pto_campaign_tmp.stale.1"
+	fresh := TestConfig.RawRoot + "/.pto_campaign_tmp.fresh.1"
+	for _, dir := range []string{stale, fresh} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+pto3.CampaignMetadataFilename, []byte(`{"_owner": "test"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.RemoveAll(fresh)
+
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	rds, err := pto3.NewRawDataStore(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temporary campaign directory not removed: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("fresh temporary campaign directory removed: %v", err)
+	}
+
+	for _, camname := range rds.CampaignNames() {
+		if camname != "test0" && camname != "test1" {
+			t.Fatalf("temporary campaign directory %s scanned as campaign", camname)
+		}
+	}
+}
+
+func TestMetadataCacheLimit(t *testing.T) {
+	config := *TestConfig
+	config.RawMetadataCacheCampaigns = 1
+
+	rds, err := pto3.NewRawDataStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam := createTestCampaign(t, rds, "lrutest")
+
+	if _, err := cam.FileNames(); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a file behind the store's back; it is not visible while the
+	// campaign's metadata is cached
+	if err := ioutil.WriteFile(TestConfig.RawRoot+"/lrutest/behind.ndjson"+pto3.FileMetadataSuffix,
+		[]byte(`{`+testRawTimes+`}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames, err := cam.FileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 0 {
+		t.Fatalf("expected cached campaign to have no files, found %v", filenames)
+	}
+
+	// using another campaign unloads this one, so the file becomes visible
+	cam0, err := rds.CampaignForName("test0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cam0.GetCampaignMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames, err = cam.FileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 1 || filenames[0] != "behind.ndjson" {
+		t.Fatalf("expected reloaded campaign to have one file, found %v", filenames)
+	}
+}
+
+func TestRawMetadataBackup(t *testing.T) {
+	var backup bytes.Buffer
+	if err := TestRDS.WriteMetadataToStream(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore into an empty store
+	config := *TestConfig
+	var err error
+	config.RawRoot, err = ioutil.TempDir("", "pto3-test-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(config.RawRoot)
+
+	rds, err := pto3.NewRawDataStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rds.ReadMetadataFromStream(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rds.CampaignNames()) != len(TestRDS.CampaignNames()) {
+		t.Fatalf("restored %d campaigns, expected %d", len(rds.CampaignNames()), len(TestRDS.CampaignNames()))
+	}
+
+	cam0, err := TestRDS.CampaignForName("test0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filenames0, err := cam0.FileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := rds.CampaignForName("test0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filenames, err := cam.FileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != len(filenames0) {
+		t.Fatalf("restored files %v, expected %v", filenames, filenames0)
+	}
+
+	for _, filename := range filenames0 {
+		md0, err := cam0.GetFileMetadata(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := cam.GetFileMetadata(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Filetype(true) != md0.Filetype(true) || md.Owner(true) != md0.Owner(true) {
+			t.Fatalf("restored metadata for %s differs: %v vs %v", filename, md.Metadata, md0.Metadata)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pto3-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/metadata.json"
+
+	if err := pto3.WriteFileAtomic(path, []byte(`{"version": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an aborted write must leave the previous content in place
+	af, err := pto3.CreateAtomic(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := af.Write([]byte(`{"vers`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := af.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"version": 1}` {
+		t.Fatalf("aborted write clobbered file: got %s", b)
+	}
+
+	// a committed write replaces it
+	if err := pto3.WriteFileAtomic(path, []byte(`{"version": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"version": 2}` {
+		t.Fatalf("committed write not visible: got %s", b)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected mode %v after atomic write", fi.Mode().Perm())
+	}
+
+	// no temporary files are left behind
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected one file after atomic writes, found %d", len(names))
+	}
+}
+
+func TestRawStreamCancel(t *testing.T) {
+	cam := createTestCampaign(t, TestRDS, "test-stream-cancel")
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.PutFileMetadata("cancel.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	testbytes, err := ioutil.ReadFile("testdata/test_raw_data.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cancelled upload fails, leaving no partial data behind
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = cam.WriteFileDataFromStreamContext(ctx, "cancel.ndjson", false, bytes.NewReader(testbytes), int64(len(testbytes)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled upload returned %v", err)
+	}
+	if _, err := cam.ReadFileData("cancel.ndjson"); !os.IsNotExist(err) {
+		t.Fatalf("cancelled upload left data file behind: %v", err)
+	}
+
+	// upload for real, then check a cancelled download fails
+	if err := cam.WriteFileDataFromStream("cancel.ndjson", false, bytes.NewReader(testbytes), int64(len(testbytes))); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	if err := cam.ReadFileDataToStreamContext(ctx, "cancel.ndjson", out); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled download returned %v", err)
+	}
+
+	out.Reset()
+	if err := cam.ReadFileDataToStreamContext(context.Background(), "cancel.ndjson", out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), testbytes) {
+		t.Fatal("downloaded data does not match uploaded data")
+	}
+}
+
+func TestMetadataSchema(t *testing.T) {
+	schemafile, err := ioutil.TempFile("", "pto3-test-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(schemafile.Name())
+	if _, err := schemafile.WriteString(`{
+		"required": ["vantage_point", "location"],
+		"properties": {
+			"vantage_point": {"type": "string", "pattern": "^vp-[0-9]+$"},
+			"location": {"enum": ["ch", "de"]},
+			"probes": {"type": "integer"}
+		}
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	schemafile.Close()
+
+	config := *TestConfig
+	config.Filetypes = map[string]pto3.FiletypeConfig{
+		"schematest": {ContentType: "application/json", MetadataSchema: schemafile.Name()},
+	}
+
+	rds, err := pto3.NewRawDataStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam := createTestCampaign(t, rds, "schematest")
+
+	// metadata conforming to the schema is accepted
+	if err := putTestFileMetadata(t, cam, "file.json", `{"_file_type": "schematest", `+testRawTimes+`, "vantage_point": "vp-1", "location": "ch", "probes": 3}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata violating it is rejected
+	for _, js := range []string{
+		`{"_file_type": "schematest", ` + testRawTimes + `, "location": "ch"}`,
+		`{"_file_type": "schematest", ` + testRawTimes + `, "vantage_point": "somewhere", "location": "ch"}`,
+		`{"_file_type": "schematest", ` + testRawTimes + `, "vantage_point": "vp-1", "location": "fr"}`,
+		`{"_file_type": "schematest", ` + testRawTimes + `, "vantage_point": "vp-1", "location": "ch", "probes": 2.5}`,
+	} {
+		err := putTestFileMetadata(t, cam, "file.json", js)
+		if err == nil {
+			t.Fatalf("metadata %s violating schema accepted", js)
+		}
+		if perr, ok := err.(*pto3.PTOError); !ok || perr.Code() != pto3.ErrCodeBadMetadata {
+			t.Fatalf("expected bad metadata error for %s, got %v", js, err)
+		}
+	}
+
+	// other filetypes are not constrained
+	if err := putTestFileMetadata(t, cam, "file.json", `{"_file_type": "test", `+testRawTimes+`}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataVocabularies(t *testing.T) {
+	config := *TestConfig
+	config.MetadataVocabularies = map[string][]string{
+		"measurement_type": {"active", "passive"},
+	}
+
+	rds, err := pto3.NewRawDataStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// campaign metadata is checked on creation
+	badcammd, err := pto3.RawMetadataFromReader(strings.NewReader(
+		`{"_owner": "ptotest@example.com", "_file_type": "test", "measurement_type": "invasive"}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rds.CreateCampaign("vocabtest_bad", badcammd); err == nil {
+		t.Fatal("campaign with out-of-vocabulary metadata created")
+	}
+	os.RemoveAll(TestConfig.RawRoot + "/vocabtest_bad")
+
+	cam := createTestCampaign(t, rds, "vocabtest")
+
+	// values in the vocabulary and keys without one are accepted
+	if err := putTestFileMetadata(t, cam, "file.ndjson", `{"_file_type": "test", `+testRawTimes+`, "measurement_type": "passive", "location": "anywhere"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// values not in the vocabulary are rejected, listing the allowed values
+	err = putTestFileMetadata(t, cam, "file.ndjson", `{"_file_type": "test", `+testRawTimes+`, "measurement_type": "invasive"}`)
+	if err == nil {
+		t.Fatal("out-of-vocabulary metadata accepted")
+	}
+	if perr, ok := err.(*pto3.PTOError); !ok || perr.Code() != pto3.ErrCodeBadMetadata {
+		t.Fatalf("expected bad metadata error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "active") || !strings.Contains(err.Error(), "passive") {
+		t.Fatalf("error %s does not list allowed values", err.Error())
+	}
+}
+
+func TestRecordCount(t *testing.T) {
+	rds, err := pto3.NewRawDataStore(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam := createTestCampaign(t, rds, "recordtest")
+
+	for _, filetype := range []string{"osf", "test"} {
+		if err := putTestFileMetadata(t, cam, filetype+".data", `{"_file_type": "`+filetype+`", `+testRawTimes+`}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// records are counted in NDJSON files, ignoring blank lines and
+	// counting a final line without a newline
+	data := "[\"a\"]\n[\"b\"]\n\n[\"c\"]\n[\"d\"]"
+	if err := cam.WriteFileDataFromStream("osf.data", false, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := cam.GetFileMetadata("osf.data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.RecordCount() == nil || *md.RecordCount() != 4 {
+		t.Fatalf("expected record count 4, got %v", md.RecordCount())
+	}
+
+	b, err := md.DumpJSONObject(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"__record_count":4`) {
+		t.Fatalf("missing __record_count in %s", b)
+	}
+
+	// the count survives reloading metadata from disk
+	rds, err = pto3.NewRawDataStore(TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cam, err = rds.CampaignForName("recordtest"); err != nil {
+		t.Fatal(err)
+	}
+	if md, err = cam.GetFileMetadata("osf.data"); err != nil {
+		t.Fatal(err)
+	}
+	if md.RecordCount() == nil || *md.RecordCount() != 4 {
+		t.Fatalf("expected record count 4 after reload, got %v", md.RecordCount())
+	}
+
+	// other files are not counted
+	if err := cam.WriteFileDataFromStream("test.data", false, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if md, err = cam.GetFileMetadata("test.data"); err != nil {
+		t.Fatal(err)
+	}
+	if md.RecordCount() != nil {
+		t.Fatalf("unexpected record count %d for non-NDJSON file", *md.RecordCount())
+	}
+}
+
+// testRawStoreBackend exercises a RawStore through the interface alone, so
+// that every backend behaves the same way.
+func testRawStoreBackend(t *testing.T, store pto3.RawStore) {
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutCampaignMetadata("ifacetest", cammd); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, camname := range store.CampaignNames() {
+		if camname == "ifacetest" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("created campaign not listed")
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PutFileMetadata("ifacetest", "iface.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	filenames, err := store.FileNames("ifacetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) != 1 || filenames[0] != "iface.ndjson" {
+		t.Fatalf("expected one file iface.ndjson, found %v", filenames)
+	}
+
+	data, err := ioutil.ReadFile("testdata/test_raw_data.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.WriteFileDataFromStream("ifacetest", "iface.ndjson", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// data may not be overwritten
+	if err := store.WriteFileDataFromStream("ifacetest", "iface.ndjson", bytes.NewReader(data)); err == nil {
+		t.Fatal("data overwritten without error")
+	}
+
+	md, err := store.GetFileMetadata("ifacetest", "iface.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Filetype(true) != "obs" || md.Get("override_me_0", true) != "campaign" || md.Get("override_me_1", true) != "file" {
+		t.Fatalf("file metadata does not inherit from campaign: %v", md.Metadata)
+	}
+	if md.DataSize() != len(data) {
+		t.Fatalf("expected data size %d, got %d", len(data), md.DataSize())
+	}
+	if md.RecordCount() == nil || *md.RecordCount() != bytes.Count(data, []byte("\n")) {
+		t.Fatalf("bad record count %v", md.RecordCount())
+	}
+
+	var out bytes.Buffer
+	if err := store.ReadFileDataToStream("ifacetest", "iface.ndjson", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("data read differs from data written")
+	}
+
+	if _, err := store.GetFileMetadata("ifacetest", "nonesuch.ndjson"); err == nil {
+		t.Fatal("got metadata for nonexistent file")
+	}
+	if _, err := store.GetCampaignMetadata("nonesuch"); err == nil {
+		t.Fatal("got metadata for nonexistent campaign")
+	}
+}
+
+func TestRawStoreBackends(t *testing.T) {
+	config := *TestConfig
+	config.ContentTypes = map[string]string{"obs": "application/vnd.mami.ndjson"}
+
+	var err error
+	config.RawRoot, err = ioutil.TempDir("", "pto3-test-rawstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(config.RawRoot)
+
+	rds, err := pto3.NewRawDataStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRawStoreBackend(t, rds)
+
+	mrs, err := pto3.NewMemoryRawStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRawStoreBackend(t, mrs)
+}
+
+// This test verifies that metadata returned by the in-memory store is not
+// changed by later updates to the store.
+func TestMemoryRawStoreCopies(t *testing.T) {
+	config := *TestConfig
+	config.ContentTypes = map[string]string{"obs": "application/vnd.mami.ndjson"}
+
+	mrs, err := pto3.NewMemoryRawStore(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.PutCampaignMetadata("copytest", cammd); err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.PutFileMetadata("copytest", "copy.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := mrs.GetFileMetadata("copytest", "copy.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before.Metadata["changed_by_caller"] = "yes"
+
+	data := "[\"a\"]\n[\"b\"]\n"
+	if err := mrs.WriteFileDataFromStream("copytest", "copy.ndjson", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mrs.PutCampaignMetadata("copytest", cammd); err != nil {
+		t.Fatal(err)
+	}
+
+	if before.DataSize() != 0 || before.RecordCount() != nil {
+		t.Fatalf("metadata returned before upload changed by upload: size %d", before.DataSize())
+	}
+
+	after, err := mrs.GetFileMetadata("copytest", "copy.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.DataSize() != len(data) {
+		t.Fatalf("expected data size %d, got %d", len(data), after.DataSize())
+	}
+	if after.Get("changed_by_caller", true) != "" {
+		t.Fatal("change to returned metadata visible in store")
+	}
+}
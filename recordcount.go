@@ -0,0 +1,76 @@
+package pto3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RecordCountSuffix is the suffix on the file on disk holding the number of
+// records in an NDJSON data file, counted when the file was uploaded
+const RecordCountSuffix = ".pto_record_count"
+
+// isNDJSON returns true if files of the given content type are
+// newline-delimited JSON, with one record per line.
+func isNDJSON(contentType string) bool {
+	return strings.HasSuffix(contentType, "ndjson")
+}
+
+// recordCounter is a writer counting the non-empty lines written to it, so
+// that records in an NDJSON stream can be counted as it is copied.
+type recordCounter struct {
+	records int
+	inLine  bool
+}
+
+func (rc *recordCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if len(bytes.TrimSpace(p)) > 0 {
+				rc.inLine = true
+			}
+			break
+		}
+		if rc.inLine || len(bytes.TrimSpace(p[:i])) > 0 {
+			rc.records++
+		}
+		rc.inLine = false
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// count returns the number of records written, including a final record
+// without a trailing newline.
+func (rc *recordCounter) count() int {
+	if rc.inLine {
+		return rc.records + 1
+	}
+	return rc.records
+}
+
+// readRecordCount reads the record count stored for a data file, returning
+// nil if none was stored.
+func readRecordCount(datapath string) (*int, error) {
+	b, err := ioutil.ReadFile(datapath + RecordCountSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, PTOErrorf("bad record count for %s: %s", datapath, err.Error())
+	}
+	return &n, nil
+}
+
+// writeRecordCount atomically stores the record count for a data file.
+func writeRecordCount(datapath string, n int) error {
+	return WriteFileAtomic(datapath+RecordCountSuffix, []byte(strconv.Itoa(n)+"\n"), 0644)
+}
@@ -0,0 +1,311 @@
+package pto3
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Timing of replication task processing: the interval between polls of the
+// replication queue, the time a claimed task is hidden from other replicators
+// while it is pushed, and the bounds on the delay before retrying a failed
+// push, which doubles with each attempt.
+const (
+	replicationPollInterval = 30 * time.Second
+	replicationLease        = 10 * time.Minute
+	replicationMinBackoff   = time.Minute
+	replicationMaxBackoff   = time.Hour
+)
+
+// DownstreamConfig configures a downstream PTO to which new observation sets
+// are pushed.
+type DownstreamConfig struct {
+	// Base URL of the downstream PTO
+	BaseURL string
+
+	// API key to use with the downstream PTO; must grant write_obs
+	APIKey string
+}
+
+// ReplicationTask is a pending push of an observation set to a downstream
+// PTO, queued in the observation database so that pushes survive restarts and
+// are retried until they succeed.
+type ReplicationTask struct {
+	ID int
+	// Observation set to push
+	SetID int `sql:",notnull"`
+	// Base URL of the downstream PTO
+	Downstream string `sql:",notnull"`
+	// Number of failed attempts so far
+	Attempts int `sql:",notnull"`
+	// Time at which the task is next due
+	NextAttempt time.Time `sql:",notnull"`
+	// Error from the last failed attempt, empty if none
+	LastError string
+	// Time at which the task was queued
+	Created time.Time `sql:",notnull"`
+}
+
+// createReplicationTables ensures the table holding the replication queue
+// exists.
+func createReplicationTables(db *pg.DB) error {
+	opts := orm.CreateTableOptions{IfNotExists: true}
+
+	if err := db.CreateTable(&ReplicationTask{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// EnqueueReplication queues a push of the observation set with the given ID
+// to every downstream PTO in the configuration. It does nothing if there are
+// no downstream PTOs.
+func EnqueueReplication(config *PTOConfiguration, db orm.DB, setID int) error {
+	now := time.Now().UTC()
+
+	for _, down := range config.Downstreams {
+		task := ReplicationTask{
+			SetID:       setID,
+			Downstream:  down.BaseURL,
+			NextAttempt: now,
+			Created:     now,
+		}
+		if err := db.Insert(&task); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// Replicator pushes observation sets queued by EnqueueReplication to
+// downstream PTOs as bundles, via POST /obs/bundle. Pushed sets carry their
+// local link and modification time in their _upstream and _upstream_modified
+// metadata, as if they had been mirrored by the downstream PTO, which uses
+// these to avoid loading the same version of a set twice. Failed pushes are
+// retried with exponential backoff. Several replicators may share a
+// database; each task is claimed by one of them at a time, for as long as it
+// is being pushed.
+type Replicator struct {
+	config *PTOConfiguration
+	db     *pg.DB
+
+	// HTTP client used to access downstream PTOs
+	Client *http.Client
+}
+
+// NewReplicator creates a Replicator for the downstream PTOs in the given
+// configuration, connecting to its observation database and creating the
+// replication queue if necessary.
+func NewReplicator(config *PTOConfiguration) (*Replicator, error) {
+	db := pg.Connect(&config.ObsDatabase)
+
+	if err := createReplicationTables(db); err != nil {
+		return nil, err
+	}
+
+	return &Replicator{config: config, db: db, Client: http.DefaultClient}, nil
+}
+
+// downstream returns the configuration for the downstream PTO with the given
+// base URL, or nil if it is no longer configured.
+func (r *Replicator) downstream(baseURL string) *DownstreamConfig {
+	for i := range r.config.Downstreams {
+		if r.config.Downstreams[i].BaseURL == baseURL {
+			return &r.config.Downstreams[i]
+		}
+	}
+	return nil
+}
+
+// claim takes the next due replication task from the queue, postponing it by
+// the replication lease so that no other replicator takes it while it is
+// pushed. Returns nil if no task is due.
+func (r *Replicator) claim() (*ReplicationTask, error) {
+	var task ReplicationTask
+
+	err := r.db.RunInTransaction(func(tx *pg.Tx) error {
+		now := time.Now().UTC()
+
+		if err := tx.Model(&task).
+			Where("next_attempt <= ?", now).
+			Order("next_attempt").
+			Limit(1).
+			For("UPDATE SKIP LOCKED").
+			Select(); err != nil {
+			return err
+		}
+
+		task.NextAttempt = now.Add(replicationLease)
+		return tx.Update(&task)
+	})
+
+	if err == pg.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &task, nil
+}
+
+// push writes an observation set as a bundle to a downstream PTO.
+func (r *Replicator) push(down *DownstreamConfig, set *ObservationSet) error {
+	set.Metadata[UpstreamMetadataKey] = LinkForSetID(r.config, set.ID)
+	if set.Modified != nil {
+		set.Metadata[UpstreamModifiedMetadataKey] = set.Modified.Format(time.RFC3339)
+	}
+
+	// stream the bundle straight from the database into the request
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(set.CopyBundleToStream(r.db, pw, ObsFormatV1))
+	}()
+	defer pr.Close()
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(down.BaseURL, "/")+"/obs/bundle", pr)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.mami.ndjson")
+	if down.APIKey != "" {
+		req.Header.Set("Authorization", "APIKEY "+down.APIKey)
+	}
+
+	res, err := r.Client.Do(req)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return PTOErrorf("downstream returned %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// process pushes the set for a claimed task, removing the task from the queue
+// on success and scheduling a retry on failure.
+func (r *Replicator) process(task *ReplicationTask) error {
+	down := r.downstream(task.Downstream)
+	if down == nil {
+		log.Printf("dropping replication of set %x to %s: downstream no longer configured", task.SetID, task.Downstream)
+		return r.remove(task)
+	}
+
+	set := ObservationSet{ID: task.SetID}
+	if err := set.SelectByID(r.db); err == pg.ErrNoRows {
+		log.Printf("dropping replication of set %x to %s: set no longer exists", task.SetID, task.Downstream)
+		return r.remove(task)
+	} else if err != nil {
+		return PTOWrapError(err)
+	}
+
+	// keep the task claimed for as long as the push takes
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		r.renewLease(task, stop)
+		close(renewed)
+	}()
+	err := r.push(down, &set)
+	close(stop)
+	<-renewed
+
+	if err != nil {
+		task.Attempts++
+		task.LastError = err.Error()
+
+		backoff := replicationMaxBackoff
+		if task.Attempts < 32 {
+			if d := replicationMinBackoff << uint(task.Attempts-1); d < backoff {
+				backoff = d
+			}
+		}
+		task.NextAttempt = time.Now().UTC().Add(backoff)
+
+		log.Printf("error replicating set %x to %s (attempt %d, retry in %v): %v",
+			task.SetID, task.Downstream, task.Attempts, backoff, err)
+		if err := r.db.Update(task); err != nil {
+			return PTOWrapError(err)
+		}
+		return nil
+	}
+
+	log.Printf("replicated set %x to %s", task.SetID, task.Downstream)
+	return r.remove(task)
+}
+
+// renewLease extends the claim on a replication task by the replication lease
+// every half lease, so that no other replicator takes it while a long push is
+// still running, until the given channel is closed.
+func (r *Replicator) renewLease(task *ReplicationTask, stop chan struct{}) {
+	ticker := time.NewTicker(replicationLease / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		lease := ReplicationTask{NextAttempt: time.Now().UTC().Add(replicationLease)}
+		if _, err := r.db.Model(&lease).Column("next_attempt").Where("id = ?", task.ID).Update(); err != nil {
+			log.Printf("error renewing lease on replication of set %x to %s: %v", task.SetID, task.Downstream, err)
+		}
+	}
+}
+
+// remove deletes a replication task from the queue.
+func (r *Replicator) remove(task *ReplicationTask) error {
+	if _, err := r.db.Model(task).Where("id = ?", task.ID).Delete(); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// ProcessQueue pushes every replication task which is currently due, and
+// returns the number of tasks processed, whether or not the push succeeded.
+func (r *Replicator) ProcessQueue() (int, error) {
+	processed := 0
+	for {
+		task, err := r.claim()
+		if err != nil || task == nil {
+			return processed, err
+		}
+
+		if err := r.process(task); err != nil {
+			return processed, err
+		}
+		processed++
+	}
+}
+
+// RunEvery processes the replication queue periodically until the given
+// channel is closed.
+func (r *Replicator) RunEvery(stop chan struct{}) {
+	ticker := time.NewTicker(replicationPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.ProcessQueue(); err != nil {
+			log.Printf("error processing replication queue: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
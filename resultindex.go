@@ -0,0 +1,97 @@
+package pto3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// A result index is a sidecar file alongside an NDJSON query result file,
+// containing the byte offset of the start of each line in the result file as
+// a big-endian 64-bit integer. The offset of line n is therefore found at
+// byte 8n of the index, allowing pagination to seek directly to any page.
+
+const resultIndexEntrySize = 8
+
+func (qc *QueryCache) indexPath(identifier string) string {
+	return qc.dataPath(identifier) + ".idx"
+}
+
+// indexResultFile writes the result index for the query with the given
+// identifier, replacing any existing index.
+func (qc *QueryCache) indexResultFile(identifier string) error {
+	in, err := os.Open(qc.dataPath(identifier))
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer in.Close()
+
+	out, err := CreateAtomic(qc.indexPath(identifier), 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	r := bufio.NewReader(in)
+	w := bufio.NewWriter(out)
+
+	var entry [resultIndexEntrySize]byte
+	var pos int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			binary.BigEndian.PutUint64(entry[:], uint64(pos))
+			if _, werr := w.Write(entry[:]); werr != nil {
+				return PTOWrapError(werr)
+			}
+			pos += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return out.Commit()
+}
+
+// openResultIndex opens the result index for the query with the given
+// identifier, building it first if the result file has not been indexed.
+func (qc *QueryCache) openResultIndex(identifier string) (*os.File, error) {
+	idx, err := os.Open(qc.indexPath(identifier))
+	if os.IsNotExist(err) {
+		if err := qc.indexResultFile(identifier); err != nil {
+			return nil, err
+		}
+		idx, err = os.Open(qc.indexPath(identifier))
+	}
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return idx, nil
+}
+
+// seekResultLine positions a result file at the start of the given line
+// using its index, returning false if the result has no such line.
+func seekResultLine(resultFile *os.File, idx *os.File, line int) (bool, error) {
+	var entry [resultIndexEntrySize]byte
+	if _, err := idx.ReadAt(entry[:], int64(line)*resultIndexEntrySize); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, PTOWrapError(err)
+	}
+
+	if _, err := resultFile.Seek(int64(binary.BigEndian.Uint64(entry[:])), io.SeekStart); err != nil {
+		return false, PTOWrapError(err)
+	}
+
+	return true, nil
+}
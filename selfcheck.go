@@ -0,0 +1,200 @@
+package pto3
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// SelfCheckResult is the result of a single configuration self-check.
+type SelfCheckResult struct {
+	// Short description of what was checked
+	Check string
+	// Error if the check failed, nil if it passed
+	Err error
+	// Suggested fix if the check failed
+	Advice string
+}
+
+// Failed returns true if the check failed.
+func (res *SelfCheckResult) Failed() bool {
+	return res.Err != nil
+}
+
+func (res *SelfCheckResult) String() string {
+	if res.Err == nil {
+		return fmt.Sprintf("ok    %s", res.Check)
+	}
+	return fmt.Sprintf("FAIL  %s: %v\n      -> %s", res.Check, res.Err, res.Advice)
+}
+
+// obsDatabaseTables lists the tables which must exist in an initialized
+// observation database. Keep this in sync with CreateTables and
+// NewQueryCache.
+var obsDatabaseTables = []string{
+	"conditions",
+	"condition_aliases",
+	"paths",
+	"observation_sets",
+	"observation_set_conditions",
+	"observations",
+	"replication_tasks",
+	"query_records",
+	"named_queries",
+	"named_query_executions",
+	"query_templates",
+}
+
+// obsDatabaseColumns lists, as table.column, the columns added by CreateTables
+// to tables created by previous versions. A database missing any of them was
+// initialized by an older version, and has an out of date schema.
+var obsDatabaseColumns = []string{
+	"conditions.description",
+	"paths.source_country",
+	"paths.target_country",
+	"observation_sets.tags",
+	"observation_sets.state",
+	"observation_sets.superseded_by",
+	"observations.metadata",
+}
+
+// SelfCheck validates a configuration for consistency, and checks that the
+// resources it refers to are available: that the observation database is
+// reachable and initialized, and that the raw data store and query cache
+// directories are writable. It returns the result of each check performed;
+// checks for applications not configured are skipped.
+func SelfCheck(config *PTOConfiguration) []SelfCheckResult {
+	var out []SelfCheckResult
+
+	check := func(desc string, err error, advice string) bool {
+		out = append(out, SelfCheckResult{desc, err, advice})
+		return err == nil
+	}
+
+	// base URL must be absolute for link generation
+	var err error
+	if config.baseURL == nil || !config.baseURL.IsAbs() || config.baseURL.Host == "" {
+		err = PTOErrorf("%s is not an absolute URL", config.BaseURL)
+	}
+	check("base URL", err, "set BaseURL to the URL clients use to reach this server, e.g. https://pto.example.com/")
+
+	// TLS needs both certificate and key
+	err = nil
+	if (config.CertificateFile == "") != (config.PrivateKeyFile == "") {
+		err = PTOErrorf("only one of CertificateFile and PrivateKeyFile given")
+	} else if config.CertificateFile != "" {
+		for _, filename := range []string{config.CertificateFile, config.PrivateKeyFile} {
+			if _, err = os.Stat(filename); err != nil {
+				break
+			}
+		}
+	}
+	check("TLS configuration", err, "give both CertificateFile and PrivateKeyFile to serve HTTPS, or neither to serve HTTP")
+
+	// raw data store
+	if config.RawRoot != "" {
+		err = nil
+		if len(config.ContentTypes) == 0 {
+			err = PTOErrorf("no filetypes in ContentTypes")
+		}
+		check("raw filetype registry", err, "map each _file_type to a MIME type in ContentTypes")
+
+		check("raw data store writable", checkWritable(config.RawRoot),
+			fmt.Sprintf("ensure %s exists and is writable by the server user", config.RawRoot))
+
+		// xz decompression needs the external xz utility
+		for filetype := range config.ContentTypes {
+			if strings.HasSuffix(filetype, "-xz") {
+				_, err = exec.LookPath("xz")
+				check("xz decompressor", err, "install xz (e.g. the xz-utils package) on the server's PATH to decompress -xz filetypes")
+				break
+			}
+		}
+	}
+
+	// observation database
+	if config.ObsDatabase.Database != "" {
+		db := pg.Connect(&config.ObsDatabase)
+		defer db.Close()
+
+		if config.GeoIPDatabase != "" {
+			gdb, err := OpenGeoIPDatabase(config.GeoIPDatabase)
+			if err == nil {
+				gdb.Close()
+			}
+			check("GeoIP database", err, fmt.Sprintf("ensure %s is a readable MaxMind-format country database", config.GeoIPDatabase))
+		}
+
+		if check("observation database reachable", PingDB(db),
+			fmt.Sprintf("ensure PostgreSQL is running at %s and accepts the credentials in ObsDatabase", config.ObsDatabase.Addr)) {
+			if check("observation database initialized", checkTables(db, obsDatabaseTables),
+				"run ptosrv -initdb to create missing tables") {
+				check("observation database schema current", checkColumns(db, obsDatabaseColumns),
+					"run ptosrv -initdb to upgrade the schema")
+			}
+		}
+	}
+
+	// query cache
+	if config.QueryCacheRoot != "" {
+		err = nil
+		if config.ObsDatabase.Database == "" {
+			err = PTOErrorf("QueryCacheRoot given without ObsDatabase")
+		}
+		check("query cache database", err, "configure ObsDatabase; query state is stored in the observation database")
+
+		check("query cache writable", checkWritable(config.QueryCacheRoot),
+			fmt.Sprintf("ensure %s exists and is writable by the server user", config.QueryCacheRoot))
+	}
+
+	return out
+}
+
+// checkTables checks that all the named tables exist in a database.
+func checkTables(db *pg.DB, tables []string) error {
+	var missing []string
+
+	for _, table := range tables {
+		var exists bool
+		if _, err := db.QueryOne(pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", table); err != nil {
+			return PTOWrapError(err)
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+
+	if len(missing) > 0 {
+		return PTOErrorf("missing tables %v", missing)
+	}
+
+	return nil
+}
+
+// checkColumns checks that all the named columns, as table.column, exist in a
+// database.
+func checkColumns(db *pg.DB, columns []string) error {
+	var missing []string
+
+	for _, column := range columns {
+		tc := strings.SplitN(column, ".", 2)
+		var exists bool
+		if _, err := db.QueryOne(pg.Scan(&exists),
+			"SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?)",
+			tc[0], tc[1]); err != nil {
+			return PTOWrapError(err)
+		}
+		if !exists {
+			missing = append(missing, column)
+		}
+	}
+
+	if len(missing) > 0 {
+		return PTOErrorf("missing columns %v", missing)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package pto3
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SetID identifies an observation set. Set IDs are integers in the database,
+// and are written in links, observation files, and queries in hexadecimal,
+// without a prefix.
+type SetID int
+
+// ParseSetID parses a set ID written in hexadecimal. Since set IDs are always
+// hexadecimal, inputs which look like they are written in another notation
+// (with a 0x prefix or a sign), or which are too large to identify a set, are
+// rejected rather than guessed at, with status 400 and error code
+// ErrCodeBadIdentifier.
+func ParseSetID(s string) (SetID, error) {
+	switch {
+	case s == "":
+		return 0, PTOErrorf("missing set ID").StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadIdentifier)
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		return 0, PTOErrorf("bad set ID %s: set IDs are hexadecimal without a 0x prefix", s).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadIdentifier)
+	case strings.HasPrefix(s, "+") || strings.HasPrefix(s, "-"):
+		return 0, PTOErrorf("bad set ID %s: set IDs are unsigned", s).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadIdentifier)
+	}
+
+	id, err := strconv.ParseUint(s, 16, 63)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return 0, PTOErrorf("bad set ID %s: out of range", s).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadIdentifier)
+		}
+		return 0, PTOErrorf("bad set ID %s: set IDs are hexadecimal", s).StatusIs(http.StatusBadRequest).CodeIs(ErrCodeBadIdentifier)
+	}
+
+	return SetID(id), nil
+}
+
+// String returns the canonical form of this set ID: lowercase hexadecimal,
+// without a prefix.
+func (id SetID) String() string {
+	return strconv.FormatInt(int64(id), 16)
+}
@@ -0,0 +1,84 @@
+package pto3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultShareLifetime is the lifetime of signed URLs for which none is
+// requested.
+const DefaultShareLifetime = 24 * time.Hour
+
+// defaultShareMaxLifetime limits the lifetime of signed URLs if the
+// configuration does not.
+const defaultShareMaxLifetime = 7 * 24 * time.Hour
+
+// pathSignature computes the signature of a path with the given expiry, an
+// HMAC-SHA256 keyed with the configured share secret. Paths are signed
+// without a leading slash, as relative to the base URL.
+func (config *PTOConfiguration) pathSignature(path string, expires int64) []byte {
+	mac := hmac.New(sha256.New, []byte(config.ShareSecret))
+	mac.Write([]byte(strings.TrimPrefix(path, "/")))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
+
+// MaxShareLifetime returns the longest lifetime a signed URL may have.
+func (config *PTOConfiguration) MaxShareLifetime() time.Duration {
+	if d, err := time.ParseDuration(config.ShareMaxLifetime); err == nil && d > 0 {
+		return d
+	}
+	return defaultShareMaxLifetime
+}
+
+// SignedLink creates a link to a relative URL from the configuration's base
+// URL, signed so as to grant access to it without an API key until the given
+// time. It fails if no share secret is configured.
+func (config *PTOConfiguration) SignedLink(relative string, expires time.Time) (string, error) {
+	if config.ShareSecret == "" {
+		return "", PTOErrorf("signed URLs not enabled on this PTO").StatusIs(http.StatusNotImplemented)
+	}
+
+	link, err := config.LinkTo(relative)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	v.Set("signature", hex.EncodeToString(config.pathSignature(relative, expires.Unix())))
+
+	return link + "?" + v.Encode(), nil
+}
+
+// VerifySignedPath verifies the expires and signature parameters of a request
+// for a path against the configured share secret, returning an error with
+// status 403 if the signature is invalid or has expired at the given time.
+func (config *PTOConfiguration) VerifySignedPath(path string, params url.Values, now time.Time) error {
+	if config.ShareSecret == "" {
+		return PTOErrorf("signed URLs not enabled on this PTO").StatusIs(http.StatusForbidden)
+	}
+
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return PTOErrorf("bad or missing signed URL expiry %q", params.Get("expires")).StatusIs(http.StatusForbidden)
+	}
+
+	sig, err := hex.DecodeString(params.Get("signature"))
+	if err != nil || !hmac.Equal(sig, config.pathSignature(path, expires)) {
+		return PTOErrorf("bad signature for %s", path).StatusIs(http.StatusForbidden)
+	}
+
+	if now.Unix() > expires {
+		return PTOErrorf("signed URL for %s expired at %s", path, time.Unix(expires, 0).UTC().Format(time.RFC3339)).StatusIs(http.StatusForbidden)
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package pto3
+
+import (
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// ObservatoryStats summarizes the contents of a whole observatory, for
+// landing pages and monitoring dashboards.
+type ObservatoryStats struct {
+	// Number of observation sets
+	Sets int `json:"sets"`
+	// Number of observations, from the cached counts of each set
+	Observations int `json:"observations"`
+	// Number of distinct conditions
+	Conditions int `json:"conditions"`
+	// Number of raw data campaigns
+	Campaigns int `json:"campaigns"`
+	// Number of raw data files
+	RawFiles int `json:"raw_files"`
+	// Total size of raw data files in bytes
+	RawBytes int64 `json:"raw_bytes"`
+	// Start of the earliest observation, if any
+	Earliest *time.Time `json:"earliest_observation,omitempty"`
+	// End of the latest observation, if any
+	Latest *time.Time `json:"latest_observation,omitempty"`
+	// Time at which these statistics were collected
+	Collected time.Time `json:"collected"`
+}
+
+// CollectObservatoryStats collects statistics on the observation database and
+// the raw data store, either of which may be nil if not configured.
+// Observation counts and times are taken from the values cached with each
+// set, so collection does not scan the observation table.
+func CollectObservatoryStats(db orm.DB, rds RawStore) (*ObservatoryStats, error) {
+	stats := ObservatoryStats{Collected: time.Now().UTC()}
+
+	if db != nil {
+		if _, err := db.QueryOne(pg.Scan(&stats.Sets, &stats.Observations, &stats.Earliest, &stats.Latest),
+			"SELECT count(*), coalesce(sum(count), 0), min(time_start), max(time_end) FROM observation_sets"); err != nil {
+			return nil, PTOWrapError(err)
+		}
+
+		var err error
+		if stats.Conditions, err = db.Model(&Condition{}).Count(); err != nil {
+			return nil, PTOWrapError(err)
+		}
+	}
+
+	if rds != nil {
+		for _, camname := range rds.CampaignNames() {
+			filenames, err := rds.FileNames(camname)
+			if err != nil {
+				return nil, err
+			}
+
+			stats.Campaigns++
+			for _, filename := range filenames {
+				md, err := rds.GetFileMetadata(camname, filename)
+				if err != nil {
+					return nil, err
+				}
+				if md.DataSize() == 0 {
+					// metadata without data yet
+					continue
+				}
+				stats.RawFiles++
+				stats.RawBytes += int64(md.DataSize())
+			}
+		}
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,243 @@
+package pto3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+)
+
+// Traceroute support for normalizers. A Traceroute is a single trace from a
+// source toward a destination, yielding one path observation. Traces are
+// read from RIPE Atlas traceroute results, which are decoded here, or from
+// scamper warts files, which are split into records here and decoded by a
+// WartsDecoder supplied by the normalizer.
+
+// Filetypes and MIME types for raw traceroute files
+const (
+	AtlasTracerouteFiletype    = "atlas-traceroute"
+	AtlasTracerouteContentType = "application/vnd.ripe.atlas.ndjson"
+	WartsFiletype              = "warts"
+	WartsContentType           = "application/vnd.scamper.warts"
+)
+
+// Conditions for traceroute path observations
+const (
+	TracerouteReachedCondition   = "trace.path.reached"
+	TracerouteUnreachedCondition = "trace.path.unreached"
+)
+
+// WartsTraceRecType is the warts record type of a traceroute
+const WartsTraceRecType = 0x0006
+
+const (
+	wartsMagic     = 0x1205
+	wartsHeaderLen = 8
+)
+
+// TracerouteHop is a single hop of a traceroute. Address is nil if no reply
+// was received at this TTL.
+type TracerouteHop struct {
+	TTL     int
+	Address net.IP
+}
+
+// Traceroute is a single trace from Source toward Destination, with hops in
+// TTL order.
+type Traceroute struct {
+	Source      net.IP
+	Destination net.IP
+	Start       time.Time
+	End         time.Time
+	Hops        []TracerouteHop
+}
+
+// Reached returns true if the destination replied to the trace.
+func (tr *Traceroute) Reached() bool {
+	for i := len(tr.Hops) - 1; i >= 0; i-- {
+		if tr.Hops[i].Address != nil {
+			return tr.Hops[i].Address.Equal(tr.Destination)
+		}
+	}
+	return false
+}
+
+// PathString returns the path traced as a PTO path string: the source, each
+// responding hop, and the destination. Runs of hops without replies, and
+// the unknown remainder of a trace that did not reach its destination,
+// appear as a single *.
+func (tr *Traceroute) PathString() string {
+	elements := []string{tr.Source.String()}
+	star := func() {
+		if elements[len(elements)-1] != "*" {
+			elements = append(elements, "*")
+		}
+	}
+
+	for _, hop := range tr.Hops {
+		switch {
+		case hop.Address == nil:
+			star()
+		case hop.Address.Equal(tr.Destination):
+			// added below
+		default:
+			elements = append(elements, hop.Address.String())
+		}
+	}
+
+	if !tr.Reached() {
+		star()
+	}
+	return strings.Join(append(elements, tr.Destination.String()), " ")
+}
+
+// Observation returns the path observation for this trace.
+func (tr *Traceroute) Observation() Observation {
+	start, end := tr.Start, tr.End
+	if end.Before(start) {
+		end = start
+	}
+
+	condition := TracerouteUnreachedCondition
+	if tr.Reached() {
+		condition = TracerouteReachedCondition
+	}
+
+	return Observation{
+		TimeStart: &start,
+		TimeEnd:   &end,
+		Path:      NewPath(tr.PathString()),
+		Condition: NewCondition(condition),
+	}
+}
+
+// atlasTracerouteResult is the subset of a RIPE Atlas traceroute result used
+// to build a Traceroute.
+type atlasTracerouteResult struct {
+	Type      string `json:"type"`
+	From      string `json:"from"`
+	SrcAddr   string `json:"src_addr"`
+	DstAddr   string `json:"dst_addr"`
+	Timestamp int64  `json:"timestamp"`
+	EndTime   int64  `json:"endtime"`
+	Result    []struct {
+		Hop    int `json:"hop"`
+		Result []struct {
+			From string `json:"from"`
+		} `json:"result"`
+	} `json:"result"`
+}
+
+// ParseAtlasTraceroute parses a single RIPE Atlas traceroute result, as a
+// JSON object. The source of the trace is the probe's public address if
+// known, or its local address otherwise. The first address replying at each
+// hop is taken as that hop's address.
+func ParseAtlasTraceroute(b []byte) (*Traceroute, error) {
+	var res atlasTracerouteResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if res.Type != "" && res.Type != "traceroute" {
+		return nil, PTOErrorf("RIPE Atlas result of type %s is not a traceroute", res.Type)
+	}
+
+	tr := new(Traceroute)
+
+	src := res.From
+	if src == "" {
+		src = res.SrcAddr
+	}
+	if tr.Source = net.ParseIP(src); tr.Source == nil {
+		return nil, PTOErrorf("RIPE Atlas traceroute has bad source address %q", src)
+	}
+	if tr.Destination = net.ParseIP(res.DstAddr); tr.Destination == nil {
+		return nil, PTOErrorf("RIPE Atlas traceroute has bad destination address %q", res.DstAddr)
+	}
+
+	tr.Start = time.Unix(res.Timestamp, 0).UTC()
+	tr.End = time.Unix(res.EndTime, 0).UTC()
+
+	for _, hop := range res.Result {
+		th := TracerouteHop{TTL: hop.Hop}
+		for _, reply := range hop.Result {
+			if th.Address = net.ParseIP(reply.From); th.Address != nil {
+				break
+			}
+		}
+		tr.Hops = append(tr.Hops, th)
+	}
+
+	return tr, nil
+}
+
+// NormalizeAtlasTraceroute is a SerialNormFunc for RIPE Atlas traceroute
+// results, one JSON object per line (as downloaded with format=txt). Blank
+// lines are skipped.
+func NormalizeAtlasTraceroute(rec []byte, mdin *RawMetadata, mdout map[string]interface{}) ([]Observation, error) {
+	if len(bytes.TrimSpace(rec)) == 0 {
+		return nil, nil
+	}
+
+	tr, err := ParseAtlasTraceroute(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []Observation{tr.Observation()}, nil
+}
+
+// SplitWartsRecords is a bufio.SplitFunc splitting a scamper warts file into
+// records, each including its eight-byte header.
+func SplitWartsRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < wartsHeaderLen {
+		if atEOF && len(data) > 0 {
+			return 0, nil, PTOErrorf("truncated warts record header")
+		}
+		return 0, nil, nil
+	}
+
+	if magic := binary.BigEndian.Uint16(data[0:2]); magic != wartsMagic {
+		return 0, nil, PTOErrorf("bad warts magic %04x", magic)
+	}
+
+	length := wartsHeaderLen + int(binary.BigEndian.Uint32(data[4:8]))
+	if len(data) < length {
+		if atEOF {
+			return 0, nil, PTOErrorf("truncated warts record")
+		}
+		return 0, nil, nil
+	}
+
+	return length, data[:length], nil
+}
+
+// WartsDecoder decodes a single warts record of the given type into a
+// Traceroute. It is called for every record in a file, in order, and
+// returns nil without error for records which do not yield a trace (e.g.
+// list and cycle records, or traces of no interest).
+type WartsDecoder func(rectype uint16, body []byte) (*Traceroute, error)
+
+// NewWartsSerialNormFunc wraps a warts decoder in a SerialNormFunc for raw
+// data split by SplitWartsRecords.
+func NewWartsSerialNormFunc(dec WartsDecoder) SerialNormFunc {
+	return func(rec []byte, mdin *RawMetadata, mdout map[string]interface{}) ([]Observation, error) {
+		tr, err := dec(binary.BigEndian.Uint16(rec[2:4]), rec[wartsHeaderLen:])
+		if err != nil || tr == nil {
+			return nil, err
+		}
+		return []Observation{tr.Observation()}, nil
+	}
+}
+
+// RegisterTracerouteFiletypes registers the traceroute filetypes with a
+// normalizer: RIPE Atlas traceroute results, and scamper warts files if a
+// warts decoder is given.
+func RegisterTracerouteFiletypes(norm *SerialScanningNormalizer, warts WartsDecoder) {
+	norm.RegisterFiletype(AtlasTracerouteFiletype, bufio.ScanLines, NormalizeAtlasTraceroute, nil)
+	if warts != nil {
+		norm.RegisterFiletype(WartsFiletype, SplitWartsRecords, NewWartsSerialNormFunc(warts), nil)
+	}
+}
@@ -0,0 +1,47 @@
+package pto3
+
+import (
+	"context"
+
+	"github.com/go-pg/pg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mami-project/pto3-go"
+
+// Tracer returns the tracer used for PTO trace spans. Spans are not recorded
+// unless the application has installed a global OpenTelemetry tracer
+// provider, as ptosrv does when a trace collector is configured.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// traceQueryHook is a query hook which records a span for each statement
+// executed, as a child of the span in its context.
+type traceQueryHook struct {
+	ctx context.Context
+}
+
+func (tqh *traceQueryHook) BeforeQuery(qe *pg.QueryEvent) {}
+
+func (tqh *traceQueryHook) AfterQuery(qe *pg.QueryEvent) {
+	_, span := Tracer().Start(tqh.ctx, "postgresql",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(qe.StartTime),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")))
+	defer span.End()
+
+	if sql, err := qe.FormattedQuery(); err == nil {
+		span.SetAttributes(attribute.String("db.statement", sql))
+	}
+	if qe.Result != nil {
+		span.SetAttributes(attribute.Int("db.rows_returned", qe.Result.RowsReturned()))
+	}
+	if qe.Error != nil {
+		span.RecordError(qe.Error)
+		span.SetStatus(codes.Error, qe.Error.Error())
+	}
+}
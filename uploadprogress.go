@@ -0,0 +1,159 @@
+package pto3
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// uploadProgressRetention is how long progress of a finished upload remains
+// available after it finishes.
+const uploadProgressRetention = time.Hour
+
+// Upload progress states
+const (
+	UploadStateUploading = "uploading"
+	UploadStateComplete  = "complete"
+	UploadStateFailed    = "failed"
+)
+
+// UploadProgress reports the progress of a streaming upload of raw data to a
+// file in a campaign.
+type UploadProgress struct {
+	// Bytes received so far
+	BytesReceived int64
+	// Bytes expected in total, or negative if unknown
+	BytesExpected int64
+	// Upload state: uploading, complete, or failed
+	State string
+	// Error causing failure, if failed
+	Error string
+	// Time upload started
+	Started time.Time
+	// Time bytes were last received, or upload finished
+	Updated time.Time
+}
+
+// MarshalJSON serializes this UploadProgress into a JSON object suitable for
+// use with the PTO API.
+func (up *UploadProgress) MarshalJSON() ([]byte, error) {
+	jmap := make(map[string]interface{})
+
+	jmap["bytes_received"] = up.BytesReceived
+	if up.BytesExpected >= 0 {
+		jmap["bytes_expected"] = up.BytesExpected
+	}
+	jmap["state"] = up.State
+	if up.Error != "" {
+		jmap["error"] = up.Error
+	}
+	jmap["started"] = up.Started.UTC().Format(time.RFC3339)
+	jmap["updated"] = up.Updated.UTC().Format(time.RFC3339)
+
+	return json.Marshal(jmap)
+}
+
+// uploadTracker tracks the progress of a single upload.
+type uploadTracker struct {
+	lock     sync.Mutex
+	progress UploadProgress
+}
+
+// progressReader wraps a reader, counting bytes read into an upload tracker.
+type progressReader struct {
+	in io.Reader
+	ut *uploadTracker
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.in.Read(p)
+	if n > 0 {
+		pr.ut.lock.Lock()
+		pr.ut.progress.BytesReceived += int64(n)
+		pr.ut.progress.Updated = time.Now()
+		pr.ut.lock.Unlock()
+	}
+	return n, err
+}
+
+// finish marks this upload finished, failed if err is not nil.
+func (ut *uploadTracker) finish(err error) {
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+
+	ut.progress.Updated = time.Now()
+	if err != nil {
+		ut.progress.State = UploadStateFailed
+		ut.progress.Error = err.Error()
+	} else {
+		ut.progress.State = UploadStateComplete
+	}
+}
+
+// uploadTable tracks the progress of uploads to files in a raw data store, by
+// campaign and filename.
+type uploadTable struct {
+	lock    sync.Mutex
+	uploads map[string]*uploadTracker
+}
+
+func uploadKey(camname string, filename string) string {
+	return camname + "/" + filename
+}
+
+// begin starts tracking an upload to a file in a campaign, replacing progress
+// of any previous upload to the file, and returns a reader counting bytes read
+// from in as received. Progress of uploads finished longer ago than the
+// retention time is discarded.
+func (tab *uploadTable) begin(camname string, filename string, in io.Reader, size int64) (*progressReader, *uploadTracker) {
+	now := time.Now()
+	ut := &uploadTracker{progress: UploadProgress{
+		BytesExpected: size,
+		State:         UploadStateUploading,
+		Started:       now,
+		Updated:       now,
+	}}
+
+	tab.lock.Lock()
+	defer tab.lock.Unlock()
+
+	if tab.uploads == nil {
+		tab.uploads = make(map[string]*uploadTracker)
+	}
+
+	for k, other := range tab.uploads {
+		other.lock.Lock()
+		expired := other.progress.State != UploadStateUploading && now.Sub(other.progress.Updated) > uploadProgressRetention
+		other.lock.Unlock()
+		if expired {
+			delete(tab.uploads, k)
+		}
+	}
+
+	tab.uploads[uploadKey(camname, filename)] = ut
+
+	return &progressReader{in: in, ut: ut}, ut
+}
+
+// progress returns the progress of the current or most recent upload to a
+// file in a campaign, or nil if none is known.
+func (tab *uploadTable) progress(camname string, filename string) *UploadProgress {
+	tab.lock.Lock()
+	ut, ok := tab.uploads[uploadKey(camname, filename)]
+	tab.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	progress := ut.progress
+	return &progress
+}
+
+// UploadProgress returns the progress of the current or most recent upload to
+// a file in a campaign through this raw data store, or nil if none is known.
+func (rds *RawDataStore) UploadProgress(camname string, filename string) *UploadProgress {
+	return rds.uploads.progress(camname, filename)
+}
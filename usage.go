@@ -0,0 +1,102 @@
+package pto3
+
+import (
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// UsageBucket is the usage of the PTO by a single principal during an hour,
+// as accounted by the servers sharing an observation database.
+type UsageBucket struct {
+	// Start of the hour
+	Hour time.Time `sql:",pk"`
+	// Principal using the PTO (see APIKeyPrincipal)
+	Key string `sql:",pk"`
+	// Number of requests served
+	Requests int `sql:",notnull"`
+	// Bytes uploaded in request bodies
+	BytesUp int64 `sql:",notnull"`
+	// Bytes downloaded in responses
+	BytesDown int64 `sql:",notnull"`
+	// Number of queries executed
+	Queries int `sql:",notnull"`
+	// Total execution time of queries executed
+	QuerySeconds float64 `sql:",notnull"`
+}
+
+// createUsageTables ensures the table holding usage buckets exists.
+func createUsageTables(db *pg.DB) error {
+	opts := orm.CreateTableOptions{IfNotExists: true}
+
+	if err := db.CreateTable(&UsageBucket{}, &opts); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// UsageStore keeps usage buckets in the observation database, so that usage
+// survives restarts, and is accounted across all servers sharing the
+// database.
+type UsageStore struct {
+	db *pg.DB
+}
+
+// NewUsageStore creates a UsageStore in the observation database in the
+// given configuration, creating its table if necessary.
+func NewUsageStore(config *PTOConfiguration) (*UsageStore, error) {
+	db := pg.Connect(&config.ObsDatabase)
+
+	if err := createUsageTables(db); err != nil {
+		return nil, err
+	}
+
+	return &UsageStore{db: db}, nil
+}
+
+// Add adds usage to the stored buckets for the same hour and principal,
+// creating buckets as necessary.
+func (us *UsageStore) Add(buckets []UsageBucket) error {
+	return us.db.RunInTransaction(func(tx *pg.Tx) error {
+		for i := range buckets {
+			b := &buckets[i]
+			if _, err := tx.Exec(`INSERT INTO usage_buckets (hour, key, requests, bytes_up, bytes_down, queries, query_seconds)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT (hour, key) DO UPDATE SET
+					requests = usage_buckets.requests + EXCLUDED.requests,
+					bytes_up = usage_buckets.bytes_up + EXCLUDED.bytes_up,
+					bytes_down = usage_buckets.bytes_down + EXCLUDED.bytes_down,
+					queries = usage_buckets.queries + EXCLUDED.queries,
+					query_seconds = usage_buckets.query_seconds + EXCLUDED.query_seconds`,
+				b.Hour.UTC(), b.Key, b.Requests, b.BytesUp, b.BytesDown, b.Queries, b.QuerySeconds); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+		return nil
+	})
+}
+
+// Select returns the stored buckets for hours between start (inclusive) and
+// end (exclusive).
+func (us *UsageStore) Select(start time.Time, end time.Time) ([]UsageBucket, error) {
+	var out []UsageBucket
+
+	if err := us.db.Model(&out).
+		Where("hour >= ?", start.UTC()).
+		Where("hour < ?", end.UTC()).
+		Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return out, nil
+}
+
+// Expire removes stored buckets for hours before a given time.
+func (us *UsageStore) Expire(before time.Time) error {
+	if _, err := us.db.Model((*UsageBucket)(nil)).Where("hour < ?", before.UTC()).Delete(); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}